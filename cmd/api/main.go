@@ -8,10 +8,9 @@ import (
 	"net/http"
 	"os/signal"
 	"syscall"
-	"time"
 )
 
-func gracefulShutdown(apiServer *http.Server, done chan bool) {
+func gracefulShutdown(apiServer *http.Server, app *server.Server, done chan bool) {
 	// Create context that listens for the interrupt signal from the OS.
 	ctx, stop := signal.NotifyContext(context.Background(), syscall.SIGINT, syscall.SIGTERM)
 	defer stop()
@@ -21,12 +20,20 @@ func gracefulShutdown(apiServer *http.Server, done chan bool) {
 
 	logger.Logger.Warn("shutting down gracefully, press Ctrl+C again to force")
 
-	// The context is used to inform the server it has 5 seconds to finish
+	// The context is used to inform the server it has SHUTDOWN_TIMEOUT to finish
 	// the request it is currently handling
-	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	ctx, cancel := context.WithTimeout(context.Background(), app.ShutdownTimeout())
 	defer cancel()
 	if err := apiServer.Shutdown(ctx); err != nil {
-		logger.Logger.Fatalf("could not gracefully shutdown the server: %v\n", err)
+		logger.Logger.Errorf("could not gracefully shutdown the server: %v\n", err)
+	}
+
+	// Flush queued write-behind updates and take a final snapshot now that no new requests can arrive. The flush
+	// gets its own SHUTDOWN_TIMEOUT, requests that were slow to drain must not cost queued writes their chance.
+	flushCtx, cancelFlush := context.WithTimeout(context.Background(), app.ShutdownTimeout())
+	defer cancelFlush()
+	if err := app.Shutdown(flushCtx); err != nil {
+		logger.Logger.Errorf("could not flush pending writes: %v\n", err)
 	}
 
 	//log.Println("Server exiting")
@@ -37,7 +44,7 @@ func gracefulShutdown(apiServer *http.Server, done chan bool) {
 
 func main() {
 
-	server, err := server.NewServer()
+	server, app, err := server.NewServer()
 	if err != nil {
 		logger.Logger.Fatalf("could not create server: %v\n", err)
 	}
@@ -46,9 +53,14 @@ func main() {
 	done := make(chan bool, 1)
 
 	// Run graceful shutdown in a separate goroutine
-	go gracefulShutdown(server, done)
+	go gracefulShutdown(server, app, done)
 
-	err = server.ListenAndServe()
+	// The certificate comes from TLSConfig.GetCertificate, which reloads it when its files change
+	if server.TLSConfig != nil {
+		err = server.ListenAndServeTLS("", "")
+	} else {
+		err = server.ListenAndServe()
+	}
 	if err != nil && err != http.ErrServerClosed {
 		logger.Logger.Fatalf("could not listen on %s: %v\n", server.Addr, err)
 	}
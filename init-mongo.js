@@ -47,7 +47,8 @@ for (let i = 1; i <= MAX_PERSONS; i++) {
     id: i,
     name: name,
     age: Math.floor(Math.random() * 100),
-    email: `person${i}@example.com`
+    email: `person${i}@example.com`,
+    version: 0
   });
 }
 
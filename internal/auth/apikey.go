@@ -0,0 +1,66 @@
+package auth
+
+import (
+	"crypto/sha256"
+	"fmt"
+	"net/http"
+	"strings"
+)
+
+// APIKeyHeader carries a static API key
+const APIKeyHeader = "X-API-Key"
+
+// apiKeys authenticates static keys, looked up by hash so a lookup's timing doesn't depend on the key's bytes
+type apiKeys map[[sha256.Size]byte]Principal
+
+// NewAPIKeys creates an authenticator for the given key to principal mapping
+func NewAPIKeys(keys map[string]Principal) Authenticator {
+	a := make(apiKeys, len(keys))
+	for key, p := range keys {
+		p.Method = MethodAPIKey
+		a[sha256.Sum256([]byte(key))] = p
+	}
+	return a
+}
+
+// ParseAPIKeys parses a comma separated list of name:key:roles entries, the roles separated by spaces,
+// e.g. "ci:3f9a...:persons:read,admin:77c1...:admin pii"
+func ParseAPIKeys(s string) (map[string]Principal, error) {
+	keys := make(map[string]Principal)
+	for _, entry := range strings.Split(s, ",") {
+		entry = strings.TrimSpace(entry)
+		if entry == "" {
+			continue
+		}
+
+		// Roles contain colons themselves, so only the first two separate fields
+		parts := strings.SplitN(entry, ":", 3)
+		if len(parts) < 2 || parts[0] == "" || parts[1] == "" {
+			return nil, fmt.Errorf("error parsing API key %q: expected name:key:roles", parts[0])
+		}
+		name, key := parts[0], parts[1]
+		if _, dup := keys[key]; dup {
+			return nil, fmt.Errorf("error parsing API key %q: key is already used", name)
+		}
+
+		p := Principal{ID: name}
+		if len(parts) == 3 {
+			p.Roles = strings.Fields(parts[2])
+		}
+		keys[key] = p
+	}
+	return keys, nil
+}
+
+func (a apiKeys) Authenticate(h http.Header) (*Principal, error) {
+	key := h.Get(APIKeyHeader)
+	if key == "" {
+		return nil, ErrNoCredentials
+	}
+
+	p, ok := a[sha256.Sum256([]byte(key))]
+	if !ok {
+		return nil, fmt.Errorf("%w: unknown API key", ErrInvalidCredentials)
+	}
+	return &p, nil
+}
@@ -0,0 +1,81 @@
+package auth
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"strings"
+)
+
+// Authentication methods recorded on a Principal
+const (
+	MethodAPIKey = "api_key"
+	MethodJWT    = "jwt"
+)
+
+var (
+	// ErrNoCredentials is returned when a request carries no credentials an authenticator understands
+	ErrNoCredentials = errors.New("missing credentials")
+	// ErrInvalidCredentials is returned when a request's credentials are present but can't be verified
+	ErrInvalidCredentials = errors.New("invalid credentials")
+)
+
+// Principal is the authenticated caller of a request
+type Principal struct {
+	// ID is the API key's name or the token's subject
+	ID     string
+	Method string
+	Roles  []string
+}
+
+// Authenticator verifies the credentials in request headers. Every protocol maps its metadata to
+// headers, so the same authenticators protect HTTP and gRPC.
+type Authenticator interface {
+	// Authenticate returns the caller, ErrNoCredentials if the headers hold none it handles,
+	// or an error wrapping ErrInvalidCredentials if they don't verify
+	Authenticate(h http.Header) (*Principal, error)
+}
+
+// chain tries authenticators in order until one finds credentials
+type chain []Authenticator
+
+// Chain combines authenticators, the first one finding credentials decides the outcome
+func Chain(authenticators ...Authenticator) Authenticator {
+	return chain(authenticators)
+}
+
+func (c chain) Authenticate(h http.Header) (*Principal, error) {
+	for _, a := range c {
+		p, err := a.Authenticate(h)
+		if errors.Is(err, ErrNoCredentials) {
+			continue
+		}
+		return p, err
+	}
+	return nil, ErrNoCredentials
+}
+
+// SecretHeader returns the headers a bare secret would arrive in over HTTP, for protocols such as RESP and memcached
+// that send a password rather than headers. A secret shaped like a JWT is a bearer token, anything else an API key.
+func SecretHeader(secret string) http.Header {
+	h := http.Header{}
+	if strings.Count(secret, ".") == 2 {
+		h.Set("Authorization", "Bearer "+secret)
+	} else {
+		h.Set(APIKeyHeader, secret)
+	}
+	return h
+}
+
+type principalKey struct{}
+
+// WithPrincipal returns a copy of ctx carrying the caller
+func WithPrincipal(ctx context.Context, p *Principal) context.Context {
+	return context.WithValue(ctx, principalKey{}, p)
+}
+
+// FromContext returns the caller attached to ctx, if any
+func FromContext(ctx context.Context) (*Principal, bool) {
+	p, ok := ctx.Value(principalKey{}).(*Principal)
+	return p, ok
+}
@@ -0,0 +1,244 @@
+package auth
+
+import (
+	"crypto/rand"
+	"crypto/rsa"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"math/big"
+	"net/http"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/golang-jwt/jwt/v5"
+)
+
+var secret = []byte("test-secret")
+
+func bearer(token string) http.Header {
+	return http.Header{"Authorization": {"Bearer " + token}}
+}
+
+func apiKey(key string) http.Header {
+	h := http.Header{}
+	h.Set(APIKeyHeader, key)
+	return h
+}
+
+func sign(t *testing.T, method jwt.SigningMethod, key interface{}, kid string, claims jwt.Claims) string {
+	t.Helper()
+
+	token := jwt.NewWithClaims(method, claims)
+	if kid != "" {
+		token.Header["kid"] = kid
+	}
+	s, err := token.SignedString(key)
+	if err != nil {
+		t.Fatalf("SignedString() error: %v", err)
+	}
+	return s
+}
+
+func validClaims(sub string) Claims {
+	return Claims{RegisteredClaims: jwt.RegisteredClaims{
+		Subject:   sub,
+		Issuer:    "https://issuer.example.com",
+		Audience:  jwt.ClaimStrings{"gocache"},
+		ExpiresAt: jwt.NewNumericDate(time.Now().Add(time.Hour)),
+	}}
+}
+
+// writeJWKS writes a key set holding the public half of key to a temp file
+func writeJWKS(t *testing.T, kid string, key *rsa.PrivateKey) string {
+	t.Helper()
+
+	set := map[string][]jwk{"keys": {{
+		Kty: "RSA",
+		Kid: kid,
+		Use: "sig",
+		Alg: "RS256",
+		N:   base64.RawURLEncoding.EncodeToString(key.N.Bytes()),
+		E:   base64.RawURLEncoding.EncodeToString(big.NewInt(int64(key.E)).Bytes()),
+	}}}
+	data, err := json.Marshal(set)
+	if err != nil {
+		t.Fatalf("Marshal() error: %v", err)
+	}
+
+	path := filepath.Join(t.TempDir(), "jwks.json")
+	if err := os.WriteFile(path, data, 0o600); err != nil {
+		t.Fatalf("WriteFile() error: %v", err)
+	}
+	return path
+}
+
+func TestAPIKeys(t *testing.T) {
+	keys, err := ParseAPIKeys("ci:key-1, admin:key-2:persons:read admin")
+	if err != nil {
+		t.Fatalf("ParseAPIKeys() error: %v", err)
+	}
+	a := NewAPIKeys(keys)
+
+	p, err := a.Authenticate(apiKey("key-2"))
+	if err != nil {
+		t.Fatalf("Authenticate() error: %v", err)
+	}
+	want := &Principal{ID: "admin", Method: MethodAPIKey, Roles: []string{RoleRead, RoleAdmin}}
+	if !reflect.DeepEqual(p, want) {
+		t.Errorf("expected %+v, got %+v", want, p)
+	}
+	if p, _ := a.Authenticate(apiKey("key-1")); p == nil || len(p.Roles) != 0 {
+		t.Errorf("expected ci without roles, got %+v", p)
+	}
+
+	if _, err := a.Authenticate(apiKey("key-3")); !errors.Is(err, ErrInvalidCredentials) {
+		t.Errorf("expected an unknown key to be invalid, got %v", err)
+	}
+	if _, err := a.Authenticate(http.Header{}); !errors.Is(err, ErrNoCredentials) {
+		t.Errorf("expected no credentials, got %v", err)
+	}
+
+	for _, bad := range []string{"ci", "ci:", ":key", "ci:key,admin:key"} {
+		if _, err := ParseAPIKeys(bad); err == nil {
+			t.Errorf("expected %q to be rejected", bad)
+		}
+	}
+}
+
+func TestJWTHS256(t *testing.T) {
+	a, err := NewJWT(JWTConfig{Secret: secret, Issuer: "https://issuer.example.com", Audience: "gocache"})
+	if err != nil {
+		t.Fatalf("NewJWT() error: %v", err)
+	}
+
+	claims := validClaims("alice")
+	claims.Roles = []string{"admin"}
+	claims.Scope = "persons:read persons:write"
+	p, err := a.Authenticate(bearer(sign(t, jwt.SigningMethodHS256, secret, "", claims)))
+	if err != nil {
+		t.Fatalf("Authenticate() error: %v", err)
+	}
+	want := &Principal{ID: "alice", Method: MethodJWT, Roles: []string{"admin", "persons:read", "persons:write"}}
+	if !reflect.DeepEqual(p, want) {
+		t.Errorf("expected %+v, got %+v", want, p)
+	}
+
+	expired := validClaims("alice")
+	expired.ExpiresAt = jwt.NewNumericDate(time.Now().Add(-time.Hour))
+	noExpiry := validClaims("alice")
+	noExpiry.ExpiresAt = nil
+	otherAudience := validClaims("alice")
+	otherAudience.Audience = jwt.ClaimStrings{"other"}
+
+	invalid := map[string]string{
+		"expired":        sign(t, jwt.SigningMethodHS256, secret, "", expired),
+		"no expiry":      sign(t, jwt.SigningMethodHS256, secret, "", noExpiry),
+		"other audience": sign(t, jwt.SigningMethodHS256, secret, "", otherAudience),
+		"no subject":     sign(t, jwt.SigningMethodHS256, secret, "", validClaims("")),
+		"wrong secret":   sign(t, jwt.SigningMethodHS256, []byte("other"), "", validClaims("alice")),
+		"HS512":          sign(t, jwt.SigningMethodHS512, secret, "", validClaims("alice")),
+		"alg none":       sign(t, jwt.SigningMethodNone, jwt.UnsafeAllowNoneSignatureType, "", validClaims("alice")),
+		"malformed":      "not.a.token",
+	}
+	for name, token := range invalid {
+		if _, err := a.Authenticate(bearer(token)); !errors.Is(err, ErrInvalidCredentials) {
+			t.Errorf("%s: expected invalid credentials, got %v", name, err)
+		}
+	}
+
+	if _, err := a.Authenticate(http.Header{"Authorization": {"Basic YWxpY2U6cGFzcw=="}}); !errors.Is(err, ErrNoCredentials) {
+		t.Errorf("expected basic auth to be ignored, got %v", err)
+	}
+}
+
+func TestJWTRS256(t *testing.T) {
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatalf("GenerateKey() error: %v", err)
+	}
+	other, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatalf("GenerateKey() error: %v", err)
+	}
+
+	a, err := NewJWT(JWTConfig{JWKSFile: writeJWKS(t, "key-1", key)})
+	if err != nil {
+		t.Fatalf("NewJWT() error: %v", err)
+	}
+
+	for _, kid := range []string{"key-1", ""} {
+		p, err := a.Authenticate(bearer(sign(t, jwt.SigningMethodRS256, key, kid, validClaims("bob"))))
+		if err != nil {
+			t.Fatalf("kid %q: Authenticate() error: %v", kid, err)
+		}
+		if p.ID != "bob" {
+			t.Errorf("kid %q: expected bob, got %+v", kid, p)
+		}
+	}
+
+	invalid := map[string]string{
+		"unknown kid":  sign(t, jwt.SigningMethodRS256, key, "key-2", validClaims("bob")),
+		"other key":    sign(t, jwt.SigningMethodRS256, other, "key-1", validClaims("bob")),
+		"HS256 no key": sign(t, jwt.SigningMethodHS256, secret, "", validClaims("bob")),
+	}
+	for name, token := range invalid {
+		if _, err := a.Authenticate(bearer(token)); !errors.Is(err, ErrInvalidCredentials) {
+			t.Errorf("%s: expected invalid credentials, got %v", name, err)
+		}
+	}
+
+	if _, err := NewJWT(JWTConfig{}); err == nil {
+		t.Error("expected a config without keys to be rejected")
+	}
+	if _, err := NewJWT(JWTConfig{JWKSFile: filepath.Join(t.TempDir(), "missing.json")}); err == nil {
+		t.Error("expected a missing JWKS file to be rejected")
+	}
+}
+
+func TestChain(t *testing.T) {
+	jwtAuth, err := NewJWT(JWTConfig{Secret: secret})
+	if err != nil {
+		t.Fatalf("NewJWT() error: %v", err)
+	}
+	a := Chain(NewAPIKeys(map[string]Principal{"key-1": {ID: "ci"}}), jwtAuth)
+
+	h := bearer(sign(t, jwt.SigningMethodHS256, secret, "", validClaims("alice")))
+	if p, err := a.Authenticate(h); err != nil || p.ID != "alice" {
+		t.Errorf("expected the token to authenticate alice, got %+v, %v", p, err)
+	}
+
+	// A bad key fails the request even if a valid token is present
+	h.Set(APIKeyHeader, "key-2")
+	if _, err := a.Authenticate(h); !errors.Is(err, ErrInvalidCredentials) {
+		t.Errorf("expected invalid credentials, got %v", err)
+	}
+
+	if _, err := a.Authenticate(http.Header{}); !errors.Is(err, ErrNoCredentials) {
+		t.Errorf("expected no credentials, got %v", err)
+	}
+}
+
+func TestSecretHeader(t *testing.T) {
+	jwtAuth, err := NewJWT(JWTConfig{Secret: secret})
+	if err != nil {
+		t.Fatalf("NewJWT() error: %v", err)
+	}
+	a := Chain(NewAPIKeys(map[string]Principal{"key-1": {ID: "ci"}}), jwtAuth)
+
+	if p, err := a.Authenticate(SecretHeader("key-1")); err != nil || p.ID != "ci" {
+		t.Errorf("expected the API key to authenticate ci, got %+v, %v", p, err)
+	}
+
+	token := sign(t, jwt.SigningMethodHS256, secret, "", validClaims("alice"))
+	if p, err := a.Authenticate(SecretHeader(token)); err != nil || p.ID != "alice" {
+		t.Errorf("expected the token to authenticate alice, got %+v, %v", p, err)
+	}
+
+	if _, err := a.Authenticate(SecretHeader("key-2")); !errors.Is(err, ErrInvalidCredentials) {
+		t.Errorf("expected invalid credentials, got %v", err)
+	}
+}
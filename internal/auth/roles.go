@@ -0,0 +1,112 @@
+package auth
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"gocache/pkg/model"
+	"slices"
+)
+
+// Roles granted to principals, from the roles of an API key or a token's roles and scope claims
+const (
+	RoleRead  = "persons:read"
+	RoleWrite = "persons:write"
+	// RoleAdmin grants every other role
+	RoleAdmin = "admin"
+	// RolePII lets a caller see personal data when masking is enabled
+	RolePII = "pii"
+)
+
+// RedactedEmail replaces the email of persons returned to callers who can't see personal data
+const RedactedEmail = "[redacted]"
+
+// ErrForbidden is returned when the caller lacks the role an operation requires
+var ErrForbidden = errors.New("forbidden")
+
+// HasRole reports whether the principal was granted role, directly or through RoleAdmin
+func (p *Principal) HasRole(role string) bool {
+	return slices.Contains(p.Roles, role) || slices.Contains(p.Roles, RoleAdmin)
+}
+
+// Authorize returns an error wrapping ErrForbidden unless the caller in ctx has role. A context without
+// a caller is only served when authentication is disabled, so it's allowed.
+func Authorize(ctx context.Context, role string) error {
+	p, ok := FromContext(ctx)
+	if !ok || p.HasRole(role) {
+		return nil
+	}
+	return fmt.Errorf("%w: %s requires the %s role", ErrForbidden, p.ID, role)
+}
+
+// Mask redacts personal data from the persons returned to callers without RolePII, the zero Mask redacts nothing
+type Mask struct {
+	PII bool
+}
+
+// hides reports whether the caller in ctx can't see personal data, anonymous callers can't either
+func (m Mask) hides(ctx context.Context) bool {
+	if !m.PII {
+		return false
+	}
+	p, ok := FromContext(ctx)
+	return !ok || !p.HasRole(RolePII)
+}
+
+// Person returns p as the caller in ctx may see it
+func (m Mask) Person(ctx context.Context, p model.Person) model.Person {
+	if m.hides(ctx) {
+		p.Email = RedactedEmail
+	}
+	return p
+}
+
+// Persons returns persons as the caller in ctx may see them, without modifying the slice
+func (m Mask) Persons(ctx context.Context, persons []model.Person) []model.Person {
+	if !m.hides(ctx) {
+		return persons
+	}
+
+	masked := make([]model.Person, len(persons))
+	for i, p := range persons {
+		p.Email = RedactedEmail
+		masked[i] = p
+	}
+	return masked
+}
+
+// Change returns c as the caller in ctx may see it
+func (m Mask) Change(ctx context.Context, c model.Change) model.Change {
+	if c.Before != nil {
+		before := m.Person(ctx, *c.Before)
+		c.Before = &before
+	}
+	if c.After != nil {
+		after := m.Person(ctx, *c.After)
+		c.After = &after
+	}
+	return c
+}
+
+// Filter returns an error wrapping ErrForbidden if f matches on personal data the caller in ctx can't see,
+// otherwise the matches would reveal it
+func (m Mask) Filter(ctx context.Context, f model.Filter) error {
+	if f.Email != "" && m.hides(ctx) {
+		return fmt.Errorf("%w: filtering by email requires the %s role", ErrForbidden, RolePII)
+	}
+	return nil
+}
+
+// Ops returns an error wrapping ErrForbidden if ops test personal data the caller in ctx can't see, otherwise
+// whether the test passes would reveal it
+func (m Mask) Ops(ctx context.Context, ops []model.FieldOp) error {
+	if !m.hides(ctx) {
+		return nil
+	}
+	for _, op := range ops {
+		if op.Op == model.OpTest && op.Field == "email" {
+			return fmt.Errorf("%w: testing the email requires the %s role", ErrForbidden, RolePII)
+		}
+	}
+	return nil
+}
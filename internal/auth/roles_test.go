@@ -0,0 +1,77 @@
+package auth
+
+import (
+	"context"
+	"errors"
+	"gocache/pkg/model"
+	"testing"
+)
+
+func TestAuthorize(t *testing.T) {
+	reader := WithPrincipal(context.Background(), &Principal{ID: "reader", Roles: []string{RoleRead}})
+	admin := WithPrincipal(context.Background(), &Principal{ID: "admin", Roles: []string{RoleAdmin}})
+
+	if err := Authorize(reader, RoleRead); err != nil {
+		t.Errorf("expected the reader to read, got %v", err)
+	}
+	if err := Authorize(reader, RoleWrite); !errors.Is(err, ErrForbidden) {
+		t.Errorf("expected the reader not to write, got %v", err)
+	}
+	for _, role := range []string{RoleRead, RoleWrite, RolePII} {
+		if err := Authorize(admin, role); err != nil {
+			t.Errorf("expected admin to have %s, got %v", role, err)
+		}
+	}
+	// Without authentication there is no caller to restrict
+	if err := Authorize(context.Background(), RoleWrite); err != nil {
+		t.Errorf("expected an anonymous context to be allowed, got %v", err)
+	}
+}
+
+func TestMask(t *testing.T) {
+	p := model.Person{ID: 1, Name: "John Doe", Email: "john@example.com"}
+	reader := WithPrincipal(context.Background(), &Principal{ID: "reader", Roles: []string{RoleRead}})
+	pii := WithPrincipal(context.Background(), &Principal{ID: "pii", Roles: []string{RoleRead, RolePII}})
+	mask := Mask{PII: true}
+
+	if got := mask.Person(reader, p).Email; got != RedactedEmail {
+		t.Errorf("expected a redacted email, got %q", got)
+	}
+	if got := mask.Person(context.Background(), p).Email; got != RedactedEmail {
+		t.Errorf("expected anonymous callers to get a redacted email, got %q", got)
+	}
+	if got := mask.Person(pii, p).Email; got != p.Email {
+		t.Errorf("expected the pii role to see the email, got %q", got)
+	}
+	if got := (Mask{}).Person(reader, p).Email; got != p.Email {
+		t.Errorf("expected a disabled mask to keep the email, got %q", got)
+	}
+
+	persons := []model.Person{p}
+	if got := mask.Persons(reader, persons); got[0].Email != RedactedEmail || persons[0].Email != p.Email {
+		t.Errorf("expected a redacted copy, got %+v from %+v", got, persons)
+	}
+
+	c := mask.Change(reader, model.Change{Op: "update", ID: 1, Before: &p, After: &p})
+	if c.Before.Email != RedactedEmail || c.After.Email != RedactedEmail || p.Email != "john@example.com" {
+		t.Errorf("expected a redacted copy of the change, got %+v, %+v", c.Before, c.After)
+	}
+
+	if err := mask.Filter(reader, model.Filter{Email: p.Email}); !errors.Is(err, ErrForbidden) {
+		t.Errorf("expected filtering by email to be forbidden, got %v", err)
+	}
+	if err := mask.Filter(pii, model.Filter{Email: p.Email}); err != nil {
+		t.Errorf("expected the pii role to filter by email, got %v", err)
+	}
+
+	test := []model.FieldOp{{Op: model.OpTest, Field: "email", Value: p.Email}}
+	if err := mask.Ops(reader, test); !errors.Is(err, ErrForbidden) {
+		t.Errorf("expected testing the email to be forbidden, got %v", err)
+	}
+	if err := mask.Ops(pii, test); err != nil {
+		t.Errorf("expected the pii role to test the email, got %v", err)
+	}
+	if err := mask.Ops(reader, []model.FieldOp{{Op: model.OpSet, Field: "email", Value: p.Email}}); err != nil {
+		t.Errorf("expected setting the email to be allowed, got %v", err)
+	}
+}
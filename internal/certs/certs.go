@@ -0,0 +1,118 @@
+// Package certs serves a TLS certificate that is reloaded when its files change, so a renewed certificate
+// is picked up without restarting the server
+package certs
+
+import (
+	"crypto/tls"
+	"fmt"
+	"gocache/internal/logger"
+	"os"
+	"sync"
+	"time"
+)
+
+// DefaultInterval is how often the certificate files are checked when no interval is given
+const DefaultInterval = 30 * time.Second
+
+// Reloader holds the certificate loaded from a certificate and key file pair and reloads it when either changes.
+// A certificate that fails to load is ignored and the previous one kept, so a half written renewal never takes
+// the server down.
+type Reloader struct {
+	certFile, keyFile string
+
+	mu      sync.RWMutex
+	cert    *tls.Certificate
+	version string // modification times and sizes of the files the certificate was loaded from
+
+	stopOnce sync.Once
+	stop     chan struct{}
+	done     chan struct{}
+}
+
+// NewReloader loads the certificate and checks its files for changes every interval until Close is called
+func NewReloader(certFile, keyFile string, interval time.Duration) (*Reloader, error) {
+	if interval <= 0 {
+		interval = DefaultInterval
+	}
+
+	r := &Reloader{certFile: certFile, keyFile: keyFile, stop: make(chan struct{}), done: make(chan struct{})}
+	if _, err := r.Reload(); err != nil {
+		return nil, err
+	}
+
+	go func() {
+		defer close(r.done)
+
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+
+		for {
+			select {
+			case <-r.stop:
+				return
+			case <-ticker.C:
+				if _, err := r.Reload(); err != nil {
+					logger.Logger.Errorf("CERTS: keeping the current certificate: %v", err)
+				}
+			}
+		}
+	}()
+	return r, nil
+}
+
+// Reload loads the certificate again if its files changed since it was last loaded, and reports whether it did
+func (r *Reloader) Reload() (bool, error) {
+	version, err := r.fileVersion()
+	if err != nil {
+		return false, err
+	}
+
+	r.mu.RLock()
+	unchanged := version == r.version
+	r.mu.RUnlock()
+	if unchanged {
+		return false, nil
+	}
+
+	cert, err := tls.LoadX509KeyPair(r.certFile, r.keyFile)
+	if err != nil {
+		return false, fmt.Errorf("error loading certificate %v: %w", r.certFile, err)
+	}
+
+	r.mu.Lock()
+	loaded := r.cert != nil
+	r.cert, r.version = &cert, version
+	r.mu.Unlock()
+
+	if loaded {
+		logger.Logger.Infof("CERTS: reloaded certificate %v", r.certFile)
+	}
+	return true, nil
+}
+
+// fileVersion identifies the current contents of both files
+func (r *Reloader) fileVersion() (string, error) {
+	var version string
+	for _, path := range []string{r.certFile, r.keyFile} {
+		info, err := os.Stat(path)
+		if err != nil {
+			return "", fmt.Errorf("error reading certificate file: %w", err)
+		}
+		version += fmt.Sprintf("%v:%v:%v;", path, info.ModTime().UnixNano(), info.Size())
+	}
+	return version, nil
+}
+
+// GetCertificate returns the current certificate, for tls.Config.GetCertificate
+func (r *Reloader) GetCertificate(*tls.ClientHelloInfo) (*tls.Certificate, error) {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	return r.cert, nil
+}
+
+// Close stops checking the files for changes
+func (r *Reloader) Close() error {
+	r.stopOnce.Do(func() { close(r.stop) })
+	<-r.done
+	return nil
+}
@@ -0,0 +1,305 @@
+package controller
+
+import (
+	"context"
+	"errors"
+	"gocache/internal/datasource"
+	"gocache/pkg/model"
+	"testing"
+	"time"
+)
+
+func newFaultController(t *testing.T) (*personController, *datasource.FaultDataSource) {
+	t.Helper()
+
+	db := datasource.NewFaultDataSource(datasource.NewMockDataSource())
+	pc, err := NewPersonController(db)
+	if err != nil {
+		t.Fatalf("NewPersonController() returned an error: %v", err)
+	}
+	return pc.(*personController), db
+}
+
+func TestUpdatePersonDataSourceFailureLeavesStoreUntouched(t *testing.T) {
+	pc, db := newFaultController(t)
+	db.Inject("UpdatePerson", datasource.Fault{})
+
+	_, err := pc.UpdatePerson(context.Background(), model.Person{ID: 1, Name: "John Smith", Age: 31, Email: "john.smith@example.com"})
+	if !errors.Is(err, datasource.ErrInjected) {
+		t.Fatalf("expected injected error, got %v", err)
+	}
+
+	cached, ok := pc.kv.GetPerson(1)
+	if !ok || cached.Name != "John Doe" {
+		t.Errorf("expected store to keep the unacknowledged original, got %+v", cached)
+	}
+}
+
+func TestUpdatePersonAppliedButUnacknowledgedRefreshesStore(t *testing.T) {
+	pc, db := newFaultController(t)
+	db.Inject("UpdatePerson", datasource.Fault{Apply: true})
+
+	updated := model.Person{ID: 1, Name: "John Smith", Age: 31, Email: "john.smith@example.com"}
+	if _, err := pc.UpdatePerson(context.Background(), updated); err == nil {
+		t.Fatal("expected an error from UpdatePerson")
+	}
+
+	updated.Version = 1
+	cached, ok := pc.kv.GetPerson(1)
+	if !ok || cached != updated {
+		t.Errorf("expected store to be refreshed with the applied write %+v, got %+v", updated, cached)
+	}
+}
+
+func TestUpdatePersonUnknownOutcomeEvictsWhenRefreshFails(t *testing.T) {
+	pc, db := newFaultController(t)
+	db.Inject("UpdatePerson", datasource.Fault{Apply: true})
+	db.Inject("GetPerson", datasource.Fault{})
+
+	if _, err := pc.UpdatePerson(context.Background(), model.Person{ID: 1, Name: "John Smith", Age: 31, Email: "john.smith@example.com"}); err == nil {
+		t.Fatal("expected an error from UpdatePerson")
+	}
+
+	if cached, ok := pc.kv.GetPerson(1); ok {
+		t.Errorf("expected person to be evicted rather than serve a possibly stale value, got %+v", cached)
+	}
+
+	persons, _ := pc.GetAllPersons(context.Background())
+	if len(persons) != 1 {
+		t.Errorf("expected only the untouched person to remain, got %+v", persons)
+	}
+}
+
+func TestUpdatePersonInsertsWhenMissingFromStore(t *testing.T) {
+	pc, _ := newFaultController(t)
+	pc.kv.DeletePerson(2)
+
+	updated, err := pc.UpdatePerson(context.Background(), model.Person{ID: 2, Name: "Jane Doe", Age: 26, Email: "jane.doe@example.com"})
+	if err != nil {
+		t.Fatalf("expected acknowledged write to succeed, got %v", err)
+	}
+
+	cached, ok := pc.kv.GetPerson(2)
+	if !ok || cached != updated || cached.Version != 1 {
+		t.Errorf("expected store to hold %+v, got %+v", updated, cached)
+	}
+}
+
+func TestUpdatePersonNotFoundEvictsPhantom(t *testing.T) {
+	pc, _ := newFaultController(t)
+	pc.kv.InsertPerson(model.Person{ID: 3, Name: "Ghost", Age: 40, Email: "ghost@example.com"})
+
+	_, err := pc.UpdatePerson(context.Background(), model.Person{ID: 3, Name: "Ghost", Age: 41, Email: "ghost@example.com"})
+	if !errors.Is(err, model.ErrNotFound) {
+		t.Fatalf("expected ErrNotFound, got %v", err)
+	}
+
+	if _, ok := pc.kv.GetPerson(3); ok {
+		t.Error("expected person missing from the data source to be evicted from the store")
+	}
+}
+
+func TestFaultDataSourceTimes(t *testing.T) {
+	db := datasource.NewFaultDataSource(datasource.NewMockDataSource())
+	db.Inject("GetAllPersons", datasource.Fault{Times: 1})
+
+	if _, err := NewPersonController(db); err == nil {
+		t.Fatal("expected first NewPersonController() to fail")
+	}
+
+	if _, err := NewPersonController(db); err != nil {
+		t.Fatalf("expected fault to be consumed, got %v", err)
+	}
+}
+
+func TestUpdatePersonStaleVersionRefreshesStore(t *testing.T) {
+	pc, db := newFaultController(t)
+
+	// Another writer bumps the person in the data source behind the cache's back
+	db.UpdatePerson(context.Background(), model.Person{ID: 1, Name: "John Elsewhere", Age: 30, Email: "john.doe@example.com"})
+
+	_, err := pc.UpdatePerson(context.Background(), model.Person{ID: 1, Name: "John Smith", Age: 31, Email: "john.smith@example.com"})
+	if !errors.Is(err, model.ErrConflict) {
+		t.Fatalf("expected ErrConflict, got %v", err)
+	}
+
+	cached, _ := pc.kv.GetPerson(1)
+	if cached.Name != "John Elsewhere" || cached.Version != 1 {
+		t.Errorf("expected store to be refreshed with the newer version, got %+v", cached)
+	}
+}
+
+func TestPatchPersonAppliesToDataSourceAndStore(t *testing.T) {
+	pc, db := newFaultController(t)
+
+	updated, err := pc.PatchPerson(context.Background(), 1, []model.FieldOp{{Op: model.OpIncrement, Field: "age", Value: 1}})
+	if err != nil {
+		t.Fatalf("PatchPerson() returned an error: %v", err)
+	}
+
+	stored, _ := db.GetPerson(context.Background(), 1)
+	cached, _ := pc.kv.GetPerson(1)
+	if updated.Age != 31 || stored != updated || cached != updated {
+		t.Errorf("expected data source and store to hold %+v, got %+v and %+v", updated, stored, cached)
+	}
+}
+
+func TestPatchPersonFailedTestChangesNothing(t *testing.T) {
+	pc, db := newFaultController(t)
+
+	_, err := pc.PatchPerson(context.Background(), 1, []model.FieldOp{
+		{Op: model.OpTest, Field: "version", Value: 7},
+		{Op: model.OpSet, Field: "name", Value: "John Smith"},
+	})
+	if !errors.Is(err, model.ErrTestFailed) {
+		t.Fatalf("expected ErrTestFailed, got %v", err)
+	}
+
+	stored, _ := db.GetPerson(context.Background(), 1)
+	cached, _ := pc.kv.GetPerson(1)
+	if stored.Name != "John Doe" || cached.Name != "John Doe" {
+		t.Errorf("expected person to be unchanged, got %+v and %+v", stored, cached)
+	}
+}
+
+func TestApplyBatchMirrorsIntoStore(t *testing.T) {
+	pc, db := newFaultController(t)
+
+	results, err := pc.ApplyBatch(context.Background(), []model.WriteOp{
+		{Op: model.OpInsert, Person: model.Person{ID: 3, Name: "Alice Johnson", Age: 8, Email: "alice@example.com", Version: 9}},
+		{Op: model.OpDelete, ID: 2},
+		{Op: model.OpUpdate, Person: model.Person{ID: 3, Name: "Alice Johnson", Age: 9, Email: "alice@example.com"}},
+	})
+	if err != nil {
+		t.Fatalf("ApplyBatch() returned an error: %v", err)
+	}
+
+	if results[2].Version != 1 {
+		t.Errorf("expected insert to start at version 0 and the update to bump it, got %+v", results)
+	}
+
+	cached, _ := pc.kv.GetPerson(3)
+	stored, _ := db.GetPerson(context.Background(), 3)
+	if cached != results[2] || stored != results[2] {
+		t.Errorf("expected store and data source to hold %+v, got %+v and %+v", results[2], cached, stored)
+	}
+
+	if _, ok := pc.kv.GetPerson(2); ok {
+		t.Error("expected person 2 to be deleted from the store")
+	}
+}
+
+func TestApplyBatchFailureChangesNothing(t *testing.T) {
+	pc, db := newFaultController(t)
+	db.Inject("ApplyWrites", datasource.Fault{Err: &model.OpError{Index: 0, Err: model.ErrConflict}})
+
+	_, err := pc.ApplyBatch(context.Background(), []model.WriteOp{{Op: model.OpDelete, ID: 1}})
+	if !errors.Is(err, model.ErrConflict) {
+		t.Fatalf("expected ErrConflict, got %v", err)
+	}
+
+	if _, ok := pc.kv.GetPerson(1); !ok {
+		t.Error("expected person 1 to remain in the store")
+	}
+}
+
+func TestImportRejectsRowsIndividually(t *testing.T) {
+	pc, db := newFaultController(t)
+	persons := []model.Person{
+		{ID: 3, Name: "Alice Johnson", Age: 8, Email: "alice@example.com", Version: 9},
+		{ID: 4, Name: "", Age: 200, Email: "bob@example.com"},
+		{ID: 1, Name: "John Doe", Age: 30, Email: "john@example.com"},
+		{ID: 3, Name: "Alice Again", Age: 9, Email: "alice@example.com"},
+		{ID: 5, Name: "Carol White", Age: 41, Email: "carol@example.com"},
+	}
+
+	result, err := pc.Import(context.Background(), persons, true)
+	if err != nil {
+		t.Fatalf("Import() returned an error: %v", err)
+	}
+	if result.Imported != 2 || len(result.Failed) != 3 {
+		t.Fatalf("expected 2 rows accepted and 3 failed on a dry run, got %+v", result)
+	}
+	if _, ok := pc.kv.GetPerson(3); ok {
+		t.Fatal("expected a dry run to write nothing")
+	}
+
+	result, err = pc.Import(context.Background(), persons, false)
+	if err != nil {
+		t.Fatalf("Import() returned an error: %v", err)
+	}
+	if result.Imported != 2 {
+		t.Errorf("expected 2 imported, got %+v", result)
+	}
+	for i, want := range []struct {
+		index int
+		err   error
+	}{{1, model.ErrInvalidPerson}, {2, model.ErrAlreadyExists}, {3, model.ErrAlreadyExists}} {
+		if i >= len(result.Failed) || result.Failed[i].Index != want.index || !errors.Is(result.Failed[i].Err, want.err) {
+			t.Errorf("expected operation %d to fail with %v, got %v", want.index, want.err, result.Failed)
+		}
+	}
+
+	// Imported persons start at version 0 in both the store and the data source
+	cached, _ := pc.kv.GetPerson(3)
+	stored, _ := db.GetPerson(context.Background(), 3)
+	if cached.Version != 0 || cached != stored || cached.Name != "Alice Johnson" {
+		t.Errorf("expected store and data source to hold the first person 3 at version 0, got %+v and %+v", cached, stored)
+	}
+	if p, _ := pc.kv.GetPerson(1); p.Name != "John Doe" || p.Email != "john.doe@example.com" {
+		t.Errorf("expected the existing person 1 to be left alone, got %+v", p)
+	}
+}
+
+func TestImportDryRunDoesNotLock(t *testing.T) {
+	pc, _ := newFaultController(t)
+
+	// A dry run only reads, so it completes while another write holds the lock
+	pc.writeMu.Lock()
+	defer pc.writeMu.Unlock()
+	done := make(chan ImportResult, 1)
+	go func() {
+		result, _ := pc.Import(context.Background(), []model.Person{{ID: 3, Name: "Alice Johnson", Age: 8, Email: "alice@example.com"}}, true)
+		done <- result
+	}()
+
+	select {
+	case result := <-done:
+		if result.Imported != 1 {
+			t.Errorf("expected 1 row accepted, got %+v", result)
+		}
+	case <-time.After(2 * time.Second):
+		t.Fatal("expected a dry run not to wait for the write lock")
+	}
+}
+
+func TestImportBatchFailureAbortsLaterRows(t *testing.T) {
+	pc, db := newFaultController(t)
+	// The first batch is written but its acknowledgement lost
+	db.Inject("InsertPersons", datasource.Fault{Apply: true, Times: 1})
+
+	persons := make([]model.Person, importBatchSize+10)
+	for i := range persons {
+		persons[i] = model.Person{ID: 10 + i, Name: "Bulk", Age: 40, Email: "bulk@example.com"}
+	}
+
+	result, err := pc.Import(context.Background(), persons, false)
+	if err != nil {
+		t.Fatalf("Import() returned an error: %v", err)
+	}
+	if result.Imported != 0 || len(result.Failed) != len(persons) {
+		t.Fatalf("expected every row to fail, got %d imported and %d failed", result.Imported, len(result.Failed))
+	}
+	if !errors.Is(result.Failed[0].Err, datasource.ErrInjected) || !errors.Is(result.Failed[len(persons)-1].Err, errImportAborted) {
+		t.Errorf("expected the batch to fail with the data source error and later rows to be aborted, got %v and %v",
+			result.Failed[0], result.Failed[len(persons)-1])
+	}
+
+	// The written batch is reconciled into the store, the rest was never sent
+	if _, ok := pc.kv.GetPerson(10); !ok {
+		t.Error("expected the unacknowledged batch to be reconciled into the store")
+	}
+	if _, err := db.GetPerson(context.Background(), 10+importBatchSize); !errors.Is(err, model.ErrNotFound) {
+		t.Errorf("expected rows after the failed batch not to be written, got %v", err)
+	}
+}
@@ -1,36 +1,173 @@
 package controller
 
 import (
+	"context"
+	"errors"
 	"fmt"
 	"gocache/internal/datasource"
 	"gocache/internal/logger"
+	"gocache/internal/metrics"
+	"gocache/internal/queue"
+	"gocache/internal/tracing"
 	"gocache/pkg/model"
 	"gocache/pkg/store"
+	"iter"
+	"slices"
+	"sync"
+	"time"
+
+	"go.opentelemetry.io/otel/trace"
 )
 
 // PersonController defines the interface for the person controller
 type PersonController interface {
 	Health() map[string]string
-	GetAllPersons() ([]model.Person, error)
-	Query(name, email string, ages []int) ([]model.Person, error)
-	UpdatePerson(p model.Person) error
+	GetAllPersons(ctx context.Context) ([]model.Person, error)
+	GetPerson(ctx context.Context, id int) (model.Person, error)
+	Query(ctx context.Context, name, email string, ages []int) ([]model.Person, error)
+	// Export yields the persons matching f as of the call, read from a store view so any number take constant memory
+	Export(ctx context.Context, f model.Filter) (iter.Seq[model.Person], error)
+	UpdatePerson(ctx context.Context, p model.Person) (model.Person, error)
+	PatchPerson(ctx context.Context, id int, ops []model.FieldOp) (model.Person, error)
+	ApplyBatch(ctx context.Context, ops []model.WriteOp) ([]model.Person, error)
+	// Import inserts new persons in batches, rejecting rows one by one rather than as a whole
+	Import(ctx context.Context, persons []model.Person, dryRun bool) (ImportResult, error)
+	Watch(opts WatchOptions) (*Watcher, error)
+	// Evict drops a person from the store only, the data source keeps it. It reports whether the person was cached.
+	Evict(id int) bool
+	QueueDepth() int
+	StoreStats() store.Stats
+	Close(ctx context.Context) error
 }
 
 // personController is the concrete implementation of PersonController
 type personController struct {
 	db datasource.DataSource
 	kv store.PersonStore // add the data source for the key-value storeh
+	wb *writeBehind      // nil unless the controller runs in write-behind mode
+	sn *snapshotter      // nil unless snapshots are enabled
+
+	watches *watchHub
+
+	// writeMu serializes writes so the store applies them in the same order as the data source
+	writeMu sync.Mutex
+}
+
+// Options configures optional controller features, the zero value is a plain write-through controller
+type Options struct {
+	// Queue enables write-behind mode when set
+	Queue       *queue.WriteQueue
+	WriteBehind WriteBehindConfig
+
+	// SnapshotPath enables warm starts from, and periodic writes to, a store snapshot when set.
+	// Warm starts rely on every data source writer bumping the person version
+	SnapshotPath     string
+	SnapshotInterval time.Duration
+
+	// WALPath logs every store write between snapshots when set, it requires SnapshotPath
+	WALPath         string
+	WALSync         store.SyncPolicy
+	WALSyncInterval time.Duration
 }
 
 // NewPersonController creates a new instance of personController
 func NewPersonController(db datasource.DataSource) (PersonController, error) {
-	kv := store.NewKVStore()
-	p, err := db.GetAllPersons()
-	if err != nil {
-		return nil, fmt.Errorf("error getting persons from data source: %w", err)
+	return NewPersonControllerWithOptions(db, Options{})
+}
+
+// NewWriteBehindPersonController creates a personController that applies updates to the store immediately
+// and flushes them to the data source from the durable queue q in the background
+func NewWriteBehindPersonController(db datasource.DataSource, q *queue.WriteQueue, cfg WriteBehindConfig) (PersonController, error) {
+	return NewPersonControllerWithOptions(db, Options{Queue: q, WriteBehind: cfg})
+}
+
+// NewPersonControllerWithOptions creates a personController with the features enabled in opts
+func NewPersonControllerWithOptions(db datasource.DataSource, opts Options) (PersonController, error) {
+	started := time.Now()
+	ctx, span := tracing.Start(context.Background(), "PersonController.Warmup")
+	defer span.End()
+
+	// Sequence numbers continue from the boot time in microseconds, so any handed out by an earlier run
+	// are older than every change kept by this one and resuming from them fails rather than skipping changes
+	c := &personController{db: db, watches: newWatchHub(uint64(time.Now().UnixMicro()))}
+
+	var wal *store.WAL
+	var logged []store.WALEntry
+	if opts.WALPath != "" {
+		if opts.SnapshotPath == "" {
+			return nil, errors.New("a write-ahead log requires a snapshot path to compact into")
+		}
+
+		var err error
+		if wal, logged, err = store.OpenWAL(opts.WALPath, opts.WALSync, opts.WALSyncInterval); err != nil {
+			return nil, err
+		}
+	}
+
+	if opts.SnapshotPath != "" {
+		c.kv = warmStart(ctx, db, opts.SnapshotPath, logged)
+	}
+	if c.kv == nil {
+		kv := store.NewKVStore()
+		p, err := db.GetAllPersons(ctx)
+		if err != nil {
+			if wal != nil {
+				wal.Close()
+			}
+			return nil, fmt.Errorf("error getting persons from data source: %w", err)
+		}
+		if err := kv.InsertPersons(p); err != nil {
+			// A person some other writer stored against the rules can't be served, that shouldn't keep the rest from loading
+			logger.Logger.WithContext(ctx).Warnf("CONTROLLER: skipped invalid persons from data source: %v", err)
+		}
+		metrics.WarmupPersons.WithLabelValues("full").Add(float64(len(p)))
+
+		// The snapshot the log builds on is gone, but the log may still hold updates the data source hasn't caught up with
+		replayed, err := replayNewer(kv, logged)
+		if err != nil {
+			if wal != nil {
+				wal.Close()
+			}
+			return nil, fmt.Errorf("error replaying write-ahead log: %w", err)
+		}
+		if replayed > 0 {
+			logger.Logger.WithContext(ctx).Infof("CONTROLLER: replayed %v write-ahead log entries newer than the data source", replayed)
+		}
+		metrics.WarmupPersons.WithLabelValues("wal").Add(float64(replayed))
+		c.kv = kv
+	}
+
+	if wal != nil {
+		durable := store.NewDurableStore(c.kv, wal)
+		// Start from a fresh snapshot and an empty log, so the log never holds entries relative to an older snapshot
+		if err := durable.Compact(opts.SnapshotPath); err != nil {
+			wal.Close()
+			return nil, fmt.Errorf("error compacting write-ahead log: %w", err)
+		}
+		c.kv = durable
 	}
-	kv.InsertPersons(p)
-	return &personController{db: db, kv: kv}, nil
+
+	if opts.Queue != nil {
+		c.wb = newWriteBehind(db, opts.Queue, opts.WriteBehind, c.reconcileRejected)
+
+		// Writes still queued from a previous run are newer than what the data source returned
+		if err := c.kv.InsertPersons(opts.Queue.Peek(opts.Queue.Depth())); err != nil {
+			if wal != nil {
+				wal.Close()
+			}
+			return nil, fmt.Errorf("error restoring queued writes: %w", err)
+		}
+
+		c.wb.start()
+	}
+
+	if opts.SnapshotPath != "" {
+		c.sn = newSnapshotter(c.kv, opts.SnapshotPath, opts.SnapshotInterval)
+		c.sn.start()
+	}
+
+	metrics.WarmupDuration.Set(time.Since(started).Seconds())
+	return c, nil
 }
 
 func (c *personController) Health() map[string]string {
@@ -38,39 +175,573 @@ func (c *personController) Health() map[string]string {
 }
 
 // Query retrieves persons from the data source based on the provided criteria
-func (c *personController) Query(name, email string, ages []int) ([]model.Person, error) {
-	logger.Logger.Infof("CONTROLLER: Query called with name=%v, email=%v, ages=%v", name, email, ages)
+func (c *personController) Query(ctx context.Context, name, email string, ages []int) ([]model.Person, error) {
+	logger.Logger.WithContext(ctx).Infof("CONTROLLER: Query called with name=%v, email=%v, ages=%v", name, email, ages)
+	span := storeSpan(ctx, "Query")
 	p := c.kv.Query(name, email, ages)
-	logger.Logger.Infof("CONTROLLER: Query success: found %v persons", len(p))
+	span.End()
+	logger.Logger.WithContext(ctx).Infof("CONTROLLER: Query success: found %v persons", len(p))
 	return p, nil
 }
 
+// Export returns the persons matching f from a view of the store, writes after the call don't change what it yields
+func (c *personController) Export(ctx context.Context, f model.Filter) (iter.Seq[model.Person], error) {
+	logger.Logger.WithContext(ctx).Infof("CONTROLLER: Export called with name=%v, email=%v, ages=%v", f.Name, f.Email, f.Ages)
+	span := storeSpan(ctx, "View")
+	view := c.kv.View()
+	span.End()
+	logger.Logger.WithContext(ctx).Infof("CONTROLLER: Export success: reading a view of %v persons", view.Len())
+	return view.Match(f), nil
+}
+
 // GetAllPersons retrieves all persons from the data source
-func (c *personController) GetAllPersons() ([]model.Person, error) {
-	logger.Logger.Info("CONTROLLER: GetAllPersons called")
+func (c *personController) GetAllPersons(ctx context.Context) ([]model.Person, error) {
+	logger.Logger.WithContext(ctx).Info("CONTROLLER: GetAllPersons called")
+	span := storeSpan(ctx, "GetAllPersons")
 	p := c.kv.GetAllPersons()
+	span.End()
 
-	logger.Logger.Infof("CONTROLLER: GetAllPersons success: found %v persons", len(p))
+	logger.Logger.WithContext(ctx).Infof("CONTROLLER: GetAllPersons success: found %v persons", len(p))
 
 	return p, nil
 }
 
-// UpdatePerson updates a person in the data source
-func (c *personController) UpdatePerson(p model.Person) error {
-	logger.Logger.Infof("CONTROLLER: UpdatePerson called with person=%v", p)
-	err := c.db.UpdatePerson(p)
+// GetPerson retrieves a single person from the key-value store
+func (c *personController) GetPerson(ctx context.Context, id int) (model.Person, error) {
+	logger.Logger.WithContext(ctx).Infof("CONTROLLER: GetPerson called with id=%v", id)
+	span := storeSpan(ctx, "GetPerson")
+	p, ok := c.kv.GetPerson(id)
+	span.End()
+	if !ok {
+		metrics.CacheLookups.WithLabelValues(metrics.Miss).Inc()
+		logger.Logger.WithContext(ctx).Infof("CONTROLLER: GetPerson: person %v not found", id)
+		return model.Person{}, model.ErrNotFound
+	}
+	metrics.CacheLookups.WithLabelValues(metrics.Hit).Inc()
+
+	logger.Logger.WithContext(ctx).Infof("CONTROLLER: GetPerson success: found person %v at version %v", id, p.Version)
+	return p, nil
+}
+
+// UpdatePerson updates a person in the data source and then in the key-value store, returning the
+// person at its new version. p.Version must match the stored version or ErrConflict is returned, and
+// an invalid person is rejected with a *model.ValidationError before anything is written.
+// Once the data source acknowledges a write the store is guaranteed to reflect it, and when the
+// outcome of a write is unknown the cached entry is reconciled so it never serves a stale value.
+func (c *personController) UpdatePerson(ctx context.Context, p model.Person) (model.Person, error) {
+	logger.Logger.WithContext(ctx).Infof("CONTROLLER: UpdatePerson called with person=%v", p)
+	if err := p.Validate(); err != nil {
+		logger.Logger.WithContext(ctx).Errorf("CONTROLLER: Error updating person: %v", err)
+		return model.Person{}, err
+	}
+
+	c.writeMu.Lock()
+	defer c.writeMu.Unlock()
+
+	if c.wb != nil {
+		return c.updatePersonWriteBehind(ctx, p)
+	}
+
+	err := c.db.UpdatePerson(ctx, p)
+	if errors.Is(err, model.ErrNotFound) {
+		logger.Logger.WithContext(ctx).Errorf("CONTROLLER: Error updating person: %v", err)
+		c.evict(p.ID)
+		return model.Person{}, err
+	}
 	if err != nil {
-		logger.Logger.Errorf("CONTROLLER: Error updating person: %v", err)
-		return err
+		logger.Logger.WithContext(ctx).Errorf("CONTROLLER: Error updating person: %v", err)
+		// The write may have been applied before the failure, or on a conflict another writer
+		// changed the person, either way the cached value can't be trusted
+		c.reconcile(ctx, p.ID)
+		return model.Person{}, err
 	}
 
-	// Update the key-value store
-	err = c.kv.UpdatePerson(p)
+	// The data source acknowledged the write, so the store takes it verbatim even if the person
+	// was missing or the cached version had drifted
+	updated := p
+	updated.Version++
+	if err := c.storeUpdate(updated); err != nil {
+		logger.Logger.WithContext(ctx).Errorf("CONTROLLER: Error storing person update: %v", err)
+		return model.Person{}, err
+	}
+
+	logger.Logger.WithContext(ctx).Info("CONTROLLER: UpdatePerson success")
+	return updated, nil
+}
+
+// PatchPerson atomically applies field operations to a person in the data source and the key-value store,
+// returning the person at its new version. A failed test op returns model.ErrTestFailed and changes nothing.
+func (c *personController) PatchPerson(ctx context.Context, id int, ops []model.FieldOp) (model.Person, error) {
+	logger.Logger.WithContext(ctx).Infof("CONTROLLER: PatchPerson called with id=%v, ops=%v", id, ops)
+	ops, err := model.NormalizeOps(ops)
+	if err != nil {
+		logger.Logger.WithContext(ctx).Errorf("CONTROLLER: Error patching person: %v", err)
+		return model.Person{}, err
+	}
+
+	c.writeMu.Lock()
+	defer c.writeMu.Unlock()
+
+	if c.wb != nil {
+		return c.patchPersonWriteBehind(ctx, id, ops)
+	}
+
+	updated, err := c.db.ApplyOps(ctx, id, ops)
+	if errors.Is(err, model.ErrNotFound) {
+		logger.Logger.WithContext(ctx).Errorf("CONTROLLER: Error patching person: %v", err)
+		c.evict(id)
+		return model.Person{}, err
+	}
+	if err != nil {
+		logger.Logger.WithContext(ctx).Errorf("CONTROLLER: Error patching person: %v", err)
+		c.reconcile(ctx, id)
+		return model.Person{}, err
+	}
+
+	// The data source computed the result atomically, so the store takes it verbatim
+	if err := c.storeUpdate(updated); err != nil {
+		logger.Logger.WithContext(ctx).Errorf("CONTROLLER: Error storing person patch: %v", err)
+		return model.Person{}, err
+	}
+
+	logger.Logger.WithContext(ctx).Infof("CONTROLLER: PatchPerson success: person %v now at version %v", id, updated.Version)
+	return updated, nil
+}
+
+// ApplyBatch runs the operations as one transaction against the data source and then mirrors the committed
+// results into the key-value store in a single store transaction, so readers never see half a batch.
+// In write-behind mode the queue is flushed first and the batch is written through synchronously.
+func (c *personController) ApplyBatch(ctx context.Context, ops []model.WriteOp) ([]model.Person, error) {
+	logger.Logger.WithContext(ctx).Infof("CONTROLLER: ApplyBatch called with %v operations", len(ops))
+	ops = append([]model.WriteOp(nil), ops...)
+	for i, op := range ops {
+		if err := op.Validate(); err != nil {
+			return nil, &model.OpError{Index: i, Err: err}
+		}
+		// New persons always start at version 0
+		if op.Op == model.OpInsert {
+			ops[i].Person.Version = 0
+		}
+	}
+
+	c.writeMu.Lock()
+	defer c.writeMu.Unlock()
+
+	if c.wb != nil {
+		// The batch must be ordered after every write already acknowledged to clients
+		if err := c.wb.flush(ctx); err != nil {
+			logger.Logger.WithContext(ctx).Errorf("CONTROLLER: Error flushing write-behind queue before batch: %v", err)
+			return nil, err
+		}
+	}
+
+	results, err := c.db.ApplyWrites(ctx, ops)
 	if err != nil {
-		logger.Logger.Errorf("CONTROLLER: Error updating key-value store: %v", err)
+		logger.Logger.WithContext(ctx).Errorf("CONTROLLER: Error applying batch: %v", err)
+		var opErr *model.OpError
+		if !errors.As(err, &opErr) {
+			// The commit outcome is unknown, so refresh every person the batch touched
+			for _, op := range ops {
+				c.reconcile(ctx, op.Key())
+			}
+		}
+		return nil, err
+	}
+
+	// Track which persons the store will hold as the batch is staged, so deletes of uncached persons are skipped
+	// and each change carries the value it replaced
+	staged := make(map[int]*model.Person)
+	changes := make([]model.Change, len(ops))
+	tx := c.kv.Begin()
+	for i, op := range ops {
+		id := op.Key()
+		before, seen := staged[id]
+		if !seen {
+			if p, ok := c.kv.GetPerson(id); ok {
+				before = &p
+			}
+		}
+		changes[i] = model.Change{Op: op.Op, ID: id, Before: before}
+
+		if op.Op == model.OpDelete {
+			if before != nil {
+				tx.Delete(id)
+			}
+			staged[id] = nil
+			continue
+		}
+		after := results[i]
+		tx.Put(after)
+		staged[id] = &after
+		changes[i].After = &after
+	}
+	if _, err := tx.Commit(); err != nil {
+		// Only possible if the store drifted, fall back to refreshing each person from the data source
+		logger.Logger.WithContext(ctx).Errorf("CONTROLLER: Error mirroring batch into key-value store: %v", err)
+		for _, op := range ops {
+			c.reconcile(ctx, op.Key())
+		}
+	}
+	c.watches.publish(changes...)
+
+	logger.Logger.WithContext(ctx).Infof("CONTROLLER: ApplyBatch success: committed %v operations", len(ops))
+	return results, nil
+}
+
+// importBatchSize is how many persons each data source call of an import inserts
+const importBatchSize = 500
+
+// errImportAborted fails the rows an import didn't get to after a data source error
+var errImportAborted = errors.New("not imported, an earlier batch failed")
+
+// ImportResult reports the outcome of an import, failed rows are identified by their index in the import
+type ImportResult struct {
+	// Imported is how many persons were inserted, or would be for a dry run
+	Imported int
+	// Failed lists the rejected rows in order. Rows failed by a data source error may or may not have been
+	// written, the store is reconciled with the data source for them.
+	Failed []*model.OpError
+}
+
+// Import validates the persons and inserts those whose ID is free into the data source a batch at a time, then
+// mirrors each batch into the key-value store. New persons start at version 0. Invalid rows and IDs taken or
+// repeated in the import are failed without affecting the other rows, and a dry run stops after these checks.
+// A data source error fails its batch and every later row. In write-behind mode the queue is flushed before each batch.
+func (c *personController) Import(ctx context.Context, persons []model.Person, dryRun bool) (ImportResult, error) {
+	logger.Logger.WithContext(ctx).Infof("CONTROLLER: Import called with %v persons, dryRun=%v", len(persons), dryRun)
+
+	var result ImportResult
+	seen := make(map[int]bool, len(persons))
+	valid := make([]int, 0, len(persons))
+	for i, p := range persons {
+		if err := p.Validate(); err != nil {
+			result.Failed = append(result.Failed, &model.OpError{Index: i, Err: err})
+			continue
+		}
+		if seen[p.ID] {
+			result.Failed = append(result.Failed, &model.OpError{Index: i, Err: fmt.Errorf("%w: id %v appears earlier in the import", model.ErrAlreadyExists, p.ID)})
+			continue
+		}
+		seen[p.ID] = true
+		valid = append(valid, i)
+	}
+
+	// The lock is only taken per batch, so a long import doesn't hold up other writes and a dry run, which writes
+	// nothing, doesn't take it at all. A person created between the check below and its batch is rejected by the
+	// data source and reconciled by importBatch.
+	batch := make([]model.Person, 0, min(len(valid), importBatchSize))
+	indexes := make([]int, 0, cap(batch))
+	for _, i := range valid {
+		if _, ok := c.kv.GetPerson(persons[i].ID); ok {
+			result.Failed = append(result.Failed, &model.OpError{Index: i, Err: model.ErrAlreadyExists})
+			continue
+		}
+		if dryRun {
+			result.Imported++
+			continue
+		}
+
+		p := persons[i]
+		p.Version = 0
+		batch = append(batch, p)
+		indexes = append(indexes, i)
+		if len(batch) < importBatchSize {
+			continue
+		}
+		if err := c.importBatch(ctx, batch, indexes, &result); err != nil {
+			return abortImport(result, valid, indexes[len(indexes)-1]), nil
+		}
+		batch, indexes = batch[:0], indexes[:0]
+	}
+	if len(batch) > 0 {
+		if err := c.importBatch(ctx, batch, indexes, &result); err != nil {
+			return abortImport(result, valid, indexes[len(indexes)-1]), nil
+		}
+	}
+
+	slices.SortFunc(result.Failed, func(a, b *model.OpError) int { return a.Index - b.Index })
+	logger.Logger.WithContext(ctx).Infof("CONTROLLER: Import success: imported %v persons, failed %v", result.Imported, len(result.Failed))
+	return result, nil
+}
+
+// importBatch inserts one batch into the data source and the store under writeMu, recording its outcome in result.
+// On an error every row of the batch is failed with it and the persons are reconciled, since the outcome is unknown.
+func (c *personController) importBatch(ctx context.Context, batch []model.Person, indexes []int, result *ImportResult) error {
+	c.writeMu.Lock()
+	defer c.writeMu.Unlock()
+
+	if c.wb != nil {
+		// The batch must be ordered after every write already acknowledged to clients
+		if err := c.wb.flush(ctx); err != nil {
+			logger.Logger.WithContext(ctx).Errorf("CONTROLLER: Error flushing write-behind queue before import batch: %v", err)
+			for _, i := range indexes {
+				result.Failed = append(result.Failed, &model.OpError{Index: i, Err: err})
+			}
+			return err
+		}
+	}
+
+	rejected, err := c.db.InsertPersons(ctx, batch)
+	if err != nil {
+		logger.Logger.WithContext(ctx).Errorf("CONTROLLER: Error importing batch of %v persons: %v", len(batch), err)
+		for j, p := range batch {
+			c.reconcile(ctx, p.ID)
+			result.Failed = append(result.Failed, &model.OpError{Index: indexes[j], Err: err})
+		}
 		return err
 	}
 
-	logger.Logger.Info("CONTROLLER: UpdatePerson success")
+	failed := make(map[int]bool, len(rejected))
+	for _, r := range rejected {
+		failed[r.Index] = true
+		result.Failed = append(result.Failed, &model.OpError{Index: indexes[r.Index], Err: r.Err})
+		// The store didn't have the person, so it drifted from the data source
+		if errors.Is(r.Err, model.ErrAlreadyExists) {
+			c.reconcile(ctx, batch[r.Index].ID)
+		}
+	}
+
+	changes := make([]model.Change, 0, len(batch)-len(rejected))
+	tx := c.kv.Begin()
+	for j := range batch {
+		if failed[j] {
+			continue
+		}
+		after := batch[j]
+		tx.Put(after)
+		changes = append(changes, model.Change{Op: model.OpInsert, ID: after.ID, After: &after})
+	}
+	if _, err := tx.Commit(); err != nil {
+		logger.Logger.WithContext(ctx).Errorf("CONTROLLER: Error mirroring import batch into key-value store: %v", err)
+		for _, change := range changes {
+			c.reconcile(ctx, change.ID)
+		}
+	}
+	c.watches.publish(changes...)
+
+	result.Imported += len(changes)
 	return nil
 }
+
+// abortImport fails the valid rows after the one at index last, which were never sent to the data source
+func abortImport(result ImportResult, valid []int, last int) ImportResult {
+	for _, i := range valid {
+		if i > last {
+			result.Failed = append(result.Failed, &model.OpError{Index: i, Err: errImportAborted})
+		}
+	}
+	slices.SortFunc(result.Failed, func(a, b *model.OpError) int { return a.Index - b.Index })
+	return result
+}
+
+// reconcile refreshes a cached person from the data source, evicting it if the data source can't be read
+func (c *personController) reconcile(ctx context.Context, id int) {
+	// A write often fails because its caller went away, the refresh still has to happen
+	p, err := c.db.GetPerson(context.WithoutCancel(ctx), id)
+	if errors.Is(err, model.ErrNotFound) {
+		c.evict(id)
+		return
+	}
+	if err != nil {
+		logger.Logger.WithContext(ctx).Errorf("CONTROLLER: Error reconciling person %v, evicting from key-value store: %v", id, err)
+		c.evict(id)
+		return
+	}
+
+	if err := c.kv.InsertPerson(p); err != nil {
+		logger.Logger.WithContext(ctx).Errorf("CONTROLLER: Error storing reconciled person %v, evicting from key-value store: %v", id, err)
+		c.evict(id)
+		return
+	}
+	logger.Logger.WithContext(ctx).Infof("CONTROLLER: reconciled person %v from data source", id)
+}
+
+// reconcileRejected replaces each person whose queued write was dead-lettered with the data source's copy, evicting
+// it if the data source doesn't have or can't read it, so the store stops serving a write the data source never took.
+// It runs inside a flush that may hold writeMu, so it relies on the store instead: the staged update only commits while
+// the store still holds the rejected version, a newer one has another write queued behind it and is left alone.
+func (c *personController) reconcileRejected(ctx context.Context, rejected []model.Person) {
+	for _, p := range rejected {
+		fresh, err := c.db.GetPerson(context.WithoutCancel(ctx), p.ID)
+		if err != nil && !errors.Is(err, model.ErrNotFound) {
+			logger.Logger.WithContext(ctx).Errorf("CONTROLLER: Error reconciling rejected person %v, evicting from key-value store: %v", p.ID, err)
+		}
+
+		tx := c.kv.Begin()
+		tx.Update(p)
+		change := model.Change{Op: model.OpUpdate, ID: p.ID, Before: &p, After: &fresh}
+		if err != nil {
+			tx.Delete(p.ID)
+			change = model.Change{Op: model.OpDelete, ID: p.ID, Before: &p}
+		} else {
+			tx.Put(fresh)
+		}
+		if _, err := tx.Commit(); err != nil {
+			if !errors.Is(err, model.ErrConflict) && !errors.Is(err, model.ErrNotFound) {
+				logger.Logger.WithContext(ctx).Errorf("CONTROLLER: Error reconciling rejected person %v: %v", p.ID, err)
+			}
+			continue
+		}
+		c.watches.publish(change)
+		logger.Logger.WithContext(ctx).Warnf("CONTROLLER: reconciled person %v after its write was dead-lettered", p.ID)
+	}
+}
+
+// evict removes a person from the key-value store if present
+func (c *personController) evict(id int) {
+	if err := c.kv.DeletePerson(id); err == nil {
+		logger.Logger.Warnf("CONTROLLER: evicted person %v from key-value store", id)
+	}
+}
+
+// updatePersonWriteBehind swaps the update into the store and durably queues it for the data source
+func (c *personController) updatePersonWriteBehind(ctx context.Context, p model.Person) (model.Person, error) {
+	current, ok := c.kv.GetPerson(p.ID)
+	if !ok {
+		logger.Logger.WithContext(ctx).Errorf("CONTROLLER: Error updating person: person %v not found", p.ID)
+		return model.Person{}, model.ErrNotFound
+	}
+
+	if current.Version != p.Version {
+		logger.Logger.WithContext(ctx).Errorf("CONTROLLER: Error updating person: stale version %v, current is %v", p.Version, current.Version)
+		return model.Person{}, model.ErrConflict
+	}
+
+	// The store is authoritative in write-behind mode, so the swap decides the new version and the queued record carries it
+	updated, err := c.kv.CompareAndSwap(current, p)
+	if err == nil {
+		err = c.queueStored(current, updated)
+	} else {
+		c.undoStored(current, updated)
+	}
+	if err != nil {
+		logger.Logger.WithContext(ctx).Errorf("CONTROLLER: Error updating person: %v", err)
+		return model.Person{}, err
+	}
+
+	logger.Logger.WithContext(ctx).Info("CONTROLLER: UpdatePerson success: queued for write-behind")
+	return updated, nil
+}
+
+// patchPersonWriteBehind applies the ops atomically in the store and queues the result
+func (c *personController) patchPersonWriteBehind(ctx context.Context, id int, ops []model.FieldOp) (model.Person, error) {
+	current, ok := c.kv.GetPerson(id)
+	if !ok {
+		logger.Logger.WithContext(ctx).Errorf("CONTROLLER: Error patching person: person %v not found", id)
+		return model.Person{}, model.ErrNotFound
+	}
+
+	updated, err := c.kv.ApplyOps(id, ops)
+	if err == nil {
+		err = c.queueStored(current, updated)
+	} else {
+		c.undoStored(current, updated)
+	}
+	if err != nil {
+		logger.Logger.WithContext(ctx).Errorf("CONTROLLER: Error patching person: %v", err)
+		return model.Person{}, err
+	}
+
+	logger.Logger.WithContext(ctx).Info("CONTROLLER: PatchPerson success: queued for write-behind")
+	return updated, nil
+}
+
+// queueStored queues a write-behind update the store has applied and notifies watchers, the store is restored to
+// before if the update can't be queued so it never serves a write the data source won't get
+func (c *personController) queueStored(before, updated model.Person) error {
+	if err := c.wb.q.Enqueue(updated); err != nil {
+		c.undoStored(before, updated)
+		return fmt.Errorf("error queueing person update: %w", err)
+	}
+	c.watches.publish(model.Change{Op: model.OpUpdate, ID: updated.ID, Before: &before, After: &updated})
+	return nil
+}
+
+// undoStored restores before after a failed write-behind update, a store that applied the update but couldn't log
+// it returns the new version along with its error. Callers hold writeMu, so no other write came in between.
+func (c *personController) undoStored(before, updated model.Person) {
+	if updated.Version <= before.Version {
+		return
+	}
+	if err := c.kv.InsertPerson(before); err != nil {
+		logger.Logger.Errorf("CONTROLLER: Error restoring person %v: %v", before.ID, err)
+	}
+}
+
+// storeUpdate stores an acknowledged update and notifies watchers, with the replaced cached value as the before image.
+// An error means the store couldn't log the update, watchers are still notified since the store now serves it.
+func (c *personController) storeUpdate(updated model.Person) error {
+	change := model.Change{Op: model.OpUpdate, ID: updated.ID, After: &updated}
+	if before, ok := c.kv.GetPerson(updated.ID); ok {
+		change.Before = &before
+	}
+
+	err := c.kv.InsertPerson(updated)
+	c.watches.publish(change)
+	return err
+}
+
+// Watch subscribes to committed changes matching opts, the caller must Stop the watcher when done
+func (c *personController) Watch(opts WatchOptions) (*Watcher, error) {
+	return c.watches.watch(opts)
+}
+
+// Evict removes a person from the key-value store without writing to the data source, a reload brings it back
+func (c *personController) Evict(id int) bool {
+	c.writeMu.Lock()
+	defer c.writeMu.Unlock()
+
+	if err := c.kv.DeletePerson(id); err != nil {
+		return false
+	}
+	logger.Logger.Infof("CONTROLLER: evicted person %v from key-value store", id)
+	return true
+}
+
+// QueueDepth returns the number of updates waiting to be flushed to the data source
+func (c *personController) QueueDepth() int {
+	if c.wb == nil {
+		return 0
+	}
+	return c.wb.q.Depth()
+}
+
+// storeSpan starts a span around a call into the store, which has no context of its own to trace with
+func storeSpan(ctx context.Context, op string) trace.Span {
+	_, span := tracing.Start(ctx, "PersonStore."+op)
+	return span
+}
+
+// StoreStats returns the number of persons in the store and the size of its indexes
+func (c *personController) StoreStats() store.Stats {
+	return c.kv.Stats()
+}
+
+// Close flushes any queued updates to the data source, writes a final snapshot and closes the write-ahead log when enabled,
+// then ends every watch
+func (c *personController) Close(ctx context.Context) error {
+	logger.Logger.Info("CONTROLLER: Close called")
+	var errs []error
+
+	if c.sn != nil {
+		c.sn.stop()
+	}
+
+	if c.wb != nil {
+		logger.Logger.Infof("CONTROLLER: flushing %v queued writes", c.wb.q.Depth())
+		errs = append(errs, c.wb.close(ctx))
+	}
+
+	// Snapshot last so it includes every write accepted before shutdown
+	if c.sn != nil {
+		errs = append(errs, c.sn.save())
+	}
+
+	if durable, ok := c.kv.(*store.DurableStore); ok {
+		errs = append(errs, durable.Close())
+	}
+
+	c.watches.close()
+
+	return errors.Join(errs...)
+}
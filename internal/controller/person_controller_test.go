@@ -1,7 +1,10 @@
 package controller
 
 import (
+	"context"
 	"gocache/internal/datasource"
+	"gocache/pkg/model"
+	"slices"
 	"testing"
 )
 
@@ -34,7 +37,7 @@ func TestPersonControllerQuery(t *testing.T) {
 	// Test the Query function
 	db := datasource.NewMockDataSource()
 	pc, _ := NewPersonController(db)
-	persons, err := pc.Query("", "", nil)
+	persons, err := pc.Query(context.Background(), "", "", nil)
 
 	if err != nil {
 		t.Fatalf("Query() returned an error: %v", err)
@@ -49,7 +52,7 @@ func TestPersonControllerGetAllPersons(t *testing.T) {
 	// Test the GetAllPersons function
 	db := datasource.NewMockDataSource()
 	pc, _ := NewPersonController(db)
-	persons, err := pc.GetAllPersons()
+	persons, err := pc.GetAllPersons(context.Background())
 
 	if err != nil {
 		t.Fatalf("GetAllPersons() returned an error: %v", err)
@@ -64,7 +67,7 @@ func TestPersonControllerGetAllPersons(t *testing.T) {
 func TestPersonControllerQueryWithName(t *testing.T) {
 	db := datasource.NewMockDataSource()
 	pc, _ := NewPersonController(db)
-	persons, err := pc.Query("John Doe", "", nil)
+	persons, err := pc.Query(context.Background(), "John Doe", "", nil)
 
 	if err != nil {
 		t.Fatalf("Query() returned an error: %v", err)
@@ -78,3 +81,44 @@ func TestPersonControllerQueryWithName(t *testing.T) {
 		t.Fatalf("Expected name John Doe, got %s", persons[0].Name)
 	}
 }
+
+func TestPersonControllerExport(t *testing.T) {
+	db := datasource.NewMockDataSource()
+	pc, _ := NewPersonController(db)
+
+	all, err := pc.Export(context.Background(), model.Filter{})
+	if err != nil {
+		t.Fatalf("Export() returned an error: %v", err)
+	}
+	johns, _ := pc.Export(context.Background(), model.Filter{Name: "John Doe"})
+
+	// Writes after the call don't change what an export yields
+	if _, err := pc.ApplyBatch(context.Background(), []model.WriteOp{{Op: model.OpDelete, ID: 1}}); err != nil {
+		t.Fatalf("ApplyBatch() returned an error: %v", err)
+	}
+
+	if persons := slices.Collect(all); len(persons) != 2 {
+		t.Errorf("expected 2 persons, got %v", persons)
+	}
+	if persons := slices.Collect(johns); len(persons) != 1 || persons[0].ID != 1 {
+		t.Errorf("expected John Doe, got %v", persons)
+	}
+}
+
+func TestPersonControllerEvict(t *testing.T) {
+	db := datasource.NewMockDataSource()
+	pc, _ := NewPersonController(db)
+
+	if !pc.Evict(1) {
+		t.Fatal("Evict() reported a cached person as not cached")
+	}
+	if _, err := pc.GetPerson(context.Background(), 1); err == nil {
+		t.Error("expected the evicted person to be gone from the cache")
+	}
+	if _, err := db.GetPerson(context.Background(), 1); err != nil {
+		t.Errorf("expected the data source to keep the evicted person, got %v", err)
+	}
+	if pc.Evict(1) {
+		t.Error("Evict() reported a person that isn't cached as evicted")
+	}
+}
@@ -0,0 +1,175 @@
+package controller
+
+import (
+	"context"
+	"gocache/internal/datasource"
+	"gocache/internal/logger"
+	"gocache/internal/metrics"
+	"gocache/pkg/model"
+	"gocache/pkg/store"
+	"sync"
+	"time"
+)
+
+// DefaultSnapshotInterval is how often the store is snapshotted when no interval is configured
+const DefaultSnapshotInterval = 5 * time.Minute
+
+// warmStart builds a store from the snapshot at path and the write-ahead log entries logged after it,
+// then catches it up with the data source by comparing versions, so only persons the data source has a newer version
+// of are fetched in full.
+// A change made without bumping the version is not seen, see DataSource.GetPersonVersions.
+// It returns nil when there is no usable snapshot or the catch-up fails, callers then do a full load.
+func warmStart(ctx context.Context, db datasource.DataSource, path string, logged []store.WALEntry) store.PersonStore {
+	snap, err := store.LoadSnapshot(path)
+	if err != nil {
+		logger.Logger.WithContext(ctx).Warnf("CONTROLLER: no usable snapshot at %v, doing a full load: %v", path, err)
+		return nil
+	}
+
+	kv := store.NewKVStore()
+	if err := kv.InsertPersons(snap.Persons); err != nil {
+		logger.Logger.WithContext(ctx).Warnf("CONTROLLER: Error restoring snapshot at %v, doing a full load: %v", path, err)
+		return nil
+	}
+	logger.Logger.WithContext(ctx).Infof("CONTROLLER: restored %v persons from snapshot taken at %v", len(snap.Persons), snap.Created)
+
+	if len(logged) > 0 {
+		if err := store.ReplayWAL(kv, logged); err != nil {
+			logger.Logger.WithContext(ctx).Warnf("CONTROLLER: Error replaying write-ahead log, doing a full load: %v", err)
+			return nil
+		}
+		logger.Logger.WithContext(ctx).Infof("CONTROLLER: replayed %v write-ahead log entries", len(logged))
+	}
+
+	versions, err := db.GetPersonVersions(ctx)
+	if err != nil {
+		logger.Logger.WithContext(ctx).Errorf("CONTROLLER: Error getting versions for snapshot catch-up, doing a full load: %v", err)
+		return nil
+	}
+
+	// A newer version in the store is a logged update write-behind hadn't flushed yet, refetching it would lose it
+	changed := make([]int, 0)
+	for id, version := range versions {
+		if p, ok := kv.GetPerson(id); !ok || p.Version < version {
+			changed = append(changed, id)
+		}
+	}
+
+	deleted := 0
+	for _, p := range kv.GetAllPersons() {
+		if _, ok := versions[p.ID]; !ok {
+			kv.DeletePerson(p.ID)
+			deleted++
+		}
+	}
+
+	persons := make([]model.Person, 0)
+	if len(changed) > 0 {
+		if persons, err = db.GetPersonsByIDs(ctx, changed); err != nil {
+			logger.Logger.WithContext(ctx).Errorf("CONTROLLER: Error fetching changed persons for snapshot catch-up, doing a full load: %v", err)
+			return nil
+		}
+		if err := kv.InsertPersons(persons); err != nil {
+			logger.Logger.WithContext(ctx).Errorf("CONTROLLER: Error storing changed persons for snapshot catch-up, doing a full load: %v", err)
+			return nil
+		}
+	}
+
+	logger.Logger.WithContext(ctx).Infof("CONTROLLER: snapshot catch-up applied %v changed and %v deleted persons", len(persons), deleted)
+	metrics.WarmupPersons.WithLabelValues("snapshot").Add(float64(len(snap.Persons)))
+	metrics.WarmupPersons.WithLabelValues("wal").Add(float64(len(logged)))
+	metrics.WarmupPersons.WithLabelValues("changed").Add(float64(len(persons)))
+	metrics.WarmupPersons.WithLabelValues("deleted").Add(float64(deleted))
+	return kv
+}
+
+// replayNewer applies the logged updates that are newer than the persons in kv, the ones write-behind hadn't flushed
+// to the data source yet. Inserts and deletes are always written through, so the data source already reflects them.
+func replayNewer(kv store.PersonStore, logged []store.WALEntry) (int, error) {
+	replayed := 0
+	for _, e := range logged {
+		if e.Delete {
+			continue
+		}
+		if p, ok := kv.GetPerson(e.Person.ID); !ok || p.Version >= e.Person.Version {
+			continue
+		}
+		if err := kv.InsertPerson(e.Person); err != nil {
+			return replayed, err
+		}
+		replayed++
+	}
+	return replayed, nil
+}
+
+// snapshotter periodically writes the store to disk
+type snapshotter struct {
+	kv       store.PersonStore
+	path     string
+	interval time.Duration
+
+	// mu serializes saves so the periodic and shutdown snapshots never race on the file
+	mu       sync.Mutex
+	stopOnce sync.Once
+	quit     chan struct{}
+	done     chan struct{}
+}
+
+func newSnapshotter(kv store.PersonStore, path string, interval time.Duration) *snapshotter {
+	if interval <= 0 {
+		interval = DefaultSnapshotInterval
+	}
+
+	return &snapshotter{
+		kv:       kv,
+		path:     path,
+		interval: interval,
+		quit:     make(chan struct{}),
+		done:     make(chan struct{}),
+	}
+}
+
+// start runs the periodic snapshot worker until stop is called
+func (s *snapshotter) start() {
+	go func() {
+		defer close(s.done)
+
+		ticker := time.NewTicker(s.interval)
+		defer ticker.Stop()
+
+		for {
+			select {
+			case <-s.quit:
+				return
+			case <-ticker.C:
+				if err := s.save(); err != nil {
+					logger.Logger.Errorf("CONTROLLER: periodic snapshot failed: %v", err)
+				}
+			}
+		}
+	}()
+}
+
+// stop halts the periodic worker, it doesn't take a final snapshot
+func (s *snapshotter) stop() {
+	s.stopOnce.Do(func() { close(s.quit) })
+	<-s.done
+}
+
+// save writes a snapshot of the store now, compacting the write-ahead log into it when there is one
+func (s *snapshotter) save() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	start := time.Now()
+	if durable, ok := s.kv.(*store.DurableStore); ok {
+		if err := durable.Compact(s.path); err != nil {
+			return err
+		}
+	} else if err := store.SaveSnapshot(s.path, s.kv); err != nil {
+		return err
+	}
+
+	logger.Logger.Infof("CONTROLLER: wrote snapshot to %v in %v", s.path, time.Since(start))
+	return nil
+}
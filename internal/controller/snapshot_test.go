@@ -0,0 +1,275 @@
+package controller
+
+import (
+	"context"
+	"gocache/internal/datasource"
+	"gocache/internal/queue"
+	"gocache/pkg/model"
+	"gocache/pkg/store"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestSnapshotWarmStartCatchesUp(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "persons.snap")
+	mock := datasource.NewMockDataSource()
+	db := datasource.NewFaultDataSource(mock)
+
+	pc, err := NewPersonControllerWithOptions(db, Options{SnapshotPath: path, SnapshotInterval: time.Hour})
+	if err != nil {
+		t.Fatalf("NewPersonControllerWithOptions() returned an error: %v", err)
+	}
+	if err := pc.Close(context.Background()); err != nil {
+		t.Fatalf("Close() returned an error: %v", err)
+	}
+
+	// Change the data source while the cache is down
+	mock.UpdatePerson(context.Background(), model.Person{ID: 1, Name: "John Smith", Age: 31, Email: "john.smith@example.com"})
+	mock.ApplyWrites(context.Background(), []model.WriteOp{
+		{Op: model.OpDelete, ID: 2},
+		{Op: model.OpInsert, Person: model.Person{ID: 3, Name: "Alice Johnson", Age: 8, Email: "alice@example.com"}},
+	})
+
+	// A warm start must not fall back to loading everything
+	db.Inject("GetAllPersons", datasource.Fault{})
+
+	pc, err = NewPersonControllerWithOptions(db, Options{SnapshotPath: path, SnapshotInterval: time.Hour})
+	if err != nil {
+		t.Fatalf("warm start returned an error: %v", err)
+	}
+	defer pc.Close(context.Background())
+
+	persons, _ := pc.GetAllPersons(context.Background())
+	if len(persons) != 2 {
+		t.Fatalf("expected persons 1 and 3 after catch-up, got %+v", persons)
+	}
+
+	if p, _ := pc.GetPerson(context.Background(), 1); p.Name != "John Smith" || p.Version != 1 {
+		t.Errorf("expected changed person to be refreshed, got %+v", p)
+	}
+	if _, err := pc.GetPerson(context.Background(), 2); err == nil {
+		t.Error("expected deleted person to be dropped")
+	}
+	if _, err := pc.GetPerson(context.Background(), 3); err != nil {
+		t.Error("expected inserted person to be fetched")
+	}
+}
+
+func TestSnapshotCorruptFallsBackToFullLoad(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "persons.snap")
+	if err := os.WriteFile(path, []byte("not a snapshot"), 0o644); err != nil {
+		t.Fatalf("failed to write snapshot: %v", err)
+	}
+
+	pc, err := NewPersonControllerWithOptions(datasource.NewMockDataSource(), Options{SnapshotPath: path, SnapshotInterval: time.Hour})
+	if err != nil {
+		t.Fatalf("NewPersonControllerWithOptions() returned an error: %v", err)
+	}
+	defer pc.Close(context.Background())
+
+	if persons, _ := pc.GetAllPersons(context.Background()); len(persons) != 2 {
+		t.Errorf("expected a full load of 2 persons, got %+v", persons)
+	}
+}
+
+func TestSnapshotCatchUpFailureFallsBackToFullLoad(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "persons.snap")
+	db := datasource.NewFaultDataSource(datasource.NewMockDataSource())
+
+	pc, _ := NewPersonControllerWithOptions(db, Options{SnapshotPath: path, SnapshotInterval: time.Hour})
+	pc.Close(context.Background())
+
+	db.Inject("GetPersonVersions", datasource.Fault{})
+
+	pc, err := NewPersonControllerWithOptions(db, Options{SnapshotPath: path, SnapshotInterval: time.Hour})
+	if err != nil {
+		t.Fatalf("NewPersonControllerWithOptions() returned an error: %v", err)
+	}
+	defer pc.Close(context.Background())
+
+	if persons, _ := pc.GetAllPersons(context.Background()); len(persons) != 2 {
+		t.Errorf("expected a full load of 2 persons, got %+v", persons)
+	}
+}
+
+func TestSnapshotWrittenPeriodically(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "persons.snap")
+
+	pc, err := NewPersonControllerWithOptions(datasource.NewMockDataSource(), Options{SnapshotPath: path, SnapshotInterval: 10 * time.Millisecond})
+	if err != nil {
+		t.Fatalf("NewPersonControllerWithOptions() returned an error: %v", err)
+	}
+	defer pc.Close(context.Background())
+
+	deadline := time.Now().Add(2 * time.Second)
+	for {
+		if _, err := os.Stat(path); err == nil {
+			return
+		}
+		if time.Now().After(deadline) {
+			t.Fatal("expected a periodic snapshot to be written")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func TestWALRecoversWritesAfterSnapshot(t *testing.T) {
+	dir := t.TempDir()
+	opts := Options{
+		SnapshotPath:     filepath.Join(dir, "persons.snap"),
+		SnapshotInterval: time.Hour,
+		WALPath:          filepath.Join(dir, "persons.wal"),
+		WALSync:          store.SyncAlways,
+	}
+	db := datasource.NewFaultDataSource(datasource.NewMockDataSource())
+
+	pc, err := NewPersonControllerWithOptions(db, opts)
+	if err != nil {
+		t.Fatalf("NewPersonControllerWithOptions() returned an error: %v", err)
+	}
+
+	if _, err := pc.UpdatePerson(context.Background(), model.Person{ID: 1, Name: "John Smith", Age: 31, Email: "john.smith@example.com"}); err != nil {
+		t.Fatalf("UpdatePerson() returned an error: %v", err)
+	}
+
+	// Crash: stop without the final snapshot, so the update only survives in the log
+	c := pc.(*personController)
+	c.sn.stop()
+	c.kv.(*store.DurableStore).Close()
+
+	// Replaying the log leaves nothing to fetch, so the restart must not need either call
+	db.Inject("GetAllPersons", datasource.Fault{})
+	db.Inject("GetPersonsByIDs", datasource.Fault{})
+
+	pc, err = NewPersonControllerWithOptions(db, opts)
+	if err != nil {
+		t.Fatalf("recovery returned an error: %v", err)
+	}
+	defer pc.Close(context.Background())
+
+	if p, _ := pc.GetPerson(context.Background(), 1); p.Name != "John Smith" || p.Version != 1 {
+		t.Errorf("expected the logged update to be recovered, got %+v", p)
+	}
+}
+
+func TestWALReplayedOverFullLoad(t *testing.T) {
+	dir := t.TempDir()
+	opts := Options{
+		SnapshotPath:     filepath.Join(dir, "persons.snap"),
+		SnapshotInterval: time.Hour,
+		WALPath:          filepath.Join(dir, "persons.wal"),
+		WALSync:          store.SyncAlways,
+	}
+	q, err := queue.NewWriteQueue(filepath.Join(dir, "queue.ndjson"))
+	if err != nil {
+		t.Fatalf("NewWriteQueue() error: %v", err)
+	}
+	writeBehind := opts
+	writeBehind.Queue = q
+	writeBehind.WriteBehind = WriteBehindConfig{BatchSize: 1, FlushInterval: time.Hour, MaxRetries: 2, RetryBackoff: time.Millisecond}
+
+	pc, err := NewPersonControllerWithOptions(datasource.NewMockDataSource(), writeBehind)
+	if err != nil {
+		t.Fatalf("NewPersonControllerWithOptions() returned an error: %v", err)
+	}
+	if _, err := pc.UpdatePerson(context.Background(), model.Person{ID: 1, Name: "John Smith", Age: 31, Email: "john.smith@example.com"}); err != nil {
+		t.Fatalf("UpdatePerson() returned an error: %v", err)
+	}
+
+	// Crash before the update is flushed, and lose the snapshot the log builds on
+	c := pc.(*personController)
+	c.sn.stop()
+	c.kv.(*store.DurableStore).Close()
+	q.Close()
+	if err := os.WriteFile(opts.SnapshotPath, []byte("not a snapshot"), 0o644); err != nil {
+		t.Fatalf("failed to write snapshot: %v", err)
+	}
+
+	// Without the queue only the log still has the update
+	pc, err = NewPersonControllerWithOptions(datasource.NewMockDataSource(), opts)
+	if err != nil {
+		t.Fatalf("recovery returned an error: %v", err)
+	}
+	defer pc.Close(context.Background())
+
+	if p, _ := pc.GetPerson(context.Background(), 1); p.Name != "John Smith" || p.Version != 1 {
+		t.Errorf("expected the logged update to be replayed over the full load, got %+v", p)
+	}
+	if persons, _ := pc.GetAllPersons(context.Background()); len(persons) != 2 {
+		t.Errorf("expected a full load of 2 persons, got %+v", persons)
+	}
+}
+
+func TestWALKeptOverOlderDataSource(t *testing.T) {
+	dir := t.TempDir()
+	opts := Options{
+		SnapshotPath:     filepath.Join(dir, "persons.snap"),
+		SnapshotInterval: time.Hour,
+		WALPath:          filepath.Join(dir, "persons.wal"),
+		WALSync:          store.SyncAlways,
+	}
+	q, err := queue.NewWriteQueue(filepath.Join(dir, "queue.ndjson"))
+	if err != nil {
+		t.Fatalf("NewWriteQueue() error: %v", err)
+	}
+	writeBehind := opts
+	writeBehind.Queue = q
+	writeBehind.WriteBehind = WriteBehindConfig{BatchSize: 1, FlushInterval: time.Hour, MaxRetries: 2, RetryBackoff: time.Millisecond}
+
+	pc, err := NewPersonControllerWithOptions(datasource.NewMockDataSource(), writeBehind)
+	if err != nil {
+		t.Fatalf("NewPersonControllerWithOptions() returned an error: %v", err)
+	}
+	if _, err := pc.UpdatePerson(context.Background(), model.Person{ID: 1, Name: "John Smith", Age: 31, Email: "john.smith@example.com"}); err != nil {
+		t.Fatalf("UpdatePerson() returned an error: %v", err)
+	}
+
+	// Crash before the update is flushed, keeping the snapshot at version 0 and the logged update at version 1
+	c := pc.(*personController)
+	c.sn.stop()
+	c.kv.(*store.DurableStore).Close()
+	q.Close()
+
+	// The data source is still at version 0 and the queue is gone, only the log has the update
+	db := datasource.NewFaultDataSource(datasource.NewMockDataSource())
+	db.Inject("GetAllPersons", datasource.Fault{})
+	pc, err = NewPersonControllerWithOptions(db, opts)
+	if err != nil {
+		t.Fatalf("recovery returned an error: %v", err)
+	}
+	defer pc.Close(context.Background())
+
+	if p, _ := pc.GetPerson(context.Background(), 1); p.Name != "John Smith" || p.Version != 1 {
+		t.Errorf("expected the logged update to survive the catch-up, got %+v", p)
+	}
+}
+
+func TestWALWriteFailureFailsUpdate(t *testing.T) {
+	dir := t.TempDir()
+	opts := Options{
+		SnapshotPath:     filepath.Join(dir, "persons.snap"),
+		SnapshotInterval: time.Hour,
+		WALPath:          filepath.Join(dir, "persons.wal"),
+		WALSync:          store.SyncAlways,
+	}
+
+	pc, err := NewPersonControllerWithOptions(datasource.NewMockDataSource(), opts)
+	if err != nil {
+		t.Fatalf("NewPersonControllerWithOptions() returned an error: %v", err)
+	}
+	defer pc.Close(context.Background())
+
+	pc.(*personController).kv.(*store.DurableStore).Close()
+	if _, err := pc.UpdatePerson(context.Background(), model.Person{ID: 1, Name: "John Smith", Age: 31, Email: "john.smith@example.com"}); err == nil {
+		t.Error("expected the update to fail when it can't be logged")
+	}
+}
+
+func TestWALRequiresSnapshotPath(t *testing.T) {
+	_, err := NewPersonControllerWithOptions(datasource.NewMockDataSource(), Options{WALPath: filepath.Join(t.TempDir(), "persons.wal"), WALSync: store.SyncNever})
+	if err == nil {
+		t.Error("expected an error when the WAL has no snapshot to compact into")
+	}
+}
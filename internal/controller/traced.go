@@ -0,0 +1,82 @@
+package controller
+
+import (
+	"context"
+	"gocache/internal/tracing"
+	"gocache/pkg/model"
+	"iter"
+
+	"go.opentelemetry.io/otel/attribute"
+)
+
+// tracedController wraps a PersonController and starts a span for every call that takes a context
+type tracedController struct {
+	PersonController
+}
+
+// Trace wraps pc so each of its calls appears in the caller's trace, with the store and data source calls it makes as children
+func Trace(pc PersonController) PersonController {
+	return &tracedController{PersonController: pc}
+}
+
+func (t *tracedController) GetAllPersons(ctx context.Context) ([]model.Person, error) {
+	ctx, span := tracing.Start(ctx, "PersonController.GetAllPersons")
+	p, err := t.PersonController.GetAllPersons(ctx)
+	tracing.End(span, err)
+	return p, err
+}
+
+func (t *tracedController) GetPerson(ctx context.Context, id int) (model.Person, error) {
+	ctx, span := tracing.Start(ctx, "PersonController.GetPerson", attribute.Int("person.id", id))
+	p, err := t.PersonController.GetPerson(ctx, id)
+	tracing.End(span, err)
+	return p, err
+}
+
+func (t *tracedController) Query(ctx context.Context, name, email string, ages []int) ([]model.Person, error) {
+	// The filter values are personal data, so only which fields were filtered on is recorded
+	ctx, span := tracing.Start(ctx, "PersonController.Query",
+		attribute.Bool("query.name", name != ""), attribute.Bool("query.email", email != ""), attribute.Int("query.ages", len(ages)))
+	p, err := t.PersonController.Query(ctx, name, email, ages)
+	span.SetAttributes(attribute.Int("query.results", len(p)))
+	tracing.End(span, err)
+	return p, err
+}
+
+func (t *tracedController) Export(ctx context.Context, f model.Filter) (iter.Seq[model.Person], error) {
+	// The span covers taking the view, the caller reads it at its own pace
+	ctx, span := tracing.Start(ctx, "PersonController.Export",
+		attribute.Bool("query.name", f.Name != ""), attribute.Bool("query.email", f.Email != ""), attribute.Int("query.ages", len(f.Ages)))
+	seq, err := t.PersonController.Export(ctx, f)
+	tracing.End(span, err)
+	return seq, err
+}
+
+func (t *tracedController) UpdatePerson(ctx context.Context, p model.Person) (model.Person, error) {
+	ctx, span := tracing.Start(ctx, "PersonController.UpdatePerson", attribute.Int("person.id", p.ID), attribute.Int64("person.version", p.Version))
+	updated, err := t.PersonController.UpdatePerson(ctx, p)
+	tracing.End(span, err)
+	return updated, err
+}
+
+func (t *tracedController) PatchPerson(ctx context.Context, id int, ops []model.FieldOp) (model.Person, error) {
+	ctx, span := tracing.Start(ctx, "PersonController.PatchPerson", attribute.Int("person.id", id), attribute.Int("patch.ops", len(ops)))
+	updated, err := t.PersonController.PatchPerson(ctx, id, ops)
+	tracing.End(span, err)
+	return updated, err
+}
+
+func (t *tracedController) ApplyBatch(ctx context.Context, ops []model.WriteOp) ([]model.Person, error) {
+	ctx, span := tracing.Start(ctx, "PersonController.ApplyBatch", attribute.Int("batch.ops", len(ops)))
+	results, err := t.PersonController.ApplyBatch(ctx, ops)
+	tracing.End(span, err)
+	return results, err
+}
+
+func (t *tracedController) Import(ctx context.Context, persons []model.Person, dryRun bool) (ImportResult, error) {
+	ctx, span := tracing.Start(ctx, "PersonController.Import", attribute.Int("import.rows", len(persons)), attribute.Bool("import.dry_run", dryRun))
+	result, err := t.PersonController.Import(ctx, persons, dryRun)
+	span.SetAttributes(attribute.Int("import.imported", result.Imported), attribute.Int("import.failed", len(result.Failed)))
+	tracing.End(span, err)
+	return result, err
+}
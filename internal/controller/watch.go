@@ -0,0 +1,158 @@
+package controller
+
+import (
+	"errors"
+	"gocache/pkg/model"
+	"sync"
+)
+
+// watchBuffer is how many changes a watcher may fall behind before it is dropped, and how many
+// recent changes are kept for watchers resuming from a sequence number
+const watchBuffer = 1024
+
+var (
+	// ErrWatchLagged ends a watch whose consumer fell too far behind to be sent every change
+	ErrWatchLagged = errors.New("watcher fell too far behind")
+	// ErrWatchExpired is returned when resuming from a sequence number whose changes are no longer kept
+	ErrWatchExpired = errors.New("changes since the requested sequence number are no longer available")
+	// ErrClosed ends a watch when the controller shuts down
+	ErrClosed = errors.New("controller closed")
+)
+
+// WatchOptions selects the changes a watcher receives
+type WatchOptions struct {
+	// Resume replays the kept changes after Since, otherwise the watch starts from the next change
+	Resume bool
+	Since  uint64
+	// Filter limits the watch to changes whose before or after image matches
+	Filter model.Filter
+}
+
+// Watcher receives matching changes in commit order
+type Watcher struct {
+	c      chan model.Change
+	hub    *watchHub
+	filter model.Filter
+	start  uint64
+	err    error // set before c is closed
+}
+
+// Changes returns the channel of changes, it is closed when the watch ends
+func (w *Watcher) Changes() <-chan model.Change {
+	return w.c
+}
+
+// Seq returns the sequence number the watch started after, every later change is delivered
+func (w *Watcher) Seq() uint64 {
+	return w.start
+}
+
+// Err reports why the watch ended once Changes is closed, nil if it was stopped by its owner
+func (w *Watcher) Err() error {
+	w.hub.mu.Lock()
+	defer w.hub.mu.Unlock()
+	return w.err
+}
+
+// Stop ends the watch and closes Changes
+func (w *Watcher) Stop() {
+	w.hub.remove(w, nil)
+}
+
+// watchHub numbers committed changes and fans them out to watchers without ever blocking the write path
+type watchHub struct {
+	mu       sync.Mutex
+	watchers map[*Watcher]struct{}
+	seq      uint64
+	history  []model.Change // the most recent changes, oldest first
+	closed   bool
+}
+
+// newWatchHub creates a hub whose first change is numbered start+1
+func newWatchHub(start uint64) *watchHub {
+	return &watchHub{watchers: make(map[*Watcher]struct{}), seq: start}
+}
+
+func (h *watchHub) watch(opts WatchOptions) (*Watcher, error) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	if h.closed {
+		return nil, ErrClosed
+	}
+
+	w := &Watcher{c: make(chan model.Change, watchBuffer), hub: h, filter: opts.Filter, start: h.seq}
+	if opts.Resume {
+		if opts.Since > h.seq || h.seq-opts.Since > uint64(len(h.history)) {
+			return nil, ErrWatchExpired
+		}
+
+		w.start = opts.Since
+		for _, change := range h.history[len(h.history)-int(h.seq-opts.Since):] {
+			if w.filter.MatchChange(change) {
+				w.c <- change
+			}
+		}
+	}
+
+	h.watchers[w] = struct{}{}
+	return w, nil
+}
+
+// publish numbers changes and sends them to every matching watcher, dropping any watcher whose buffer is full
+func (h *watchHub) publish(changes ...model.Change) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	for i := range changes {
+		h.seq++
+		changes[i].Seq = h.seq
+	}
+	h.history = append(h.history, changes...)
+	if n := len(h.history) - watchBuffer; n > 0 {
+		h.history = h.history[n:]
+	}
+
+	for w := range h.watchers {
+		for _, change := range changes {
+			if !w.filter.MatchChange(change) {
+				continue
+			}
+
+			select {
+			case w.c <- change:
+				continue
+			default:
+			}
+			h.drop(w, ErrWatchLagged)
+			break
+		}
+	}
+}
+
+func (h *watchHub) remove(w *Watcher, err error) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	h.drop(w, err)
+}
+
+// drop ends a watch, h.mu must be held
+func (h *watchHub) drop(w *Watcher, err error) {
+	if _, ok := h.watchers[w]; !ok {
+		return
+	}
+	delete(h.watchers, w)
+	w.err = err
+	close(w.c)
+}
+
+// close ends every watch with ErrClosed, later watches fail immediately
+func (h *watchHub) close() {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	h.closed = true
+	for w := range h.watchers {
+		h.drop(w, ErrClosed)
+	}
+}
@@ -0,0 +1,173 @@
+package controller
+
+import (
+	"context"
+	"errors"
+	"gocache/internal/datasource"
+	"gocache/pkg/model"
+	"reflect"
+	"testing"
+)
+
+func mustWatch(t *testing.T, pc PersonController, opts WatchOptions) *Watcher {
+	t.Helper()
+	w, err := pc.Watch(opts)
+	if err != nil {
+		t.Fatalf("Watch() returned an error: %v", err)
+	}
+	t.Cleanup(w.Stop)
+	return w
+}
+
+// expectChanges reads len(want) changes from w and fails if any more are buffered
+func expectChanges(t *testing.T, w *Watcher, want ...model.Change) {
+	t.Helper()
+	for _, expected := range want {
+		if got := <-w.Changes(); !reflect.DeepEqual(got, expected) {
+			t.Errorf("expected change %+v, got %+v", expected, got)
+		}
+	}
+
+	select {
+	case got := <-w.Changes():
+		t.Errorf("expected no more changes, got %+v", got)
+	default:
+	}
+}
+
+func TestWatchReceivesCommittedChanges(t *testing.T) {
+	pc, db := newFaultController(t)
+	w := mustWatch(t, pc, WatchOptions{})
+	base := w.Seq()
+
+	john, _ := pc.GetPerson(context.Background(), 1)
+	jane, _ := pc.GetPerson(context.Background(), 2)
+	updated, err := pc.UpdatePerson(context.Background(), model.Person{ID: 1, Name: "John Smith", Age: 31, Email: "john@example.com"})
+	if err != nil {
+		t.Fatalf("UpdatePerson() returned an error: %v", err)
+	}
+
+	// Failed writes aren't published
+	db.Inject("UpdatePerson", datasource.Fault{})
+	pc.UpdatePerson(context.Background(), model.Person{ID: 2, Name: "Jane Doe", Email: "jane@example.com"})
+
+	// Within a batch each change's before image is the value left by the previous op
+	results, err := pc.ApplyBatch(context.Background(), []model.WriteOp{
+		{Op: model.OpInsert, Person: model.Person{ID: 3, Name: "Alice Johnson", Email: "alice@example.com"}},
+		{Op: model.OpDelete, ID: 2},
+		{Op: model.OpUpdate, Person: model.Person{ID: 3, Name: "Alice Smith", Email: "alice@example.com"}},
+	})
+	if err != nil {
+		t.Fatalf("ApplyBatch() returned an error: %v", err)
+	}
+
+	expectChanges(t, w,
+		model.Change{Seq: base + 1, Op: model.OpUpdate, ID: 1, Before: &john, After: &updated},
+		model.Change{Seq: base + 2, Op: model.OpInsert, ID: 3, After: &results[0]},
+		model.Change{Seq: base + 3, Op: model.OpDelete, ID: 2, Before: &jane},
+		model.Change{Seq: base + 4, Op: model.OpUpdate, ID: 3, Before: &results[0], After: &results[2]},
+	)
+	if base != pc.watches.seq-4 {
+		t.Errorf("expected the watch to start after sequence %v, got %v", pc.watches.seq-4, base)
+	}
+}
+
+func TestWatchResumeAndFilter(t *testing.T) {
+	pc, _ := newFaultController(t)
+	base := pc.watches.seq
+
+	for _, age := range []int{40, 41, 42} {
+		p, _ := pc.GetPerson(context.Background(), 2)
+		p.Age = age
+		if _, err := pc.UpdatePerson(context.Background(), p); err != nil {
+			t.Fatalf("UpdatePerson() returned an error: %v", err)
+		}
+	}
+
+	resumed := mustWatch(t, pc, WatchOptions{Resume: true, Since: base + 1})
+	for _, seq := range []uint64{base + 2, base + 3} {
+		if got := <-resumed.Changes(); got.Seq != seq {
+			t.Errorf("expected replayed change %v, got %+v", seq, got)
+		}
+	}
+	if resumed.Seq() != base+1 {
+		t.Errorf("expected the resumed watch to start after sequence %v, got %v", base+1, resumed.Seq())
+	}
+
+	// Changes where neither image matches are skipped, including in the replay
+	filtered := mustWatch(t, pc, WatchOptions{Resume: true, Since: base + 1, Filter: model.Filter{Ages: []int{42}}})
+	if got := <-filtered.Changes(); got.Seq != base+3 {
+		t.Errorf("expected only change 3 to match, got %+v", got)
+	}
+	pc.ApplyBatch(context.Background(), []model.WriteOp{{Op: model.OpInsert, Person: model.Person{ID: 3, Name: "Alice Johnson", Age: 30, Email: "alice@example.com"}}})
+	expectChanges(t, filtered)
+
+	// The insert was change 4, anything later can't have been seen in this run
+	mustWatch(t, pc, WatchOptions{Resume: true, Since: base + 4})
+	if _, err := pc.Watch(WatchOptions{Resume: true, Since: base + 5}); !errors.Is(err, ErrWatchExpired) {
+		t.Errorf("expected ErrWatchExpired for a future sequence number, got %v", err)
+	}
+}
+
+func TestWatchExpiresOldSequenceNumbers(t *testing.T) {
+	pc, _ := newFaultController(t)
+	base := pc.watches.seq
+
+	// Only changes 3 onwards are kept
+	for i := 0; i < watchBuffer+2; i++ {
+		p, _ := pc.GetPerson(context.Background(), 1)
+		pc.UpdatePerson(context.Background(), p)
+	}
+
+	for _, since := range []uint64{0, base + 1} {
+		if _, err := pc.Watch(WatchOptions{Resume: true, Since: since}); !errors.Is(err, ErrWatchExpired) {
+			t.Errorf("since %v: expected ErrWatchExpired, got %v", since, err)
+		}
+	}
+	w := mustWatch(t, pc, WatchOptions{Resume: true, Since: base + 2})
+	if len(w.Changes()) != watchBuffer {
+		t.Errorf("expected %v replayed changes, got %v", watchBuffer, len(w.Changes()))
+	}
+}
+
+func TestWatchDropsLaggingWatcher(t *testing.T) {
+	pc, _ := newFaultController(t)
+	slow := mustWatch(t, pc, WatchOptions{})
+	stopped := mustWatch(t, pc, WatchOptions{})
+	stopped.Stop()
+
+	for i := 0; i <= watchBuffer; i++ {
+		p, _ := pc.GetPerson(context.Background(), 1)
+		if _, err := pc.UpdatePerson(context.Background(), p); err != nil {
+			t.Fatalf("UpdatePerson() returned an error: %v", err)
+		}
+	}
+
+	n := 0
+	for range slow.Changes() {
+		n++
+	}
+	if n != watchBuffer || !errors.Is(slow.Err(), ErrWatchLagged) {
+		t.Errorf("expected %v buffered changes and ErrWatchLagged, got %v and %v", watchBuffer, n, slow.Err())
+	}
+
+	if _, open := <-stopped.Changes(); open || stopped.Err() != nil {
+		t.Errorf("expected a stopped watcher to end without an error, got %v", stopped.Err())
+	}
+}
+
+func TestCloseEndsWatches(t *testing.T) {
+	pc, _ := newFaultController(t)
+	w := mustWatch(t, pc, WatchOptions{})
+
+	if err := pc.Close(context.Background()); err != nil {
+		t.Fatalf("Close() returned an error: %v", err)
+	}
+
+	if _, open := <-w.Changes(); open || !errors.Is(w.Err(), ErrClosed) {
+		t.Errorf("expected the watch to end with ErrClosed, got %v", w.Err())
+	}
+	if _, err := pc.Watch(WatchOptions{}); !errors.Is(err, ErrClosed) {
+		t.Errorf("expected a watch after Close to fail, got %v", err)
+	}
+}
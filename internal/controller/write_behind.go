@@ -0,0 +1,195 @@
+package controller
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"gocache/internal/datasource"
+	"gocache/internal/logger"
+	"gocache/internal/metrics"
+	"gocache/internal/queue"
+	"gocache/pkg/model"
+	"sync"
+	"time"
+)
+
+// WriteBehindConfig controls how queued writes are flushed to the data source
+type WriteBehindConfig struct {
+	BatchSize     int
+	FlushInterval time.Duration
+	MaxRetries    int
+	RetryBackoff  time.Duration
+}
+
+// DefaultWriteBehindConfig returns the settings used when none are configured
+func DefaultWriteBehindConfig() WriteBehindConfig {
+	return WriteBehindConfig{
+		BatchSize:     100,
+		FlushInterval: time.Second,
+		MaxRetries:    3,
+		RetryBackoff:  100 * time.Millisecond,
+	}
+}
+
+// writeBehind drains a durable write queue into the data source from a background worker
+type writeBehind struct {
+	q   *queue.WriteQueue
+	db  datasource.DataSource
+	cfg WriteBehindConfig
+
+	// onRejected is handed the writes moved to the dead-letter file, so the store stops serving them
+	onRejected func(ctx context.Context, rejected []model.Person)
+
+	// flushMu serializes flushes so the worker and a shutdown flush never send the same batch twice
+	flushMu   sync.Mutex
+	stop      chan struct{}
+	done      chan struct{}
+	closeOnce sync.Once
+	closeErr  error
+}
+
+func newWriteBehind(db datasource.DataSource, q *queue.WriteQueue, cfg WriteBehindConfig, onRejected func(context.Context, []model.Person)) *writeBehind {
+	defaults := DefaultWriteBehindConfig()
+	if cfg.BatchSize <= 0 {
+		cfg.BatchSize = defaults.BatchSize
+	}
+	if cfg.FlushInterval <= 0 {
+		cfg.FlushInterval = defaults.FlushInterval
+	}
+	if cfg.MaxRetries < 0 {
+		cfg.MaxRetries = defaults.MaxRetries
+	}
+	if cfg.RetryBackoff <= 0 {
+		cfg.RetryBackoff = defaults.RetryBackoff
+	}
+
+	return &writeBehind{
+		q:          q,
+		db:         db,
+		cfg:        cfg,
+		onRejected: onRejected,
+		stop:       make(chan struct{}),
+		done:       make(chan struct{}),
+	}
+}
+
+// start runs the flush worker until close is called
+func (w *writeBehind) start() {
+	go func() {
+		defer close(w.done)
+
+		ticker := time.NewTicker(w.cfg.FlushInterval)
+		defer ticker.Stop()
+
+		for {
+			select {
+			case <-w.stop:
+				return
+			case <-ticker.C:
+				if err := w.flush(context.Background()); err != nil {
+					logger.Logger.Errorf("CONTROLLER: write-behind flush failed, %v writes pending: %v", w.q.Depth(), err)
+				}
+			}
+		}
+	}()
+}
+
+// flush sends queued writes to the data source in batches until the queue is empty
+func (w *writeBehind) flush(ctx context.Context) error {
+	w.flushMu.Lock()
+	defer w.flushMu.Unlock()
+
+	for {
+		batch := w.q.Peek(w.cfg.BatchSize)
+		if len(batch) == 0 {
+			metrics.WriteBehindLastFlush.SetToCurrentTime()
+			return nil
+		}
+
+		backoff := w.cfg.RetryBackoff
+		var err error
+		for attempt := 0; attempt <= w.cfg.MaxRetries; attempt++ {
+			if attempt > 0 {
+				select {
+				case <-ctx.Done():
+					return ctx.Err()
+				case <-time.After(backoff):
+				}
+				backoff *= 2
+			}
+
+			if err = w.db.UpdatePersons(ctx, batch); err == nil {
+				break
+			}
+			logger.Logger.Warnf("CONTROLLER: write-behind batch of %v failed (attempt %v): %v", len(batch), attempt+1, err)
+		}
+		if err != nil {
+			metrics.WriteBehindFailures.Inc()
+			// A write the data source keeps rejecting would otherwise hold up every write queued behind it
+			if skipped, skipErr := w.skipRejected(ctx, len(batch)); !skipped {
+				return errors.Join(fmt.Errorf("error flushing write-behind batch: %w", err), skipErr)
+			}
+			continue
+		}
+
+		if err := w.q.Ack(len(batch)); err != nil {
+			return fmt.Errorf("error acknowledging write-behind batch: %w", err)
+		}
+		metrics.WriteBehindFlushed.Add(float64(len(batch)))
+		logger.Logger.Infof("CONTROLLER: write-behind flushed %v writes", len(batch))
+	}
+}
+
+// skipRejected writes the n writes of a batch that failed every retry one at a time, plus the next queued write so
+// a failing batch of one can still be told apart from an outage. Once any of them is written the data source is
+// known to be up, so the ones it rejected are moved to the dead-letter file, all of them are acknowledged and the
+// rejected ones are handed to onRejected. It reports whether the queue moved on, a batch whose every write fails is kept.
+func (w *writeBehind) skipRejected(ctx context.Context, n int) (bool, error) {
+	writes := w.q.Peek(n + 1)
+	var rejected []model.Person
+	for _, p := range writes {
+		if err := w.db.UpdatePersons(ctx, []model.Person{p}); err != nil {
+			logger.Logger.Warnf("CONTROLLER: write-behind write of person %v version %v failed: %v", p.ID, p.Version, err)
+			rejected = append(rejected, p)
+		}
+	}
+	if len(rejected) == len(writes) {
+		return false, nil
+	}
+	// A canceled flush fails the remaining writes without the data source having rejected them
+	if err := ctx.Err(); err != nil {
+		return false, err
+	}
+
+	if len(rejected) > 0 {
+		if err := w.q.DeadLetter(rejected); err != nil {
+			return false, err
+		}
+		metrics.WriteBehindDeadLettered.Add(float64(len(rejected)))
+		logger.Logger.Errorf("CONTROLLER: write-behind moved %v rejected writes to the dead-letter file", len(rejected))
+	}
+	if err := w.q.Ack(len(writes)); err != nil {
+		return false, fmt.Errorf("error acknowledging write-behind batch: %w", err)
+	}
+	metrics.WriteBehindFlushed.Add(float64(len(writes) - len(rejected)))
+	if len(rejected) > 0 {
+		w.onRejected(ctx, rejected)
+	}
+	return true, nil
+}
+
+// close stops the worker, flushes whatever is still queued and closes the queue, later calls return the same result
+func (w *writeBehind) close(ctx context.Context) error {
+	w.closeOnce.Do(func() {
+		close(w.stop)
+		<-w.done
+
+		flushErr := w.flush(ctx)
+		if flushErr != nil {
+			logger.Logger.Errorf("CONTROLLER: write-behind shutdown flush failed, %v writes left on disk: %v", w.q.Depth(), flushErr)
+		}
+
+		w.closeErr = errors.Join(flushErr, w.q.Close())
+	})
+	return w.closeErr
+}
@@ -0,0 +1,247 @@
+package controller
+
+import (
+	"context"
+	"errors"
+	"gocache/internal/datasource"
+	"gocache/internal/queue"
+	"gocache/pkg/model"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// flakyDataSource fails the first failures batch writes before delegating to the wrapped data source
+type flakyDataSource struct {
+	datasource.DataSource
+	failures int
+	batches  [][]model.Person
+}
+
+func (f *flakyDataSource) UpdatePersons(ctx context.Context, p []model.Person) error {
+	if f.failures > 0 {
+		f.failures--
+		return errors.New("transient failure")
+	}
+	f.batches = append(f.batches, p)
+	return f.DataSource.UpdatePersons(ctx, p)
+}
+
+func newTestWriteBehind(t *testing.T, db datasource.DataSource) (PersonController, *queue.WriteQueue) {
+	t.Helper()
+
+	q, err := queue.NewWriteQueue(filepath.Join(t.TempDir(), "queue.ndjson"))
+	if err != nil {
+		t.Fatalf("NewWriteQueue() error: %v", err)
+	}
+
+	// A long interval keeps the background worker out of the way so tests flush explicitly
+	cfg := WriteBehindConfig{BatchSize: 1, FlushInterval: time.Hour, MaxRetries: 2, RetryBackoff: time.Millisecond}
+	pc, err := NewWriteBehindPersonController(db, q, cfg)
+	if err != nil {
+		t.Fatalf("NewWriteBehindPersonController() returned an error: %v", err)
+	}
+	return pc, q
+}
+
+func TestWriteBehindUpdateAppliesToStoreImmediately(t *testing.T) {
+	db := &flakyDataSource{DataSource: datasource.NewMockDataSource()}
+	pc, _ := newTestWriteBehind(t, db)
+	defer pc.Close(context.Background())
+
+	updated := model.Person{ID: 1, Name: "John Smith", Age: 31, Email: "john.smith@example.com"}
+	if _, err := pc.UpdatePerson(context.Background(), updated); err != nil {
+		t.Fatalf("UpdatePerson() returned an error: %v", err)
+	}
+
+	persons, _ := pc.Query(context.Background(), "John Smith", "", nil)
+	if len(persons) != 1 {
+		t.Fatalf("expected update to be visible in the store, got %+v", persons)
+	}
+
+	if pc.QueueDepth() != 1 {
+		t.Errorf("expected queue depth 1, got %d", pc.QueueDepth())
+	}
+
+	if len(db.batches) != 0 {
+		t.Errorf("expected no data source writes before flush, got %+v", db.batches)
+	}
+}
+
+func TestWriteBehindUpdatePersonNotFound(t *testing.T) {
+	pc, _ := newTestWriteBehind(t, datasource.NewMockDataSource())
+	defer pc.Close(context.Background())
+
+	if _, err := pc.UpdatePerson(context.Background(), model.Person{ID: 999}); err == nil {
+		t.Fatal("expected an error updating a missing person")
+	}
+
+	if pc.QueueDepth() != 0 {
+		t.Errorf("expected nothing queued, got depth %d", pc.QueueDepth())
+	}
+}
+
+func TestWriteBehindFlushRetriesInBatches(t *testing.T) {
+	db := &flakyDataSource{DataSource: datasource.NewMockDataSource(), failures: 2}
+	pc, _ := newTestWriteBehind(t, db)
+
+	pc.UpdatePerson(context.Background(), model.Person{ID: 1, Name: "John Smith", Age: 31, Email: "john.smith@example.com"})
+	pc.UpdatePerson(context.Background(), model.Person{ID: 2, Name: "Jane Doe", Age: 26, Email: "jane.doe@example.com"})
+
+	if err := pc.Close(context.Background()); err != nil {
+		t.Fatalf("Close() returned an error: %v", err)
+	}
+
+	if len(db.batches) != 2 {
+		t.Fatalf("expected 2 batches of 1 after retries, got %+v", db.batches)
+	}
+
+	persons, _ := db.GetAllPersons(context.Background())
+	if persons[0].Name != "John Smith" || persons[1].Name != "Jane Doe" {
+		t.Errorf("expected data source to hold flushed updates, got %+v", persons)
+	}
+}
+
+func TestWriteBehindFlushKeepsWritesOnFailure(t *testing.T) {
+	db := &flakyDataSource{DataSource: datasource.NewMockDataSource(), failures: 100}
+	pc, q := newTestWriteBehind(t, db)
+
+	pc.UpdatePerson(context.Background(), model.Person{ID: 1, Name: "John Smith", Age: 31, Email: "john.smith@example.com"})
+
+	if err := pc.Close(context.Background()); err == nil {
+		t.Fatal("expected Close() to report the failed flush")
+	}
+
+	if q.Depth() != 1 {
+		t.Errorf("expected the write to stay queued, got depth %d", q.Depth())
+	}
+}
+
+// poisonDataSource rejects every bulk write that includes the person with ID poison
+type poisonDataSource struct {
+	datasource.DataSource
+	poison int
+}
+
+func (p *poisonDataSource) UpdatePersons(ctx context.Context, persons []model.Person) error {
+	for _, person := range persons {
+		if person.ID == p.poison {
+			return errors.New("rejected")
+		}
+	}
+	return p.DataSource.UpdatePersons(ctx, persons)
+}
+
+func TestWriteBehindDeadLettersRejectedWrites(t *testing.T) {
+	db := &poisonDataSource{DataSource: datasource.NewMockDataSource(), poison: 1}
+	pc, q := newTestWriteBehind(t, db)
+
+	pc.UpdatePerson(context.Background(), model.Person{ID: 1, Name: "John Smith", Age: 31, Email: "john.smith@example.com"})
+	pc.UpdatePerson(context.Background(), model.Person{ID: 2, Name: "Jane Doe", Age: 26, Email: "jane.doe@example.com"})
+
+	if err := pc.Close(context.Background()); err != nil {
+		t.Fatalf("Close() returned an error: %v", err)
+	}
+	if err := pc.Close(context.Background()); err != nil {
+		t.Errorf("expected a second Close() to return the first result, got %v", err)
+	}
+
+	if q.Depth() != 0 {
+		t.Errorf("expected the rejected write not to hold up the queue, got depth %d", q.Depth())
+	}
+	if jane, _ := db.GetPerson(context.Background(), 2); jane.Name != "Jane Doe" {
+		t.Errorf("expected the write behind the rejected one to be flushed, got %+v", jane)
+	}
+	if john, _ := pc.GetPerson(context.Background(), 1); john.Name != "John Doe" || john.Version != 0 {
+		t.Errorf("expected the store to serve the data source's copy of the rejected write, got %+v", john)
+	}
+	if jane, _ := pc.GetPerson(context.Background(), 2); jane.Name != "Jane Doe" || jane.Version != 1 {
+		t.Errorf("expected the flushed write to stay in the store, got %+v", jane)
+	}
+}
+
+func TestWriteBehindReconcilesRejectedWritesDuringBatch(t *testing.T) {
+	db := &poisonDataSource{DataSource: datasource.NewMockDataSource(), poison: 1}
+	pc, _ := newTestWriteBehind(t, db)
+	defer pc.Close(context.Background())
+
+	pc.UpdatePerson(context.Background(), model.Person{ID: 1, Name: "John Smith", Age: 31, Email: "john.smith@example.com"})
+	pc.UpdatePerson(context.Background(), model.Person{ID: 2, Name: "Jane Doe", Age: 26, Email: "jane.doe@example.com"})
+
+	// The batch flushes the queue while holding the write lock, dead-lettering the rejected write on the way
+	_, err := pc.ApplyBatch(context.Background(), []model.WriteOp{
+		{Op: model.OpUpdate, Person: model.Person{ID: 2, Name: "Jane Doe", Age: 27, Email: "jane.doe@example.com", Version: 1}},
+	})
+	if err != nil {
+		t.Fatalf("ApplyBatch() returned an error: %v", err)
+	}
+
+	if john, _ := pc.GetPerson(context.Background(), 1); john.Name != "John Doe" || john.Version != 0 {
+		t.Errorf("expected the store to serve the data source's copy of the rejected write, got %+v", john)
+	}
+}
+
+func TestWriteBehindStaleVersion(t *testing.T) {
+	pc, _ := newTestWriteBehind(t, datasource.NewMockDataSource())
+	defer pc.Close(context.Background())
+
+	updated, err := pc.UpdatePerson(context.Background(), model.Person{ID: 1, Name: "John Smith", Age: 31, Email: "john.smith@example.com"})
+	if err != nil || updated.Version != 1 {
+		t.Fatalf("expected update to version 1, got %+v, %v", updated, err)
+	}
+
+	_, err = pc.UpdatePerson(context.Background(), model.Person{ID: 1, Name: "John Again", Age: 32, Email: "john.smith@example.com"})
+	if !errors.Is(err, model.ErrConflict) {
+		t.Fatalf("expected ErrConflict, got %v", err)
+	}
+
+	if pc.QueueDepth() != 1 {
+		t.Errorf("expected the rejected update not to be queued, got depth %d", pc.QueueDepth())
+	}
+}
+
+func TestWriteBehindBatchFlushesQueueFirst(t *testing.T) {
+	db := &flakyDataSource{DataSource: datasource.NewMockDataSource()}
+	pc, _ := newTestWriteBehind(t, db)
+	defer pc.Close(context.Background())
+
+	pc.UpdatePerson(context.Background(), model.Person{ID: 1, Name: "John Smith", Age: 31, Email: "john.smith@example.com"})
+
+	// The batch builds on the queued update's version, so it only succeeds if the queue was flushed first
+	_, err := pc.ApplyBatch(context.Background(), []model.WriteOp{
+		{Op: model.OpUpdate, Person: model.Person{ID: 1, Name: "John Smith", Age: 32, Email: "john.smith@example.com", Version: 1}},
+	})
+	if err != nil {
+		t.Fatalf("ApplyBatch() returned an error: %v", err)
+	}
+
+	if pc.QueueDepth() != 0 {
+		t.Errorf("expected queue to be drained, got depth %d", pc.QueueDepth())
+	}
+
+	stored, _ := db.GetPerson(context.Background(), 1)
+	if stored.Age != 32 || stored.Version != 2 {
+		t.Errorf("expected data source to hold the batch result, got %+v", stored)
+	}
+}
+
+func TestWriteBehindPatchUndoneWhenNotQueued(t *testing.T) {
+	pc, q := newTestWriteBehind(t, datasource.NewMockDataSource())
+	defer pc.Close(context.Background())
+
+	patched, err := pc.PatchPerson(context.Background(), 1, []model.FieldOp{{Op: model.OpIncrement, Field: "age", Value: 1}})
+	if err != nil || patched.Age != 31 || patched.Version != 1 {
+		t.Fatalf("expected the patch at version 1, got %+v, %v", patched, err)
+	}
+
+	q.Close()
+	if _, err := pc.PatchPerson(context.Background(), 1, []model.FieldOp{{Op: model.OpIncrement, Field: "age", Value: 1}}); err == nil {
+		t.Fatal("expected the patch to fail when it can't be queued")
+	}
+	if _, err := pc.UpdatePerson(context.Background(), model.Person{ID: 1, Name: "John Smith", Age: 40, Email: "john.smith@example.com", Version: 1}); err == nil {
+		t.Fatal("expected the update to fail when it can't be queued")
+	}
+	if p, _ := pc.GetPerson(context.Background(), 1); p != patched {
+		t.Errorf("expected the store to be restored to %+v, got %+v", patched, p)
+	}
+}
@@ -1,9 +1,30 @@
 package datasource
 
-import "gocache/pkg/model"
+import (
+	"context"
+	"gocache/pkg/model"
+)
 
 type DataSource interface {
 	Health() map[string]string
-	GetAllPersons() ([]model.Person, error)
-	UpdatePerson(p model.Person) error
+	GetAllPersons(ctx context.Context) ([]model.Person, error)
+	GetPerson(ctx context.Context, id int) (model.Person, error)
+	// GetPersonVersions returns the version of every person keyed by ID, used to catch up a restored snapshot.
+	// Every writer to the data source, including ones outside this service, must bump a person's version on each change,
+	// otherwise a warm start keeps serving the snapshot's stale copy of that person
+	GetPersonVersions(ctx context.Context) (map[int]int64, error)
+	GetPersonsByIDs(ctx context.Context, ids []int) ([]model.Person, error)
+	// UpdatePerson replaces a person whose stored version matches p.Version and increments the version
+	UpdatePerson(ctx context.Context, p model.Person) error
+	// ApplyOps atomically applies field operations to a person, increments its version and returns the result
+	ApplyOps(ctx context.Context, id int, ops []model.FieldOp) (model.Person, error)
+	// ApplyWrites runs the operations in a single transaction and returns the resulting persons in order
+	// (the deleted person for deletes). Failures are reported as *model.OpError and nothing is written.
+	ApplyWrites(ctx context.Context, ops []model.WriteOp) ([]model.Person, error)
+	// UpdatePersons writes persons verbatim, including versions already assigned by the store
+	UpdatePersons(ctx context.Context, p []model.Person) error
+	// InsertPersons inserts new persons in bulk without a transaction. Persons whose ID is taken are left as they
+	// are and reported as *model.OpError wrapping model.ErrAlreadyExists while the others are inserted, an error
+	// means the outcome of the whole call is unknown.
+	InsertPersons(ctx context.Context, p []model.Person) ([]*model.OpError, error)
 }
@@ -0,0 +1,156 @@
+package datasource
+
+import (
+	"context"
+	"errors"
+	"gocache/pkg/model"
+	"sync"
+)
+
+// ErrInjected is the default error returned by FaultDataSource when a fault is triggered
+var ErrInjected = errors.New("injected fault")
+
+// Fault describes how a FaultDataSource call should misbehave
+type Fault struct {
+	// Err is returned to the caller, ErrInjected is used when nil
+	Err error
+	// Apply forwards the call to the wrapped data source before failing, simulating a write that
+	// committed but whose acknowledgement was lost (e.g. a timeout after the server applied it)
+	Apply bool
+	// Times is how many calls the fault applies to, zero means every call
+	Times int
+}
+
+// FaultDataSource wraps a DataSource and injects failures into selected calls for testing
+type FaultDataSource struct {
+	DataSource
+
+	mu     sync.Mutex
+	faults map[string]*Fault
+}
+
+// NewFaultDataSource creates a FaultDataSource that delegates to inner until faults are injected
+func NewFaultDataSource(inner DataSource) *FaultDataSource {
+	return &FaultDataSource{
+		DataSource: inner,
+		faults:     make(map[string]*Fault),
+	}
+}
+
+// Inject makes calls to the named method (e.g. "UpdatePerson") fail as described by f
+func (f *FaultDataSource) Inject(method string, fault Fault) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	f.faults[method] = &fault
+}
+
+// Clear removes every injected fault
+func (f *FaultDataSource) Clear() {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	f.faults = make(map[string]*Fault)
+}
+
+// trigger reports whether method should fail and consumes one use of its fault
+func (f *FaultDataSource) trigger(method string) (Fault, bool) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	fault, ok := f.faults[method]
+	if !ok {
+		return Fault{}, false
+	}
+
+	if fault.Times > 0 {
+		fault.Times--
+		if fault.Times == 0 {
+			delete(f.faults, method)
+		}
+	}
+
+	ret := *fault
+	if ret.Err == nil {
+		ret.Err = ErrInjected
+	}
+	return ret, true
+}
+
+func (f *FaultDataSource) GetAllPersons(ctx context.Context) ([]model.Person, error) {
+	if fault, ok := f.trigger("GetAllPersons"); ok {
+		return nil, fault.Err
+	}
+	return f.DataSource.GetAllPersons(ctx)
+}
+
+func (f *FaultDataSource) GetPerson(ctx context.Context, id int) (model.Person, error) {
+	if fault, ok := f.trigger("GetPerson"); ok {
+		return model.Person{}, fault.Err
+	}
+	return f.DataSource.GetPerson(ctx, id)
+}
+
+func (f *FaultDataSource) GetPersonVersions(ctx context.Context) (map[int]int64, error) {
+	if fault, ok := f.trigger("GetPersonVersions"); ok {
+		return nil, fault.Err
+	}
+	return f.DataSource.GetPersonVersions(ctx)
+}
+
+func (f *FaultDataSource) GetPersonsByIDs(ctx context.Context, ids []int) ([]model.Person, error) {
+	if fault, ok := f.trigger("GetPersonsByIDs"); ok {
+		return nil, fault.Err
+	}
+	return f.DataSource.GetPersonsByIDs(ctx, ids)
+}
+
+func (f *FaultDataSource) UpdatePerson(ctx context.Context, p model.Person) error {
+	if fault, ok := f.trigger("UpdatePerson"); ok {
+		if fault.Apply {
+			f.DataSource.UpdatePerson(ctx, p)
+		}
+		return fault.Err
+	}
+	return f.DataSource.UpdatePerson(ctx, p)
+}
+
+func (f *FaultDataSource) ApplyOps(ctx context.Context, id int, ops []model.FieldOp) (model.Person, error) {
+	if fault, ok := f.trigger("ApplyOps"); ok {
+		if fault.Apply {
+			f.DataSource.ApplyOps(ctx, id, ops)
+		}
+		return model.Person{}, fault.Err
+	}
+	return f.DataSource.ApplyOps(ctx, id, ops)
+}
+
+func (f *FaultDataSource) ApplyWrites(ctx context.Context, ops []model.WriteOp) ([]model.Person, error) {
+	if fault, ok := f.trigger("ApplyWrites"); ok {
+		if fault.Apply {
+			f.DataSource.ApplyWrites(ctx, ops)
+		}
+		return nil, fault.Err
+	}
+	return f.DataSource.ApplyWrites(ctx, ops)
+}
+
+func (f *FaultDataSource) UpdatePersons(ctx context.Context, p []model.Person) error {
+	if fault, ok := f.trigger("UpdatePersons"); ok {
+		if fault.Apply {
+			f.DataSource.UpdatePersons(ctx, p)
+		}
+		return fault.Err
+	}
+	return f.DataSource.UpdatePersons(ctx, p)
+}
+
+func (f *FaultDataSource) InsertPersons(ctx context.Context, p []model.Person) ([]*model.OpError, error) {
+	if fault, ok := f.trigger("InsertPersons"); ok {
+		if fault.Apply {
+			f.DataSource.InsertPersons(ctx, p)
+		}
+		return nil, fault.Err
+	}
+	return f.DataSource.InsertPersons(ctx, p)
+}
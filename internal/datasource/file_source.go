@@ -0,0 +1,289 @@
+package datasource
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"gocache/internal/logger"
+	"gocache/pkg/model"
+	"os"
+	"path/filepath"
+	"sync"
+)
+
+// fileSource is a DataSource backed by a local file, it keeps the persons in memory and rewrites
+// the whole file atomically on every write, so it suits local development and tests rather than large data sets
+type fileSource struct {
+	path   string
+	format string
+
+	mu      sync.RWMutex
+	persons []model.Person
+}
+
+// NewFileSource opens a file-backed data source at path. An empty format is inferred from the file
+// extension (.json, .ndjson or .jsonl, .csv). A missing file starts empty and is created on the first write.
+func NewFileSource(path, format string) (DataSource, error) {
+	if format == "" {
+		format = formatFromExt(path)
+	}
+
+	switch format {
+	case FormatJSON, FormatNDJSON, FormatCSV:
+	default:
+		return nil, fmt.Errorf("unknown data file format %q, expected %q, %q or %q", format, FormatJSON, FormatNDJSON, FormatCSV)
+	}
+
+	f := &fileSource{path: path, format: format, persons: make([]model.Person, 0)}
+
+	file, err := os.Open(path)
+	if errors.Is(err, os.ErrNotExist) {
+		logger.Logger.Warnf("DATASOURCE: data file %v does not exist, starting empty", path)
+		return f, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("error opening data file: %w", err)
+	}
+	defer file.Close()
+
+	if f.persons, err = readPersons(file, format); err != nil {
+		return nil, fmt.Errorf("error reading data file %v: %w", path, err)
+	}
+
+	seen := make(map[int]bool, len(f.persons))
+	for _, p := range f.persons {
+		if seen[p.ID] {
+			return nil, fmt.Errorf("error reading data file %v: duplicate person id %v", path, p.ID)
+		}
+		seen[p.ID] = true
+	}
+
+	logger.Logger.Infof("DATASOURCE: loaded %v persons from %v", len(f.persons), path)
+	return f, nil
+}
+
+func (f *fileSource) Health() map[string]string {
+	if _, err := os.Stat(filepath.Dir(f.path)); err != nil {
+		logger.Logger.Errorf("data file directory unavailable: %v", err)
+	}
+
+	return map[string]string{
+		"message": "It's healthy",
+	}
+}
+
+func (f *fileSource) GetAllPersons(ctx context.Context) ([]model.Person, error) {
+	f.mu.RLock()
+	defer f.mu.RUnlock()
+
+	return append([]model.Person(nil), f.persons...), nil
+}
+
+func (f *fileSource) GetPerson(ctx context.Context, id int) (model.Person, error) {
+	f.mu.RLock()
+	defer f.mu.RUnlock()
+
+	if i := findPerson(f.persons, id); i >= 0 {
+		return f.persons[i], nil
+	}
+	return model.Person{}, model.ErrNotFound
+}
+
+func (f *fileSource) GetPersonVersions(ctx context.Context) (map[int]int64, error) {
+	f.mu.RLock()
+	defer f.mu.RUnlock()
+
+	versions := make(map[int]int64, len(f.persons))
+	for _, p := range f.persons {
+		versions[p.ID] = p.Version
+	}
+	return versions, nil
+}
+
+func (f *fileSource) GetPersonsByIDs(ctx context.Context, ids []int) ([]model.Person, error) {
+	f.mu.RLock()
+	defer f.mu.RUnlock()
+
+	persons := make([]model.Person, 0, len(ids))
+	for _, id := range ids {
+		if i := findPerson(f.persons, id); i >= 0 {
+			persons = append(persons, f.persons[i])
+		}
+	}
+	return persons, nil
+}
+
+func (f *fileSource) UpdatePerson(ctx context.Context, p model.Person) error {
+	return f.write(func(persons []model.Person) ([]model.Person, error) {
+		i := findPerson(persons, p.ID)
+		if i < 0 {
+			return nil, model.ErrNotFound
+		}
+		if persons[i].Version != p.Version {
+			return nil, model.ErrConflict
+		}
+		p.Version++
+		persons[i] = p
+		return persons, nil
+	})
+}
+
+func (f *fileSource) ApplyOps(ctx context.Context, id int, ops []model.FieldOp) (model.Person, error) {
+	var result model.Person
+	err := f.write(func(persons []model.Person) ([]model.Person, error) {
+		i := findPerson(persons, id)
+		if i < 0 {
+			return nil, model.ErrNotFound
+		}
+		result = persons[i]
+		if err := result.Apply(ops); err != nil {
+			return nil, err
+		}
+		result.Version++
+		persons[i] = result
+		return persons, nil
+	})
+	if err != nil {
+		return model.Person{}, err
+	}
+	return result, nil
+}
+
+func (f *fileSource) ApplyWrites(ctx context.Context, ops []model.WriteOp) ([]model.Person, error) {
+	results := make([]model.Person, len(ops))
+	err := f.write(func(persons []model.Person) ([]model.Person, error) {
+		for i, op := range ops {
+			idx := findPerson(persons, op.Key())
+			switch op.Op {
+			case model.OpInsert:
+				if idx >= 0 {
+					return nil, &model.OpError{Index: i, Err: model.ErrAlreadyExists}
+				}
+				persons = append(persons, op.Person)
+				results[i] = op.Person
+			case model.OpUpdate:
+				if idx < 0 {
+					return nil, &model.OpError{Index: i, Err: model.ErrNotFound}
+				}
+				if persons[idx].Version != op.Person.Version {
+					return nil, &model.OpError{Index: i, Err: model.ErrConflict}
+				}
+				results[i] = op.Person
+				results[i].Version++
+				persons[idx] = results[i]
+			case model.OpDelete:
+				if idx < 0 {
+					return nil, &model.OpError{Index: i, Err: model.ErrNotFound}
+				}
+				results[i] = persons[idx]
+				persons = append(persons[:idx], persons[idx+1:]...)
+			default:
+				return nil, &model.OpError{Index: i, Err: op.Validate()}
+			}
+		}
+		return persons, nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return results, nil
+}
+
+// UpdatePersons writes persons verbatim, persons that don't exist are skipped rather than failing the batch
+func (f *fileSource) UpdatePersons(ctx context.Context, p []model.Person) error {
+	return f.write(func(persons []model.Person) ([]model.Person, error) {
+		for _, person := range p {
+			if i := findPerson(persons, person.ID); i >= 0 {
+				persons[i] = person
+			}
+		}
+		return persons, nil
+	})
+}
+
+// InsertPersons appends the persons whose ID is free and saves the file once
+func (f *fileSource) InsertPersons(ctx context.Context, p []model.Person) ([]*model.OpError, error) {
+	var rejected []*model.OpError
+	err := f.write(func(persons []model.Person) ([]model.Person, error) {
+		taken := make(map[int]bool, len(persons)+len(p))
+		for _, person := range persons {
+			taken[person.ID] = true
+		}
+		for i, person := range p {
+			if taken[person.ID] {
+				rejected = append(rejected, &model.OpError{Index: i, Err: model.ErrAlreadyExists})
+				continue
+			}
+			taken[person.ID] = true
+			persons = append(persons, person)
+		}
+		return persons, nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return rejected, nil
+}
+
+// write applies fn to a copy of the persons and persists the result before making it visible,
+// so a failed operation or a failed file write leaves both the file and readers untouched
+func (f *fileSource) write(fn func([]model.Person) ([]model.Person, error)) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	persons, err := fn(append([]model.Person(nil), f.persons...))
+	if err != nil {
+		return err
+	}
+
+	if err := f.save(persons); err != nil {
+		logger.Logger.Errorf("DATASOURCE: Error writing data file: %v", err)
+		return err
+	}
+
+	f.persons = persons
+	return nil
+}
+
+// save atomically replaces the data file with persons
+func (f *fileSource) save(persons []model.Person) error {
+	dir := filepath.Dir(f.path)
+	if err := os.MkdirAll(dir, 0o755); err != nil {
+		return fmt.Errorf("error creating data file directory: %w", err)
+	}
+
+	tmp, err := os.CreateTemp(dir, filepath.Base(f.path)+".tmp-*")
+	if err != nil {
+		return fmt.Errorf("error creating temporary data file: %w", err)
+	}
+	defer os.Remove(tmp.Name())
+
+	if err := writePersons(tmp, f.format, persons); err != nil {
+		tmp.Close()
+		return fmt.Errorf("error encoding data file: %w", err)
+	}
+
+	if err := tmp.Sync(); err != nil {
+		tmp.Close()
+		return fmt.Errorf("error syncing data file: %w", err)
+	}
+
+	if err := tmp.Close(); err != nil {
+		return fmt.Errorf("error closing data file: %w", err)
+	}
+
+	if err := os.Rename(tmp.Name(), f.path); err != nil {
+		return fmt.Errorf("error replacing data file: %w", err)
+	}
+
+	return nil
+}
+
+func findPerson(persons []model.Person, id int) int {
+	for i, p := range persons {
+		if p.ID == id {
+			return i
+		}
+	}
+	return -1
+}
@@ -0,0 +1,150 @@
+package datasource
+
+import (
+	"context"
+	"errors"
+	"gocache/pkg/model"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestFileSourceFormats(t *testing.T) {
+	files := map[string]string{
+		"persons.json":   `[{"id":1,"name":"John Doe","age":30,"email":"john@example.com"},{"id":2,"name":"Jane Smith","age":25,"email":"jane@example.com","version":2}]`,
+		"persons.ndjson": "{\"id\":1,\"name\":\"John Doe\",\"age\":30,\"email\":\"john@example.com\"}\n\n{\"id\":2,\"name\":\"Jane Smith\",\"age\":25,\"email\":\"jane@example.com\",\"version\":2}\n",
+		"persons.csv":    "email,id,name,age,version\njohn@example.com,1,John Doe,30,\njane@example.com,2,Jane Smith,25,2\n",
+	}
+
+	for name, content := range files {
+		t.Run(name, func(t *testing.T) {
+			path := filepath.Join(t.TempDir(), name)
+			os.WriteFile(path, []byte(content), 0o644)
+
+			db, err := NewFileSource(path, "")
+			if err != nil {
+				t.Fatalf("NewFileSource() error: %v", err)
+			}
+
+			if p, _ := db.GetPerson(context.Background(), 2); p.Name != "Jane Smith" || p.Version != 2 {
+				t.Fatalf("unexpected person %+v", p)
+			}
+
+			if err := db.UpdatePerson(context.Background(), model.Person{ID: 1, Name: "John Doe", Age: 31, Email: "john@example.com"}); err != nil {
+				t.Fatalf("UpdatePerson() error: %v", err)
+			}
+
+			// A reopened source must see the write in the same format
+			db, err = NewFileSource(path, "")
+			if err != nil {
+				t.Fatalf("reopening error: %v", err)
+			}
+			if p, _ := db.GetPerson(context.Background(), 1); p.Age != 31 || p.Version != 1 {
+				t.Errorf("expected the update to be persisted, got %+v", p)
+			}
+			if persons, _ := db.GetAllPersons(context.Background()); len(persons) != 2 {
+				t.Errorf("expected 2 persons, got %+v", persons)
+			}
+		})
+	}
+}
+
+func TestFileSourceMissingFile(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "data", "persons.ndjson")
+
+	db, err := NewFileSource(path, "")
+	if err != nil {
+		t.Fatalf("NewFileSource() error: %v", err)
+	}
+	if persons, _ := db.GetAllPersons(context.Background()); len(persons) != 0 {
+		t.Errorf("expected no persons, got %+v", persons)
+	}
+
+	if _, err := db.ApplyWrites(context.Background(), []model.WriteOp{{Op: model.OpInsert, Person: model.Person{ID: 1, Name: "John Doe"}}}); err != nil {
+		t.Fatalf("ApplyWrites() error: %v", err)
+	}
+
+	entries, _ := os.ReadDir(filepath.Dir(path))
+	if len(entries) != 1 || entries[0].Name() != "persons.ndjson" {
+		t.Errorf("expected only the data file to be written, got %v", entries)
+	}
+}
+
+func TestFileSourceFailedWritesChangeNothing(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "persons.json")
+	os.WriteFile(path, []byte(`[{"id":1,"name":"John Doe","age":30,"email":"john@example.com"}]`), 0o644)
+	before, _ := os.ReadFile(path)
+
+	db, _ := NewFileSource(path, "")
+
+	if err := db.UpdatePerson(context.Background(), model.Person{ID: 1, Version: 5}); !errors.Is(err, model.ErrConflict) {
+		t.Errorf("expected model.ErrConflict, got %v", err)
+	}
+
+	_, err := db.ApplyWrites(context.Background(), []model.WriteOp{
+		{Op: model.OpDelete, ID: 1},
+		{Op: model.OpDelete, ID: 2},
+	})
+	var opErr *model.OpError
+	if !errors.As(err, &opErr) || opErr.Index != 1 {
+		t.Errorf("expected an error on operation 1, got %v", err)
+	}
+
+	if _, err := db.GetPerson(context.Background(), 1); err != nil {
+		t.Error("expected the failed batch to leave person 1 in place")
+	}
+	if after, _ := os.ReadFile(path); string(after) != string(before) {
+		t.Errorf("expected the file to be untouched, got %s", after)
+	}
+}
+
+func TestFileSourceRejectsBadInput(t *testing.T) {
+	dir := t.TempDir()
+	files := map[string]string{
+		"duplicate.json": `[{"id":1},{"id":1}]`,
+		"bad.ndjson":     "{\"id\":1}\nnot json\n",
+		"columns.csv":    "id,name\n1,John Doe\n",
+		"age.csv":        "id,name,age,email\n1,John Doe,thirty,john@example.com\n",
+	}
+
+	for name, content := range files {
+		path := filepath.Join(dir, name)
+		os.WriteFile(path, []byte(content), 0o644)
+		if _, err := NewFileSource(path, ""); err == nil {
+			t.Errorf("%s: expected an error", name)
+		}
+	}
+
+	if _, err := NewFileSource(filepath.Join(dir, "persons.json"), "xml"); err == nil || !strings.Contains(err.Error(), "xml") {
+		t.Errorf("expected an unknown format error, got %v", err)
+	}
+}
+
+func TestFileSourceInsertPersons(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "persons.ndjson")
+	os.WriteFile(path, []byte("{\"id\":1,\"name\":\"John Doe\",\"age\":30,\"email\":\"john@example.com\"}\n"), 0o644)
+	db, err := NewFileSource(path, "")
+	if err != nil {
+		t.Fatalf("NewFileSource() error: %v", err)
+	}
+
+	rejected, err := db.InsertPersons(context.Background(), []model.Person{
+		{ID: 1, Name: "Taken"},
+		{ID: 2, Name: "Jane Smith", Age: 25, Email: "jane@example.com"},
+	})
+	if err != nil {
+		t.Fatalf("InsertPersons() error: %v", err)
+	}
+	if len(rejected) != 1 || rejected[0].Index != 0 || !errors.Is(rejected[0].Err, model.ErrAlreadyExists) {
+		t.Fatalf("expected operation 0 to be rejected as existing, got %v", rejected)
+	}
+
+	db, err = NewFileSource(path, "")
+	if err != nil {
+		t.Fatalf("reopening error: %v", err)
+	}
+	if persons, _ := db.GetAllPersons(context.Background()); len(persons) != 2 || persons[0].Name != "John Doe" {
+		t.Errorf("expected the new person to be persisted next to the old one, got %+v", persons)
+	}
+}
@@ -0,0 +1,291 @@
+package datasource
+
+import (
+	"bufio"
+	"encoding/csv"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"gocache/pkg/model"
+	"io"
+	"path/filepath"
+	"strconv"
+	"strings"
+)
+
+// Supported file formats, also used to export persons over HTTP
+const (
+	FormatJSON   = "json"
+	FormatNDJSON = "ndjson"
+	FormatCSV    = "csv"
+)
+
+// csvHeader is the column order written to CSV files, reading accepts the columns in any order
+var csvHeader = []string{"id", "name", "age", "email", "version"}
+
+func formatFromExt(path string) string {
+	switch strings.ToLower(filepath.Ext(path)) {
+	case ".ndjson", ".jsonl":
+		return FormatNDJSON
+	case ".csv":
+		return FormatCSV
+	default:
+		return FormatJSON
+	}
+}
+
+func readPersons(r io.Reader, format string) ([]model.Person, error) {
+	persons := make([]model.Person, 0)
+
+	switch format {
+	case FormatJSON:
+		data, err := io.ReadAll(r)
+		if err != nil {
+			return nil, err
+		}
+		if len(strings.TrimSpace(string(data))) == 0 {
+			return persons, nil
+		}
+		if err := json.Unmarshal(data, &persons); err != nil {
+			return nil, err
+		}
+	case FormatNDJSON, FormatCSV:
+		pr, err := NewPersonReader(r, format)
+		if err != nil {
+			return nil, err
+		}
+		for {
+			p, err := pr.Read()
+			if errors.Is(err, io.EOF) {
+				return persons, nil
+			}
+			if err != nil {
+				return nil, err
+			}
+			persons = append(persons, p)
+		}
+	}
+
+	return persons, nil
+}
+
+// RowError is a row of an NDJSON or CSV list that couldn't be decoded, the rows after it can still be read
+type RowError struct {
+	// Line is the 1-based line the row starts on
+	Line int
+	Err  error
+}
+
+func (e *RowError) Error() string {
+	return fmt.Sprintf("line %d: %v", e.Line, e.Err)
+}
+
+func (e *RowError) Unwrap() error {
+	return e.Err
+}
+
+// PersonReader decodes persons one row at a time from NDJSON or CSV, so an upload can be checked row by row
+// without holding it in memory. CSV columns may come in any order, version is optional.
+type PersonReader struct {
+	scanner *bufio.Scanner
+	line    int
+
+	cr   *csv.Reader
+	cols map[string]int
+}
+
+// NewPersonReader returns a reader decoding persons from r in format, CSV starts with its header row
+func NewPersonReader(r io.Reader, format string) (*PersonReader, error) {
+	switch format {
+	case FormatNDJSON:
+		scanner := bufio.NewScanner(r)
+		scanner.Buffer(make([]byte, 64*1024), 1024*1024)
+		return &PersonReader{scanner: scanner}, nil
+	case FormatCSV:
+		pr := &PersonReader{cr: csv.NewReader(r)}
+		// Rows with a wrong number of fields are reported like any other bad row
+		pr.cr.FieldsPerRecord = -1
+
+		header, err := pr.cr.Read()
+		if errors.Is(err, io.EOF) {
+			return pr, nil
+		}
+		if err != nil {
+			return nil, err
+		}
+		pr.cols = make(map[string]int, len(header))
+		for i, h := range header {
+			pr.cols[strings.ToLower(strings.TrimSpace(h))] = i
+		}
+		for _, required := range []string{"id", "name", "age", "email"} {
+			if _, ok := pr.cols[required]; !ok {
+				return nil, fmt.Errorf("missing %q column", required)
+			}
+		}
+		return pr, nil
+	default:
+		return nil, fmt.Errorf("unknown row format %q, expected %q or %q", format, FormatNDJSON, FormatCSV)
+	}
+}
+
+// Read returns the next person and io.EOF after the last one. A row that can't be decoded is returned as a
+// *RowError and reading can go on, any other error ends the list.
+func (pr *PersonReader) Read() (model.Person, error) {
+	if pr.cr != nil {
+		return pr.readCSV()
+	}
+
+	for pr.scanner.Scan() {
+		pr.line++
+		if len(strings.TrimSpace(pr.scanner.Text())) == 0 {
+			continue
+		}
+		var p model.Person
+		if err := json.Unmarshal(pr.scanner.Bytes(), &p); err != nil {
+			return model.Person{}, &RowError{Line: pr.line, Err: err}
+		}
+		return p, nil
+	}
+	if err := pr.scanner.Err(); err != nil {
+		return model.Person{}, err
+	}
+	return model.Person{}, io.EOF
+}
+
+// Line returns the line the row last read starts on
+func (pr *PersonReader) Line() int {
+	return pr.line
+}
+
+func (pr *PersonReader) readCSV() (model.Person, error) {
+	if pr.cols == nil {
+		return model.Person{}, io.EOF
+	}
+
+	record, err := pr.cr.Read()
+	var parseErr *csv.ParseError
+	if errors.As(err, &parseErr) {
+		pr.line = parseErr.StartLine
+		return model.Person{}, &RowError{Line: pr.line, Err: parseErr.Err}
+	}
+	if err != nil {
+		return model.Person{}, err
+	}
+
+	pr.line, _ = pr.cr.FieldPos(0)
+	line := pr.line
+	for _, i := range pr.cols {
+		if i >= len(record) {
+			return model.Person{}, &RowError{Line: line, Err: fmt.Errorf("expected %d fields, got %d", len(pr.cols), len(record))}
+		}
+	}
+
+	var p model.Person
+	if p.ID, err = strconv.Atoi(record[pr.cols["id"]]); err != nil {
+		return model.Person{}, &RowError{Line: line, Err: fmt.Errorf("invalid id: %w", err)}
+	}
+	if p.Age, err = strconv.Atoi(record[pr.cols["age"]]); err != nil {
+		return model.Person{}, &RowError{Line: line, Err: fmt.Errorf("invalid age: %w", err)}
+	}
+	p.Name = record[pr.cols["name"]]
+	p.Email = record[pr.cols["email"]]
+	if i, ok := pr.cols["version"]; ok && record[i] != "" {
+		if p.Version, err = strconv.ParseInt(record[i], 10, 64); err != nil {
+			return model.Person{}, &RowError{Line: line, Err: fmt.Errorf("invalid version: %w", err)}
+		}
+	}
+	return p, nil
+}
+
+func writePersons(w io.Writer, format string, persons []model.Person) error {
+	pw, err := NewPersonWriter(w, format)
+	if err != nil {
+		return err
+	}
+	for _, p := range persons {
+		if err := pw.Write(p); err != nil {
+			return err
+		}
+	}
+	return pw.Close()
+}
+
+// PersonWriter encodes persons one at a time in one of the file formats, so a list can be written without
+// holding all of it in memory. JSON is written as an indented array.
+type PersonWriter struct {
+	format string
+	bw     *bufio.Writer
+	enc    *json.Encoder
+	cw     *csv.Writer
+	count  int
+}
+
+// NewPersonWriter returns a writer encoding persons to w in format, CSV starts with its header row
+func NewPersonWriter(w io.Writer, format string) (*PersonWriter, error) {
+	pw := &PersonWriter{format: format, bw: bufio.NewWriter(w)}
+
+	switch format {
+	case FormatJSON:
+	case FormatNDJSON:
+		pw.enc = json.NewEncoder(pw.bw)
+	case FormatCSV:
+		pw.cw = csv.NewWriter(pw.bw)
+		if err := pw.cw.Write(csvHeader); err != nil {
+			return nil, err
+		}
+	default:
+		return nil, fmt.Errorf("unknown person format %q, expected %q, %q or %q", format, FormatJSON, FormatNDJSON, FormatCSV)
+	}
+	return pw, nil
+}
+
+// Write encodes p, it may stay buffered until Flush or Close
+func (pw *PersonWriter) Write(p model.Person) error {
+	defer func() { pw.count++ }()
+
+	switch pw.format {
+	case FormatJSON:
+		sep := ",\n  "
+		if pw.count == 0 {
+			sep = "[\n  "
+		}
+		data, err := json.MarshalIndent(p, "  ", "  ")
+		if err != nil {
+			return err
+		}
+		if _, err := pw.bw.WriteString(sep); err != nil {
+			return err
+		}
+		_, err = pw.bw.Write(data)
+		return err
+	case FormatNDJSON:
+		return pw.enc.Encode(p)
+	default:
+		return pw.cw.Write([]string{strconv.Itoa(p.ID), p.Name, strconv.Itoa(p.Age), p.Email, strconv.FormatInt(p.Version, 10)})
+	}
+}
+
+// Flush writes the buffered persons to the underlying writer
+func (pw *PersonWriter) Flush() error {
+	if pw.cw != nil {
+		pw.cw.Flush()
+		if err := pw.cw.Error(); err != nil {
+			return err
+		}
+	}
+	return pw.bw.Flush()
+}
+
+// Close ends the list and flushes it, it doesn't close the underlying writer
+func (pw *PersonWriter) Close() error {
+	if pw.format == FormatJSON {
+		end := "\n]\n"
+		if pw.count == 0 {
+			end = "[]\n"
+		}
+		if _, err := pw.bw.WriteString(end); err != nil {
+			return err
+		}
+	}
+	return pw.Flush()
+}
@@ -0,0 +1,60 @@
+package datasource
+
+import (
+	"errors"
+	"gocache/pkg/model"
+	"io"
+	"strings"
+	"testing"
+)
+
+func TestPersonReaderReportsBadRows(t *testing.T) {
+	inputs := map[string]struct {
+		input   string
+		badLine int
+	}{
+		FormatNDJSON: {"{\"id\":1,\"name\":\"John Doe\",\"age\":30,\"email\":\"john@example.com\"}\nnot json\n\n{\"id\":2,\"name\":\"Jane Smith\",\"age\":25,\"email\":\"jane@example.com\"}\n", 2},
+		FormatCSV:    {"name,id,age,email\nJohn Doe,1,30,john@example.com\nNobody,x,1,nobody@example.com\n\"Jane Smith\",2,25,jane@example.com\n", 3},
+	}
+
+	for format, tc := range inputs {
+		t.Run(format, func(t *testing.T) {
+			pr, err := NewPersonReader(strings.NewReader(tc.input), format)
+			if err != nil {
+				t.Fatalf("NewPersonReader() error: %v", err)
+			}
+
+			var persons []model.Person
+			var lines []int
+			var rowErrs []*RowError
+			for {
+				p, err := pr.Read()
+				if errors.Is(err, io.EOF) {
+					break
+				}
+				var rowErr *RowError
+				if errors.As(err, &rowErr) {
+					rowErrs = append(rowErrs, rowErr)
+					continue
+				}
+				if err != nil {
+					t.Fatalf("Read() error: %v", err)
+				}
+				persons = append(persons, p)
+				lines = append(lines, pr.Line())
+			}
+
+			// The bad row is reported by line and the rows after it are still read
+			if len(rowErrs) != 1 || rowErrs[0].Line != tc.badLine {
+				t.Fatalf("expected one bad row on line %d, got %v", tc.badLine, rowErrs)
+			}
+			if len(persons) != 2 || persons[1].Name != "Jane Smith" || lines[1] != 4 {
+				t.Errorf("expected both good rows with the second on line 4, got %+v on lines %v", persons, lines)
+			}
+		})
+	}
+
+	if _, err := NewPersonReader(strings.NewReader("id,name\n"), FormatCSV); err == nil {
+		t.Error("expected an error for missing CSV columns")
+	}
+}
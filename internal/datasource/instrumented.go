@@ -0,0 +1,109 @@
+package datasource
+
+import (
+	"context"
+	"errors"
+	"gocache/internal/metrics"
+	"gocache/internal/tracing"
+	"gocache/pkg/model"
+	"time"
+)
+
+// InstrumentedDataSource wraps a DataSource, records the latency and failures of every call and traces them
+type InstrumentedDataSource struct {
+	DataSource
+}
+
+// Instrument wraps db so its calls are reported in the data source metrics and in the caller's trace
+func Instrument(db DataSource) *InstrumentedDataSource {
+	return &InstrumentedDataSource{DataSource: db}
+}
+
+// observe starts the span of a call to op, the returned function records the call once it returns err
+func observe(ctx context.Context, op string) (context.Context, func(err error)) {
+	start := time.Now()
+	ctx, span := tracing.Start(ctx, "DataSource."+op)
+	return ctx, func(err error) {
+		metrics.DataSourceDuration.WithLabelValues(op).Observe(time.Since(start).Seconds())
+		if !failed(err) {
+			span.End()
+			return
+		}
+		metrics.DataSourceErrors.WithLabelValues(op).Inc()
+		tracing.End(span, err)
+	}
+}
+
+// failed reports whether err is a failure of the data source, rejected writes and missing persons are answers
+func failed(err error) bool {
+	if err == nil {
+		return false
+	}
+	for _, expected := range []error{model.ErrNotFound, model.ErrConflict, model.ErrAlreadyExists, model.ErrInvalidOp, model.ErrTestFailed, model.ErrInvalidPerson} {
+		if errors.Is(err, expected) {
+			return false
+		}
+	}
+	return true
+}
+
+func (i *InstrumentedDataSource) Health() map[string]string {
+	// Health checks aren't traced, probes would start a trace every few seconds
+	start := time.Now()
+	defer func() { metrics.DataSourceDuration.WithLabelValues("Health").Observe(time.Since(start).Seconds()) }()
+	return i.DataSource.Health()
+}
+
+func (i *InstrumentedDataSource) GetAllPersons(ctx context.Context) (p []model.Person, err error) {
+	ctx, done := observe(ctx, "GetAllPersons")
+	defer func() { done(err) }()
+	return i.DataSource.GetAllPersons(ctx)
+}
+
+func (i *InstrumentedDataSource) GetPerson(ctx context.Context, id int) (p model.Person, err error) {
+	ctx, done := observe(ctx, "GetPerson")
+	defer func() { done(err) }()
+	return i.DataSource.GetPerson(ctx, id)
+}
+
+func (i *InstrumentedDataSource) GetPersonVersions(ctx context.Context) (v map[int]int64, err error) {
+	ctx, done := observe(ctx, "GetPersonVersions")
+	defer func() { done(err) }()
+	return i.DataSource.GetPersonVersions(ctx)
+}
+
+func (i *InstrumentedDataSource) GetPersonsByIDs(ctx context.Context, ids []int) (p []model.Person, err error) {
+	ctx, done := observe(ctx, "GetPersonsByIDs")
+	defer func() { done(err) }()
+	return i.DataSource.GetPersonsByIDs(ctx, ids)
+}
+
+func (i *InstrumentedDataSource) UpdatePerson(ctx context.Context, p model.Person) (err error) {
+	ctx, done := observe(ctx, "UpdatePerson")
+	defer func() { done(err) }()
+	return i.DataSource.UpdatePerson(ctx, p)
+}
+
+func (i *InstrumentedDataSource) ApplyOps(ctx context.Context, id int, ops []model.FieldOp) (p model.Person, err error) {
+	ctx, done := observe(ctx, "ApplyOps")
+	defer func() { done(err) }()
+	return i.DataSource.ApplyOps(ctx, id, ops)
+}
+
+func (i *InstrumentedDataSource) ApplyWrites(ctx context.Context, ops []model.WriteOp) (p []model.Person, err error) {
+	ctx, done := observe(ctx, "ApplyWrites")
+	defer func() { done(err) }()
+	return i.DataSource.ApplyWrites(ctx, ops)
+}
+
+func (i *InstrumentedDataSource) UpdatePersons(ctx context.Context, p []model.Person) (err error) {
+	ctx, done := observe(ctx, "UpdatePersons")
+	defer func() { done(err) }()
+	return i.DataSource.UpdatePersons(ctx, p)
+}
+
+func (i *InstrumentedDataSource) InsertPersons(ctx context.Context, p []model.Person) (rejected []*model.OpError, err error) {
+	ctx, done := observe(ctx, "InsertPersons")
+	defer func() { done(err) }()
+	return i.DataSource.InsertPersons(ctx, p)
+}
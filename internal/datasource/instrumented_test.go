@@ -0,0 +1,46 @@
+package datasource
+
+import (
+	"context"
+	"errors"
+	"gocache/internal/metrics"
+	"gocache/pkg/model"
+	"testing"
+
+	"github.com/prometheus/client_golang/prometheus/testutil"
+)
+
+func TestInstrumentCountsFailures(t *testing.T) {
+	faults := NewFaultDataSource(NewMockDataSource())
+	db := Instrument(faults)
+	errorsOf := func(op string) float64 { return testutil.ToFloat64(metrics.DataSourceErrors.WithLabelValues(op)) }
+
+	before := errorsOf("GetPerson")
+	p, err := db.GetPerson(context.Background(), 1)
+	if err != nil {
+		t.Fatalf("GetPerson() error: %v", err)
+	}
+	if _, err := db.GetPerson(context.Background(), 999); !errors.Is(err, model.ErrNotFound) {
+		t.Fatalf("expected model.ErrNotFound, got %v", err)
+	}
+	if got := errorsOf("GetPerson"); got != before {
+		t.Errorf("expected a missing person not to count as a failure, got %v more", got-before)
+	}
+
+	faults.Inject("GetPerson", Fault{Times: 1})
+	if _, err := db.GetPerson(context.Background(), 1); !errors.Is(err, ErrInjected) {
+		t.Fatalf("expected ErrInjected, got %v", err)
+	}
+	if got := errorsOf("GetPerson"); got != before+1 {
+		t.Errorf("expected the failure to be counted, got %v more", got-before)
+	}
+
+	before = errorsOf("UpdatePerson")
+	p.Version += 10
+	if err := db.UpdatePerson(context.Background(), p); !errors.Is(err, model.ErrConflict) {
+		t.Fatalf("expected model.ErrConflict, got %v", err)
+	}
+	if got := errorsOf("UpdatePerson"); got != before {
+		t.Errorf("expected a conflict not to count as a failure, got %v more", got-before)
+	}
+}
@@ -1,6 +1,7 @@
 package datasource
 
 import (
+	"context"
 	"gocache/pkg/model"
 )
 
@@ -23,16 +24,135 @@ func (m *MockDataSource) Health() map[string]string {
 	return map[string]string{"status": "healthy"}
 }
 
-func (m *MockDataSource) GetAllPersons() ([]model.Person, error) {
+func (m *MockDataSource) GetAllPersons(ctx context.Context) ([]model.Person, error) {
 	return m.persons, nil
 }
 
-func (m *MockDataSource) UpdatePerson(p model.Person) error {
+func (m *MockDataSource) GetPerson(ctx context.Context, id int) (model.Person, error) {
+	for _, person := range m.persons {
+		if person.ID == id {
+			return person, nil
+		}
+	}
+	return model.Person{}, model.ErrNotFound
+}
+
+func (m *MockDataSource) GetPersonVersions(ctx context.Context) (map[int]int64, error) {
+	versions := make(map[int]int64, len(m.persons))
+	for _, person := range m.persons {
+		versions[person.ID] = person.Version
+	}
+	return versions, nil
+}
+
+func (m *MockDataSource) GetPersonsByIDs(ctx context.Context, ids []int) ([]model.Person, error) {
+	persons := make([]model.Person, 0, len(ids))
+	for _, id := range ids {
+		if person, err := m.GetPerson(ctx, id); err == nil {
+			persons = append(persons, person)
+		}
+	}
+	return persons, nil
+}
+
+func (m *MockDataSource) UpdatePerson(ctx context.Context, p model.Person) error {
 	for i, person := range m.persons {
 		if person.ID == p.ID {
+			if person.Version != p.Version {
+				return model.ErrConflict
+			}
+			p.Version++
 			m.persons[i] = p
 			return nil
 		}
 	}
+	return model.ErrNotFound
+}
+
+func (m *MockDataSource) ApplyOps(ctx context.Context, id int, ops []model.FieldOp) (model.Person, error) {
+	for i, person := range m.persons {
+		if person.ID == id {
+			if err := person.Apply(ops); err != nil {
+				return model.Person{}, err
+			}
+			person.Version++
+			m.persons[i] = person
+			return person, nil
+		}
+	}
+	return model.Person{}, model.ErrNotFound
+}
+
+func (m *MockDataSource) ApplyWrites(ctx context.Context, ops []model.WriteOp) ([]model.Person, error) {
+	// Work on a copy so a failing operation leaves the data untouched
+	persons := make([]model.Person, len(m.persons))
+	copy(persons, m.persons)
+
+	find := func(id int) int {
+		for i, p := range persons {
+			if p.ID == id {
+				return i
+			}
+		}
+		return -1
+	}
+
+	results := make([]model.Person, len(ops))
+	for i, op := range ops {
+		idx := find(op.Key())
+		switch op.Op {
+		case model.OpInsert:
+			if idx >= 0 {
+				return nil, &model.OpError{Index: i, Err: model.ErrAlreadyExists}
+			}
+			persons = append(persons, op.Person)
+			results[i] = op.Person
+		case model.OpUpdate:
+			if idx < 0 {
+				return nil, &model.OpError{Index: i, Err: model.ErrNotFound}
+			}
+			if persons[idx].Version != op.Person.Version {
+				return nil, &model.OpError{Index: i, Err: model.ErrConflict}
+			}
+			results[i] = op.Person
+			results[i].Version++
+			persons[idx] = results[i]
+		case model.OpDelete:
+			if idx < 0 {
+				return nil, &model.OpError{Index: i, Err: model.ErrNotFound}
+			}
+			results[i] = persons[idx]
+			persons = append(persons[:idx], persons[idx+1:]...)
+		default:
+			return nil, &model.OpError{Index: i, Err: op.Validate()}
+		}
+	}
+
+	m.persons = persons
+	return results, nil
+}
+
+// UpdatePersons mirrors a bulk write, persons that don't exist are skipped rather than failing the batch
+func (m *MockDataSource) UpdatePersons(ctx context.Context, p []model.Person) error {
+	for _, person := range p {
+		for i := range m.persons {
+			if m.persons[i].ID == person.ID {
+				m.persons[i] = person
+				break
+			}
+		}
+	}
 	return nil
 }
+
+func (m *MockDataSource) InsertPersons(ctx context.Context, p []model.Person) ([]*model.OpError, error) {
+	var rejected []*model.OpError
+	for i, person := range p {
+		if _, err := m.GetPerson(ctx, person.ID); err == nil {
+			rejected = append(rejected, &model.OpError{Index: i, Err: model.ErrAlreadyExists})
+			continue
+		}
+		m.persons = append(m.persons, person)
+	}
+	return rejected, nil
+}
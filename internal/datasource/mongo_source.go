@@ -2,6 +2,7 @@ package datasource
 
 import (
 	"context"
+	"errors"
 	"fmt"
 	"gocache/internal/logger"
 	"gocache/pkg/model"
@@ -28,9 +29,13 @@ var (
 	coll     = os.Getenv("COLLECTION_NAME")
 )
 
+// errNoTransactions is MongoDB's IllegalOperation code, returned for a transaction on a standalone server
+const errNoTransactions = 20
+
 func NewMongo() (DataSource, error) {
-	uri := fmt.Sprintf("mongodb://%s:%s@%s:%s/?authSource=admin", username, password, host, port)
-	client, err := mongo.Connect(context.Background(), options.Client().ApplyURI(uri))
+	// A direct connection keeps talking to DB_HOST, rather than the host names the replica set advertises
+	uri := fmt.Sprintf("mongodb://%s:%s@%s:%s/?authSource=admin&directConnection=true", username, password, host, port)
+	client, err := mongo.Connect(context.Background(), options.Client().ApplyURI(uri).SetMonitor(newCommandMonitor()))
 
 	personColl := client.Database(name).Collection(coll)
 
@@ -60,43 +65,384 @@ func (m *mongoSource) Health() map[string]string {
 }
 
 // Person methods
-func (m *mongoSource) GetAllPersons() ([]model.Person, error) {
-	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+func (m *mongoSource) GetAllPersons(ctx context.Context) ([]model.Person, error) {
+	ctx, cancel := context.WithTimeout(ctx, 5*time.Second)
 	defer cancel()
-	logger.Logger.Info("DATASOURCE: GetAllPersons called")
+	logger.Logger.WithContext(ctx).Info("DATASOURCE: GetAllPersons called")
 
 	cursor, err := m.personColl.Find(ctx, bson.D{})
 	if err != nil {
-		logger.Logger.Errorf("DATASOURCE: GetAllPersons error getting collection: %v", err)
+		logger.Logger.WithContext(ctx).Errorf("DATASOURCE: GetAllPersons error getting collection: %v", err)
 		return nil, err
 	}
 
 	var persons []model.Person
 	if err = cursor.All(ctx, &persons); err != nil {
-		logger.Logger.Errorf("DATASOURCE: GetAllPersons error finding all on collection: %v", err)
+		logger.Logger.WithContext(ctx).Errorf("DATASOURCE: GetAllPersons error finding all on collection: %v", err)
 		return nil, err
 	}
 
-	logger.Logger.Infof("DATASOURCE: GetAllPersons success: found %v persons", len(persons))
+	logger.Logger.WithContext(ctx).Infof("DATASOURCE: GetAllPersons success: found %v persons", len(persons))
 
 	return persons, nil
 }
 
-func (m *mongoSource) UpdatePerson(person model.Person) error {
-	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+func (m *mongoSource) GetPerson(ctx context.Context, id int) (model.Person, error) {
+	ctx, cancel := context.WithTimeout(ctx, 5*time.Second)
+	defer cancel()
+	logger.Logger.WithContext(ctx).Infof("DATASOURCE: GetPerson called with id=%v", id)
+
+	var person model.Person
+	err := m.personColl.FindOne(ctx, bson.D{{Key: "id", Value: id}}).Decode(&person)
+	if errors.Is(err, mongo.ErrNoDocuments) {
+		return model.Person{}, model.ErrNotFound
+	}
+	if err != nil {
+		logger.Logger.WithContext(ctx).Errorf("DATASOURCE: GetPerson error finding person: %v", err)
+		return model.Person{}, err
+	}
+
+	logger.Logger.WithContext(ctx).Infof("DATASOURCE: GetPerson success: found person with ID %v", id)
+
+	return person, nil
+}
+
+// GetPersonVersions projects only id and version so catching up a snapshot doesn't transfer whole documents
+func (m *mongoSource) GetPersonVersions(ctx context.Context) (map[int]int64, error) {
+	ctx, cancel := context.WithTimeout(ctx, 30*time.Second)
+	defer cancel()
+	logger.Logger.WithContext(ctx).Info("DATASOURCE: GetPersonVersions called")
+
+	opts := options.Find().SetProjection(bson.D{{Key: "_id", Value: 0}, {Key: "id", Value: 1}, {Key: "version", Value: 1}})
+	cursor, err := m.personColl.Find(ctx, bson.D{}, opts)
+	if err != nil {
+		logger.Logger.WithContext(ctx).Errorf("DATASOURCE: GetPersonVersions error finding versions: %v", err)
+		return nil, err
+	}
+	defer cursor.Close(ctx)
+
+	versions := make(map[int]int64)
+	for cursor.Next(ctx) {
+		var doc struct {
+			ID      int   `bson:"id"`
+			Version int64 `bson:"version"`
+		}
+		if err := cursor.Decode(&doc); err != nil {
+			logger.Logger.WithContext(ctx).Errorf("DATASOURCE: GetPersonVersions error decoding version: %v", err)
+			return nil, err
+		}
+		versions[doc.ID] = doc.Version
+	}
+
+	if err := cursor.Err(); err != nil {
+		logger.Logger.WithContext(ctx).Errorf("DATASOURCE: GetPersonVersions error iterating versions: %v", err)
+		return nil, err
+	}
+
+	logger.Logger.WithContext(ctx).Infof("DATASOURCE: GetPersonVersions success: found %v versions", len(versions))
+
+	return versions, nil
+}
+
+func (m *mongoSource) GetPersonsByIDs(ctx context.Context, ids []int) ([]model.Person, error) {
+	ctx, cancel := context.WithTimeout(ctx, 30*time.Second)
 	defer cancel()
-	logger.Logger.Infof("DATASOURCE: UpdatePerson called")
+	logger.Logger.WithContext(ctx).Infof("DATASOURCE: GetPersonsByIDs called with %v ids", len(ids))
 
-	filter := bson.D{{Key: "id", Value: person.ID}}
-	update := bson.D{{Key: "$set", Value: person}}
+	persons := make([]model.Person, 0, len(ids))
+	if len(ids) == 0 {
+		return persons, nil
+	}
 
-	_, err := m.personColl.UpdateOne(ctx, filter, update)
+	cursor, err := m.personColl.Find(ctx, bson.D{{Key: "id", Value: bson.D{{Key: "$in", Value: ids}}}})
 	if err != nil {
-		logger.Logger.Errorf("DATASOURCE: UpdatePerson error updating person: %v", err)
+		logger.Logger.WithContext(ctx).Errorf("DATASOURCE: GetPersonsByIDs error finding persons: %v", err)
+		return nil, err
+	}
+
+	if err = cursor.All(ctx, &persons); err != nil {
+		logger.Logger.WithContext(ctx).Errorf("DATASOURCE: GetPersonsByIDs error decoding persons: %v", err)
+		return nil, err
+	}
+
+	logger.Logger.WithContext(ctx).Infof("DATASOURCE: GetPersonsByIDs success: found %v persons", len(persons))
+
+	return persons, nil
+}
+
+func (m *mongoSource) UpdatePerson(ctx context.Context, person model.Person) error {
+	ctx, cancel := context.WithTimeout(ctx, 5*time.Second)
+	defer cancel()
+	logger.Logger.WithContext(ctx).Infof("DATASOURCE: UpdatePerson called")
+
+	filter := bson.D{{Key: "id", Value: person.ID}, {Key: "$or", Value: versionFilter(person.Version)}}
+	updated := person
+	updated.Version++
+	update := bson.D{{Key: "$set", Value: updated}}
+
+	result, err := m.personColl.UpdateOne(ctx, filter, update)
+	if err != nil {
+		logger.Logger.WithContext(ctx).Errorf("DATASOURCE: UpdatePerson error updating person: %v", err)
 		return err
 	}
 
-	logger.Logger.Infof("DATASOURCE: UpdatePerson success: updated person with ID %v", person.ID)
+	if result.MatchedCount == 0 {
+		// Nothing matched the version, find out whether the person exists at all
+		count, err := m.personColl.CountDocuments(ctx, bson.D{{Key: "id", Value: person.ID}})
+		if err != nil {
+			logger.Logger.WithContext(ctx).Errorf("DATASOURCE: UpdatePerson error checking person: %v", err)
+			return err
+		}
+		if count == 0 {
+			logger.Logger.WithContext(ctx).Errorf("DATASOURCE: UpdatePerson error: no person with ID %v", person.ID)
+			return model.ErrNotFound
+		}
+		logger.Logger.WithContext(ctx).Errorf("DATASOURCE: UpdatePerson error: stale version %v for person with ID %v", person.Version, person.ID)
+		return model.ErrConflict
+	}
+
+	logger.Logger.WithContext(ctx).Infof("DATASOURCE: UpdatePerson success: updated person with ID %v", person.ID)
 
 	return nil
 }
+
+// ApplyOps translates field operations into a single conditional findOneAndUpdate so they apply atomically
+func (m *mongoSource) ApplyOps(ctx context.Context, id int, ops []model.FieldOp) (model.Person, error) {
+	ctx, cancel := context.WithTimeout(ctx, 5*time.Second)
+	defer cancel()
+	logger.Logger.WithContext(ctx).Infof("DATASOURCE: ApplyOps called with id=%v, ops=%v", id, ops)
+
+	ops, err := model.NormalizeOps(ops)
+	if err != nil {
+		return model.Person{}, err
+	}
+
+	// Conditions go in an $and, several ops can test the same field (If-Match and a version test,
+	// or a test of age and an increment of it) and duplicate keys in one document would drop all but one
+	conditions := bson.A{bson.D{{Key: "id", Value: id}}}
+	set := bson.D{}
+	inc := bson.D{{Key: "version", Value: int64(1)}}
+	for _, op := range ops {
+		switch op.Op {
+		case model.OpTest:
+			if op.Field == "version" {
+				conditions = append(conditions, bson.D{{Key: "$or", Value: versionFilter(op.Value.(int64))}})
+			} else {
+				conditions = append(conditions, bson.D{{Key: op.Field, Value: op.Value}})
+			}
+		case model.OpSet:
+			set = append(set, bson.E{Key: op.Field, Value: op.Value})
+		case model.OpIncrement:
+			inc = append(inc, bson.E{Key: op.Field, Value: op.Value})
+			// Only match while the result stays within bounds, the update itself can't be validated
+			n := op.Value.(int)
+			conditions = append(conditions, bson.D{{Key: op.Field, Value: bson.D{{Key: "$gte", Value: model.MinAge - n}, {Key: "$lte", Value: model.MaxAge - n}}}})
+		}
+	}
+	filter := bson.D{{Key: "$and", Value: conditions}}
+
+	update := bson.D{{Key: "$inc", Value: inc}}
+	if len(set) > 0 {
+		update = append(update, bson.E{Key: "$set", Value: set})
+	}
+
+	var person model.Person
+	opts := options.FindOneAndUpdate().SetReturnDocument(options.After)
+	err = m.personColl.FindOneAndUpdate(ctx, filter, update, opts).Decode(&person)
+	if errors.Is(err, mongo.ErrNoDocuments) {
+		// Nothing matched, either the person is missing, a test op failed or an increment went out of bounds
+		var current model.Person
+		err := m.personColl.FindOne(ctx, bson.D{{Key: "id", Value: id}}).Decode(&current)
+		if errors.Is(err, mongo.ErrNoDocuments) {
+			return model.Person{}, model.ErrNotFound
+		}
+		if err != nil {
+			logger.Logger.WithContext(ctx).Errorf("DATASOURCE: ApplyOps error checking person: %v", err)
+			return model.Person{}, err
+		}
+		if err := current.Apply(ops); errors.Is(err, model.ErrInvalidPerson) {
+			logger.Logger.WithContext(ctx).Errorf("DATASOURCE: ApplyOps invalid result for person with ID %v: %v", id, err)
+			return model.Person{}, err
+		}
+		logger.Logger.WithContext(ctx).Errorf("DATASOURCE: ApplyOps test failed for person with ID %v", id)
+		return model.Person{}, model.ErrTestFailed
+	}
+	if err != nil {
+		logger.Logger.WithContext(ctx).Errorf("DATASOURCE: ApplyOps error updating person: %v", err)
+		return model.Person{}, err
+	}
+
+	logger.Logger.WithContext(ctx).Infof("DATASOURCE: ApplyOps success: person with ID %v now at version %v", id, person.Version)
+
+	return person, nil
+}
+
+// ApplyWrites runs the operations inside a multi-document transaction, which requires MongoDB to run as a replica set
+func (m *mongoSource) ApplyWrites(ctx context.Context, ops []model.WriteOp) ([]model.Person, error) {
+	ctx, cancel := context.WithTimeout(ctx, 10*time.Second)
+	defer cancel()
+	logger.Logger.WithContext(ctx).Infof("DATASOURCE: ApplyWrites called with %v operations", len(ops))
+
+	session, err := m.db.StartSession()
+	if err != nil {
+		logger.Logger.WithContext(ctx).Errorf("DATASOURCE: ApplyWrites error starting session: %v", err)
+		return nil, err
+	}
+	defer session.EndSession(ctx)
+
+	result, err := session.WithTransaction(ctx, func(sc mongo.SessionContext) (interface{}, error) {
+		results := make([]model.Person, len(ops))
+		for i, op := range ops {
+			person, err := m.applyWrite(sc, op)
+			if err != nil {
+				return nil, &model.OpError{Index: i, Err: err}
+			}
+			results[i] = person
+		}
+		return results, nil
+	})
+	var serverErr mongo.ServerError
+	if errors.As(err, &serverErr) && serverErr.HasErrorCode(errNoTransactions) {
+		err = fmt.Errorf("error starting transaction, MongoDB must run as a replica set: %w", err)
+	}
+	if err != nil {
+		logger.Logger.WithContext(ctx).Errorf("DATASOURCE: ApplyWrites error, transaction aborted: %v", err)
+		return nil, err
+	}
+
+	logger.Logger.WithContext(ctx).Infof("DATASOURCE: ApplyWrites success: committed %v operations", len(ops))
+
+	return result.([]model.Person), nil
+}
+
+// applyWrite performs one transactional write and returns the resulting person
+func (m *mongoSource) applyWrite(ctx mongo.SessionContext, op model.WriteOp) (model.Person, error) {
+	filter := bson.D{{Key: "id", Value: op.Key()}}
+
+	switch op.Op {
+	case model.OpInsert:
+		count, err := m.personColl.CountDocuments(ctx, filter)
+		if err != nil {
+			return model.Person{}, err
+		}
+		if count > 0 {
+			return model.Person{}, model.ErrAlreadyExists
+		}
+		if _, err := m.personColl.InsertOne(ctx, op.Person); err != nil {
+			return model.Person{}, err
+		}
+		return op.Person, nil
+	case model.OpUpdate:
+		updated := op.Person
+		updated.Version++
+		versioned := append(filter, bson.E{Key: "$or", Value: versionFilter(op.Person.Version)})
+		result, err := m.personColl.UpdateOne(ctx, versioned, bson.D{{Key: "$set", Value: updated}})
+		if err != nil {
+			return model.Person{}, err
+		}
+		if result.MatchedCount == 0 {
+			count, err := m.personColl.CountDocuments(ctx, filter)
+			if err != nil {
+				return model.Person{}, err
+			}
+			if count == 0 {
+				return model.Person{}, model.ErrNotFound
+			}
+			return model.Person{}, model.ErrConflict
+		}
+		return updated, nil
+	case model.OpDelete:
+		var deleted model.Person
+		err := m.personColl.FindOneAndDelete(ctx, filter).Decode(&deleted)
+		if errors.Is(err, mongo.ErrNoDocuments) {
+			return model.Person{}, model.ErrNotFound
+		}
+		return deleted, err
+	}
+
+	return model.Person{}, op.Validate()
+}
+
+// versionFilter matches documents at the given version, documents written before versioning count as version 0
+func versionFilter(version int64) bson.A {
+	filter := bson.A{bson.D{{Key: "version", Value: version}}}
+	if version == 0 {
+		filter = append(filter, bson.D{{Key: "version", Value: bson.D{{Key: "$exists", Value: false}}}})
+	}
+	return filter
+}
+
+// UpdatePersons applies a batch of updates in a single ordered bulk write so later writes to the same ID win
+func (m *mongoSource) UpdatePersons(ctx context.Context, persons []model.Person) error {
+	ctx, cancel := context.WithTimeout(ctx, 5*time.Second)
+	defer cancel()
+	logger.Logger.WithContext(ctx).Infof("DATASOURCE: UpdatePersons called with %v persons", len(persons))
+
+	if len(persons) == 0 {
+		return nil
+	}
+
+	models := make([]mongo.WriteModel, 0, len(persons))
+	for _, person := range persons {
+		models = append(models, mongo.NewUpdateOneModel().
+			SetFilter(bson.D{{Key: "id", Value: person.ID}}).
+			SetUpdate(bson.D{{Key: "$set", Value: person}}))
+	}
+
+	_, err := m.personColl.BulkWrite(ctx, models, options.BulkWrite().SetOrdered(true))
+	if err != nil {
+		logger.Logger.WithContext(ctx).Errorf("DATASOURCE: UpdatePersons error updating persons: %v", err)
+		return err
+	}
+
+	logger.Logger.WithContext(ctx).Infof("DATASOURCE: UpdatePersons success: updated %v persons", len(persons))
+
+	return nil
+}
+
+// InsertPersons upserts the persons in an unordered bulk write that only sets fields on insert, so a person whose ID
+// is taken is left untouched and reported as already existing while the rest are still written
+func (m *mongoSource) InsertPersons(ctx context.Context, persons []model.Person) ([]*model.OpError, error) {
+	ctx, cancel := context.WithTimeout(ctx, 30*time.Second)
+	defer cancel()
+	logger.Logger.WithContext(ctx).Infof("DATASOURCE: InsertPersons called with %v persons", len(persons))
+
+	if len(persons) == 0 {
+		return nil, nil
+	}
+
+	models := make([]mongo.WriteModel, 0, len(persons))
+	for _, person := range persons {
+		models = append(models, mongo.NewUpdateOneModel().
+			SetFilter(bson.D{{Key: "id", Value: person.ID}}).
+			SetUpdate(bson.D{{Key: "$setOnInsert", Value: person}}).
+			SetUpsert(true))
+	}
+
+	result, err := m.personColl.BulkWrite(ctx, models, options.BulkWrite().SetOrdered(false))
+	failed := make(map[int]error)
+	var bulkErr mongo.BulkWriteException
+	if errors.As(err, &bulkErr) && bulkErr.WriteConcernError == nil {
+		// Rows rejected by the server, e.g. by the schema validator, don't fail the others
+		for _, writeErr := range bulkErr.WriteErrors {
+			failed[writeErr.Index] = fmt.Errorf("error inserting person: %v", writeErr.Message)
+		}
+	} else if err != nil {
+		logger.Logger.WithContext(ctx).Errorf("DATASOURCE: InsertPersons error inserting persons: %v", err)
+		return nil, err
+	}
+
+	var rejected []*model.OpError
+	for i := range persons {
+		if err, ok := failed[i]; ok {
+			rejected = append(rejected, &model.OpError{Index: i, Err: err})
+			continue
+		}
+		if _, ok := result.UpsertedIDs[int64(i)]; !ok {
+			rejected = append(rejected, &model.OpError{Index: i, Err: model.ErrAlreadyExists})
+		}
+	}
+
+	logger.Logger.WithContext(ctx).Infof("DATASOURCE: InsertPersons success: inserted %v persons", len(persons)-len(rejected))
+	return rejected, nil
+}
@@ -1,7 +1,10 @@
+//go:build integration
+
 package datasource
 
 import (
 	"context"
+	"errors"
 	"gocache/pkg/model"
 	"testing"
 	"time"
@@ -12,21 +15,29 @@ import (
 	"go.mongodb.org/mongo-driver/bson"
 )
 
-func mustStartMongoContainer() (func(context.Context) error, error) {
+// startMongoContainer starts a MongoDB container for the test and points the package settings at it,
+// the test is skipped when there is no Docker to run it on
+func startMongoContainer(t *testing.T) {
+	t.Helper()
+	skipWithoutDocker(t)
+
 	ctx := context.Background()
 	dbContainer, err := mongodb.Run(ctx, "mongo:latest", mongodb.WithUsername("root"), mongodb.WithPassword("password"), testcontainers.WithWaitStrategy(wait.ForLog("Waiting for connections")))
+	if dbContainer != nil {
+		t.Cleanup(func() { dbContainer.Terminate(context.Background()) })
+	}
 	if err != nil {
-		return nil, err
+		t.Fatalf("Failed to start MongoDB container: %v", err)
 	}
 
 	dbHost, err := dbContainer.Host(ctx)
 	if err != nil {
-		return dbContainer.Terminate, err
+		t.Fatalf("Failed to get MongoDB container host: %v", err)
 	}
 
 	dbPort, err := dbContainer.MappedPort(ctx, "27017/tcp")
 	if err != nil {
-		return dbContainer.Terminate, err
+		t.Fatalf("Failed to get MongoDB container port: %v", err)
 	}
 
 	// Set the connection details
@@ -36,16 +47,23 @@ func mustStartMongoContainer() (func(context.Context) error, error) {
 	password = "password"
 	name = "gocache"
 	coll = "person"
-
-	return dbContainer.Terminate, nil
 }
 
-func TestMain(m *testing.M) {
-	mustStartMongoContainer()
-	m.Run()
+// skipWithoutDocker skips the test unless Docker is reachable, testcontainers panics rather than
+// failing when it can't find a Docker host at all
+func skipWithoutDocker(t *testing.T) {
+	t.Helper()
+	defer func() {
+		if r := recover(); r != nil {
+			t.Skipf("Docker is not available: %v", r)
+		}
+	}()
+	testcontainers.SkipIfProviderIsNotHealthy(t)
 }
 
 func TestNew(t *testing.T) {
+	startMongoContainer(t)
+
 	mongo, err := NewMongo()
 	if err != nil {
 		t.Fatalf("New() error: %v", err)
@@ -57,6 +75,8 @@ func TestNew(t *testing.T) {
 }
 
 func TestHealth(t *testing.T) {
+	startMongoContainer(t)
+
 	mongo, err := NewMongo()
 	if err != nil {
 		t.Fatalf("New() error: %v", err)
@@ -68,11 +88,7 @@ func TestHealth(t *testing.T) {
 	}
 }
 func TestGetAllPersons(t *testing.T) {
-	terminate, err := mustStartMongoContainer()
-	if err != nil {
-		t.Fatalf("Failed to start MongoDB container: %v", err)
-	}
-	defer terminate(context.Background())
+	startMongoContainer(t)
 
 	mongo, err := NewMongo()
 	if err != nil {
@@ -92,7 +108,7 @@ func TestGetAllPersons(t *testing.T) {
 	}
 
 	// Test GetAllPersons
-	persons, err := mongo.GetAllPersons()
+	persons, err := mongo.GetAllPersons(context.Background())
 	if err != nil {
 		t.Fatalf("GetAllPersons() error: %v", err)
 	}
@@ -110,11 +126,7 @@ func TestGetAllPersons(t *testing.T) {
 }
 
 func TestUpdatePerson(t *testing.T) {
-	terminate, err := mustStartMongoContainer()
-	if err != nil {
-		t.Fatalf("Failed to start MongoDB container: %v", err)
-	}
-	defer terminate(context.Background())
+	startMongoContainer(t)
 
 	mongo, err := NewMongo()
 	if err != nil {
@@ -132,7 +144,7 @@ func TestUpdatePerson(t *testing.T) {
 
 	// Update the person
 	person := model.Person{ID: 1, Name: "John Smith", Age: 35, Email: "john.smith@example.com"}
-	err = mongo.UpdatePerson(person)
+	err = mongo.UpdatePerson(context.Background(), person)
 	if err != nil {
 		t.Fatalf("UpdatePerson() error: %v", err)
 	}
@@ -156,3 +168,67 @@ func TestUpdatePerson(t *testing.T) {
 		t.Errorf("Expected email %s, got %s", person.Email, updatedPerson.Email)
 	}
 }
+
+func TestApplyOpsRepeatedFields(t *testing.T) {
+	startMongoContainer(t)
+
+	mongo, err := NewMongo()
+	if err != nil {
+		t.Fatalf("New() error: %v", err)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	collection := mongo.(*mongoSource).db.Database("gocache").Collection("person")
+	_, err = collection.InsertOne(ctx, bson.D{{Key: "id", Value: 1}, {Key: "name", Value: "John Doe"}, {Key: "age", Value: 30}, {Key: "email", Value: "john.doe@example.com"}, {Key: "version", Value: int64(1)}})
+	if err != nil {
+		t.Fatalf("Failed to insert test data: %v", err)
+	}
+
+	// Every condition on a repeated field must hold, not just the last one
+	cases := []struct {
+		name    string
+		ops     []model.FieldOp
+		wantErr error
+		wantAge int
+	}{
+		{"stale If-Match with a current body version", []model.FieldOp{
+			{Op: model.OpTest, Field: "version", Value: 0},
+			{Op: model.OpTest, Field: "version", Value: 1},
+			{Op: model.OpSet, Field: "name", Value: "John Smith"},
+		}, model.ErrTestFailed, 30},
+		{"wrong age with an increment of it", []model.FieldOp{
+			{Op: model.OpTest, Field: "age", Value: 99},
+			{Op: model.OpIncrement, Field: "age", Value: 1},
+		}, model.ErrTestFailed, 30},
+		{"If-Match with a body test", []model.FieldOp{
+			{Op: model.OpTest, Field: "version", Value: 1},
+			{Op: model.OpTest, Field: "name", Value: "John Doe"},
+			{Op: model.OpSet, Field: "name", Value: "John Smith"},
+		}, nil, 30},
+		{"age test with an increment of it", []model.FieldOp{
+			{Op: model.OpTest, Field: "age", Value: 30},
+			{Op: model.OpIncrement, Field: "age", Value: 2},
+		}, nil, 32},
+	}
+	for _, tc := range cases {
+		person, err := mongo.ApplyOps(context.Background(), 1, tc.ops)
+		if !errors.Is(err, tc.wantErr) {
+			t.Fatalf("%s: expected error %v, got %v", tc.name, tc.wantErr, err)
+		}
+		if err != nil {
+			continue
+		}
+		if person.Age != tc.wantAge {
+			t.Errorf("%s: expected age %d, got %d", tc.name, tc.wantAge, person.Age)
+		}
+	}
+
+	var stored model.Person
+	if err := collection.FindOne(ctx, bson.D{{Key: "id", Value: 1}}).Decode(&stored); err != nil {
+		t.Fatalf("Failed to find person: %v", err)
+	}
+	if stored.Name != "John Smith" || stored.Age != 32 || stored.Version != 3 {
+		t.Errorf("expected John Smith aged 32 at version 3, got %+v", stored)
+	}
+}
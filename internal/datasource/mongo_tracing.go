@@ -0,0 +1,61 @@
+package datasource
+
+import (
+	"context"
+	"errors"
+	"gocache/internal/tracing"
+	"sync"
+
+	"go.mongodb.org/mongo-driver/event"
+	semconv "go.opentelemetry.io/otel/semconv/v1.24.0"
+	"go.opentelemetry.io/otel/trace"
+)
+
+// commandTracer traces every command the Mongo driver sends as a child of the span in the command's context.
+// Commands sent outside a trace, such as health checks, aren't traced.
+type commandTracer struct {
+	spans sync.Map // commandKey to the span of the command in flight
+}
+
+type commandKey struct {
+	conn      string
+	requestID int64
+}
+
+// newCommandMonitor returns a driver command monitor that traces commands
+func newCommandMonitor() *event.CommandMonitor {
+	t := &commandTracer{}
+	return &event.CommandMonitor{Started: t.started, Succeeded: t.succeeded, Failed: t.failed}
+}
+
+func (t *commandTracer) started(ctx context.Context, e *event.CommandStartedEvent) {
+	if !trace.SpanContextFromContext(ctx).IsValid() {
+		return
+	}
+
+	name := e.CommandName
+	attrs := []trace.SpanStartOption{trace.WithSpanKind(trace.SpanKindClient)}
+	// A command document starts with the command name, whose value is the collection for collection commands
+	if collection, ok := e.Command.Lookup(e.CommandName).StringValueOK(); ok {
+		name += " " + e.DatabaseName + "." + collection
+		attrs = append(attrs, trace.WithAttributes(semconv.DBMongoDBCollection(collection)))
+	}
+	attrs = append(attrs, trace.WithAttributes(semconv.DBSystemMongoDB, semconv.DBName(e.DatabaseName), semconv.DBOperation(e.CommandName)))
+
+	_, span := tracing.Tracer().Start(ctx, name, attrs...)
+	t.spans.Store(commandKey{e.ConnectionID, e.RequestID}, span)
+}
+
+func (t *commandTracer) succeeded(_ context.Context, e *event.CommandSucceededEvent) {
+	t.finish(e.CommandFinishedEvent, nil)
+}
+
+func (t *commandTracer) failed(_ context.Context, e *event.CommandFailedEvent) {
+	t.finish(e.CommandFinishedEvent, errors.New(e.Failure))
+}
+
+func (t *commandTracer) finish(e event.CommandFinishedEvent, err error) {
+	if span, ok := t.spans.LoadAndDelete(commandKey{e.ConnectionID, e.RequestID}); ok {
+		tracing.End(span.(trace.Span), err)
+	}
+}
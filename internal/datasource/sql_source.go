@@ -0,0 +1,467 @@
+package datasource
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"gocache/internal/logger"
+	"gocache/pkg/model"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	_ "modernc.org/sqlite"
+)
+
+// DriverSQLite is the database/sql driver name of the bundled SQLite driver
+const DriverSQLite = "sqlite"
+
+// migrations are applied in order and recorded in schema_migrations, append new ones and never edit old ones.
+// Statements stick to SQL that SQLite and PostgreSQL both accept.
+var migrations = []string{
+	`CREATE TABLE persons (
+		id      BIGINT PRIMARY KEY,
+		name    TEXT NOT NULL,
+		age     INTEGER NOT NULL,
+		email   TEXT NOT NULL,
+		version BIGINT NOT NULL DEFAULT 0
+	)`,
+}
+
+// sqlMaxParams bounds the placeholders in one IN list, below SQLite's default limit
+const sqlMaxParams = 500
+
+// ApplyOps retries this many times when another writer changes the person between the read and the write
+const sqlOpRetries = 5
+
+const personColumns = "id, name, age, email, version"
+
+// sqlSource is a DataSource backed by a database/sql database. Queries use $n placeholders, which
+// both SQLite and PostgreSQL understand, so pointing it at Postgres only needs that driver registered.
+type sqlSource struct {
+	db *sql.DB
+}
+
+// NewSQL opens the database with the named database/sql driver and migrates its schema
+func NewSQL(driver, dsn string) (DataSource, error) {
+	if driver == DriverSQLite {
+		// SQLite creates a missing database file but not its directory
+		if path := sqlitePath(dsn); path != "" {
+			if err := os.MkdirAll(filepath.Dir(path), 0o755); err != nil {
+				return nil, fmt.Errorf("error creating directory for %v: %w", path, err)
+			}
+		}
+	}
+
+	db, err := sql.Open(driver, dsn)
+	if err != nil {
+		return nil, fmt.Errorf("error opening %v database: %w", driver, err)
+	}
+
+	if driver == DriverSQLite {
+		// SQLite allows a single writer, sharing one connection avoids busy errors between them
+		db.SetMaxOpenConns(1)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	if err := db.PingContext(ctx); err != nil {
+		db.Close()
+		return nil, fmt.Errorf("error connecting to %v database: %w", driver, err)
+	}
+
+	if err := migrate(ctx, db); err != nil {
+		db.Close()
+		return nil, err
+	}
+
+	return &sqlSource{db: db}, nil
+}
+
+// sqlitePath returns the file a SQLite DSN such as data/gocache.db or file:data/gocache.db?_pragma=... opens,
+// or "" for an in-memory database
+func sqlitePath(dsn string) string {
+	path, query, _ := strings.Cut(strings.TrimPrefix(dsn, "file:"), "?")
+	if path == "" || path == ":memory:" || strings.Contains(query, "mode=memory") {
+		return ""
+	}
+	return path
+}
+
+// migrate applies every migration the database hasn't recorded yet, each in its own transaction
+func migrate(ctx context.Context, db *sql.DB) error {
+	if _, err := db.ExecContext(ctx, `CREATE TABLE IF NOT EXISTS schema_migrations (version INTEGER PRIMARY KEY)`); err != nil {
+		return fmt.Errorf("error creating schema_migrations: %w", err)
+	}
+
+	var current int
+	if err := db.QueryRowContext(ctx, `SELECT COALESCE(MAX(version), 0) FROM schema_migrations`).Scan(&current); err != nil {
+		return fmt.Errorf("error reading schema version: %w", err)
+	}
+
+	for i := current; i < len(migrations); i++ {
+		tx, err := db.BeginTx(ctx, nil)
+		if err != nil {
+			return err
+		}
+
+		if _, err := tx.ExecContext(ctx, migrations[i]); err != nil {
+			tx.Rollback()
+			return fmt.Errorf("error applying migration %d: %w", i+1, err)
+		}
+		if _, err := tx.ExecContext(ctx, `INSERT INTO schema_migrations (version) VALUES ($1)`, i+1); err != nil {
+			tx.Rollback()
+			return fmt.Errorf("error recording migration %d: %w", i+1, err)
+		}
+		if err := tx.Commit(); err != nil {
+			return fmt.Errorf("error committing migration %d: %w", i+1, err)
+		}
+
+		logger.Logger.Infof("DATASOURCE: applied schema migration %d", i+1)
+	}
+
+	return nil
+}
+
+func (s *sqlSource) Health() map[string]string {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	if err := s.db.PingContext(ctx); err != nil {
+		logger.Logger.Errorf("db down: %v", err)
+	}
+
+	return map[string]string{
+		"message": "It's healthy",
+	}
+}
+
+func (s *sqlSource) GetAllPersons(ctx context.Context) ([]model.Person, error) {
+	ctx, cancel := context.WithTimeout(ctx, 5*time.Second)
+	defer cancel()
+	logger.Logger.WithContext(ctx).Info("DATASOURCE: GetAllPersons called")
+
+	persons, err := s.queryPersons(ctx, `SELECT `+personColumns+` FROM persons ORDER BY id`)
+	if err != nil {
+		logger.Logger.WithContext(ctx).Errorf("DATASOURCE: GetAllPersons error: %v", err)
+		return nil, err
+	}
+
+	logger.Logger.WithContext(ctx).Infof("DATASOURCE: GetAllPersons success: found %v persons", len(persons))
+	return persons, nil
+}
+
+func (s *sqlSource) GetPerson(ctx context.Context, id int) (model.Person, error) {
+	ctx, cancel := context.WithTimeout(ctx, 5*time.Second)
+	defer cancel()
+
+	return getPerson(ctx, s.db, id)
+}
+
+func (s *sqlSource) GetPersonVersions(ctx context.Context) (map[int]int64, error) {
+	ctx, cancel := context.WithTimeout(ctx, 5*time.Second)
+	defer cancel()
+
+	rows, err := s.db.QueryContext(ctx, `SELECT id, version FROM persons`)
+	if err != nil {
+		return nil, fmt.Errorf("error getting person versions: %w", err)
+	}
+	defer rows.Close()
+
+	versions := make(map[int]int64)
+	for rows.Next() {
+		var id int
+		var version int64
+		if err := rows.Scan(&id, &version); err != nil {
+			return nil, fmt.Errorf("error decoding person version: %w", err)
+		}
+		versions[id] = version
+	}
+	return versions, rows.Err()
+}
+
+func (s *sqlSource) GetPersonsByIDs(ctx context.Context, ids []int) ([]model.Person, error) {
+	ctx, cancel := context.WithTimeout(ctx, 5*time.Second)
+	defer cancel()
+
+	persons := make([]model.Person, 0, len(ids))
+	for start := 0; start < len(ids); start += sqlMaxParams {
+		chunk := ids[start:min(start+sqlMaxParams, len(ids))]
+
+		placeholders := make([]string, len(chunk))
+		args := make([]any, len(chunk))
+		for i, id := range chunk {
+			placeholders[i] = fmt.Sprintf("$%d", i+1)
+			args[i] = id
+		}
+
+		found, err := s.queryPersons(ctx, `SELECT `+personColumns+` FROM persons WHERE id IN (`+strings.Join(placeholders, ", ")+`)`, args...)
+		if err != nil {
+			return nil, fmt.Errorf("error getting persons by id: %w", err)
+		}
+		persons = append(persons, found...)
+	}
+
+	return persons, nil
+}
+
+func (s *sqlSource) UpdatePerson(ctx context.Context, p model.Person) error {
+	ctx, cancel := context.WithTimeout(ctx, 5*time.Second)
+	defer cancel()
+
+	return updatePerson(ctx, s.db, p)
+}
+
+func (s *sqlSource) ApplyOps(ctx context.Context, id int, ops []model.FieldOp) (model.Person, error) {
+	ctx, cancel := context.WithTimeout(ctx, 5*time.Second)
+	defer cancel()
+
+	// Read, apply and write back conditionally on the version read, retrying if another writer got in between.
+	// This avoids SELECT ... FOR UPDATE, which SQLite doesn't support.
+	for attempt := 0; attempt < sqlOpRetries; attempt++ {
+		person, err := getPerson(ctx, s.db, id)
+		if err != nil {
+			return model.Person{}, err
+		}
+
+		updated := person
+		if err := updated.Apply(ops); err != nil {
+			return model.Person{}, err
+		}
+
+		err = updatePerson(ctx, s.db, updated)
+		if errors.Is(err, model.ErrConflict) {
+			continue
+		}
+		if err != nil {
+			return model.Person{}, err
+		}
+
+		updated.Version++
+		return updated, nil
+	}
+
+	return model.Person{}, model.ErrConflict
+}
+
+func (s *sqlSource) ApplyWrites(ctx context.Context, ops []model.WriteOp) ([]model.Person, error) {
+	ctx, cancel := context.WithTimeout(ctx, 10*time.Second)
+	defer cancel()
+	logger.Logger.WithContext(ctx).Infof("DATASOURCE: ApplyWrites called with %v operations", len(ops))
+
+	tx, err := s.db.BeginTx(ctx, nil)
+	if err != nil {
+		return nil, fmt.Errorf("error starting transaction: %w", err)
+	}
+	defer tx.Rollback()
+
+	results := make([]model.Person, len(ops))
+	for i, op := range ops {
+		if results[i], err = applyWrite(ctx, tx, op); err != nil {
+			// The deferred rollback discards every earlier write
+			logger.Logger.WithContext(ctx).Errorf("DATASOURCE: ApplyWrites error, transaction aborted: %v", err)
+			return nil, &model.OpError{Index: i, Err: err}
+		}
+	}
+
+	if err := tx.Commit(); err != nil {
+		logger.Logger.WithContext(ctx).Errorf("DATASOURCE: ApplyWrites error committing: %v", err)
+		return nil, fmt.Errorf("error committing transaction: %w", err)
+	}
+
+	logger.Logger.WithContext(ctx).Infof("DATASOURCE: ApplyWrites success: committed %v operations", len(ops))
+	return results, nil
+}
+
+// UpdatePersons writes persons verbatim in one transaction, persons that don't exist are skipped rather than failing the batch
+func (s *sqlSource) UpdatePersons(ctx context.Context, p []model.Person) error {
+	ctx, cancel := context.WithTimeout(ctx, 30*time.Second)
+	defer cancel()
+
+	tx, err := s.db.BeginTx(ctx, nil)
+	if err != nil {
+		return fmt.Errorf("error starting transaction: %w", err)
+	}
+	defer tx.Rollback()
+
+	for _, person := range p {
+		_, err := tx.ExecContext(ctx, `UPDATE persons SET name = $1, age = $2, email = $3, version = $4 WHERE id = $5`,
+			person.Name, person.Age, person.Email, person.Version, person.ID)
+		if err != nil {
+			return fmt.Errorf("error writing person %v: %w", person.ID, err)
+		}
+	}
+
+	return tx.Commit()
+}
+
+// InsertPersons inserts persons in one transaction, a chunk of rows per statement. Rows whose ID is taken are
+// skipped by the database and reported as already existing.
+func (s *sqlSource) InsertPersons(ctx context.Context, p []model.Person) ([]*model.OpError, error) {
+	ctx, cancel := context.WithTimeout(ctx, 30*time.Second)
+	defer cancel()
+	logger.Logger.WithContext(ctx).Infof("DATASOURCE: InsertPersons called with %v persons", len(p))
+
+	tx, err := s.db.BeginTx(ctx, nil)
+	if err != nil {
+		return nil, fmt.Errorf("error starting transaction: %w", err)
+	}
+	defer tx.Rollback()
+
+	inserted := make(map[int]bool, len(p))
+	// Each row takes five placeholders
+	chunkSize := sqlMaxParams / 5
+	for start := 0; start < len(p); start += chunkSize {
+		chunk := p[start:min(start+chunkSize, len(p))]
+
+		rows := make([]string, len(chunk))
+		args := make([]any, 0, len(chunk)*5)
+		for i, person := range chunk {
+			n := len(args)
+			rows[i] = fmt.Sprintf("($%d, $%d, $%d, $%d, $%d)", n+1, n+2, n+3, n+4, n+5)
+			args = append(args, person.ID, person.Name, person.Age, person.Email, person.Version)
+		}
+
+		if err := insertReturningIDs(ctx, tx, `INSERT INTO persons (`+personColumns+`) VALUES `+strings.Join(rows, ", ")+
+			` ON CONFLICT (id) DO NOTHING RETURNING id`, args, inserted); err != nil {
+			logger.Logger.WithContext(ctx).Errorf("DATASOURCE: InsertPersons error, transaction aborted: %v", err)
+			return nil, err
+		}
+	}
+
+	if err := tx.Commit(); err != nil {
+		logger.Logger.WithContext(ctx).Errorf("DATASOURCE: InsertPersons error committing: %v", err)
+		return nil, fmt.Errorf("error committing transaction: %w", err)
+	}
+
+	var rejected []*model.OpError
+	for i, person := range p {
+		if !inserted[person.ID] {
+			rejected = append(rejected, &model.OpError{Index: i, Err: model.ErrAlreadyExists})
+		}
+	}
+
+	logger.Logger.WithContext(ctx).Infof("DATASOURCE: InsertPersons success: inserted %v persons", len(p)-len(rejected))
+	return rejected, nil
+}
+
+// insertReturningIDs runs an INSERT ... RETURNING id and records the returned IDs in inserted
+func insertReturningIDs(ctx context.Context, tx *sql.Tx, query string, args []any, inserted map[int]bool) error {
+	rows, err := tx.QueryContext(ctx, query, args...)
+	if err != nil {
+		return fmt.Errorf("error inserting persons: %w", err)
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var id int
+		if err := rows.Scan(&id); err != nil {
+			return fmt.Errorf("error inserting persons: %w", err)
+		}
+		inserted[id] = true
+	}
+	if err := rows.Err(); err != nil {
+		return fmt.Errorf("error inserting persons: %w", err)
+	}
+	return nil
+}
+
+// sqlExecutor is the subset of *sql.DB and *sql.Tx the helpers need, so they run in or outside a transaction
+type sqlExecutor interface {
+	ExecContext(ctx context.Context, query string, args ...any) (sql.Result, error)
+	QueryRowContext(ctx context.Context, query string, args ...any) *sql.Row
+}
+
+// applyWrite performs one transactional write and returns the resulting person
+func applyWrite(ctx context.Context, ex sqlExecutor, op model.WriteOp) (model.Person, error) {
+	switch op.Op {
+	case model.OpInsert:
+		if _, err := getPerson(ctx, ex, op.Person.ID); err == nil {
+			return model.Person{}, model.ErrAlreadyExists
+		} else if !errors.Is(err, model.ErrNotFound) {
+			return model.Person{}, err
+		}
+
+		_, err := ex.ExecContext(ctx, `INSERT INTO persons (`+personColumns+`) VALUES ($1, $2, $3, $4, $5)`,
+			op.Person.ID, op.Person.Name, op.Person.Age, op.Person.Email, op.Person.Version)
+		if err != nil {
+			return model.Person{}, fmt.Errorf("error inserting person: %w", err)
+		}
+		return op.Person, nil
+	case model.OpUpdate:
+		if err := updatePerson(ctx, ex, op.Person); err != nil {
+			return model.Person{}, err
+		}
+		updated := op.Person
+		updated.Version++
+		return updated, nil
+	case model.OpDelete:
+		person, err := getPerson(ctx, ex, op.ID)
+		if err != nil {
+			return model.Person{}, err
+		}
+		if _, err := ex.ExecContext(ctx, `DELETE FROM persons WHERE id = $1`, op.ID); err != nil {
+			return model.Person{}, fmt.Errorf("error deleting person: %w", err)
+		}
+		return person, nil
+	default:
+		return model.Person{}, op.Validate()
+	}
+}
+
+func getPerson(ctx context.Context, ex sqlExecutor, id int) (model.Person, error) {
+	var p model.Person
+	err := ex.QueryRowContext(ctx, `SELECT `+personColumns+` FROM persons WHERE id = $1`, id).
+		Scan(&p.ID, &p.Name, &p.Age, &p.Email, &p.Version)
+	if errors.Is(err, sql.ErrNoRows) {
+		return model.Person{}, model.ErrNotFound
+	}
+	if err != nil {
+		return model.Person{}, fmt.Errorf("error getting person: %w", err)
+	}
+	return p, nil
+}
+
+// updatePerson replaces a person only if its stored version matches p.Version, bumping the version
+func updatePerson(ctx context.Context, ex sqlExecutor, p model.Person) error {
+	res, err := ex.ExecContext(ctx, `UPDATE persons SET name = $1, age = $2, email = $3, version = version + 1 WHERE id = $4 AND version = $5`,
+		p.Name, p.Age, p.Email, p.ID, p.Version)
+	if err != nil {
+		return fmt.Errorf("error updating person: %w", err)
+	}
+
+	n, err := res.RowsAffected()
+	if err != nil {
+		return fmt.Errorf("error updating person: %w", err)
+	}
+	if n > 0 {
+		return nil
+	}
+
+	// Nothing matched, tell a missing person apart from a stale version
+	if _, err := getPerson(ctx, ex, p.ID); err != nil {
+		return err
+	}
+	return model.ErrConflict
+}
+
+func (s *sqlSource) queryPersons(ctx context.Context, query string, args ...any) ([]model.Person, error) {
+	rows, err := s.db.QueryContext(ctx, query, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	persons := make([]model.Person, 0)
+	for rows.Next() {
+		var p model.Person
+		if err := rows.Scan(&p.ID, &p.Name, &p.Age, &p.Email, &p.Version); err != nil {
+			return nil, err
+		}
+		persons = append(persons, p)
+	}
+	return persons, rows.Err()
+}
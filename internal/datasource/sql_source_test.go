@@ -0,0 +1,173 @@
+package datasource
+
+import (
+	"context"
+	"errors"
+	"gocache/pkg/model"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func newTestSQL(t *testing.T, path string) DataSource {
+	t.Helper()
+
+	db, err := NewSQL(DriverSQLite, path)
+	if err != nil {
+		t.Fatalf("NewSQL() error: %v", err)
+	}
+	t.Cleanup(func() { db.(*sqlSource).db.Close() })
+
+	_, err = db.ApplyWrites(context.Background(), []model.WriteOp{
+		{Op: model.OpInsert, Person: model.Person{ID: 1, Name: "John Doe", Age: 30, Email: "john.doe@example.com"}},
+		{Op: model.OpInsert, Person: model.Person{ID: 2, Name: "Jane Smith", Age: 25, Email: "jane.smith@example.com"}},
+	})
+	if err != nil {
+		t.Fatalf("seeding error: %v", err)
+	}
+	return db
+}
+
+func TestSQLMigrationIsIdempotent(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "gocache.db")
+	newTestSQL(t, path)
+
+	// Reopening must not re-run the migration or lose data
+	db, err := NewSQL(DriverSQLite, path)
+	if err != nil {
+		t.Fatalf("reopening error: %v", err)
+	}
+	defer db.(*sqlSource).db.Close()
+
+	if persons, _ := db.GetAllPersons(context.Background()); len(persons) != 2 {
+		t.Errorf("expected 2 persons, got %+v", persons)
+	}
+}
+
+func TestSQLCreatesDatabaseDirectory(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "data", "gocache.db")
+	newTestSQL(t, path)
+
+	if _, err := os.Stat(path); err != nil {
+		t.Errorf("expected the database to be created at %v: %v", path, err)
+	}
+}
+
+func TestSQLitePath(t *testing.T) {
+	for dsn, want := range map[string]string{
+		"data/gocache.db": "data/gocache.db",
+		"file:data/gocache.db?_pragma=foreign_keys(1)": "data/gocache.db",
+		":memory:":                              "",
+		"file:test.db?mode=memory&cache=shared": "",
+	} {
+		if got := sqlitePath(dsn); got != want {
+			t.Errorf("sqlitePath(%q) = %q, want %q", dsn, got, want)
+		}
+	}
+}
+
+func TestSQLReads(t *testing.T) {
+	db := newTestSQL(t, filepath.Join(t.TempDir(), "gocache.db"))
+
+	if p, err := db.GetPerson(context.Background(), 2); err != nil || p.Name != "Jane Smith" {
+		t.Errorf("unexpected person %+v, error %v", p, err)
+	}
+	if _, err := db.GetPerson(context.Background(), 3); !errors.Is(err, model.ErrNotFound) {
+		t.Errorf("expected model.ErrNotFound, got %v", err)
+	}
+
+	persons, err := db.GetPersonsByIDs(context.Background(), []int{2, 3})
+	if err != nil || len(persons) != 1 || persons[0].ID != 2 {
+		t.Errorf("expected only person 2, got %+v, error %v", persons, err)
+	}
+
+	if versions, _ := db.GetPersonVersions(context.Background()); len(versions) != 2 || versions[1] != 0 {
+		t.Errorf("unexpected versions %v", versions)
+	}
+}
+
+func TestSQLUpdatePersonVersioning(t *testing.T) {
+	db := newTestSQL(t, filepath.Join(t.TempDir(), "gocache.db"))
+
+	if err := db.UpdatePerson(context.Background(), model.Person{ID: 1, Name: "John Smith", Age: 31, Email: "john.smith@example.com"}); err != nil {
+		t.Fatalf("UpdatePerson() error: %v", err)
+	}
+	if p, _ := db.GetPerson(context.Background(), 1); p.Name != "John Smith" || p.Version != 1 {
+		t.Errorf("expected the update at version 1, got %+v", p)
+	}
+
+	if err := db.UpdatePerson(context.Background(), model.Person{ID: 1, Name: "Stale"}); !errors.Is(err, model.ErrConflict) {
+		t.Errorf("expected model.ErrConflict, got %v", err)
+	}
+	if err := db.UpdatePerson(context.Background(), model.Person{ID: 3, Name: "Missing"}); !errors.Is(err, model.ErrNotFound) {
+		t.Errorf("expected model.ErrNotFound, got %v", err)
+	}
+
+	p, err := db.ApplyOps(context.Background(), 2, []model.FieldOp{{Op: model.OpIncrement, Field: "age", Value: 1}})
+	if err != nil || p.Age != 26 || p.Version != 1 {
+		t.Errorf("expected age 26 at version 1, got %+v, error %v", p, err)
+	}
+
+	if err := db.UpdatePersons(context.Background(), []model.Person{{ID: 2, Name: "Jane Smith", Age: 40, Version: 7}, {ID: 9}}); err != nil {
+		t.Fatalf("UpdatePersons() error: %v", err)
+	}
+	if p, _ := db.GetPerson(context.Background(), 2); p.Age != 40 || p.Version != 7 {
+		t.Errorf("expected the verbatim write, got %+v", p)
+	}
+}
+
+func TestSQLApplyWritesIsAtomic(t *testing.T) {
+	db := newTestSQL(t, filepath.Join(t.TempDir(), "gocache.db"))
+
+	_, err := db.ApplyWrites(context.Background(), []model.WriteOp{
+		{Op: model.OpDelete, ID: 1},
+		{Op: model.OpInsert, Person: model.Person{ID: 2, Name: "Duplicate"}},
+	})
+
+	var opErr *model.OpError
+	if !errors.As(err, &opErr) || opErr.Index != 1 || !errors.Is(err, model.ErrAlreadyExists) {
+		t.Fatalf("expected ErrAlreadyExists on operation 1, got %v", err)
+	}
+	if _, err := db.GetPerson(context.Background(), 1); err != nil {
+		t.Error("expected the delete to be rolled back")
+	}
+
+	results, err := db.ApplyWrites(context.Background(), []model.WriteOp{
+		{Op: model.OpUpdate, Person: model.Person{ID: 1, Name: "John Doe", Age: 31}},
+		{Op: model.OpDelete, ID: 2},
+	})
+	if err != nil {
+		t.Fatalf("ApplyWrites() error: %v", err)
+	}
+	if results[0].Version != 1 || results[1].Name != "Jane Smith" {
+		t.Errorf("unexpected results %+v", results)
+	}
+	if persons, _ := db.GetAllPersons(context.Background()); len(persons) != 1 {
+		t.Errorf("expected 1 person, got %+v", persons)
+	}
+}
+
+func TestSQLInsertPersons(t *testing.T) {
+	db := newTestSQL(t, filepath.Join(t.TempDir(), "gocache.db"))
+
+	// Enough persons to take several statements, with a taken ID in the middle
+	persons := []model.Person{{ID: 3, Name: "New", Age: 20, Email: "new@example.com"}, {ID: 2, Name: "Taken"}}
+	for id := 10; id < 260; id++ {
+		persons = append(persons, model.Person{ID: id, Name: "Bulk", Age: 40, Email: "bulk@example.com"})
+	}
+
+	rejected, err := db.InsertPersons(context.Background(), persons)
+	if err != nil {
+		t.Fatalf("InsertPersons() error: %v", err)
+	}
+	if len(rejected) != 1 || rejected[0].Index != 1 || !errors.Is(rejected[0].Err, model.ErrAlreadyExists) {
+		t.Fatalf("expected only operation 1 to be rejected as existing, got %v", rejected)
+	}
+
+	if p, _ := db.GetPerson(context.Background(), 2); p.Name != "Jane Smith" {
+		t.Errorf("expected the existing person to be left alone, got %+v", p)
+	}
+	if all, _ := db.GetAllPersons(context.Background()); len(all) != 2+len(persons)-1 {
+		t.Errorf("expected %d persons, got %d", 2+len(persons)-1, len(all))
+	}
+}
@@ -0,0 +1,99 @@
+// Package expiry evicts persons from the cache once a TTL set through one of the cache protocols runs out
+package expiry
+
+import (
+	"gocache/internal/controller"
+	"gocache/internal/logger"
+	"sync"
+	"time"
+)
+
+// Expirer evicts persons from the controller's store once their TTL runs out, the data source keeps them.
+// TTLs live only in memory, so they are lost on restart and a person's TTL survives it being rewritten over HTTP.
+type Expirer struct {
+	pc controller.PersonController
+
+	mu      sync.Mutex
+	entries map[int]*expiry
+	stopped bool
+}
+
+type expiry struct {
+	deadline time.Time
+	timer    *time.Timer
+}
+
+// NewExpirer creates an Expirer that evicts persons through pc
+func NewExpirer(pc controller.PersonController) *Expirer {
+	return &Expirer{pc: pc, entries: make(map[int]*expiry)}
+}
+
+// Set schedules the person's eviction after d, replacing any earlier TTL
+func (e *Expirer) Set(id int, d time.Duration) {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+
+	if e.stopped {
+		return
+	}
+
+	if old, ok := e.entries[id]; ok {
+		old.timer.Stop()
+	}
+
+	entry := &expiry{deadline: time.Now().Add(d)}
+	entry.timer = time.AfterFunc(d, func() { e.fire(id, entry) })
+	e.entries[id] = entry
+}
+
+// TTL returns the time left before the person expires, false when no TTL is set
+func (e *Expirer) TTL(id int) (time.Duration, bool) {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+
+	entry, ok := e.entries[id]
+	if !ok {
+		return 0, false
+	}
+	return max(time.Until(entry.deadline), 0), true
+}
+
+// Clear removes the person's TTL and reports whether there was one
+func (e *Expirer) Clear(id int) bool {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+
+	entry, ok := e.entries[id]
+	if ok {
+		entry.timer.Stop()
+		delete(e.entries, id)
+	}
+	return ok
+}
+
+// Stop cancels every pending expiration
+func (e *Expirer) Stop() {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+
+	e.stopped = true
+	for id, entry := range e.entries {
+		entry.timer.Stop()
+		delete(e.entries, id)
+	}
+}
+
+func (e *Expirer) fire(id int, entry *expiry) {
+	e.mu.Lock()
+	// The TTL may have been replaced or cleared after the timer had already fired
+	if e.entries[id] != entry {
+		e.mu.Unlock()
+		return
+	}
+	delete(e.entries, id)
+	e.mu.Unlock()
+
+	if e.pc.Evict(id) {
+		logger.Logger.Infof("EXPIRY: expired person %v", id)
+	}
+}
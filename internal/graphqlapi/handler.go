@@ -0,0 +1,384 @@
+package graphqlapi
+
+import (
+	"context"
+	_ "embed"
+	"encoding/json"
+	"errors"
+	"gocache/internal/auth"
+	"gocache/internal/controller"
+	"gocache/internal/logger"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/gorilla/websocket"
+	graphql "github.com/graph-gophers/graphql-go"
+	gqlerrors "github.com/graph-gophers/graphql-go/errors"
+)
+
+//go:embed schema.graphql
+var schemaString string
+
+const (
+	// maxRequestSize bounds the body of a POSTed request
+	maxRequestSize = 1 << 20
+	// maxDepth bounds how deeply a query may nest selections
+	maxDepth = 10
+
+	// wsProtocol is the graphql-ws subprotocol spoken by subscription clients
+	wsProtocol = "graphql-transport-ws"
+	// wsInitTimeout is how long a client has to send connection_init after connecting
+	wsInitTimeout = 10 * time.Second
+	// wsKeepAlive is how often an idle connection is pinged, a client missing two pings is disconnected
+	wsKeepAlive = 15 * time.Second
+	// wsWriteTimeout bounds each write, a client that stops reading is disconnected
+	wsWriteTimeout = 10 * time.Second
+)
+
+// graphql-transport-ws message types
+const (
+	msgConnectionInit = "connection_init"
+	msgConnectionAck  = "connection_ack"
+	msgPing           = "ping"
+	msgPong           = "pong"
+	msgSubscribe      = "subscribe"
+	msgNext           = "next"
+	msgError          = "error"
+	msgComplete       = "complete"
+)
+
+// graphql-transport-ws close codes
+const (
+	closeBadRequest        = 4400
+	closeUnauthorized      = 4401
+	closeForbidden         = 4403
+	closeInitTimeout       = 4408
+	closeSubscriberExists  = 4409
+	closeTooManyInitialise = 4429
+)
+
+// Handler serves GraphQL requests POSTed as JSON and GraphQL subscriptions over WebSockets
+type Handler struct {
+	schema   *graphql.Schema
+	authn    auth.Authenticator
+	done     <-chan struct{}
+	upgrader websocket.Upgrader
+}
+
+// request is a GraphQL request, the body of a POST and the payload of a subscribe message
+type request struct {
+	Query         string                 `json:"query"`
+	OperationName string                 `json:"operationName"`
+	Variables     map[string]interface{} `json:"variables"`
+}
+
+// NewHandler creates a handler resolving through pc and masking persons with mask. When authn is set a WebSocket
+// whose upgrade request carried no credentials must authenticate in its connection_init message. Closing done ends
+// every subscription, checkOrigin decides which browser origins may open one.
+func NewHandler(pc controller.PersonController, authn auth.Authenticator, mask auth.Mask, done <-chan struct{}, checkOrigin func(r *http.Request) bool) *Handler {
+	schema := graphql.MustParseSchema(schemaString, &resolver{pc: pc, mask: mask},
+		graphql.MaxDepth(maxDepth),
+		// Changes are handed over once the previous one was written, which may take up to a write timeout
+		graphql.SubscribeResolverTimeout(wsWriteTimeout),
+	)
+
+	return &Handler{
+		schema: schema,
+		authn:  authn,
+		done:   done,
+		upgrader: websocket.Upgrader{
+			Subprotocols: []string{wsProtocol},
+			CheckOrigin:  checkOrigin,
+		},
+	}
+}
+
+func (h *Handler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	switch {
+	case r.Method == http.MethodPost:
+		h.serveRequest(w, r)
+	case r.Method == http.MethodGet && websocket.IsWebSocketUpgrade(r):
+		h.serveWebSocket(w, r)
+	default:
+		w.Header().Set("Allow", http.MethodPost)
+		writeJSON(w, http.StatusMethodNotAllowed, map[string]string{"error": "GraphQL requests must be POSTed, subscriptions need a WebSocket"})
+	}
+}
+
+// serveRequest executes a single query or mutation
+func (h *Handler) serveRequest(w http.ResponseWriter, r *http.Request) {
+	var req request
+	if err := json.NewDecoder(http.MaxBytesReader(w, r.Body, maxRequestSize)).Decode(&req); err != nil {
+		logger.Logger.Errorf("GRAPHQL: error decoding request: %v", err)
+		writeJSON(w, http.StatusBadRequest, map[string]string{"error": "Invalid GraphQL request"})
+		return
+	}
+
+	resp := h.schema.Exec(r.Context(), req.Query, req.OperationName, req.Variables)
+	withExtensions(resp.Errors)
+	writeJSON(w, http.StatusOK, resp)
+}
+
+func writeJSON(w http.ResponseWriter, status int, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(v)
+}
+
+// withExtensions copies the code of resolver errors the library reported without their extensions
+func withExtensions(errs []*gqlerrors.QueryError) {
+	for _, e := range errs {
+		var coded *codedError
+		if e.Extensions == nil && errors.As(e.ResolverError, &coded) {
+			e.Extensions = coded.Extensions()
+		}
+	}
+}
+
+// wsMessage is a graphql-transport-ws message
+type wsMessage struct {
+	ID      string          `json:"id,omitempty"`
+	Type    string          `json:"type"`
+	Payload json.RawMessage `json:"payload,omitempty"`
+}
+
+// wsConn is a graphql-transport-ws connection, any number of operations may run on it at once
+type wsConn struct {
+	h    *Handler
+	conn *websocket.Conn
+	ctx  context.Context
+	// principal is the caller authenticated by connection_init, operations run as the upgrade request's otherwise
+	principal *auth.Principal
+
+	writeMu sync.Mutex
+
+	mu   sync.Mutex
+	subs map[string]context.CancelFunc
+	wg   sync.WaitGroup
+}
+
+func (h *Handler) serveWebSocket(w http.ResponseWriter, r *http.Request) {
+	conn, err := h.upgrader.Upgrade(w, r, nil)
+	if err != nil {
+		// The upgrader has already replied
+		logger.Logger.Errorf("GRAPHQL: error upgrading connection: %v", err)
+		return
+	}
+	defer conn.Close()
+
+	ctx, cancel := context.WithCancel(r.Context())
+	c := &wsConn{h: h, conn: conn, ctx: ctx, subs: make(map[string]context.CancelFunc)}
+	defer c.wg.Wait()
+	defer cancel()
+
+	if conn.Subprotocol() != wsProtocol {
+		c.close(websocket.CloseProtocolError, "Subprotocol not acceptable")
+		return
+	}
+
+	go c.keepAlive()
+	c.readLoop()
+}
+
+// keepAlive pings the client until the connection ends, closing it when the server shuts down
+func (c *wsConn) keepAlive() {
+	t := time.NewTicker(wsKeepAlive)
+	defer t.Stop()
+
+	for {
+		select {
+		case <-c.ctx.Done():
+			return
+		case <-c.h.done:
+			c.close(websocket.CloseGoingAway, controller.ErrClosed.Error())
+			return
+		case <-t.C:
+			if err := c.conn.WriteControl(websocket.PingMessage, nil, time.Now().Add(wsWriteTimeout)); err != nil {
+				return
+			}
+		}
+	}
+}
+
+// readLoop handles client messages until the connection fails or is closed
+func (c *wsConn) readLoop() {
+	acked := false
+	c.conn.SetReadDeadline(time.Now().Add(wsInitTimeout))
+	c.conn.SetPongHandler(func(string) error {
+		if !acked {
+			return nil
+		}
+		return c.conn.SetReadDeadline(time.Now().Add(2 * wsKeepAlive))
+	})
+
+	for {
+		_, data, err := c.conn.ReadMessage()
+		if err != nil {
+			var netErr interface{ Timeout() bool }
+			if !acked && errors.As(err, &netErr) && netErr.Timeout() {
+				c.close(closeInitTimeout, "Connection initialisation timeout")
+			}
+			return
+		}
+
+		var m wsMessage
+		if err := json.Unmarshal(data, &m); err != nil {
+			c.close(closeBadRequest, "Invalid message")
+			return
+		}
+
+		switch m.Type {
+		case msgConnectionInit:
+			if acked {
+				c.close(closeTooManyInitialise, "Too many initialisation requests")
+				return
+			}
+			if !c.init(m.Payload) {
+				c.close(closeForbidden, "Forbidden")
+				return
+			}
+			acked = true
+			c.conn.SetReadDeadline(time.Now().Add(2 * wsKeepAlive))
+			c.write(wsMessage{Type: msgConnectionAck})
+		case msgPing:
+			c.write(wsMessage{Type: msgPong})
+		case msgPong:
+		case msgSubscribe:
+			if !acked {
+				c.close(closeUnauthorized, "Unauthorized")
+				return
+			}
+			var req request
+			if m.ID == "" || json.Unmarshal(m.Payload, &req) != nil {
+				c.close(closeBadRequest, "Invalid subscribe message")
+				return
+			}
+			if !c.subscribe(m.ID, req) {
+				c.close(closeSubscriberExists, "Subscriber for "+m.ID+" already exists")
+				return
+			}
+		case msgComplete:
+			c.mu.Lock()
+			if cancel, ok := c.subs[m.ID]; ok {
+				cancel()
+			}
+			c.mu.Unlock()
+		default:
+			c.close(closeBadRequest, "Invalid message type")
+			return
+		}
+	}
+}
+
+// init authenticates the connection from the connection_init payload, whose string fields are read as headers such
+// as Authorization or X-API-Key. A connection whose upgrade request was authenticated may send no credentials.
+func (c *wsConn) init(payload json.RawMessage) bool {
+	if c.h.authn == nil {
+		return true
+	}
+
+	var fields map[string]interface{}
+	json.Unmarshal(payload, &fields)
+	h := http.Header{}
+	for k, v := range fields {
+		if s, ok := v.(string); ok {
+			h.Set(k, s)
+		}
+	}
+
+	p, err := c.h.authn.Authenticate(h)
+	if errors.Is(err, auth.ErrNoCredentials) {
+		_, ok := auth.FromContext(c.ctx)
+		return ok
+	}
+	if err != nil {
+		logger.Logger.Warnf("GRAPHQL: Rejected connection_init: %v", err)
+		return false
+	}
+	c.principal = p
+	return true
+}
+
+// subscribe runs an operation in the background, returning false if id is already in use
+func (c *wsConn) subscribe(id string, req request) bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if _, ok := c.subs[id]; ok {
+		return false
+	}
+
+	ctx, cancel := context.WithCancel(c.ctx)
+	if c.principal != nil {
+		ctx = auth.WithPrincipal(ctx, c.principal)
+	}
+	reason := &endReason{}
+	ctx = context.WithValue(ctx, endReasonKey{}, reason)
+	c.subs[id] = cancel
+
+	c.wg.Add(1)
+	go func() {
+		defer c.wg.Done()
+		defer func() {
+			c.mu.Lock()
+			delete(c.subs, id)
+			c.mu.Unlock()
+			cancel()
+		}()
+
+		responses, err := c.h.schema.Subscribe(ctx, req.Query, req.OperationName, req.Variables)
+		if err != nil {
+			c.writeErrors(id, []*gqlerrors.QueryError{{Message: err.Error()}})
+			return
+		}
+
+		for resp := range responses {
+			resp := resp.(*graphql.Response)
+			withExtensions(resp.Errors)
+
+			// An operation that never executed is answered with an error instead of a result
+			if resp.Data == nil && len(resp.Errors) > 0 {
+				c.writeErrors(id, resp.Errors)
+				return
+			}
+			payload, _ := json.Marshal(resp)
+			if c.write(wsMessage{ID: id, Type: msgNext, Payload: payload}) != nil {
+				return
+			}
+		}
+
+		// The client completed the operation itself or went away
+		if ctx.Err() != nil {
+			return
+		}
+		if reason.err != nil {
+			logger.Logger.Infof("GRAPHQL: subscription %v ended: %v", id, reason.err)
+			var coded *codedError
+			errors.As(reason.err, &coded)
+			c.writeErrors(id, []*gqlerrors.QueryError{{Message: reason.err.Error(), Extensions: coded.Extensions()}})
+			return
+		}
+		c.write(wsMessage{ID: id, Type: msgComplete})
+	}()
+	return true
+}
+
+func (c *wsConn) writeErrors(id string, errs []*gqlerrors.QueryError) error {
+	payload, _ := json.Marshal(errs)
+	return c.write(wsMessage{ID: id, Type: msgError, Payload: payload})
+}
+
+func (c *wsConn) write(m wsMessage) error {
+	c.writeMu.Lock()
+	defer c.writeMu.Unlock()
+	c.conn.SetWriteDeadline(time.Now().Add(wsWriteTimeout))
+	return c.conn.WriteJSON(m)
+}
+
+// close sends a close frame and closes the connection, which ends the read loop and every operation
+func (c *wsConn) close(code int, reason string) {
+	c.writeMu.Lock()
+	defer c.writeMu.Unlock()
+	c.conn.WriteControl(websocket.CloseMessage, websocket.FormatCloseMessage(code, reason), time.Now().Add(wsWriteTimeout))
+	c.conn.Close()
+}
@@ -0,0 +1,439 @@
+package graphqlapi
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"gocache/internal/auth"
+	"gocache/internal/controller"
+	"gocache/internal/datasource"
+	"gocache/pkg/model"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+func newTestServer(t *testing.T) (*httptest.Server, controller.PersonController, chan struct{}) {
+	t.Helper()
+
+	pc, err := controller.NewPersonController(datasource.NewMockDataSource())
+	if err != nil {
+		t.Fatalf("NewPersonController() error: %v", err)
+	}
+
+	done := make(chan struct{})
+	ts := httptest.NewServer(NewHandler(pc, nil, auth.Mask{}, done, func(*http.Request) bool { return true }))
+	t.Cleanup(ts.Close)
+	return ts, pc, done
+}
+
+// newAuthTestServer serves requests as a caller with roles, masking personal data
+func newAuthTestServer(t *testing.T, roles ...string) *httptest.Server {
+	t.Helper()
+
+	pc, err := controller.NewPersonController(datasource.NewMockDataSource())
+	if err != nil {
+		t.Fatalf("NewPersonController() error: %v", err)
+	}
+
+	h := NewHandler(pc, nil, auth.Mask{PII: true}, make(chan struct{}), func(*http.Request) bool { return true })
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		p := &auth.Principal{ID: "test", Method: auth.MethodAPIKey, Roles: roles}
+		h.ServeHTTP(w, r.WithContext(auth.WithPrincipal(r.Context(), p)))
+	}))
+	t.Cleanup(ts.Close)
+	return ts
+}
+
+type gqlResponse struct {
+	Data   json.RawMessage `json:"data"`
+	Errors []struct {
+		Message    string                 `json:"message"`
+		Extensions map[string]interface{} `json:"extensions"`
+	} `json:"errors"`
+}
+
+// code returns the extensions code of the first error, empty if there isn't one
+func (r gqlResponse) code() string {
+	if len(r.Errors) == 0 {
+		return ""
+	}
+	code, _ := r.Errors[0].Extensions["code"].(string)
+	return code
+}
+
+// post executes query and decodes its data into out
+func post(t *testing.T, ts *httptest.Server, query string, variables map[string]interface{}, out interface{}) gqlResponse {
+	t.Helper()
+
+	body, _ := json.Marshal(request{Query: query, Variables: variables})
+	resp, err := http.Post(ts.URL, "application/json", bytes.NewReader(body))
+	if err != nil {
+		t.Fatalf("POST failed: %v", err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("expected 200, got %d", resp.StatusCode)
+	}
+
+	var r gqlResponse
+	if err := json.NewDecoder(resp.Body).Decode(&r); err != nil {
+		t.Fatalf("invalid response: %v", err)
+	}
+	if out != nil && len(r.Data) > 0 {
+		if err := json.Unmarshal(r.Data, out); err != nil {
+			t.Fatalf("invalid data %s: %v", r.Data, err)
+		}
+	}
+	return r
+}
+
+func TestQueries(t *testing.T) {
+	ts, pc, _ := newTestServer(t)
+	pc.ApplyBatch(context.Background(), []model.WriteOp{{Op: model.OpInsert, Person: model.Person{ID: 3, Name: "Alice Johnson", Age: 25, Email: "alice@example.com"}}})
+
+	var person struct {
+		Found, Missing *model.Person
+	}
+	r := post(t, ts, `{ found: person(id: 2) { id name age email version } missing: person(id: 9) { id } }`, nil, &person)
+	if len(r.Errors) > 0 || person.Found == nil || person.Found.Name != "Jane Smith" || person.Missing != nil {
+		t.Fatalf("expected Jane and null, got %+v (%+v)", person, r.Errors)
+	}
+
+	type page struct {
+		Items       []model.Person
+		TotalCount  int
+		EndCursor   *string
+		HasNextPage bool
+	}
+	var pages struct{ First, Next page }
+	r = post(t, ts, `query($after: String) {
+		first: persons(first: 2) { items { id } totalCount endCursor hasNextPage }
+		next: persons(first: 2, after: $after) { items { id } totalCount endCursor hasNextPage }
+	}`, map[string]interface{}{"after": "2"}, &pages)
+	if len(r.Errors) > 0 {
+		t.Fatalf("persons returned errors: %+v", r.Errors)
+	}
+	if len(pages.First.Items) != 2 || pages.First.Items[0].ID != 1 || *pages.First.EndCursor != "2" || !pages.First.HasNextPage || pages.First.TotalCount != 3 {
+		t.Errorf("expected the first two persons, got %+v", pages.First)
+	}
+	if len(pages.Next.Items) != 1 || pages.Next.Items[0].ID != 3 || pages.Next.HasNextPage {
+		t.Errorf("expected the last person, got %+v", pages.Next)
+	}
+
+	var stats struct {
+		All, Young, None struct {
+			Count          int
+			MinAge, MaxAge *int
+			AverageAge     *float64
+		}
+	}
+	r = post(t, ts, `{
+		all: personStats { count minAge maxAge averageAge }
+		young: personStats(filter: {ages: [25]}) { count minAge maxAge averageAge }
+		none: personStats(filter: {name: "Nobody"}) { count minAge maxAge averageAge }
+	}`, nil, &stats)
+	if len(r.Errors) > 0 {
+		t.Fatalf("personStats returned errors: %+v", r.Errors)
+	}
+	if stats.All.Count != 3 || *stats.All.MinAge != 25 || *stats.All.MaxAge != 30 || *stats.All.AverageAge != 80.0/3 {
+		t.Errorf("unexpected stats for everyone: %+v", stats.All)
+	}
+	if stats.Young.Count != 2 || *stats.Young.MaxAge != 25 {
+		t.Errorf("unexpected stats for age 25: %+v", stats.Young)
+	}
+	if stats.None.Count != 0 || stats.None.MinAge != nil || stats.None.AverageAge != nil {
+		t.Errorf("expected empty stats, got %+v", stats.None)
+	}
+
+	if r := post(t, ts, `{ persons(first: 101) { totalCount } }`, nil, nil); r.code() != codeBadInput {
+		t.Errorf("expected an oversized page to be rejected, got %+v", r.Errors)
+	}
+}
+
+func TestMutations(t *testing.T) {
+	ts, pc, _ := newTestServer(t)
+
+	var created struct{ CreatePerson model.Person }
+	r := post(t, ts, `mutation { createPerson(input: {id: 3, name: "Alice Johnson", age: 28, email: "alice@example.com"}) { id name age email version } }`, nil, &created)
+	want := model.Person{ID: 3, Name: "Alice Johnson", Age: 28, Email: "alice@example.com"}
+	if len(r.Errors) > 0 || created.CreatePerson != want {
+		t.Fatalf("expected %+v, got %+v (%+v)", want, created, r.Errors)
+	}
+	if r := post(t, ts, `mutation { createPerson(input: {id: 3, name: "Again", age: 0, email: "again@example.com"}) { id } }`, nil, nil); r.code() != codeAlreadyExists {
+		t.Errorf("expected a duplicate insert to fail with %v, got %+v", codeAlreadyExists, r.Errors)
+	}
+
+	update := `mutation($version: Int) { updatePerson(id: 3, input: {age: 29}, version: $version) { age version } }`
+	var updated struct{ UpdatePerson model.Person }
+	r = post(t, ts, update, map[string]interface{}{"version": 0}, &updated)
+	if len(r.Errors) > 0 || updated.UpdatePerson.Age != 29 || updated.UpdatePerson.Version != 1 {
+		t.Fatalf("expected age 29 at version 1, got %+v (%+v)", updated, r.Errors)
+	}
+	if r := post(t, ts, update, map[string]interface{}{"version": 0}, nil); r.code() != codeConflict {
+		t.Errorf("expected a stale version to fail with %v, got %+v", codeConflict, r.Errors)
+	}
+
+	var deleted struct{ DeletePerson bool }
+	if r := post(t, ts, `mutation { deletePerson(id: 3) }`, nil, &deleted); len(r.Errors) > 0 || !deleted.DeletePerson {
+		t.Fatalf("expected the delete to succeed, got %+v (%+v)", deleted, r.Errors)
+	}
+	if _, err := pc.GetPerson(context.Background(), 3); err == nil {
+		t.Errorf("expected person 3 to be deleted")
+	}
+	if r := post(t, ts, `mutation { deletePerson(id: 3) }`, nil, nil); r.code() != codeNotFound {
+		t.Errorf("expected a second delete to fail with %v, got %+v", codeNotFound, r.Errors)
+	}
+}
+
+func TestRejectsBadRequests(t *testing.T) {
+	ts, _, _ := newTestServer(t)
+
+	resp, err := http.Post(ts.URL, "application/json", strings.NewReader("{"))
+	if err != nil {
+		t.Fatalf("POST failed: %v", err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusBadRequest {
+		t.Errorf("expected 400 for invalid JSON, got %d", resp.StatusCode)
+	}
+
+	resp, err = http.Get(ts.URL + "?query={persons{totalCount}}")
+	if err != nil {
+		t.Fatalf("GET failed: %v", err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusMethodNotAllowed {
+		t.Errorf("expected 405 for a plain GET, got %d", resp.StatusCode)
+	}
+}
+
+// dialWS opens a graphql-transport-ws connection and completes the handshake
+func dialWS(t *testing.T, ts *httptest.Server) *websocket.Conn {
+	t.Helper()
+
+	dialer := websocket.Dialer{Subprotocols: []string{wsProtocol}}
+	conn, _, err := dialer.Dial("ws"+strings.TrimPrefix(ts.URL, "http"), nil)
+	if err != nil {
+		t.Fatalf("Dial() failed: %v", err)
+	}
+	t.Cleanup(func() { conn.Close() })
+	conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+
+	conn.WriteJSON(wsMessage{Type: msgConnectionInit})
+	if m := readWS(t, conn); m.Type != msgConnectionAck {
+		t.Fatalf("expected connection_ack, got %+v", m)
+	}
+	return conn
+}
+
+func readWS(t *testing.T, conn *websocket.Conn) wsMessage {
+	t.Helper()
+	var m wsMessage
+	if err := conn.ReadJSON(&m); err != nil {
+		t.Fatalf("ReadJSON() failed: %v", err)
+	}
+	return m
+}
+
+func subscribeWS(conn *websocket.Conn, id, query string) {
+	payload, _ := json.Marshal(request{Query: query})
+	conn.WriteJSON(wsMessage{ID: id, Type: msgSubscribe, Payload: payload})
+}
+
+type changeData struct {
+	PersonChanged struct {
+		Seq    string
+		Op     string
+		ID     int
+		Before *model.Person
+		After  *model.Person
+	}
+}
+
+func readChange(t *testing.T, conn *websocket.Conn, id string) changeData {
+	t.Helper()
+
+	m := readWS(t, conn)
+	if m.Type != msgNext || m.ID != id {
+		t.Fatalf("expected next for %v, got %+v %s", id, m, m.Payload)
+	}
+	var r struct{ Data changeData }
+	json.Unmarshal(m.Payload, &r)
+	return r.Data
+}
+
+func TestSubscriptions(t *testing.T) {
+	ts, pc, done := newTestServer(t)
+	conn := dialWS(t, ts)
+
+	const query = `subscription($since: String) {
+		personChanged(filter: {ages: [25, 26]}, since: $since) { seq op id before { age } after { age version } }
+	}`
+	// Resuming from the current sequence number doesn't depend on when the subscription starts
+	w, _ := pc.Watch(controller.WatchOptions{})
+	start := strconv.FormatUint(w.Seq(), 10)
+	w.Stop()
+	payload, _ := json.Marshal(request{Query: query, Variables: map[string]interface{}{"since": start}})
+	conn.WriteJSON(wsMessage{ID: "1", Type: msgSubscribe, Payload: payload})
+
+	jane, _ := pc.GetPerson(context.Background(), 2)
+	jane.Age = 26
+	pc.UpdatePerson(context.Background(), jane)
+	updated := readChange(t, conn, "1").PersonChanged
+	if updated.Op != "UPDATE" || updated.ID != 2 || updated.Before.Age != 25 || updated.After.Age != 26 || updated.After.Version != 1 {
+		t.Fatalf("expected Jane's update, got %+v", updated)
+	}
+
+	// John doesn't match the filter, the delete of Jane does through its before image
+	john, _ := pc.GetPerson(context.Background(), 1)
+	pc.UpdatePerson(context.Background(), john)
+	pc.ApplyBatch(context.Background(), []model.WriteOp{{Op: model.OpDelete, ID: 2}})
+	deleted := readChange(t, conn, "1").PersonChanged
+	if deleted.Op != "DELETE" || deleted.ID != 2 || deleted.Before == nil || deleted.After != nil {
+		t.Fatalf("expected the delete of Jane, got %+v", deleted)
+	}
+
+	// Queries run over the socket too, and a duplicate id closes the connection
+	subscribeWS(conn, "2", `{ personStats { count } }`)
+	if m := readWS(t, conn); m.Type != msgNext || m.ID != "2" || !strings.Contains(string(m.Payload), `"count":1`) {
+		t.Errorf("expected the query result, got %+v %s", m, m.Payload)
+	}
+	if m := readWS(t, conn); m.Type != msgComplete || m.ID != "2" {
+		t.Errorf("expected the query to complete, got %+v", m)
+	}
+
+	// A resume point from before the delete replays it
+	resumed := dialWS(t, ts)
+	payload, _ = json.Marshal(request{Query: query, Variables: map[string]interface{}{"since": updated.Seq}})
+	resumed.WriteJSON(wsMessage{ID: "r", Type: msgSubscribe, Payload: payload})
+	if c := readChange(t, resumed, "r").PersonChanged; c.Seq != deleted.Seq {
+		t.Errorf("expected the delete to be replayed, got %+v", c)
+	}
+
+	subscribeWS(resumed, "expired", `subscription { personChanged(since: "1") { seq } }`)
+	m := readWS(t, resumed)
+	if m.Type != msgError || m.ID != "expired" || !strings.Contains(string(m.Payload), codeGone) {
+		t.Errorf("expected an expired resume point to fail with %v, got %+v %s", codeGone, m, m.Payload)
+	}
+
+	close(done)
+	if _, _, err := conn.ReadMessage(); !websocket.IsCloseError(err, websocket.CloseGoingAway) {
+		t.Errorf("expected a going away close, got %v", err)
+	}
+}
+
+func TestSubscriptionProtocolErrors(t *testing.T) {
+	ts, _, _ := newTestServer(t)
+	url := "ws" + strings.TrimPrefix(ts.URL, "http")
+
+	dialer := websocket.Dialer{Subprotocols: []string{wsProtocol}}
+	conn, _, err := dialer.Dial(url, nil)
+	if err != nil {
+		t.Fatalf("Dial() failed: %v", err)
+	}
+	defer conn.Close()
+	conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+
+	subscribeWS(conn, "1", `subscription { personChanged { seq } }`)
+	if _, _, err := conn.ReadMessage(); !websocket.IsCloseError(err, closeUnauthorized) {
+		t.Errorf("expected subscribing before connection_init to close with %v, got %v", closeUnauthorized, err)
+	}
+
+	conn = dialWS(t, ts)
+	subscribeWS(conn, "1", `subscription { personChanged { seq } }`)
+	subscribeWS(conn, "1", `subscription { personChanged { seq } }`)
+	if _, _, err := conn.ReadMessage(); !websocket.IsCloseError(err, closeSubscriberExists) {
+		t.Errorf("expected a duplicate id to close with %v, got %v", closeSubscriberExists, err)
+	}
+}
+
+func TestResolverErrorCodes(t *testing.T) {
+	cases := map[error]string{
+		&model.OpError{Index: 0, Err: model.ErrNotFound}: codeNotFound,
+		model.ErrTestFailed:        codeConflict,
+		controller.ErrWatchExpired: codeGone,
+		controller.ErrClosed:       codeUnavailable,
+	}
+	for err, want := range cases {
+		got := resolverError(err).(*codedError).Extensions()
+		if !reflect.DeepEqual(got, map[string]interface{}{"code": want}) {
+			t.Errorf("%v: expected %v, got %v", err, want, got)
+		}
+	}
+}
+
+func TestAuthorization(t *testing.T) {
+	reader := newAuthTestServer(t, auth.RoleRead)
+
+	var data struct{ Person model.Person }
+	r := post(t, reader, `{ person(id: 2) { id email } }`, nil, &data)
+	if len(r.Errors) > 0 || data.Person.Email != auth.RedactedEmail {
+		t.Errorf("expected a redacted email, got %+v (%+v)", data.Person, r.Errors)
+	}
+	if r := post(t, reader, `{ persons(filter: {email: "jane.smith@example.com"}) { totalCount } }`, nil, nil); r.code() != codeForbidden {
+		t.Errorf("expected filtering by email to be forbidden, got %+v", r.Errors)
+	}
+	if r := post(t, reader, `mutation { deletePerson(id: 2) }`, nil, nil); r.code() != codeForbidden {
+		t.Errorf("expected a reader's mutation to be forbidden, got %+v", r.Errors)
+	}
+
+	writer := newAuthTestServer(t, auth.RoleWrite)
+	if r := post(t, writer, `{ person(id: 2) { id } }`, nil, nil); r.code() != codeForbidden {
+		t.Errorf("expected a writer's query to be forbidden, got %+v", r.Errors)
+	}
+
+	admin := newAuthTestServer(t, auth.RoleAdmin)
+	r = post(t, admin, `{ person(id: 2) { id email } }`, nil, &data)
+	if len(r.Errors) > 0 || data.Person.Email == auth.RedactedEmail {
+		t.Errorf("expected an admin to see the email, got %+v (%+v)", data.Person, r.Errors)
+	}
+}
+
+func TestConnectionInitAuthentication(t *testing.T) {
+	pc, err := controller.NewPersonController(datasource.NewMockDataSource())
+	if err != nil {
+		t.Fatalf("NewPersonController() error: %v", err)
+	}
+	authn := auth.NewAPIKeys(map[string]auth.Principal{"key-1": {ID: "reader", Roles: []string{auth.RoleRead}}})
+	ts := httptest.NewServer(NewHandler(pc, authn, auth.Mask{}, make(chan struct{}), func(*http.Request) bool { return true }))
+	t.Cleanup(ts.Close)
+
+	dial := func(payload string) *websocket.Conn {
+		dialer := websocket.Dialer{Subprotocols: []string{wsProtocol}}
+		conn, _, err := dialer.Dial("ws"+strings.TrimPrefix(ts.URL, "http"), nil)
+		if err != nil {
+			t.Fatalf("Dial() failed: %v", err)
+		}
+		t.Cleanup(func() { conn.Close() })
+		conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+		conn.WriteJSON(wsMessage{Type: msgConnectionInit, Payload: json.RawMessage(payload)})
+		return conn
+	}
+
+	for _, payload := range []string{`null`, `{"X-API-Key":"key-2"}`} {
+		if _, _, err := dial(payload).ReadMessage(); !websocket.IsCloseError(err, closeForbidden) {
+			t.Errorf("%s: expected connection_init to close with %v, got %v", payload, closeForbidden, err)
+		}
+	}
+
+	conn := dial(`{"X-API-Key":"key-1"}`)
+	if m := readWS(t, conn); m.Type != msgConnectionAck {
+		t.Fatalf("expected connection_ack, got %+v", m)
+	}
+	subscribeWS(conn, "1", `{ person(id: 2) { id } }`)
+	if m := readWS(t, conn); m.Type != msgNext || !strings.Contains(string(m.Payload), `"id":2`) {
+		t.Errorf("expected the query result, got %+v %s", m, m.Payload)
+	}
+	readWS(t, conn)
+	subscribeWS(conn, "2", `mutation { deletePerson(id: 2) }`)
+	if m := readWS(t, conn); !strings.Contains(string(m.Payload), codeForbidden) {
+		t.Errorf("expected the reader's mutation to be forbidden, got %+v %s", m, m.Payload)
+	}
+}
@@ -0,0 +1,419 @@
+package graphqlapi
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"gocache/internal/auth"
+	"gocache/internal/controller"
+	"gocache/pkg/model"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// maxPageSize caps how many persons a single page may hold
+const maxPageSize = 100
+
+// Error codes reported in the extensions of resolver errors
+const (
+	codeNotFound      = "NOT_FOUND"
+	codeConflict      = "CONFLICT"
+	codeAlreadyExists = "ALREADY_EXISTS"
+	codeBadInput      = "BAD_USER_INPUT"
+	codeForbidden     = "FORBIDDEN"
+	codeGone          = "GONE"
+	codeLagged        = "LAGGED"
+	codeUnavailable   = "UNAVAILABLE"
+	codeInternal      = "INTERNAL_SERVER_ERROR"
+)
+
+// codedError is a resolver error whose code is sent in the GraphQL error's extensions
+type codedError struct {
+	code string
+	err  error
+}
+
+func (e *codedError) Error() string {
+	return e.err.Error()
+}
+
+func (e *codedError) Unwrap() error {
+	return e.err
+}
+
+func (e *codedError) Extensions() map[string]interface{} {
+	ext := map[string]interface{}{"code": e.code}
+	var invalid *model.ValidationError
+	if errors.As(e.err, &invalid) {
+		ext["fields"] = invalid.Fields
+	}
+	return ext
+}
+
+// resolverError attaches the code matching a controller error
+func resolverError(err error) error {
+	// Every mutation writes a single person, so the batch position adds nothing
+	var opErr *model.OpError
+	if errors.As(err, &opErr) {
+		err = opErr.Err
+	}
+
+	code := codeInternal
+	switch {
+	case errors.Is(err, model.ErrNotFound):
+		code = codeNotFound
+	case errors.Is(err, model.ErrConflict), errors.Is(err, model.ErrTestFailed):
+		code = codeConflict
+	case errors.Is(err, model.ErrAlreadyExists):
+		code = codeAlreadyExists
+	case errors.Is(err, model.ErrInvalidOp), errors.Is(err, model.ErrInvalidPerson):
+		code = codeBadInput
+	case errors.Is(err, auth.ErrForbidden):
+		code = codeForbidden
+	case errors.Is(err, controller.ErrWatchExpired):
+		code = codeGone
+	case errors.Is(err, controller.ErrWatchLagged):
+		code = codeLagged
+	case errors.Is(err, controller.ErrClosed):
+		code = codeUnavailable
+	}
+	return &codedError{code: code, err: err}
+}
+
+func badInput(format string, args ...interface{}) error {
+	return &codedError{code: codeBadInput, err: fmt.Errorf(format, args...)}
+}
+
+// resolver is the root resolver, every field goes through the PersonController. Queries and subscriptions
+// need the read role and mutations the write role, the persons returned are masked for the caller.
+type resolver struct {
+	pc   controller.PersonController
+	mask auth.Mask
+}
+
+type personFilter struct {
+	Name  *string
+	Email *string
+	Ages  *[]int32
+}
+
+func (f *personFilter) toModel() model.Filter {
+	var filter model.Filter
+	if f == nil {
+		return filter
+	}
+	if f.Name != nil {
+		filter.Name = *f.Name
+	}
+	if f.Email != nil {
+		filter.Email = *f.Email
+	}
+	if f.Ages != nil {
+		for _, age := range *f.Ages {
+			filter.Ages = append(filter.Ages, int(age))
+		}
+	}
+	return filter
+}
+
+// query returns the persons matching filter ordered by id, as the caller in ctx may see them
+func (r *resolver) query(ctx context.Context, filter *personFilter) ([]model.Person, error) {
+	if err := auth.Authorize(ctx, auth.RoleRead); err != nil {
+		return nil, resolverError(err)
+	}
+	f := filter.toModel()
+	if err := r.mask.Filter(ctx, f); err != nil {
+		return nil, resolverError(err)
+	}
+
+	persons, err := r.pc.Query(ctx, f.Name, f.Email, f.Ages)
+	if err != nil {
+		return nil, resolverError(err)
+	}
+
+	persons = r.mask.Persons(ctx, persons)
+	sort.Slice(persons, func(i, j int) bool { return persons[i].ID < persons[j].ID })
+	return persons, nil
+}
+
+func (r *resolver) Person(ctx context.Context, args struct{ ID int32 }) (*personResolver, error) {
+	if err := auth.Authorize(ctx, auth.RoleRead); err != nil {
+		return nil, resolverError(err)
+	}
+
+	p, err := r.pc.GetPerson(ctx, int(args.ID))
+	if errors.Is(err, model.ErrNotFound) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, resolverError(err)
+	}
+	return &personResolver{r.mask.Person(ctx, p)}, nil
+}
+
+func (r *resolver) Persons(ctx context.Context, args struct {
+	Filter *personFilter
+	First  int32
+	After  *string
+}) (*pageResolver, error) {
+	if args.First < 0 || args.First > maxPageSize {
+		return nil, badInput("first must be between 0 and %d", maxPageSize)
+	}
+
+	persons, err := r.query(ctx, args.Filter)
+	if err != nil {
+		return nil, err
+	}
+	page := &pageResolver{total: len(persons)}
+
+	// The cursor is the id of the last person on the previous page
+	if args.After != nil {
+		after, err := strconv.Atoi(*args.After)
+		if err != nil {
+			return nil, badInput("invalid cursor %q", *args.After)
+		}
+		persons = persons[sort.Search(len(persons), func(i int) bool { return persons[i].ID > after }):]
+	}
+
+	if len(persons) > int(args.First) {
+		page.items, page.hasNext = persons[:args.First], true
+	} else {
+		page.items = persons
+	}
+	return page, nil
+}
+
+func (r *resolver) PersonStats(ctx context.Context, args struct{ Filter *personFilter }) (*statsResolver, error) {
+	persons, err := r.query(ctx, args.Filter)
+	if err != nil {
+		return nil, err
+	}
+	return &statsResolver{persons}, nil
+}
+
+type personInput struct {
+	ID    int32
+	Name  string
+	Age   int32
+	Email string
+}
+
+type personPatch struct {
+	Name  *string
+	Age   *int32
+	Email *string
+}
+
+func (r *resolver) CreatePerson(ctx context.Context, args struct{ Input personInput }) (*personResolver, error) {
+	if err := auth.Authorize(ctx, auth.RoleWrite); err != nil {
+		return nil, resolverError(err)
+	}
+
+	p := model.Person{ID: int(args.Input.ID), Name: args.Input.Name, Age: int(args.Input.Age), Email: args.Input.Email}
+	results, err := r.pc.ApplyBatch(ctx, []model.WriteOp{{Op: model.OpInsert, Person: p}})
+	if err != nil {
+		return nil, resolverError(err)
+	}
+	return &personResolver{r.mask.Person(ctx, results[0])}, nil
+}
+
+func (r *resolver) UpdatePerson(ctx context.Context, args struct {
+	ID      int32
+	Input   personPatch
+	Version *int32
+}) (*personResolver, error) {
+	if err := auth.Authorize(ctx, auth.RoleWrite); err != nil {
+		return nil, resolverError(err)
+	}
+
+	var ops []model.FieldOp
+	if args.Version != nil {
+		ops = append(ops, model.FieldOp{Op: model.OpTest, Field: "version", Value: int64(*args.Version)})
+	}
+	if args.Input.Name != nil {
+		ops = append(ops, model.FieldOp{Op: model.OpSet, Field: "name", Value: *args.Input.Name})
+	}
+	if args.Input.Age != nil {
+		ops = append(ops, model.FieldOp{Op: model.OpSet, Field: "age", Value: int(*args.Input.Age)})
+	}
+	if args.Input.Email != nil {
+		ops = append(ops, model.FieldOp{Op: model.OpSet, Field: "email", Value: *args.Input.Email})
+	}
+
+	p, err := r.pc.PatchPerson(ctx, int(args.ID), ops)
+	if err != nil {
+		return nil, resolverError(err)
+	}
+	return &personResolver{r.mask.Person(ctx, p)}, nil
+}
+
+func (r *resolver) DeletePerson(ctx context.Context, args struct{ ID int32 }) (bool, error) {
+	if err := auth.Authorize(ctx, auth.RoleWrite); err != nil {
+		return false, resolverError(err)
+	}
+
+	if _, err := r.pc.ApplyBatch(ctx, []model.WriteOp{{Op: model.OpDelete, ID: int(args.ID)}}); err != nil {
+		return false, resolverError(err)
+	}
+	return true, nil
+}
+
+// endReasonKey holds an *endReason in a subscription's context
+type endReasonKey struct{}
+
+// endReason is set by a subscription that ends on its own, so the transport can tell the client why
+type endReason struct {
+	err error
+}
+
+func (r *resolver) PersonChanged(ctx context.Context, args struct {
+	Filter *personFilter
+	Since  *string
+}) (<-chan *changeResolver, error) {
+	if err := auth.Authorize(ctx, auth.RoleRead); err != nil {
+		return nil, resolverError(err)
+	}
+	opts := controller.WatchOptions{Filter: args.Filter.toModel()}
+	if err := r.mask.Filter(ctx, opts.Filter); err != nil {
+		return nil, resolverError(err)
+	}
+	if args.Since != nil {
+		since, err := strconv.ParseUint(*args.Since, 10, 64)
+		if err != nil {
+			return nil, badInput("invalid sequence number %q", *args.Since)
+		}
+		opts.Resume, opts.Since = true, since
+	}
+
+	w, err := r.pc.Watch(opts)
+	if err != nil {
+		return nil, resolverError(err)
+	}
+
+	c := make(chan *changeResolver)
+	go func() {
+		defer close(c)
+		defer w.Stop()
+
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case change, ok := <-w.Changes():
+				if !ok {
+					if reason, _ := ctx.Value(endReasonKey{}).(*endReason); reason != nil && w.Err() != nil {
+						reason.err = resolverError(w.Err())
+					}
+					return
+				}
+
+				select {
+				case c <- &changeResolver{r.mask.Change(ctx, change)}:
+				case <-ctx.Done():
+					return
+				}
+			}
+		}
+	}()
+	return c, nil
+}
+
+type personResolver struct {
+	p model.Person
+}
+
+func (r *personResolver) ID() int32      { return int32(r.p.ID) }
+func (r *personResolver) Name() string   { return r.p.Name }
+func (r *personResolver) Age() int32     { return int32(r.p.Age) }
+func (r *personResolver) Email() string  { return r.p.Email }
+func (r *personResolver) Version() int32 { return int32(r.p.Version) }
+
+type pageResolver struct {
+	items   []model.Person
+	total   int
+	hasNext bool
+}
+
+func (r *pageResolver) Items() []*personResolver {
+	items := make([]*personResolver, len(r.items))
+	for i, p := range r.items {
+		items[i] = &personResolver{p}
+	}
+	return items
+}
+
+func (r *pageResolver) TotalCount() int32 { return int32(r.total) }
+func (r *pageResolver) HasNextPage() bool { return r.hasNext }
+
+func (r *pageResolver) EndCursor() *string {
+	if len(r.items) == 0 {
+		return nil
+	}
+	cursor := strconv.Itoa(r.items[len(r.items)-1].ID)
+	return &cursor
+}
+
+type statsResolver struct {
+	persons []model.Person
+}
+
+func (r *statsResolver) Count() int32 { return int32(len(r.persons)) }
+
+func (r *statsResolver) MinAge() *int32 {
+	if len(r.persons) == 0 {
+		return nil
+	}
+	low := r.persons[0].Age
+	for _, p := range r.persons {
+		low = min(low, p.Age)
+	}
+	age := int32(low)
+	return &age
+}
+
+func (r *statsResolver) MaxAge() *int32 {
+	if len(r.persons) == 0 {
+		return nil
+	}
+	high := r.persons[0].Age
+	for _, p := range r.persons {
+		high = max(high, p.Age)
+	}
+	age := int32(high)
+	return &age
+}
+
+func (r *statsResolver) AverageAge() *float64 {
+	if len(r.persons) == 0 {
+		return nil
+	}
+	sum := 0
+	for _, p := range r.persons {
+		sum += p.Age
+	}
+	avg := float64(sum) / float64(len(r.persons))
+	return &avg
+}
+
+type changeResolver struct {
+	c model.Change
+}
+
+func (r *changeResolver) Seq() string { return strconv.FormatUint(r.c.Seq, 10) }
+func (r *changeResolver) Op() string  { return strings.ToUpper(r.c.Op) }
+func (r *changeResolver) ID() int32   { return int32(r.c.ID) }
+
+func (r *changeResolver) Before() *personResolver {
+	if r.c.Before == nil {
+		return nil
+	}
+	return &personResolver{*r.c.Before}
+}
+
+func (r *changeResolver) After() *personResolver {
+	if r.c.After == nil {
+		return nil
+	}
+	return &personResolver{*r.c.After}
+}
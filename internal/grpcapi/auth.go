@@ -0,0 +1,91 @@
+package grpcapi
+
+import (
+	"context"
+	"errors"
+	"gocache/internal/auth"
+	"gocache/internal/logger"
+	"gocache/pkg/personpb"
+	"net/http"
+
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/status"
+)
+
+// methodRoles is the role each method requires, methods missing here are reserved to admins
+var methodRoles = map[string]string{
+	personpb.PersonService_Get_FullMethodName:    auth.RoleRead,
+	personpb.PersonService_List_FullMethodName:   auth.RoleRead,
+	personpb.PersonService_Query_FullMethodName:  auth.RoleRead,
+	personpb.PersonService_Watch_FullMethodName:  auth.RoleRead,
+	personpb.PersonService_Upsert_FullMethodName: auth.RoleWrite,
+	personpb.PersonService_Delete_FullMethodName: auth.RoleWrite,
+}
+
+// authenticate verifies the call's metadata the same way the REST API verifies headers,
+// and checks the caller has the method's role, returning a context carrying the caller
+func authenticate(ctx context.Context, authn auth.Authenticator, method string) (context.Context, error) {
+	p, err := authn.Authenticate(incomingHeader(ctx))
+	if err != nil {
+		logger.Logger.WithContext(ctx).Warnf("GRPC: Rejected %s: %v", method, err)
+		if errors.Is(err, auth.ErrNoCredentials) {
+			return nil, status.Error(codes.Unauthenticated, "authentication required")
+		}
+		return nil, status.Error(codes.Unauthenticated, "invalid credentials")
+	}
+
+	logger.Logger.WithContext(ctx).Debugf("GRPC: %s authenticated as %s (%s)", method, p.ID, p.Method)
+	ctx = auth.WithPrincipal(ctx, p)
+
+	role, ok := methodRoles[method]
+	if !ok {
+		role = auth.RoleAdmin
+	}
+	if err := auth.Authorize(ctx, role); err != nil {
+		logger.Logger.WithContext(ctx).Warnf("GRPC: Rejected %s: %v", method, err)
+		return nil, status.Error(codes.PermissionDenied, err.Error())
+	}
+	return ctx, nil
+}
+
+// incomingHeader returns the call's metadata as HTTP headers
+func incomingHeader(ctx context.Context) http.Header {
+	md, _ := metadata.FromIncomingContext(ctx)
+	h := make(http.Header, len(md))
+	for k, v := range md {
+		h[http.CanonicalHeaderKey(k)] = v
+	}
+	return h
+}
+
+func unaryAuthInterceptor(authn auth.Authenticator) grpc.UnaryServerInterceptor {
+	return func(ctx context.Context, req interface{}, info *grpc.UnaryServerInfo, handler grpc.UnaryHandler) (interface{}, error) {
+		ctx, err := authenticate(ctx, authn, info.FullMethod)
+		if err != nil {
+			return nil, err
+		}
+		return handler(ctx, req)
+	}
+}
+
+func streamAuthInterceptor(authn auth.Authenticator) grpc.StreamServerInterceptor {
+	return func(srv interface{}, ss grpc.ServerStream, info *grpc.StreamServerInfo, handler grpc.StreamHandler) error {
+		ctx, err := authenticate(ss.Context(), authn, info.FullMethod)
+		if err != nil {
+			return err
+		}
+		return handler(srv, &contextStream{ServerStream: ss, ctx: ctx})
+	}
+}
+
+// contextStream replaces the context of a stream, e.g. with one carrying the caller
+type contextStream struct {
+	grpc.ServerStream
+	ctx context.Context
+}
+
+func (s *contextStream) Context() context.Context {
+	return s.ctx
+}
@@ -0,0 +1,280 @@
+// Package grpcapi serves the person cache over gRPC using the personpb schema, every call goes through
+// the same controller as the REST API so the data source stays authoritative
+package grpcapi
+
+import (
+	"context"
+	"crypto/tls"
+	"errors"
+	"gocache/internal/auth"
+	"gocache/internal/controller"
+	"gocache/internal/logger"
+	"gocache/pkg/model"
+	"gocache/pkg/personpb"
+	"net"
+	"strconv"
+	"sync"
+
+	"google.golang.org/genproto/googleapis/rpc/errdetails"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/credentials"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/status"
+)
+
+// Server implements personpb.PersonServiceServer on top of a PersonController
+type Server struct {
+	personpb.UnimplementedPersonServiceServer
+
+	pc        controller.PersonController
+	mask      auth.Mask
+	grpc      *grpc.Server
+	done      chan struct{} // closed by Close to end open watches
+	closeOnce sync.Once
+}
+
+// NewServer creates a gRPC server backed by pc, calls must authenticate with authn unless it's nil
+// and the persons returned are masked for the caller. Connections are served over TLS with tlsConfig
+// unless it's nil.
+func NewServer(pc controller.PersonController, authn auth.Authenticator, mask auth.Mask, tlsConfig *tls.Config) *Server {
+	// Calls are traced before they are authenticated, so rejected calls show up in traces too
+	opts := []grpc.ServerOption{
+		grpc.ChainUnaryInterceptor(unaryTraceInterceptor),
+		grpc.ChainStreamInterceptor(streamTraceInterceptor),
+	}
+	if tlsConfig != nil {
+		opts = append(opts, grpc.Creds(credentials.NewTLS(tlsConfig)))
+	}
+	if authn != nil {
+		opts = append(opts,
+			grpc.ChainUnaryInterceptor(unaryAuthInterceptor(authn)),
+			grpc.ChainStreamInterceptor(streamAuthInterceptor(authn)))
+	}
+
+	s := &Server{
+		pc:   pc,
+		mask: mask,
+		grpc: grpc.NewServer(opts...),
+		done: make(chan struct{}),
+	}
+	personpb.RegisterPersonServiceServer(s.grpc, s)
+	return s
+}
+
+// Serve accepts connections on l until Close is called
+func (s *Server) Serve(l net.Listener) error {
+	logger.Logger.Infof("GRPC: listening on %v", l.Addr())
+	return s.grpc.Serve(l)
+}
+
+// Close ends open watches and waits for in-flight calls to finish
+func (s *Server) Close() error {
+	s.closeOnce.Do(func() {
+		close(s.done)
+		s.grpc.GracefulStop()
+	})
+	return nil
+}
+
+// Get returns a single person
+func (s *Server) Get(ctx context.Context, req *personpb.GetRequest) (*personpb.Person, error) {
+	p, err := s.pc.GetPerson(ctx, int(req.GetId()))
+	if err != nil {
+		return nil, statusError(err)
+	}
+	return toProto(s.mask.Person(ctx, p)), nil
+}
+
+// List streams every cached person
+func (s *Server) List(_ *personpb.ListRequest, stream grpc.ServerStreamingServer[personpb.Person]) error {
+	persons, err := s.pc.GetAllPersons(stream.Context())
+	if err != nil {
+		return statusError(err)
+	}
+
+	for _, p := range s.mask.Persons(stream.Context(), persons) {
+		if err := stream.Send(toProto(p)); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Query returns the persons matching the request
+func (s *Server) Query(ctx context.Context, req *personpb.QueryRequest) (*personpb.QueryResponse, error) {
+	if err := s.mask.Filter(ctx, model.Filter{Email: req.GetEmail()}); err != nil {
+		return nil, status.Error(codes.PermissionDenied, err.Error())
+	}
+
+	persons, err := s.pc.Query(ctx, req.GetName(), req.GetEmail(), toInts(req.GetAges()))
+	if err != nil {
+		return nil, statusError(err)
+	}
+	persons = s.mask.Persons(ctx, persons)
+
+	resp := &personpb.QueryResponse{Persons: make([]*personpb.Person, len(persons))}
+	for i, p := range persons {
+		resp.Persons[i] = toProto(p)
+	}
+	return resp, nil
+}
+
+// Upsert updates the person if it exists and inserts it otherwise
+func (s *Server) Upsert(ctx context.Context, req *personpb.UpsertRequest) (*personpb.Person, error) {
+	if req.GetPerson() == nil {
+		return nil, status.Error(codes.InvalidArgument, "person is required")
+	}
+	p := fromProto(req.GetPerson())
+
+	if _, err := s.pc.GetPerson(ctx, p.ID); err == nil {
+		updated, err := s.pc.UpdatePerson(ctx, p)
+		if err != nil {
+			return nil, statusError(err)
+		}
+		return toProto(s.mask.Person(ctx, updated)), nil
+	}
+
+	results, err := s.pc.ApplyBatch(ctx, []model.WriteOp{{Op: model.OpInsert, Person: p}})
+	if err != nil {
+		return nil, statusError(err)
+	}
+	return toProto(s.mask.Person(ctx, results[0])), nil
+}
+
+// Delete removes a person
+func (s *Server) Delete(ctx context.Context, req *personpb.DeleteRequest) (*personpb.DeleteResponse, error) {
+	if _, err := s.pc.ApplyBatch(ctx, []model.WriteOp{{Op: model.OpDelete, ID: int(req.GetId())}}); err != nil {
+		return nil, statusError(err)
+	}
+	return &personpb.DeleteResponse{}, nil
+}
+
+// Watch streams committed changes until the client goes away, the watcher lags or the server closes
+func (s *Server) Watch(req *personpb.WatchRequest, stream grpc.ServerStreamingServer[personpb.Change]) error {
+	filter := model.Filter{Name: req.GetName(), Email: req.GetEmail(), Ages: toInts(req.GetAges())}
+	if err := s.mask.Filter(stream.Context(), filter); err != nil {
+		return status.Error(codes.PermissionDenied, err.Error())
+	}
+
+	w, err := s.pc.Watch(controller.WatchOptions{Resume: req.Since != nil, Since: req.GetSince(), Filter: filter})
+	if errors.Is(err, controller.ErrWatchExpired) {
+		return status.Error(codes.OutOfRange, err.Error())
+	}
+	if err != nil {
+		return status.Error(codes.Unavailable, err.Error())
+	}
+	defer w.Stop()
+
+	// Sending the headers tells the client every change after watch-seq will be delivered
+	if err := stream.SendHeader(metadata.Pairs("watch-seq", strconv.FormatUint(w.Seq(), 10))); err != nil {
+		return err
+	}
+
+	for {
+		select {
+		case <-stream.Context().Done():
+			return status.FromContextError(stream.Context().Err()).Err()
+		case <-s.done:
+			return status.Error(codes.Unavailable, "server is shutting down")
+		case change, ok := <-w.Changes():
+			if !ok {
+				if errors.Is(w.Err(), controller.ErrWatchLagged) {
+					return status.Error(codes.ResourceExhausted, w.Err().Error())
+				}
+				return status.Error(codes.Unavailable, "watch ended")
+			}
+			if err := stream.Send(toProtoChange(s.mask.Change(stream.Context(), change))); err != nil {
+				return err
+			}
+		}
+	}
+}
+
+// statusError maps controller errors onto gRPC status codes
+func statusError(err error) error {
+	// Every call writes a single person, so the batch position adds nothing
+	var opErr *model.OpError
+	if errors.As(err, &opErr) {
+		err = opErr.Err
+	}
+
+	switch {
+	case errors.Is(err, model.ErrNotFound):
+		return status.Error(codes.NotFound, err.Error())
+	case errors.Is(err, model.ErrConflict):
+		return status.Error(codes.Aborted, err.Error())
+	case errors.Is(err, model.ErrAlreadyExists):
+		return status.Error(codes.AlreadyExists, err.Error())
+	case errors.Is(err, model.ErrInvalidOp):
+		return status.Error(codes.InvalidArgument, err.Error())
+	case errors.Is(err, model.ErrInvalidPerson):
+		return invalidPersonError(err)
+	}
+
+	logger.Logger.Errorf("GRPC: Error handling call: %v", err)
+	return status.Error(codes.Internal, err.Error())
+}
+
+func toProto(p model.Person) *personpb.Person {
+	return &personpb.Person{
+		Id:      int64(p.ID),
+		Name:    p.Name,
+		Age:     int32(p.Age),
+		Email:   p.Email,
+		Version: p.Version,
+	}
+}
+
+func fromProto(p *personpb.Person) model.Person {
+	return model.Person{
+		ID:      int(p.GetId()),
+		Name:    p.GetName(),
+		Age:     int(p.GetAge()),
+		Email:   p.GetEmail(),
+		Version: p.GetVersion(),
+	}
+}
+
+var changeOps = map[string]personpb.Change_Op{
+	model.OpInsert: personpb.Change_OP_INSERT,
+	model.OpUpdate: personpb.Change_OP_UPDATE,
+	model.OpDelete: personpb.Change_OP_DELETE,
+}
+
+func toProtoChange(c model.Change) *personpb.Change {
+	change := &personpb.Change{Seq: c.Seq, Op: changeOps[c.Op], Id: int64(c.ID)}
+	if c.Before != nil {
+		change.Before = toProto(*c.Before)
+	}
+	if c.After != nil {
+		change.After = toProto(*c.After)
+	}
+	return change
+}
+
+func toInts(ages []int32) []int {
+	ints := make([]int, len(ages))
+	for i, age := range ages {
+		ints[i] = int(age)
+	}
+	return ints
+}
+
+// invalidPersonError reports a person breaking the validation rules as InvalidArgument with a field violation per invalid field
+func invalidPersonError(err error) error {
+	st := status.New(codes.InvalidArgument, err.Error())
+
+	var invalid *model.ValidationError
+	if !errors.As(err, &invalid) {
+		return st.Err()
+	}
+	details := &errdetails.BadRequest{}
+	for _, f := range invalid.Fields {
+		details.FieldViolations = append(details.FieldViolations, &errdetails.BadRequest_FieldViolation{Field: f.Field, Description: f.Message})
+	}
+	if withDetails, err := st.WithDetails(details); err == nil {
+		st = withDetails
+	}
+	return st.Err()
+}
@@ -0,0 +1,294 @@
+package grpcapi
+
+import (
+	"context"
+	"errors"
+	"gocache/internal/auth"
+	"gocache/internal/controller"
+	"gocache/internal/datasource"
+	"gocache/pkg/personpb"
+	"io"
+	"net"
+	"strconv"
+	"testing"
+	"time"
+
+	"google.golang.org/genproto/googleapis/rpc/errdetails"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/credentials/insecure"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/status"
+	"google.golang.org/grpc/test/bufconn"
+	"google.golang.org/protobuf/proto"
+)
+
+func newTestServer(t *testing.T) (personpb.PersonServiceClient, *Server) {
+	t.Helper()
+	return newAuthTestServer(t, nil, auth.Mask{})
+}
+
+// newAuthTestServer starts a server requiring authn's credentials and masking persons with mask
+func newAuthTestServer(t *testing.T, authn auth.Authenticator, mask auth.Mask) (personpb.PersonServiceClient, *Server) {
+	t.Helper()
+
+	pc, err := controller.NewPersonController(datasource.NewMockDataSource())
+	if err != nil {
+		t.Fatalf("NewPersonController() error: %v", err)
+	}
+
+	l := bufconn.Listen(1 << 20)
+	s := NewServer(pc, authn, mask, nil)
+	go s.Serve(l)
+
+	conn, err := grpc.NewClient("passthrough:///bufconn",
+		grpc.WithContextDialer(func(ctx context.Context, _ string) (net.Conn, error) { return l.DialContext(ctx) }),
+		grpc.WithTransportCredentials(insecure.NewCredentials()))
+	if err != nil {
+		t.Fatalf("failed to dial: %v", err)
+	}
+
+	t.Cleanup(func() {
+		conn.Close()
+		s.Close()
+	})
+
+	return personpb.NewPersonServiceClient(conn), s
+}
+
+func testContext(t *testing.T) context.Context {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	t.Cleanup(cancel)
+	return ctx
+}
+
+func expectCode(t *testing.T, err error, code codes.Code) {
+	t.Helper()
+	if status.Code(err) != code {
+		t.Errorf("expected %v, got %v", code, err)
+	}
+}
+
+// watchSeq returns the sequence number a watch starts after
+func watchSeq(t *testing.T, stream grpc.ServerStreamingClient[personpb.Change]) uint64 {
+	t.Helper()
+
+	header, err := stream.Header()
+	if err != nil {
+		t.Fatalf("Header() error: %v", err)
+	}
+	seq, err := strconv.ParseUint(header.Get("watch-seq")[0], 10, 64)
+	if err != nil {
+		t.Fatalf("invalid watch-seq header %v: %v", header, err)
+	}
+	return seq
+}
+
+func TestGetAndQuery(t *testing.T) {
+	client, _ := newTestServer(t)
+	ctx := testContext(t)
+
+	p, err := client.Get(ctx, &personpb.GetRequest{Id: 1})
+	want := &personpb.Person{Id: 1, Name: "John Doe", Age: 30, Email: "john.doe@example.com"}
+	if err != nil || !proto.Equal(p, want) {
+		t.Errorf("expected %v, got %v (%v)", want, p, err)
+	}
+
+	_, err = client.Get(ctx, &personpb.GetRequest{Id: 9})
+	expectCode(t, err, codes.NotFound)
+
+	resp, err := client.Query(ctx, &personpb.QueryRequest{Ages: []int32{25}})
+	if err != nil || len(resp.GetPersons()) != 1 || resp.GetPersons()[0].GetName() != "Jane Smith" {
+		t.Errorf("expected Jane Smith, got %v (%v)", resp, err)
+	}
+}
+
+func TestList(t *testing.T) {
+	client, _ := newTestServer(t)
+
+	stream, err := client.List(testContext(t), &personpb.ListRequest{})
+	if err != nil {
+		t.Fatalf("List() error: %v", err)
+	}
+
+	var names []string
+	for {
+		p, err := stream.Recv()
+		if errors.Is(err, io.EOF) {
+			break
+		}
+		if err != nil {
+			t.Fatalf("Recv() error: %v", err)
+		}
+		names = append(names, p.GetName())
+	}
+
+	if len(names) != 2 {
+		t.Errorf("expected 2 persons, got %v", names)
+	}
+}
+
+func TestUpsertAndDelete(t *testing.T) {
+	client, _ := newTestServer(t)
+	ctx := testContext(t)
+
+	p, err := client.Upsert(ctx, &personpb.UpsertRequest{Person: &personpb.Person{Id: 1, Name: "John Smith", Age: 31, Email: "john.smith@example.com"}})
+	if err != nil || p.GetVersion() != 1 || p.GetName() != "John Smith" {
+		t.Errorf("expected John Smith at version 1, got %v (%v)", p, err)
+	}
+
+	_, err = client.Upsert(ctx, &personpb.UpsertRequest{Person: &personpb.Person{Id: 1, Name: "Stale", Email: "stale@example.com"}})
+	expectCode(t, err, codes.Aborted)
+
+	// Inserts ignore the version
+	p, err = client.Upsert(ctx, &personpb.UpsertRequest{Person: &personpb.Person{Id: 3, Name: "Alice Johnson", Email: "alice@example.com", Version: 7}})
+	if err != nil || p.GetVersion() != 0 {
+		t.Errorf("expected a new person at version 0, got %v (%v)", p, err)
+	}
+
+	_, err = client.Upsert(ctx, &personpb.UpsertRequest{})
+	expectCode(t, err, codes.InvalidArgument)
+
+	// Invalid persons are rejected with a violation per field
+	_, err = client.Upsert(ctx, &personpb.UpsertRequest{Person: &personpb.Person{Id: 4, Name: "Bob Brown", Age: -1, Email: "bob"}})
+	expectCode(t, err, codes.InvalidArgument)
+	var violations []string
+	for _, detail := range status.Convert(err).Details() {
+		if br, ok := detail.(*errdetails.BadRequest); ok {
+			for _, v := range br.GetFieldViolations() {
+				violations = append(violations, v.GetField())
+			}
+		}
+	}
+	if len(violations) != 2 || violations[0] != "age" || violations[1] != "email" {
+		t.Errorf("expected age and email violations, got %v", violations)
+	}
+
+	if _, err := client.Delete(ctx, &personpb.DeleteRequest{Id: 3}); err != nil {
+		t.Errorf("Delete() error: %v", err)
+	}
+	_, err = client.Delete(ctx, &personpb.DeleteRequest{Id: 3})
+	expectCode(t, err, codes.NotFound)
+}
+
+func TestWatch(t *testing.T) {
+	client, s := newTestServer(t)
+	ctx := testContext(t)
+
+	stream, err := client.Watch(ctx, &personpb.WatchRequest{Name: "Jane Smith"})
+	if err != nil {
+		t.Fatalf("Watch() error: %v", err)
+	}
+	seq := watchSeq(t, stream)
+
+	// Writes from any front end show up on the watch, filtered on either image
+	jane, _ := s.pc.GetPerson(context.Background(), 2)
+	renamed := jane
+	renamed.Name = "Jane Doe"
+	if _, err := s.pc.UpdatePerson(context.Background(), renamed); err != nil {
+		t.Fatalf("UpdatePerson() error: %v", err)
+	}
+	client.Upsert(ctx, &personpb.UpsertRequest{Person: &personpb.Person{Id: 3, Name: "Alice Johnson", Email: "alice@example.com"}})
+
+	want := &personpb.Change{
+		Seq:    seq + 1,
+		Op:     personpb.Change_OP_UPDATE,
+		Id:     2,
+		Before: toProto(jane),
+		After:  &personpb.Person{Id: 2, Name: "Jane Doe", Age: 25, Email: "jane.smith@example.com", Version: 1},
+	}
+	if got, err := stream.Recv(); err != nil || !proto.Equal(got, want) {
+		t.Errorf("expected %v, got %v (%v)", want, got, err)
+	}
+
+	s.Close()
+	_, err = stream.Recv()
+	expectCode(t, err, codes.Unavailable)
+}
+
+func TestWatchResume(t *testing.T) {
+	client, _ := newTestServer(t)
+	ctx := testContext(t)
+
+	stream, err := client.Watch(ctx, &personpb.WatchRequest{})
+	if err != nil {
+		t.Fatalf("Watch() error: %v", err)
+	}
+	seq := watchSeq(t, stream)
+
+	client.Delete(ctx, &personpb.DeleteRequest{Id: 1})
+	client.Delete(ctx, &personpb.DeleteRequest{Id: 2})
+
+	stream, err = client.Watch(ctx, &personpb.WatchRequest{Since: proto.Uint64(seq + 1)})
+	if err != nil {
+		t.Fatalf("Watch() error: %v", err)
+	}
+	if got, err := stream.Recv(); err != nil || got.GetSeq() != seq+2 || got.GetBefore().GetName() != "Jane Smith" {
+		t.Errorf("expected the second delete to be replayed, got %v (%v)", got, err)
+	}
+
+	stream, err = client.Watch(ctx, &personpb.WatchRequest{Since: proto.Uint64(seq + 9)})
+	if err == nil {
+		_, err = stream.Recv()
+	}
+	expectCode(t, err, codes.OutOfRange)
+}
+
+func TestAuthentication(t *testing.T) {
+	client, _ := newAuthTestServer(t, auth.NewAPIKeys(map[string]auth.Principal{"key-1": {ID: "ci", Roles: []string{auth.RoleRead}}}), auth.Mask{})
+	ctx := testContext(t)
+
+	_, err := client.Get(ctx, &personpb.GetRequest{Id: 1})
+	expectCode(t, err, codes.Unauthenticated)
+
+	_, err = client.Get(metadata.AppendToOutgoingContext(ctx, "x-api-key", "key-2"), &personpb.GetRequest{Id: 1})
+	expectCode(t, err, codes.Unauthenticated)
+
+	authed := metadata.AppendToOutgoingContext(ctx, "x-api-key", "key-1")
+	if _, err := client.Get(authed, &personpb.GetRequest{Id: 1}); err != nil {
+		t.Errorf("expected a valid key to be accepted, got %v", err)
+	}
+
+	stream, err := client.Watch(ctx, &personpb.WatchRequest{})
+	if err == nil {
+		_, err = stream.Recv()
+	}
+	expectCode(t, err, codes.Unauthenticated)
+
+	stream, err = client.Watch(authed, &personpb.WatchRequest{})
+	if err != nil {
+		t.Fatalf("Watch() error: %v", err)
+	}
+	if _, err := stream.Header(); err != nil {
+		t.Errorf("expected an authenticated watch to start, got %v", err)
+	}
+}
+
+func TestAuthorization(t *testing.T) {
+	client, _ := newAuthTestServer(t, auth.NewAPIKeys(map[string]auth.Principal{
+		"reader": {ID: "reader", Roles: []string{auth.RoleRead}},
+		"admin":  {ID: "admin", Roles: []string{auth.RoleAdmin}},
+	}), auth.Mask{PII: true})
+	reader := metadata.AppendToOutgoingContext(testContext(t), "x-api-key", "reader")
+	admin := metadata.AppendToOutgoingContext(testContext(t), "x-api-key", "admin")
+
+	p, err := client.Get(reader, &personpb.GetRequest{Id: 1})
+	if err != nil {
+		t.Fatalf("Get() error: %v", err)
+	}
+	if p.GetEmail() != auth.RedactedEmail {
+		t.Errorf("expected a redacted email, got %q", p.GetEmail())
+	}
+
+	_, err = client.Query(reader, &personpb.QueryRequest{Email: "john.doe@example.com"})
+	expectCode(t, err, codes.PermissionDenied)
+	_, err = client.Delete(reader, &personpb.DeleteRequest{Id: 1})
+	expectCode(t, err, codes.PermissionDenied)
+
+	if p, err = client.Get(admin, &personpb.GetRequest{Id: 1}); err != nil || p.GetEmail() == auth.RedactedEmail {
+		t.Errorf("expected admin to see the email, got %v, %v", p, err)
+	}
+	if _, err := client.Delete(admin, &personpb.DeleteRequest{Id: 1}); err != nil {
+		t.Errorf("expected admin to delete, got %v", err)
+	}
+}
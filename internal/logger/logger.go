@@ -2,6 +2,7 @@ package logger
 
 import (
 	"github.com/sirupsen/logrus"
+	"go.opentelemetry.io/otel/trace"
 )
 
 var Logger = logrus.New()
@@ -9,4 +10,24 @@ var Logger = logrus.New()
 func init() {
 	Logger.SetFormatter(&logrus.JSONFormatter{})
 	Logger.SetLevel(logrus.InfoLevel)
+	Logger.AddHook(traceHook{})
+}
+
+// traceHook adds the trace and span IDs of the span in an entry's context, so Logger.WithContext(ctx) lines
+// can be found from a trace
+type traceHook struct{}
+
+func (traceHook) Levels() []logrus.Level {
+	return logrus.AllLevels
+}
+
+func (traceHook) Fire(e *logrus.Entry) error {
+	if e.Context == nil {
+		return nil
+	}
+	if sc := trace.SpanContextFromContext(e.Context); sc.IsValid() {
+		e.Data["trace_id"] = sc.TraceID().String()
+		e.Data["span_id"] = sc.SpanID().String()
+	}
+	return nil
 }
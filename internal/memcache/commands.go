@@ -0,0 +1,387 @@
+package memcache
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"gocache/internal/auth"
+	"gocache/internal/logger"
+	"gocache/pkg/model"
+	"io"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// keyPrefix namespaces person keys, person 42 is stored under person:42
+const keyPrefix = "person:"
+
+const (
+	maxKeyLen  = 250
+	maxLineLen = 2048
+	maxValue   = 1 << 20
+
+	// relativeExptimeLimit is memcached's cut-off, larger exptimes are absolute unix timestamps
+	relativeExptimeLimit = 60 * 60 * 24 * 30
+)
+
+// errClient is a malformed request, reported to the client as CLIENT_ERROR
+var errClient = errors.New("CLIENT_ERROR")
+
+// commandRoles is the role each command requires, commands missing here need none
+var commandRoles = map[string]string{
+	"get":     auth.RoleRead,
+	"gets":    auth.RoleRead,
+	"set":     auth.RoleWrite,
+	"add":     auth.RoleWrite,
+	"replace": auth.RoleWrite,
+	"cas":     auth.RoleWrite,
+	"delete":  auth.RoleWrite,
+	"touch":   auth.RoleWrite,
+}
+
+// handle reads and runs one command, reporting whether the client asked to quit.
+// Only connection errors are returned, command failures are written to the client.
+func (s *Server) handle(sess *session, r *bufio.Reader, w *bufio.Writer) (bool, error) {
+	line, err := r.ReadSlice('\n')
+	if errors.Is(err, bufio.ErrBufferFull) || len(line) > maxLineLen {
+		w.WriteString("CLIENT_ERROR line too long\r\n")
+		return true, nil
+	}
+	if err != nil {
+		return false, err
+	}
+
+	fields := strings.Fields(string(line))
+	if len(fields) == 0 {
+		w.WriteString("ERROR\r\n")
+		return false, nil
+	}
+
+	if s.authn != nil && !sess.authenticated() {
+		switch fields[0] {
+		case "set":
+			return false, s.authenticate(sess, r, w, fields[1:])
+		case "quit":
+			return true, nil
+		default:
+			// The command may be followed by a data block we'd misread as commands, so the connection is closed
+			w.WriteString("CLIENT_ERROR unauthenticated\r\n")
+			return true, nil
+		}
+	}
+
+	switch cmd := fields[0]; cmd {
+	case "get", "gets":
+		s.get(sess, w, fields[1:], cmd == "gets")
+	case "set", "add", "replace", "cas":
+		return false, s.store(sess, r, w, cmd, fields[1:])
+	case "delete":
+		s.delete(sess, w, fields[1:])
+	case "touch":
+		s.touch(sess, w, fields[1:])
+	case "version":
+		w.WriteString("VERSION gocache-1.0.0\r\n")
+	case "quit":
+		return true, nil
+	default:
+		w.WriteString("ERROR\r\n")
+	}
+
+	return false, nil
+}
+
+// get writes a VALUE block for each key that holds a person, gets adds the version as the cas unique
+func (s *Server) get(sess *session, w *bufio.Writer, keys []string, withCAS bool) {
+	if len(keys) == 0 {
+		w.WriteString("ERROR\r\n")
+		return
+	}
+	if err := authorize(sess, "get"); err != nil {
+		w.WriteString(errorReply(err) + "\r\n")
+		return
+	}
+
+	for _, key := range keys {
+		p, ok := s.lookup(sess.ctx, key)
+		if !ok {
+			continue
+		}
+		p = s.mask.Person(sess.ctx, p)
+
+		data, _ := json.Marshal(p)
+		if withCAS {
+			fmt.Fprintf(w, "VALUE %s 0 %d %d\r\n", key, len(data), p.Version)
+		} else {
+			fmt.Fprintf(w, "VALUE %s 0 %d\r\n", key, len(data))
+		}
+		w.Write(data)
+		w.WriteString("\r\n")
+	}
+	w.WriteString("END\r\n")
+}
+
+// store handles set, add, replace and cas:
+//
+//	<cmd> <key> <flags> <exptime> <bytes> [<cas unique>] [noreply]\r\n<data>\r\n
+//
+// Flags aren't stored, values always come back with flags 0
+func (s *Server) store(sess *session, r *bufio.Reader, w *bufio.Writer, cmd string, args []string) error {
+	want := 4
+	if cmd == "cas" {
+		want = 5
+	}
+	if len(args) < want || len(args) > want+1 {
+		w.WriteString("ERROR\r\n")
+		return nil
+	}
+	noreply := len(args) == want+1 && args[want] == "noreply"
+
+	data, err := readData(r, w, args[3])
+	if data == nil {
+		return err
+	}
+
+	reply, err := "", authorize(sess, cmd)
+	if err == nil {
+		reply, err = s.storePerson(sess, cmd, args, data)
+	}
+	if err != nil {
+		reply = errorReply(err)
+	}
+	if !noreply {
+		w.WriteString(reply + "\r\n")
+	}
+	return nil
+}
+
+func (s *Server) storePerson(sess *session, cmd string, args []string, data []byte) (string, error) {
+	id, ok := parseKey(args[0])
+	if !ok {
+		return "", fmt.Errorf("%w only %s<id> keys are supported", errClient, keyPrefix)
+	}
+	if _, err := strconv.ParseUint(args[1], 10, 32); err != nil {
+		return "", fmt.Errorf("%w bad command line format", errClient)
+	}
+	ttl, expires, err := parseExptime(args[2])
+	if err != nil {
+		return "", err
+	}
+
+	var p model.Person
+	if err := json.Unmarshal(data, &p); err != nil {
+		return "", fmt.Errorf("%w value is not a valid person: %v", errClient, err)
+	}
+	if p.ID != 0 && p.ID != id {
+		return "", fmt.Errorf("%w person id %d doesn't match key %s", errClient, p.ID, args[0])
+	}
+	p.ID = id
+
+	current, exists := s.lookup(sess.ctx, args[0])
+	switch cmd {
+	case "add":
+		if exists {
+			return "NOT_STORED", nil
+		}
+	case "replace":
+		if !exists {
+			return "NOT_STORED", nil
+		}
+	case "cas":
+		if !exists {
+			return "NOT_FOUND", nil
+		}
+		version, err := strconv.ParseInt(args[4], 10, 64)
+		if err != nil {
+			return "", fmt.Errorf("%w bad command line format", errClient)
+		}
+		current.Version = version
+	}
+
+	if exists {
+		// set and replace are last-write-wins, cas carries the version the client read
+		p.Version = current.Version
+		_, err = s.pc.UpdatePerson(sess.ctx, p)
+	} else {
+		p.Version = 0
+		_, err = s.pc.ApplyBatch(sess.ctx, []model.WriteOp{{Op: model.OpInsert, Person: p}})
+	}
+	if errors.Is(err, model.ErrConflict) {
+		return "EXISTS", nil
+	}
+	if errors.Is(err, model.ErrAlreadyExists) {
+		return "NOT_STORED", nil
+	}
+	if err != nil {
+		return "", err
+	}
+
+	// Storing replaces the item, including its expiry, which like any TTL only evicts the person from the cache
+	if expires {
+		s.expires.Set(id, ttl)
+	} else {
+		s.expires.Clear(id)
+	}
+	return "STORED", nil
+}
+
+// delete handles: delete <key> [noreply]
+func (s *Server) delete(sess *session, w *bufio.Writer, args []string) {
+	if len(args) < 1 || len(args) > 2 {
+		w.WriteString("ERROR\r\n")
+		return
+	}
+	noreply := len(args) == 2 && args[1] == "noreply"
+
+	reply := "NOT_FOUND"
+	if err := authorize(sess, "delete"); err != nil {
+		reply = errorReply(err)
+	} else if p, ok := s.lookup(sess.ctx, args[0]); ok {
+		_, err := s.pc.ApplyBatch(sess.ctx, []model.WriteOp{{Op: model.OpDelete, ID: p.ID}})
+		switch {
+		case errors.Is(err, model.ErrNotFound):
+		case err != nil:
+			reply = errorReply(err)
+		default:
+			s.expires.Clear(p.ID)
+			reply = "DELETED"
+		}
+	}
+
+	if !noreply {
+		w.WriteString(reply + "\r\n")
+	}
+}
+
+// touch handles: touch <key> <exptime> [noreply]
+func (s *Server) touch(sess *session, w *bufio.Writer, args []string) {
+	if len(args) < 2 || len(args) > 3 {
+		w.WriteString("ERROR\r\n")
+		return
+	}
+	noreply := len(args) == 3 && args[2] == "noreply"
+
+	reply := "NOT_FOUND"
+	ttl, expires, err := parseExptime(args[1])
+	if err == nil {
+		err = authorize(sess, "touch")
+	}
+	if err != nil {
+		reply = errorReply(err)
+	} else if p, ok := s.lookup(sess.ctx, args[0]); ok {
+		if expires {
+			s.expires.Set(p.ID, ttl)
+		} else {
+			s.expires.Clear(p.ID)
+		}
+		reply = "TOUCHED"
+	}
+
+	if !noreply {
+		w.WriteString(reply + "\r\n")
+	}
+}
+
+// authorize returns a client error unless the caller has the role cmd requires
+func authorize(sess *session, cmd string) error {
+	if err := auth.Authorize(sess.ctx, commandRoles[cmd]); err != nil {
+		logger.Logger.Warnf("MEMCACHE: Rejected %s: %v", cmd, err)
+		return fmt.Errorf("%w permission denied", errClient)
+	}
+	return nil
+}
+
+// authenticate handles memcached's ASCII authentication, a set before any other command whose value is
+// "<username> <password>". Only the password is checked, it holds an API key or a JWT.
+func (s *Server) authenticate(sess *session, r *bufio.Reader, w *bufio.Writer, args []string) error {
+	if len(args) < 4 {
+		w.WriteString("ERROR\r\n")
+		return nil
+	}
+
+	data, err := readData(r, w, args[3])
+	if data == nil {
+		return err
+	}
+
+	_, password, _ := strings.Cut(string(data), " ")
+	p, err := s.authn.Authenticate(auth.SecretHeader(password))
+	if err != nil {
+		logger.Logger.Warnf("MEMCACHE: authentication failed: %v", err)
+		w.WriteString("CLIENT_ERROR authentication failure\r\n")
+		return nil
+	}
+
+	sess.ctx = auth.WithPrincipal(context.Background(), p)
+	w.WriteString("STORED\r\n")
+	return nil
+}
+
+// readData reads the data block of a storage command whose size argument is size. It has to be consumed before any
+// reply, even one rejecting the command. A nil block means the command failed and was already answered, or err is set.
+func readData(r *bufio.Reader, w *bufio.Writer, size string) ([]byte, error) {
+	n, err := strconv.Atoi(size)
+	if err != nil || n < 0 || n > maxValue {
+		w.WriteString("CLIENT_ERROR bad data chunk\r\n")
+		return nil, nil
+	}
+
+	data := make([]byte, n+2)
+	if _, err := io.ReadFull(r, data); err != nil {
+		return nil, err
+	}
+	if data[n] != '\r' || data[n+1] != '\n' {
+		w.WriteString("CLIENT_ERROR bad data chunk\r\n")
+		return nil, nil
+	}
+	return data[:n], nil
+}
+
+// lookup returns the person stored under key, keys outside the person namespace never exist
+func (s *Server) lookup(ctx context.Context, key string) (model.Person, bool) {
+	id, ok := parseKey(key)
+	if !ok {
+		return model.Person{}, false
+	}
+
+	p, err := s.pc.GetPerson(ctx, id)
+	return p, err == nil
+}
+
+func parseKey(key string) (int, bool) {
+	if len(key) > maxKeyLen || !strings.HasPrefix(key, keyPrefix) {
+		return 0, false
+	}
+
+	id, err := strconv.Atoi(key[len(keyPrefix):])
+	return id, err == nil
+}
+
+// parseExptime converts a memcached exptime into a TTL: 0 never expires, negative expires now,
+// up to 30 days is relative seconds and anything larger is an absolute unix time
+func parseExptime(v string) (time.Duration, bool, error) {
+	n, err := strconv.ParseInt(v, 10, 64)
+	if err != nil {
+		return 0, false, fmt.Errorf("%w bad command line format", errClient)
+	}
+
+	switch {
+	case n == 0:
+		return 0, false, nil
+	case n < 0:
+		return 0, true, nil
+	case n <= relativeExptimeLimit:
+		return time.Duration(n) * time.Second, true, nil
+	default:
+		return max(time.Until(time.Unix(n, 0)), 0), true, nil
+	}
+}
+
+func errorReply(err error) string {
+	if errors.Is(err, errClient) {
+		return err.Error()
+	}
+	return "SERVER_ERROR " + strings.NewReplacer("\r", " ", "\n", " ").Replace(err.Error())
+}
@@ -0,0 +1,139 @@
+// Package memcache serves the person cache over the memcached ASCII protocol, values are persons
+// encoded as JSON under person:<id> keys and every write goes through the controller
+package memcache
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"gocache/internal/auth"
+	"gocache/internal/controller"
+	"gocache/internal/expiry"
+	"gocache/internal/logger"
+	"io"
+	"net"
+	"sync"
+	"time"
+)
+
+// Server accepts memcached text protocol connections and maps their commands onto a PersonController
+type Server struct {
+	pc      controller.PersonController
+	expires *expiry.Expirer
+	authn   auth.Authenticator
+	mask    auth.Mask
+
+	mu       sync.Mutex
+	listener net.Listener
+	conns    map[net.Conn]struct{}
+	closed   bool
+	wg       sync.WaitGroup
+}
+
+// NewServer creates a memcached server backed by pc, whose exptimes are tracked by expires. Connections must
+// authenticate with authn before any other command unless it's nil, and see persons through mask.
+func NewServer(pc controller.PersonController, expires *expiry.Expirer, authn auth.Authenticator, mask auth.Mask) *Server {
+	return &Server{
+		pc:      pc,
+		expires: expires,
+		authn:   authn,
+		mask:    mask,
+		conns:   make(map[net.Conn]struct{}),
+	}
+}
+
+// Serve accepts connections on l until Close is called, it always returns a non-nil error
+func (s *Server) Serve(l net.Listener) error {
+	s.mu.Lock()
+	if s.closed {
+		s.mu.Unlock()
+		l.Close()
+		return net.ErrClosed
+	}
+	s.listener = l
+	s.mu.Unlock()
+
+	logger.Logger.Infof("MEMCACHE: listening on %v", l.Addr())
+
+	for {
+		conn, err := l.Accept()
+		if err != nil {
+			return err
+		}
+
+		s.mu.Lock()
+		if s.closed {
+			s.mu.Unlock()
+			conn.Close()
+			return net.ErrClosed
+		}
+		s.conns[conn] = struct{}{}
+		s.wg.Add(1)
+		s.mu.Unlock()
+
+		go s.serveConn(conn)
+	}
+}
+
+// Close stops accepting connections and closes open ones, the expirer is left to its owner
+func (s *Server) Close() error {
+	s.mu.Lock()
+	s.closed = true
+	var err error
+	if s.listener != nil {
+		err = s.listener.Close()
+	}
+	for conn := range s.conns {
+		conn.Close()
+	}
+	s.mu.Unlock()
+
+	s.wg.Wait()
+	return err
+}
+
+// session is the per-connection state
+type session struct {
+	// ctx carries the caller once the connection has authenticated
+	ctx context.Context
+}
+
+func (sess *session) authenticated() bool {
+	_, ok := auth.FromContext(sess.ctx)
+	return ok
+}
+
+func (s *Server) serveConn(conn net.Conn) {
+	defer func() {
+		conn.Close()
+		s.mu.Lock()
+		delete(s.conns, conn)
+		s.mu.Unlock()
+		s.wg.Done()
+	}()
+
+	r := bufio.NewReader(conn)
+	w := bufio.NewWriter(conn)
+	sess := &session{ctx: context.Background()}
+
+	for {
+		quit, err := s.handle(sess, r, w)
+		if err != nil {
+			if !errors.Is(err, io.EOF) && !errors.Is(err, net.ErrClosed) {
+				logger.Logger.Warnf("MEMCACHE: Error reading from %v: %v", conn.RemoteAddr(), err)
+			}
+			return
+		}
+
+		// Flush once the pipeline is drained rather than after every reply
+		if r.Buffered() == 0 || quit {
+			conn.SetWriteDeadline(time.Now().Add(10 * time.Second))
+			if err := w.Flush(); err != nil {
+				return
+			}
+		}
+		if quit {
+			return
+		}
+	}
+}
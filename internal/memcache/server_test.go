@@ -0,0 +1,276 @@
+package memcache
+
+import (
+	"bufio"
+	"context"
+	"fmt"
+	"gocache/internal/auth"
+	"gocache/internal/controller"
+	"gocache/internal/datasource"
+	"gocache/internal/expiry"
+	"net"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+// client is a minimal memcached text protocol client
+type client struct {
+	conn net.Conn
+	r    *bufio.Reader
+}
+
+func newTestServer(t *testing.T) (*client, controller.PersonController) {
+	t.Helper()
+	return newAuthServer(t, nil, auth.Mask{})
+}
+
+// newAuthServer starts a server whose connections must authenticate with authn and see persons through mask
+func newAuthServer(t *testing.T, authn auth.Authenticator, mask auth.Mask) (*client, controller.PersonController) {
+	t.Helper()
+	return newSourceServer(t, datasource.NewMockDataSource(), authn, mask)
+}
+
+// newSourceServer starts a server like newAuthServer that caches persons from db
+func newSourceServer(t *testing.T, db datasource.DataSource, authn auth.Authenticator, mask auth.Mask) (*client, controller.PersonController) {
+	t.Helper()
+
+	pc, err := controller.NewPersonController(db)
+	if err != nil {
+		t.Fatalf("NewPersonController() error: %v", err)
+	}
+
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("failed to listen: %v", err)
+	}
+
+	expires := expiry.NewExpirer(pc)
+	s := NewServer(pc, expires, authn, mask)
+	go s.Serve(l)
+
+	conn, err := net.Dial("tcp", l.Addr().String())
+	if err != nil {
+		t.Fatalf("failed to dial: %v", err)
+	}
+	conn.SetDeadline(time.Now().Add(5 * time.Second))
+
+	t.Cleanup(func() {
+		conn.Close()
+		s.Close()
+		expires.Stop()
+	})
+
+	return &client{conn: conn, r: bufio.NewReader(conn)}, pc
+}
+
+// do sends raw and reads reply lines up to and including the first terminal line
+func (c *client) do(t *testing.T, raw string) []string {
+	t.Helper()
+
+	c.conn.Write([]byte(raw))
+
+	var lines []string
+	for {
+		line, err := c.r.ReadString('\n')
+		if err != nil {
+			t.Fatalf("%q: failed to read reply: %v", raw, err)
+		}
+		line = strings.TrimSuffix(line, "\r\n")
+		lines = append(lines, line)
+
+		if !strings.HasPrefix(line, "VALUE ") && !strings.HasPrefix(line, "{") {
+			return lines
+		}
+	}
+}
+
+// storage builds a storage command for value, suffix holds what follows the byte count (cas unique, noreply)
+func storage(cmd, value, suffix string) string {
+	if suffix != "" {
+		suffix = " " + suffix
+	}
+	return fmt.Sprintf("%s %d%s\r\n%s\r\n", cmd, len(value), suffix, value)
+}
+
+func expect(t *testing.T, got []string, want ...string) {
+	t.Helper()
+	if strings.Join(got, "|") != strings.Join(want, "|") {
+		t.Errorf("expected %q, got %q", want, got)
+	}
+}
+
+func TestGet(t *testing.T) {
+	c, _ := newTestServer(t)
+
+	john := `{"id":1,"name":"John Doe","age":30,"email":"john.doe@example.com","version":0}`
+	expect(t, c.do(t, "get person:1 person:9 other\r\n"), "VALUE person:1 0 78", john, "END")
+	expect(t, c.do(t, "gets person:1\r\n"), "VALUE person:1 0 78 0", john, "END")
+	expect(t, c.do(t, "version\r\n"), "VERSION gocache-1.0.0")
+	expect(t, c.do(t, "bogus\r\n"), "ERROR")
+}
+
+func TestStorageCommands(t *testing.T) {
+	c, pc := newTestServer(t)
+
+	value := `{"name":"John Smith","age":31,"email":"john@example.com"}`
+	expect(t, c.do(t, storage("set person:1 0 0", value, "")), "STORED")
+	if p, _ := pc.GetPerson(context.Background(), 1); p.Name != "John Smith" || p.Version != 1 {
+		t.Errorf("expected the set to go through the controller, got %+v", p)
+	}
+
+	expect(t, c.do(t, storage("add person:1 0 0", value, "")), "NOT_STORED")
+	expect(t, c.do(t, storage("replace person:7 0 0", value, "")), "NOT_STORED")
+	expect(t, c.do(t, storage("add person:7 0 0", value, "")), "STORED")
+	expect(t, c.do(t, storage("replace person:7 0 0", value, "")), "STORED")
+
+	if p, _ := pc.GetPerson(context.Background(), 7); p.Name != "John Smith" || p.Version != 1 {
+		t.Errorf("expected person 7 to be added then replaced, got %+v", p)
+	}
+
+	// noreply suppresses the response, the next command's reply comes straight back
+	c.conn.Write([]byte(storage("set person:2 0 0", value, "noreply")))
+	expect(t, c.do(t, "delete person:2\r\n"), "DELETED")
+	expect(t, c.do(t, "delete person:2\r\n"), "NOT_FOUND")
+
+	for _, raw := range []string{"set person:3 0 0 5\r\nhello\r\n", "set other 0 0 2\r\n{}\r\n"} {
+		if reply := c.do(t, raw); !strings.HasPrefix(reply[0], "CLIENT_ERROR") {
+			t.Errorf("%q: expected a client error, got %q", raw, reply)
+		}
+	}
+	expect(t, c.do(t, "set person:3 0 0 2\r\n{}xx\r\n"), "CLIENT_ERROR bad data chunk")
+}
+
+func TestCAS(t *testing.T) {
+	c, pc := newTestServer(t)
+
+	value := `{"name":"Jane Doe","age":26,"email":"jane@example.com"}`
+	expect(t, c.do(t, storage("cas person:9 0 0", value, "0")), "NOT_FOUND")
+	expect(t, c.do(t, storage("cas person:2 0 0", value, "3")), "EXISTS")
+	expect(t, c.do(t, storage("cas person:2 0 0", value, "0")), "STORED")
+	expect(t, c.do(t, storage("cas person:2 0 0", value, "0")), "EXISTS")
+
+	if p, _ := pc.GetPerson(context.Background(), 2); p.Name != "Jane Doe" || p.Version != 1 {
+		t.Errorf("expected a single successful cas, got %+v", p)
+	}
+}
+
+func TestExptime(t *testing.T) {
+	c, pc := newTestServer(t)
+
+	expect(t, c.do(t, "touch person:9 10\r\n"), "NOT_FOUND")
+	expect(t, c.do(t, "touch person:1 1000\r\n"), "TOUCHED")
+
+	value := `{"name":"Jane Smith","age":25,"email":"jane@example.com"}`
+	expect(t, c.do(t, storage("set person:2 0 1", value, "")), "STORED")
+
+	// Storing without an exptime clears the one set by touch
+	expect(t, c.do(t, storage("set person:1 0 0", value, "")), "STORED")
+
+	deadline := time.Now().Add(3 * time.Second)
+	for {
+		if _, err := pc.GetPerson(context.Background(), 2); err != nil {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatal("expected person 2 to expire")
+		}
+		time.Sleep(20 * time.Millisecond)
+	}
+
+	expect(t, c.do(t, "get person:2\r\n"), "END")
+	if _, err := pc.GetPerson(context.Background(), 1); err != nil {
+		t.Error("expected person 1 to have no expiry")
+	}
+}
+
+func TestExptimeKeepsDataSource(t *testing.T) {
+	db := datasource.NewMockDataSource()
+	c, pc := newSourceServer(t, db, nil, auth.Mask{})
+
+	// A negative exptime expires the item at once, which only evicts it from the cache
+	value := `{"name":"Jane Smith","age":25,"email":"jane@example.com"}`
+	expect(t, c.do(t, storage("set person:2 0 -1", value, "")), "STORED")
+
+	deadline := time.Now().Add(3 * time.Second)
+	for {
+		if _, err := pc.GetPerson(context.Background(), 2); err != nil {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatal("expected person 2 to expire")
+		}
+		time.Sleep(20 * time.Millisecond)
+	}
+
+	if p, err := db.GetPerson(context.Background(), 2); err != nil || p.Name != "Jane Smith" {
+		t.Errorf("expected the data source to keep the stored person, got %+v, %v", p, err)
+	}
+}
+
+func TestAuth(t *testing.T) {
+	authn := auth.NewAPIKeys(map[string]auth.Principal{"key-1": {ID: "ci", Roles: []string{auth.RoleRead}}})
+
+	c, _ := newAuthServer(t, authn, auth.Mask{})
+	expect(t, c.do(t, storage("set auth 0 0", "user key-2", "")), "CLIENT_ERROR authentication failure")
+	expect(t, c.do(t, storage("set auth 0 0", "user key-1", "")), "STORED")
+	expect(t, c.do(t, "gets person:9\r\n"), "END")
+
+	// Any other command before authenticating is refused and ends the connection
+	c, _ = newAuthServer(t, authn, auth.Mask{})
+	expect(t, c.do(t, "get person:1\r\n"), "CLIENT_ERROR unauthenticated")
+	if _, err := c.r.ReadString('\n'); err == nil {
+		t.Error("expected the connection to be closed")
+	}
+}
+
+func TestRolesAndMask(t *testing.T) {
+	authn := auth.NewAPIKeys(map[string]auth.Principal{
+		"reader": {ID: "reader", Roles: []string{auth.RoleRead}},
+		"admin":  {ID: "admin", Roles: []string{auth.RoleAdmin}},
+	})
+
+	c, _ := newAuthServer(t, authn, auth.Mask{PII: true})
+	expect(t, c.do(t, storage("set auth 0 0", "user reader", "")), "STORED")
+	masked := `{"id":1,"name":"John Doe","age":30,"email":"[redacted]","version":0}`
+	expect(t, c.do(t, "get person:1\r\n"), "VALUE person:1 0 68", masked, "END")
+
+	value := `{"name":"John Smith","age":31,"email":"john@example.com"}`
+	expect(t, c.do(t, storage("set person:1 0 0", value, "")), "CLIENT_ERROR permission denied")
+	expect(t, c.do(t, "delete person:1\r\n"), "CLIENT_ERROR permission denied")
+	expect(t, c.do(t, "touch person:1 10\r\n"), "CLIENT_ERROR permission denied")
+
+	c, pc := newAuthServer(t, authn, auth.Mask{PII: true})
+	expect(t, c.do(t, storage("set auth 0 0", "user admin", "")), "STORED")
+	expect(t, c.do(t, storage("set person:1 0 0", value, "")), "STORED")
+	if p, _ := pc.GetPerson(context.Background(), 1); p.Name != "John Smith" {
+		t.Errorf("expected the admin's set to go through, got %+v", p)
+	}
+}
+
+func TestParseExptime(t *testing.T) {
+	cases := map[string]struct {
+		ttl     time.Duration
+		expires bool
+	}{
+		"0":     {0, false},
+		"-1":    {0, true},
+		"60":    {time.Minute, true},
+		"10000": {10000 * time.Second, true},
+		"1":     {time.Second, true},
+	}
+
+	for v, want := range cases {
+		ttl, expires, err := parseExptime(v)
+		if err != nil || ttl != want.ttl || expires != want.expires {
+			t.Errorf("%s: expected %v/%v, got %v/%v/%v", v, want.ttl, want.expires, ttl, expires, err)
+		}
+	}
+
+	// Past the 30 day limit the value is an absolute unix time
+	abs := strconv.FormatInt(time.Now().Add(time.Hour).Unix(), 10)
+	if ttl, _, _ := parseExptime(abs); ttl < 59*time.Minute || ttl > time.Hour {
+		t.Errorf("expected about an hour for an absolute exptime, got %v", ttl)
+	}
+}
@@ -0,0 +1,154 @@
+// Package metrics defines the Prometheus metrics of the cache. Every layer records into the collectors
+// declared here, and NewRegistry gathers them for the /metrics endpoint.
+package metrics
+
+import (
+	"gocache/pkg/store"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/collectors"
+)
+
+const namespace = "gocache"
+
+// Results of a cache lookup
+const (
+	Hit  = "hit"
+	Miss = "miss"
+)
+
+var (
+	// HTTPRequests counts finished HTTP requests by method, route and status
+	HTTPRequests = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "http_requests_total",
+		Help:      "HTTP requests by method, route and status code.",
+	}, []string{"method", "route", "status"})
+
+	// HTTPDuration observes how long HTTP requests take, watch feeds included
+	HTTPDuration = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Namespace: namespace,
+		Name:      "http_request_duration_seconds",
+		Help:      "HTTP request latency by method, route and status code.",
+		Buckets:   prometheus.DefBuckets,
+	}, []string{"method", "route", "status"})
+
+	// CacheLookups counts lookups of a single person by whether the store held it
+	CacheLookups = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "cache_lookups_total",
+		Help:      "Lookups of a person by id, by result (hit or miss).",
+	}, []string{"result"})
+
+	// DataSourceDuration observes the latency of data source calls by method
+	DataSourceDuration = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Namespace: namespace,
+		Name:      "datasource_call_duration_seconds",
+		Help:      "Data source call latency by method.",
+		Buckets:   prometheus.DefBuckets,
+	}, []string{"op"})
+
+	// DataSourceErrors counts failed data source calls by method, rejected writes such as conflicts aren't failures
+	DataSourceErrors = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "datasource_errors_total",
+		Help:      "Failed data source calls by method.",
+	}, []string{"op"})
+
+	// WarmupPersons counts the persons loaded at startup by phase: full, snapshot, wal, changed and deleted
+	WarmupPersons = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "warmup_persons_total",
+		Help:      "Persons loaded into the store at startup, by phase.",
+	}, []string{"phase"})
+
+	// WarmupDuration is how long the last warm-up took
+	WarmupDuration = prometheus.NewGauge(prometheus.GaugeOpts{
+		Namespace: namespace,
+		Name:      "warmup_duration_seconds",
+		Help:      "How long loading the store took at startup.",
+	})
+
+	// WriteBehindFlushed counts the queued writes that reached the data source
+	WriteBehindFlushed = prometheus.NewCounter(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "write_behind_flushed_total",
+		Help:      "Queued writes flushed to the data source in write-behind mode.",
+	})
+
+	// WriteBehindFailures counts flushes that gave up after every retry
+	WriteBehindFailures = prometheus.NewCounter(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "write_behind_flush_failures_total",
+		Help:      "Write-behind flushes that failed after every retry.",
+	})
+
+	// WriteBehindDeadLettered counts the queued writes moved to the dead-letter file after the data source rejected them
+	WriteBehindDeadLettered = prometheus.NewCounter(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "write_behind_dead_lettered_total",
+		Help:      "Queued writes the data source kept rejecting, moved to the dead-letter file.",
+	})
+
+	// WriteBehindLastFlush is when the write queue was last emptied into the data source
+	WriteBehindLastFlush = prometheus.NewGauge(prometheus.GaugeOpts{
+		Namespace: namespace,
+		Name:      "write_behind_last_flush_timestamp_seconds",
+		Help:      "Unix time the write queue was last fully flushed to the data source.",
+	})
+)
+
+// NewRegistry returns a registry gathering every metric of this package, the Go runtime and process metrics,
+// plus the given collectors
+func NewRegistry(extra ...prometheus.Collector) *prometheus.Registry {
+	r := prometheus.NewRegistry()
+	r.MustRegister(
+		collectors.NewGoCollector(),
+		collectors.NewProcessCollector(collectors.ProcessCollectorOpts{}),
+		HTTPRequests,
+		HTTPDuration,
+		CacheLookups,
+		DataSourceDuration,
+		DataSourceErrors,
+		WarmupPersons,
+		WarmupDuration,
+		WriteBehindFlushed,
+		WriteBehindFailures,
+		WriteBehindDeadLettered,
+		WriteBehindLastFlush,
+	)
+	r.MustRegister(extra...)
+	return r
+}
+
+var (
+	storePersonsDesc = prometheus.NewDesc(namespace+"_store_persons", "Persons held by the store.", nil, nil)
+	indexKeysDesc    = prometheus.NewDesc(namespace+"_store_index_keys", "Distinct keys of each store index.", []string{"index"}, nil)
+	queueDepthDesc   = prometheus.NewDesc(namespace+"_write_queue_depth", "Writes waiting to reach the data source in write-behind mode.", nil, nil)
+)
+
+// storeCollector reads the size of the store and the write queue whenever metrics are gathered
+type storeCollector struct {
+	stats      func() store.Stats
+	queueDepth func() int
+}
+
+// NewStoreCollector reports the store, its indexes and the write queue through the given functions
+func NewStoreCollector(stats func() store.Stats, queueDepth func() int) prometheus.Collector {
+	return &storeCollector{stats: stats, queueDepth: queueDepth}
+}
+
+func (c *storeCollector) Describe(ch chan<- *prometheus.Desc) {
+	ch <- storePersonsDesc
+	ch <- indexKeysDesc
+	ch <- queueDepthDesc
+}
+
+func (c *storeCollector) Collect(ch chan<- prometheus.Metric) {
+	stats := c.stats()
+	ch <- prometheus.MustNewConstMetric(storePersonsDesc, prometheus.GaugeValue, float64(stats.Persons))
+	for index, keys := range stats.Indexes {
+		ch <- prometheus.MustNewConstMetric(indexKeysDesc, prometheus.GaugeValue, float64(keys), index)
+	}
+	ch <- prometheus.MustNewConstMetric(queueDepthDesc, prometheus.GaugeValue, float64(c.queueDepth()))
+}
@@ -0,0 +1,234 @@
+package queue
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"gocache/internal/logger"
+	"gocache/pkg/model"
+	"os"
+	"path/filepath"
+	"sync"
+)
+
+// deadLetterSuffix names the dead-letter file after the queue file
+const deadLetterSuffix = ".dead"
+
+// WriteQueue is a durable FIFO queue of pending person writes backed by an NDJSON file.
+// Every enqueued write is fsynced before Enqueue returns so acknowledged writes survive a crash.
+type WriteQueue struct {
+	mu      sync.Mutex
+	path    string
+	file    *os.File
+	pending []model.Person
+}
+
+// NewWriteQueue opens the queue file at path, creating it if needed, and loads any pending writes
+func NewWriteQueue(path string) (*WriteQueue, error) {
+	if err := os.MkdirAll(filepath.Dir(path), 0o755); err != nil {
+		return nil, fmt.Errorf("error creating queue directory: %w", err)
+	}
+
+	pending, err := load(path)
+	if err != nil {
+		return nil, err
+	}
+
+	file, err := os.OpenFile(path, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0o644)
+	if err != nil {
+		return nil, fmt.Errorf("error opening queue file: %w", err)
+	}
+
+	q := &WriteQueue{
+		path:    path,
+		file:    file,
+		pending: pending,
+	}
+
+	// Rewrite the loaded entries so a torn tail can't corrupt the next append
+	if err := q.rewrite(pending); err != nil {
+		file.Close()
+		return nil, err
+	}
+
+	logger.Logger.Infof("QUEUE: opened %v with %v pending writes", path, len(pending))
+
+	return q, nil
+}
+
+// Enqueue durably appends a write to the end of the queue
+func (q *WriteQueue) Enqueue(p model.Person) error {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	line, err := json.Marshal(p)
+	if err != nil {
+		return fmt.Errorf("error encoding queued write: %w", err)
+	}
+
+	if _, err := q.file.Write(append(line, '\n')); err != nil {
+		return fmt.Errorf("error appending to queue file: %w", err)
+	}
+
+	if err := q.file.Sync(); err != nil {
+		return fmt.Errorf("error syncing queue file: %w", err)
+	}
+
+	q.pending = append(q.pending, p)
+	return nil
+}
+
+// Peek returns up to n writes from the head of the queue without removing them
+func (q *WriteQueue) Peek(n int) []model.Person {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	if n > len(q.pending) {
+		n = len(q.pending)
+	}
+
+	batch := make([]model.Person, n)
+	copy(batch, q.pending[:n])
+	return batch
+}
+
+// Ack removes the first n writes from the queue once they have been persisted downstream
+func (q *WriteQueue) Ack(n int) error {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	if n > len(q.pending) {
+		n = len(q.pending)
+	}
+
+	remaining := make([]model.Person, len(q.pending)-n)
+	copy(remaining, q.pending[n:])
+
+	if err := q.rewrite(remaining); err != nil {
+		return err
+	}
+
+	q.pending = remaining
+	return nil
+}
+
+// DeadLetter durably appends writes the data source keeps rejecting to the dead-letter file next to the queue file,
+// named after it with a .dead suffix, where they can be inspected and replayed
+func (q *WriteQueue) DeadLetter(persons []model.Person) error {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	file, err := os.OpenFile(q.path+deadLetterSuffix, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0o644)
+	if err != nil {
+		return fmt.Errorf("error opening dead-letter file: %w", err)
+	}
+	defer file.Close()
+
+	enc := json.NewEncoder(file)
+	for _, p := range persons {
+		if err := enc.Encode(p); err != nil {
+			return fmt.Errorf("error appending to dead-letter file: %w", err)
+		}
+	}
+
+	if err := file.Sync(); err != nil {
+		return fmt.Errorf("error syncing dead-letter file: %w", err)
+	}
+	return nil
+}
+
+// Depth returns the number of writes waiting to be flushed
+func (q *WriteQueue) Depth() int {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	return len(q.pending)
+}
+
+// Close closes the underlying queue file, pending writes stay on disk
+func (q *WriteQueue) Close() error {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	return q.file.Close()
+}
+
+// rewrite atomically replaces the queue file with the given writes, callers must hold q.mu
+func (q *WriteQueue) rewrite(persons []model.Person) error {
+	tmp, err := os.CreateTemp(filepath.Dir(q.path), filepath.Base(q.path)+".tmp-*")
+	if err != nil {
+		return fmt.Errorf("error creating temporary queue file: %w", err)
+	}
+	defer os.Remove(tmp.Name())
+
+	w := bufio.NewWriter(tmp)
+	enc := json.NewEncoder(w)
+	for _, p := range persons {
+		if err := enc.Encode(p); err != nil {
+			tmp.Close()
+			return fmt.Errorf("error encoding queued write: %w", err)
+		}
+	}
+
+	if err := w.Flush(); err != nil {
+		tmp.Close()
+		return fmt.Errorf("error writing temporary queue file: %w", err)
+	}
+
+	if err := tmp.Sync(); err != nil {
+		tmp.Close()
+		return fmt.Errorf("error syncing temporary queue file: %w", err)
+	}
+
+	if err := tmp.Close(); err != nil {
+		return fmt.Errorf("error closing temporary queue file: %w", err)
+	}
+
+	if err := os.Rename(tmp.Name(), q.path); err != nil {
+		return fmt.Errorf("error replacing queue file: %w", err)
+	}
+
+	file, err := os.OpenFile(q.path, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0o644)
+	if err != nil {
+		return fmt.Errorf("error reopening queue file: %w", err)
+	}
+
+	q.file.Close()
+	q.file = file
+	return nil
+}
+
+// load reads every complete write from the queue file, a torn final line from a crash is dropped
+func load(path string) ([]model.Person, error) {
+	pending := make([]model.Person, 0)
+
+	file, err := os.Open(path)
+	if os.IsNotExist(err) {
+		return pending, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("error opening queue file: %w", err)
+	}
+	defer file.Close()
+
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		line := scanner.Bytes()
+		if len(line) == 0 {
+			continue
+		}
+
+		var p model.Person
+		if err := json.Unmarshal(line, &p); err != nil {
+			logger.Logger.Warnf("QUEUE: skipping unreadable entry in %v: %v", path, err)
+			continue
+		}
+		pending = append(pending, p)
+	}
+
+	if err := scanner.Err(); err != nil {
+		return nil, fmt.Errorf("error reading queue file: %w", err)
+	}
+
+	return pending, nil
+}
@@ -0,0 +1,166 @@
+package queue
+
+import (
+	"gocache/pkg/model"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestEnqueueAndPeek(t *testing.T) {
+	q, err := NewWriteQueue(filepath.Join(t.TempDir(), "queue.ndjson"))
+	if err != nil {
+		t.Fatalf("NewWriteQueue() error: %v", err)
+	}
+	defer q.Close()
+
+	persons := []model.Person{
+		{ID: 1, Name: "John Doe", Email: "john@example.com", Age: 30},
+		{ID: 2, Name: "Jane Smith", Email: "jane@example.com", Age: 25},
+	}
+	for _, p := range persons {
+		if err := q.Enqueue(p); err != nil {
+			t.Fatalf("Enqueue() error: %v", err)
+		}
+	}
+
+	if q.Depth() != 2 {
+		t.Fatalf("expected depth 2, got %d", q.Depth())
+	}
+
+	batch := q.Peek(10)
+	if len(batch) != 2 || batch[0] != persons[0] || batch[1] != persons[1] {
+		t.Errorf("expected %+v, got %+v", persons, batch)
+	}
+
+	if q.Depth() != 2 {
+		t.Errorf("expected Peek() to leave depth at 2, got %d", q.Depth())
+	}
+}
+
+func TestAck(t *testing.T) {
+	q, err := NewWriteQueue(filepath.Join(t.TempDir(), "queue.ndjson"))
+	if err != nil {
+		t.Fatalf("NewWriteQueue() error: %v", err)
+	}
+	defer q.Close()
+
+	for i := 1; i <= 3; i++ {
+		if err := q.Enqueue(model.Person{ID: i}); err != nil {
+			t.Fatalf("Enqueue() error: %v", err)
+		}
+	}
+
+	if err := q.Ack(2); err != nil {
+		t.Fatalf("Ack() error: %v", err)
+	}
+
+	batch := q.Peek(10)
+	if len(batch) != 1 || batch[0].ID != 3 {
+		t.Errorf("expected only person 3 to remain, got %+v", batch)
+	}
+
+	// Writes enqueued after an ack must land in the rewritten file
+	if err := q.Enqueue(model.Person{ID: 4}); err != nil {
+		t.Fatalf("Enqueue() error: %v", err)
+	}
+
+	if q.Depth() != 2 {
+		t.Errorf("expected depth 2, got %d", q.Depth())
+	}
+}
+
+func TestReopenRestoresPending(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "queue.ndjson")
+
+	q, err := NewWriteQueue(path)
+	if err != nil {
+		t.Fatalf("NewWriteQueue() error: %v", err)
+	}
+
+	for i := 1; i <= 3; i++ {
+		if err := q.Enqueue(model.Person{ID: i, Name: "John Doe"}); err != nil {
+			t.Fatalf("Enqueue() error: %v", err)
+		}
+	}
+	if err := q.Ack(1); err != nil {
+		t.Fatalf("Ack() error: %v", err)
+	}
+	if err := q.Enqueue(model.Person{ID: 4, Name: "John Doe"}); err != nil {
+		t.Fatalf("Enqueue() error: %v", err)
+	}
+	q.Close()
+
+	reopened, err := NewWriteQueue(path)
+	if err != nil {
+		t.Fatalf("NewWriteQueue() error: %v", err)
+	}
+	defer reopened.Close()
+
+	batch := reopened.Peek(10)
+	if len(batch) != 3 || batch[0].ID != 2 || batch[2].ID != 4 {
+		t.Errorf("expected persons 2, 3 and 4 after reopen, got %+v", batch)
+	}
+}
+
+func TestReopenDropsTornWrite(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "queue.ndjson")
+
+	content := `{"id":1,"name":"John Doe","age":30,"email":"john@example.com"}` + "\n" + `{"id":2,"name":"Ja`
+	if err := os.WriteFile(path, []byte(content), 0o644); err != nil {
+		t.Fatalf("failed to write queue file: %v", err)
+	}
+
+	q, err := NewWriteQueue(path)
+	if err != nil {
+		t.Fatalf("NewWriteQueue() error: %v", err)
+	}
+
+	if q.Depth() != 1 {
+		t.Errorf("expected torn write to be dropped leaving depth 1, got %d", q.Depth())
+	}
+
+	if err := q.Enqueue(model.Person{ID: 3, Name: "Alice Johnson"}); err != nil {
+		t.Fatalf("Enqueue() error: %v", err)
+	}
+	q.Close()
+
+	reopened, err := NewWriteQueue(path)
+	if err != nil {
+		t.Fatalf("NewWriteQueue() error: %v", err)
+	}
+	defer reopened.Close()
+
+	batch := reopened.Peek(10)
+	if len(batch) != 2 || batch[1].ID != 3 {
+		t.Errorf("expected persons 1 and 3 after reopen, got %+v", batch)
+	}
+}
+
+func TestDeadLetter(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "queue.ndjson")
+	q, err := NewWriteQueue(path)
+	if err != nil {
+		t.Fatalf("NewWriteQueue() error: %v", err)
+	}
+	defer q.Close()
+
+	rejected := []model.Person{{ID: 1, Name: "John Doe", Email: "john@example.com", Age: 30}}
+	if err := q.DeadLetter(rejected); err != nil {
+		t.Fatalf("DeadLetter() error: %v", err)
+	}
+	if err := q.DeadLetter(rejected); err != nil {
+		t.Fatalf("DeadLetter() error: %v", err)
+	}
+
+	dead, err := load(path + deadLetterSuffix)
+	if err != nil {
+		t.Fatalf("load() error: %v", err)
+	}
+	if len(dead) != 2 || dead[0] != rejected[0] || dead[1] != rejected[0] {
+		t.Errorf("expected both dead letters to be appended, got %+v", dead)
+	}
+	if q.Depth() != 0 {
+		t.Errorf("expected dead letters to stay out of the queue, got depth %d", q.Depth())
+	}
+}
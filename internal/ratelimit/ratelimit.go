@@ -0,0 +1,134 @@
+// Package ratelimit limits how often each client may call, using an in-memory token bucket per client
+package ratelimit
+
+import (
+	"fmt"
+	"math"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// sweepInterval is how often buckets that have refilled are dropped, a full bucket is the same as no bucket
+const sweepInterval = time.Minute
+
+// Limit allows Rate requests per second on average and bursts of up to Burst requests
+type Limit struct {
+	Rate  float64
+	Burst int
+}
+
+// ParseLimit parses a limit written as rate/unit with an optional :burst, e.g. "10/s", "600/m:50" or "1000/h".
+// The burst defaults to the rate per unit, so a limit per hour or day also works as a quota.
+func ParseLimit(s string) (Limit, error) {
+	spec, burst, hasBurst := strings.Cut(strings.TrimSpace(s), ":")
+	count, unit, ok := strings.Cut(spec, "/")
+	if !ok {
+		return Limit{}, fmt.Errorf("error parsing rate limit %q: expected rate/unit[:burst]", s)
+	}
+
+	n, err := strconv.Atoi(count)
+	if err != nil || n < 1 {
+		return Limit{}, fmt.Errorf("error parsing rate limit %q: invalid rate", s)
+	}
+	per := map[string]time.Duration{"s": time.Second, "m": time.Minute, "h": time.Hour, "d": 24 * time.Hour}[unit]
+	if per == 0 {
+		return Limit{}, fmt.Errorf("error parsing rate limit %q: unit must be s, m, h or d", s)
+	}
+
+	l := Limit{Rate: float64(n) / per.Seconds(), Burst: n}
+	if hasBurst {
+		if l.Burst, err = strconv.Atoi(burst); err != nil || l.Burst < 1 {
+			return Limit{}, fmt.Errorf("error parsing rate limit %q: invalid burst", s)
+		}
+	}
+	return l, nil
+}
+
+// Result is the outcome of a request against its client's bucket
+type Result struct {
+	Allowed bool
+	// Limit is the bucket's size and Remaining how many requests it still allows right now
+	Limit     int
+	Remaining int
+	// Reset is how long until the bucket is full again
+	Reset time.Duration
+	// RetryAfter is how long until the next request is allowed, zero if this one was
+	RetryAfter time.Duration
+}
+
+// Limiter keeps a bucket per client key, all sharing the same limit
+type Limiter struct {
+	limit Limit
+	now   func() time.Time // replaced by tests to simulate time passing
+
+	mu        sync.Mutex
+	buckets   map[string]*bucket
+	lastSweep time.Time
+}
+
+type bucket struct {
+	tokens float64
+	last   time.Time
+}
+
+// NewLimiter creates a limiter applying limit to each client
+func NewLimiter(limit Limit) *Limiter {
+	return &Limiter{limit: limit, now: time.Now, buckets: make(map[string]*bucket)}
+}
+
+// Allow takes a token from key's bucket if it has one
+func (l *Limiter) Allow(key string) Result {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	now := l.now()
+	l.sweep(now)
+
+	b, ok := l.buckets[key]
+	if !ok {
+		b = &bucket{tokens: float64(l.limit.Burst), last: now}
+		l.buckets[key] = b
+	}
+	b.refill(l.limit, now)
+
+	res := Result{Limit: l.limit.Burst}
+	if b.tokens >= 1 {
+		b.tokens--
+		res.Allowed = true
+	} else {
+		res.RetryAfter = l.wait(1 - b.tokens)
+	}
+	res.Remaining = int(b.tokens)
+	res.Reset = l.wait(float64(l.limit.Burst) - b.tokens)
+	return res
+}
+
+// refill adds the tokens earned since the bucket was last used
+func (b *bucket) refill(limit Limit, now time.Time) {
+	if elapsed := now.Sub(b.last); elapsed > 0 {
+		b.tokens = math.Min(float64(limit.Burst), b.tokens+elapsed.Seconds()*limit.Rate)
+	}
+	b.last = now
+}
+
+// wait returns how long it takes to earn tokens
+func (l *Limiter) wait(tokens float64) time.Duration {
+	return time.Duration(tokens / l.limit.Rate * float64(time.Second))
+}
+
+// sweep drops the buckets that have refilled, so clients that went away don't hold memory
+func (l *Limiter) sweep(now time.Time) {
+	if now.Sub(l.lastSweep) < sweepInterval {
+		return
+	}
+	l.lastSweep = now
+
+	for key, b := range l.buckets {
+		b.refill(l.limit, now)
+		if b.tokens >= float64(l.limit.Burst) {
+			delete(l.buckets, key)
+		}
+	}
+}
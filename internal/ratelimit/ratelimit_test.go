@@ -0,0 +1,91 @@
+package ratelimit
+
+import (
+	"testing"
+	"time"
+)
+
+// newTestLimiter returns a limiter whose clock only moves when the returned function is called
+func newTestLimiter(limit Limit) (*Limiter, func(d time.Duration)) {
+	now := time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)
+	l := NewLimiter(limit)
+	l.now = func() time.Time { return now }
+	return l, func(d time.Duration) { now = now.Add(d) }
+}
+
+func TestParseLimit(t *testing.T) {
+	cases := map[string]Limit{
+		"10/s":     {Rate: 10, Burst: 10},
+		"600/m:50": {Rate: 10, Burst: 50},
+		"3600/h":   {Rate: 1, Burst: 3600},
+		"86400/d":  {Rate: 1, Burst: 86400},
+	}
+	for s, want := range cases {
+		if got, err := ParseLimit(s); err != nil || got != want {
+			t.Errorf("ParseLimit(%q) = %+v, %v, expected %+v", s, got, err, want)
+		}
+	}
+
+	for _, bad := range []string{"", "10", "10/w", "0/s", "-1/s", "ten/s", "10/s:0", "10/s:x"} {
+		if _, err := ParseLimit(bad); err == nil {
+			t.Errorf("expected %q to be rejected", bad)
+		}
+	}
+}
+
+func TestBurst(t *testing.T) {
+	l, advance := newTestLimiter(Limit{Rate: 2, Burst: 5})
+
+	for i := 0; i < 5; i++ {
+		res := l.Allow("client")
+		if !res.Allowed || res.Remaining != 4-i || res.Limit != 5 {
+			t.Fatalf("request %d: expected to be allowed with %d remaining, got %+v", i, 4-i, res)
+		}
+	}
+
+	res := l.Allow("client")
+	if res.Allowed || res.Remaining != 0 {
+		t.Fatalf("expected the burst to be exhausted, got %+v", res)
+	}
+	if res.RetryAfter != 500*time.Millisecond || res.Reset != 2500*time.Millisecond {
+		t.Errorf("expected to retry after 500ms and reset after 2.5s, got %+v", res)
+	}
+
+	// Other clients have their own bucket
+	if res := l.Allow("other"); !res.Allowed {
+		t.Errorf("expected another client to be allowed, got %+v", res)
+	}
+
+	advance(500 * time.Millisecond)
+	if res := l.Allow("client"); !res.Allowed || res.Remaining != 0 {
+		t.Errorf("expected one token to be earned, got %+v", res)
+	}
+	if res := l.Allow("client"); res.Allowed {
+		t.Errorf("expected the earned token to be spent, got %+v", res)
+	}
+
+	// A bucket never holds more than the burst, however long the client waits
+	advance(time.Hour)
+	for i := 0; i < 5; i++ {
+		l.Allow("client")
+	}
+	if res := l.Allow("client"); res.Allowed {
+		t.Errorf("expected the refilled burst to be exhausted, got %+v", res)
+	}
+}
+
+func TestSweepDropsRefilledBuckets(t *testing.T) {
+	l, advance := newTestLimiter(Limit{Rate: 1, Burst: 2})
+
+	l.Allow("idle")
+	advance(sweepInterval)
+	l.Allow("busy")
+	l.Allow("busy")
+
+	if _, ok := l.buckets["idle"]; ok {
+		t.Error("expected the refilled bucket to be dropped")
+	}
+	if _, ok := l.buckets["busy"]; !ok {
+		t.Error("expected the drained bucket to be kept")
+	}
+}
@@ -0,0 +1,707 @@
+package resp
+
+import (
+	"container/heap"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"gocache/internal/auth"
+	"gocache/internal/logger"
+	"gocache/pkg/model"
+	"math"
+	"path"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// keyPrefix namespaces person keys, person 42 is the hash person:42
+const keyPrefix = "person:"
+
+// hashFields are the fields of a person hash in reply order
+var hashFields = []string{"id", "name", "age", "email", "version"}
+
+// command describes a supported command, arity counts the command name like Redis does and maxArgs 0 means unbounded
+type command struct {
+	minArgs int
+	maxArgs int
+	run     func(s *Server, sess *session, args []string)
+}
+
+var commands map[string]command
+
+// unauthenticated are the commands a connection can run before it authenticates
+var unauthenticated = map[string]bool{"AUTH": true, "HELLO": true, "QUIT": true}
+
+// commandRoles is the role each command requires, commands missing here only manage the connection
+var commandRoles = map[string]string{
+	"DBSIZE":  auth.RoleRead,
+	"GET":     auth.RoleRead,
+	"EXISTS":  auth.RoleRead,
+	"TYPE":    auth.RoleRead,
+	"TTL":     auth.RoleRead,
+	"PTTL":    auth.RoleRead,
+	"SCAN":    auth.RoleRead,
+	"KEYS":    auth.RoleRead,
+	"HGETALL": auth.RoleRead,
+	"HGET":    auth.RoleRead,
+	"HMGET":   auth.RoleRead,
+	"HEXISTS": auth.RoleRead,
+	"HLEN":    auth.RoleRead,
+	"HKEYS":   auth.RoleRead,
+	"HVALS":   auth.RoleRead,
+	"SET":     auth.RoleWrite,
+	"DEL":     auth.RoleWrite,
+	"UNLINK":  auth.RoleWrite,
+	"EXPIRE":  auth.RoleWrite,
+	"PEXPIRE": auth.RoleWrite,
+	"PERSIST": auth.RoleWrite,
+	"HSET":    auth.RoleWrite,
+	"HMSET":   auth.RoleWrite,
+	"HINCRBY": auth.RoleWrite,
+}
+
+func init() {
+	commands = map[string]command{
+		"PING":    {1, 2, cmdPing},
+		"ECHO":    {2, 2, func(s *Server, sess *session, args []string) { sess.w.bulk(args[0]) }},
+		"AUTH":    {2, 3, cmdAuth},
+		"HELLO":   {1, 0, cmdHello},
+		"QUIT":    {1, 1, nil},
+		"SELECT":  {2, 2, cmdSelect},
+		"COMMAND": {1, 0, func(s *Server, sess *session, args []string) { sess.w.array(0) }},
+		"DBSIZE":  {1, 1, cmdDBSize},
+		"GET":     {2, 2, cmdGet},
+		"SET":     {3, 3, cmdSet},
+		"DEL":     {2, 0, cmdDel},
+		"UNLINK":  {2, 0, cmdDel},
+		"EXISTS":  {2, 0, cmdExists},
+		"TYPE":    {2, 2, cmdType},
+		"EXPIRE":  {3, 3, cmdExpire},
+		"PEXPIRE": {3, 3, cmdExpire},
+		"TTL":     {2, 2, cmdTTL},
+		"PTTL":    {2, 2, cmdTTL},
+		"PERSIST": {2, 2, cmdPersist},
+		"SCAN":    {2, 8, cmdScan},
+		"KEYS":    {2, 2, cmdKeys},
+		"HGETALL": {2, 2, cmdHGetAll},
+		"HGET":    {3, 3, cmdHGet},
+		"HMGET":   {3, 0, cmdHMGet},
+		"HSET":    {4, 0, cmdHSet},
+		"HMSET":   {4, 0, cmdHSet},
+		"HINCRBY": {4, 4, cmdHIncrBy},
+		"HEXISTS": {3, 3, cmdHExists},
+		"HLEN":    {2, 2, cmdHLen},
+		"HKEYS":   {2, 2, cmdHKeys},
+		"HVALS":   {2, 2, cmdHVals},
+	}
+}
+
+func cmdPing(s *Server, sess *session, args []string) {
+	if len(args) == 1 {
+		sess.w.bulk(args[0])
+		return
+	}
+	sess.w.simple("PONG")
+}
+
+// cmdAuth handles AUTH [username] password. There's only the default user, so the username is ignored
+// and the password holds an API key or a JWT.
+func cmdAuth(s *Server, sess *session, args []string) {
+	if s.authenticate(sess, args[len(args)-1]) {
+		sess.w.simple("OK")
+	}
+}
+
+// cmdHello negotiates the protocol version, optionally authenticating first with AUTH username password
+func cmdHello(s *Server, sess *session, args []string) {
+	proto := sess.w.proto
+	if len(args) > 0 {
+		var err error
+		proto, err = strconv.Atoi(args[0])
+		if err != nil || proto < 2 || proto > 3 {
+			sess.w.errorf("NOPROTO unsupported protocol version")
+			return
+		}
+		for i := 1; i < len(args); i++ {
+			switch strings.ToUpper(args[i]) {
+			case "SETNAME":
+				i++
+			case "AUTH":
+				if i+2 >= len(args) {
+					sess.w.errorf("ERR syntax error in HELLO option '%s'", args[i])
+					return
+				}
+				if !s.authenticate(sess, args[i+2]) {
+					return
+				}
+				i += 2
+			default:
+				sess.w.errorf("ERR syntax error in HELLO option '%s'", args[i])
+				return
+			}
+		}
+	}
+	if s.authn != nil && !sess.authenticated() {
+		sess.w.errorf("NOAUTH HELLO must be called with the client already authenticated, otherwise the HELLO <proto> AUTH <user> <pass> option can be used to authenticate the client and select the RESP protocol version at the same time")
+		return
+	}
+	sess.w.proto = proto
+
+	sess.w.mapHeader(7)
+	sess.w.bulk("server")
+	sess.w.bulk("gocache")
+	sess.w.bulk("version")
+	sess.w.bulk("1.0.0")
+	sess.w.bulk("proto")
+	sess.w.integer(int64(sess.w.proto))
+	sess.w.bulk("id")
+	sess.w.integer(sess.id)
+	sess.w.bulk("mode")
+	sess.w.bulk("standalone")
+	sess.w.bulk("role")
+	sess.w.bulk("master")
+	sess.w.bulk("modules")
+	sess.w.array(0)
+}
+
+func cmdSelect(s *Server, sess *session, args []string) {
+	if args[0] != "0" {
+		sess.w.errorf("ERR DB index is out of range")
+		return
+	}
+	sess.w.simple("OK")
+}
+
+func cmdDBSize(s *Server, sess *session, args []string) {
+	sess.w.integer(int64(s.pc.StoreStats().Persons))
+}
+
+// cmdGet fails on every person like Redis does on a hash, TYPE reports them as hashes and clients trust it
+func cmdGet(s *Server, sess *session, args []string) {
+	if _, ok := s.lookup(sess.ctx, args[0]); ok {
+		sess.w.errorf("WRONGTYPE Operation against a key holding the wrong kind of value")
+		return
+	}
+	sess.w.null()
+}
+
+// cmdSet replaces the person with the JSON value, inserting it if needed. Like Redis it clears any TTL.
+func cmdSet(s *Server, sess *session, args []string) {
+	id, ok := parseKey(args[0])
+	if !ok {
+		sess.w.errorf("ERR only %s<id> keys are supported", keyPrefix)
+		return
+	}
+
+	var p model.Person
+	if err := json.Unmarshal([]byte(args[1]), &p); err != nil {
+		sess.w.errorf("ERR value is not a valid person: %v", err)
+		return
+	}
+	if p.ID != 0 && p.ID != id {
+		sess.w.errorf("ERR person id %d doesn't match key %s", p.ID, args[0])
+		return
+	}
+	p.ID = id
+
+	// SET is last-write-wins, so it takes whatever version is current
+	if current, ok := s.lookup(sess.ctx, args[0]); ok {
+		p.Version = current.Version
+		if _, err := s.pc.UpdatePerson(sess.ctx, p); err != nil {
+			sess.w.errorf("ERR %v", err)
+			return
+		}
+	} else {
+		p.Version = 0
+		if _, err := s.pc.ApplyBatch(sess.ctx, []model.WriteOp{{Op: model.OpInsert, Person: p}}); err != nil {
+			sess.w.errorf("ERR %v", err)
+			return
+		}
+	}
+
+	s.expires.Clear(id)
+	sess.w.simple("OK")
+}
+
+func cmdDel(s *Server, sess *session, args []string) {
+	ops := make([]model.WriteOp, 0, len(args))
+	seen := make(map[int]bool)
+	for _, key := range args {
+		if p, ok := s.lookup(sess.ctx, key); ok && !seen[p.ID] {
+			seen[p.ID] = true
+			ops = append(ops, model.WriteOp{Op: model.OpDelete, ID: p.ID})
+		}
+	}
+
+	if len(ops) > 0 {
+		if _, err := s.pc.ApplyBatch(sess.ctx, ops); err != nil {
+			sess.w.errorf("ERR %v", err)
+			return
+		}
+	}
+
+	for id := range seen {
+		s.expires.Clear(id)
+	}
+	sess.w.integer(int64(len(ops)))
+}
+
+func cmdExists(s *Server, sess *session, args []string) {
+	var n int64
+	for _, key := range args {
+		if _, ok := s.lookup(sess.ctx, key); ok {
+			n++
+		}
+	}
+	sess.w.integer(n)
+}
+
+func cmdType(s *Server, sess *session, args []string) {
+	if _, ok := s.lookup(sess.ctx, args[0]); ok {
+		sess.w.simple("hash")
+		return
+	}
+	sess.w.simple("none")
+}
+
+// cmdExpire handles EXPIRE (seconds) and PEXPIRE (milliseconds), a non-positive TTL evicts the person from the cache now
+func cmdExpire(s *Server, sess *session, args []string) {
+	n, err := strconv.ParseInt(args[1], 10, 64)
+	if err != nil {
+		sess.w.errorf("ERR value is not an integer or out of range")
+		return
+	}
+
+	p, ok := s.lookup(sess.ctx, args[0])
+	if !ok {
+		sess.w.integer(0)
+		return
+	}
+
+	unit := time.Second
+	if sess.cmd == "PEXPIRE" {
+		unit = time.Millisecond
+	}
+	if n > int64(math.MaxInt64/unit) {
+		sess.w.errorf("ERR invalid expire time in '%s' command", strings.ToLower(sess.cmd))
+		return
+	}
+
+	if n <= 0 {
+		s.expires.Clear(p.ID)
+		s.pc.Evict(p.ID)
+		sess.w.integer(1)
+		return
+	}
+
+	s.expires.Set(p.ID, time.Duration(n)*unit)
+	sess.w.integer(1)
+}
+
+// cmdTTL handles TTL and PTTL, -2 means the key doesn't exist and -1 that it has no TTL
+func cmdTTL(s *Server, sess *session, args []string) {
+	p, ok := s.lookup(sess.ctx, args[0])
+	if !ok {
+		sess.w.integer(-2)
+		return
+	}
+
+	left, ok := s.expires.TTL(p.ID)
+	if !ok {
+		sess.w.integer(-1)
+		return
+	}
+
+	if sess.cmd == "PTTL" {
+		sess.w.integer(left.Milliseconds())
+		return
+	}
+	// Round up like Redis, so a key that still exists never reports 0
+	sess.w.integer(int64((left + time.Second - 1) / time.Second))
+}
+
+func cmdPersist(s *Server, sess *session, args []string) {
+	p, ok := s.lookup(sess.ctx, args[0])
+	if !ok || !s.expires.Clear(p.ID) {
+		sess.w.integer(0)
+		return
+	}
+	sess.w.integer(1)
+}
+
+// cmdScan iterates the keys in ID order, the cursor is the last ID returned so persons added or deleted between
+// calls don't make it skip any others
+func cmdScan(s *Server, sess *session, args []string) {
+	cursor, err := strconv.Atoi(args[0])
+	if err != nil || cursor < 0 {
+		sess.w.errorf("ERR invalid cursor")
+		return
+	}
+
+	pattern, count, typ := "*", 10, ""
+	for i := 1; i < len(args); i += 2 {
+		if i+1 >= len(args) {
+			sess.w.errorf("ERR syntax error")
+			return
+		}
+		switch strings.ToUpper(args[i]) {
+		case "MATCH":
+			pattern = args[i+1]
+		case "COUNT":
+			if count, err = strconv.Atoi(args[i+1]); err != nil || count < 1 {
+				sess.w.errorf("ERR value is not an integer or out of range")
+				return
+			}
+		case "TYPE":
+			typ = strings.ToLower(args[i+1])
+		default:
+			sess.w.errorf("ERR syntax error")
+			return
+		}
+	}
+
+	ids, more, err := s.scanIDs(sess.ctx, cursor, count)
+	if err != nil {
+		sess.w.errorf("ERR %v", err)
+		return
+	}
+
+	// Like Redis, COUNT bounds the keys per call and MATCH filters afterwards, so a page can be empty
+	keys := make([]string, 0, len(ids))
+	for _, id := range ids {
+		if key := personKey(id); (typ == "" || typ == "hash") && matchKey(pattern, key) {
+			keys = append(keys, key)
+		}
+	}
+
+	next := 0
+	if more {
+		next = ids[len(ids)-1]
+	}
+
+	sess.w.array(2)
+	sess.w.bulk(strconv.Itoa(next))
+	sess.w.array(len(keys))
+	for _, key := range keys {
+		sess.w.bulk(key)
+	}
+}
+
+func cmdKeys(s *Server, sess *session, args []string) {
+	persons, err := s.pc.Export(sess.ctx, model.Filter{})
+	if err != nil {
+		sess.w.errorf("ERR %v", err)
+		return
+	}
+
+	// Only the matching IDs are collected and sorted
+	var ids []int
+	for p := range persons {
+		if matchKey(args[0], personKey(p.ID)) {
+			ids = append(ids, p.ID)
+		}
+	}
+	sort.Ints(ids)
+
+	keys := make([]string, len(ids))
+	for i, id := range ids {
+		keys[i] = personKey(id)
+	}
+
+	sess.w.array(len(keys))
+	for _, key := range keys {
+		sess.w.bulk(key)
+	}
+}
+
+func cmdHGetAll(s *Server, sess *session, args []string) {
+	p, ok := s.view(sess.ctx, args[0])
+	if !ok {
+		sess.w.mapHeader(0)
+		return
+	}
+
+	sess.w.mapHeader(len(hashFields))
+	for _, field := range hashFields {
+		value, _ := fieldValue(p, field)
+		sess.w.bulk(field)
+		sess.w.bulk(value)
+	}
+}
+
+func cmdHGet(s *Server, sess *session, args []string) {
+	p, ok := s.view(sess.ctx, args[0])
+	if !ok {
+		sess.w.null()
+		return
+	}
+
+	value, ok := fieldValue(p, args[1])
+	if !ok {
+		sess.w.null()
+		return
+	}
+	sess.w.bulk(value)
+}
+
+func cmdHMGet(s *Server, sess *session, args []string) {
+	p, found := s.view(sess.ctx, args[0])
+
+	sess.w.array(len(args) - 1)
+	for _, field := range args[1:] {
+		value, ok := fieldValue(p, field)
+		if !found || !ok {
+			sess.w.null()
+			continue
+		}
+		sess.w.bulk(value)
+	}
+}
+
+// cmdHSet sets fields on the person, creating it if it doesn't exist. HSET replies with the number
+// of fields added, which is only non-zero on creation, while the deprecated HMSET replies OK.
+func cmdHSet(s *Server, sess *session, args []string) {
+	id, ok := parseKey(args[0])
+	if !ok {
+		sess.w.errorf("ERR only %s<id> keys are supported", keyPrefix)
+		return
+	}
+	if len(args)%2 != 1 {
+		sess.w.errorf("ERR wrong number of arguments for '%s' command", strings.ToLower(sess.cmd))
+		return
+	}
+
+	ops := make([]model.FieldOp, 0, len(args)/2)
+	for i := 1; i < len(args); i += 2 {
+		op, err := setOp(args[i], args[i+1])
+		if err != nil {
+			sess.w.errorf("ERR %v", err)
+			return
+		}
+		ops = append(ops, op)
+	}
+
+	added := 0
+	if _, ok := s.lookup(sess.ctx, args[0]); ok {
+		if _, err := s.pc.PatchPerson(sess.ctx, id, ops); err != nil {
+			sess.w.errorf("ERR %v", err)
+			return
+		}
+	} else {
+		p := model.Person{ID: id}
+		if err := p.Apply(ops); err != nil {
+			sess.w.errorf("ERR %v", err)
+			return
+		}
+		if _, err := s.pc.ApplyBatch(sess.ctx, []model.WriteOp{{Op: model.OpInsert, Person: p}}); err != nil {
+			sess.w.errorf("ERR %v", err)
+			return
+		}
+		added = len(ops)
+	}
+
+	if sess.cmd == "HMSET" {
+		sess.w.simple("OK")
+		return
+	}
+	sess.w.integer(int64(added))
+}
+
+func cmdHIncrBy(s *Server, sess *session, args []string) {
+	id, ok := parseKey(args[0])
+	if !ok {
+		sess.w.errorf("ERR only %s<id> keys are supported", keyPrefix)
+		return
+	}
+
+	n, err := strconv.Atoi(args[2])
+	if err != nil {
+		sess.w.errorf("ERR value is not an integer or out of range")
+		return
+	}
+
+	p, err := s.pc.PatchPerson(sess.ctx, id, []model.FieldOp{{Op: model.OpIncrement, Field: args[1], Value: n}})
+	if errors.Is(err, model.ErrNotFound) {
+		sess.w.errorf("ERR no such key")
+		return
+	}
+	if err != nil {
+		sess.w.errorf("ERR %v", err)
+		return
+	}
+	sess.w.integer(int64(p.Age))
+}
+
+func cmdHExists(s *Server, sess *session, args []string) {
+	p, found := s.lookup(sess.ctx, args[0])
+	if _, ok := fieldValue(p, args[1]); found && ok {
+		sess.w.integer(1)
+		return
+	}
+	sess.w.integer(0)
+}
+
+func cmdHLen(s *Server, sess *session, args []string) {
+	if _, ok := s.lookup(sess.ctx, args[0]); ok {
+		sess.w.integer(int64(len(hashFields)))
+		return
+	}
+	sess.w.integer(0)
+}
+
+func cmdHKeys(s *Server, sess *session, args []string) {
+	if _, ok := s.lookup(sess.ctx, args[0]); !ok {
+		sess.w.array(0)
+		return
+	}
+
+	sess.w.array(len(hashFields))
+	for _, field := range hashFields {
+		sess.w.bulk(field)
+	}
+}
+
+func cmdHVals(s *Server, sess *session, args []string) {
+	p, ok := s.view(sess.ctx, args[0])
+	if !ok {
+		sess.w.array(0)
+		return
+	}
+
+	sess.w.array(len(hashFields))
+	for _, field := range hashFields {
+		value, _ := fieldValue(p, field)
+		sess.w.bulk(value)
+	}
+}
+
+// authenticate checks password and attaches its caller to the session, replying with the error if it doesn't verify
+func (s *Server) authenticate(sess *session, password string) bool {
+	if s.authn == nil {
+		sess.w.errorf("ERR AUTH <password> called without any password configured for the default user. Are you sure your configuration is correct?")
+		return false
+	}
+
+	p, err := s.authn.Authenticate(auth.SecretHeader(password))
+	if err != nil {
+		logger.Logger.Warnf("RESP: authentication failed for connection %d: %v", sess.id, err)
+		sess.w.errorf("WRONGPASS invalid username-password pair or user is disabled.")
+		return false
+	}
+
+	sess.ctx = auth.WithPrincipal(context.Background(), p)
+	return true
+}
+
+// lookup returns the person stored under key, keys outside the person namespace never exist
+func (s *Server) lookup(ctx context.Context, key string) (model.Person, bool) {
+	id, ok := parseKey(key)
+	if !ok {
+		return model.Person{}, false
+	}
+
+	p, err := s.pc.GetPerson(ctx, id)
+	return p, err == nil
+}
+
+// view returns the person stored under key as the caller in ctx may see it
+func (s *Server) view(ctx context.Context, key string) (model.Person, bool) {
+	p, ok := s.lookup(ctx, key)
+	return s.mask.Person(ctx, p), ok
+}
+
+// scanIDs returns up to count of the smallest IDs above after in order, reading a store view so a call neither
+// copies nor sorts the store. more reports whether IDs are left past the last one returned.
+func (s *Server) scanIDs(ctx context.Context, after, count int) ([]int, bool, error) {
+	persons, err := s.pc.Export(ctx, model.Filter{})
+	if err != nil {
+		return nil, false, err
+	}
+
+	var ids idHeap
+	more := false
+	for p := range persons {
+		switch {
+		case p.ID <= after:
+		case ids.Len() < count:
+			heap.Push(&ids, p.ID)
+		default:
+			more = true
+			if p.ID < ids[0] {
+				ids[0] = p.ID
+				heap.Fix(&ids, 0)
+			}
+		}
+	}
+
+	sort.Ints(ids)
+	return ids, more, nil
+}
+
+// idHeap is a max-heap of IDs, the largest is replaced when a smaller one comes along
+type idHeap []int
+
+func (h idHeap) Len() int           { return len(h) }
+func (h idHeap) Less(i, j int) bool { return h[i] > h[j] }
+func (h idHeap) Swap(i, j int)      { h[i], h[j] = h[j], h[i] }
+func (h *idHeap) Push(x any)        { *h = append(*h, x.(int)) }
+func (h *idHeap) Pop() any {
+	old := *h
+	x := old[len(old)-1]
+	*h = old[:len(old)-1]
+	return x
+}
+
+func parseKey(key string) (int, bool) {
+	if !strings.HasPrefix(key, keyPrefix) {
+		return 0, false
+	}
+
+	id, err := strconv.Atoi(key[len(keyPrefix):])
+	return id, err == nil
+}
+
+func personKey(id int) string {
+	return keyPrefix + strconv.Itoa(id)
+}
+
+// matchKey reports whether key matches a Redis glob pattern, malformed patterns match nothing
+func matchKey(pattern, key string) bool {
+	ok, err := path.Match(pattern, key)
+	return err == nil && ok
+}
+
+func fieldValue(p model.Person, field string) (string, bool) {
+	switch field {
+	case "id":
+		return strconv.Itoa(p.ID), true
+	case "name":
+		return p.Name, true
+	case "age":
+		return strconv.Itoa(p.Age), true
+	case "email":
+		return p.Email, true
+	case "version":
+		return strconv.FormatInt(p.Version, 10), true
+	}
+	return "", false
+}
+
+// setOp builds a set operation, converting the value to the field's type since RESP values are all strings
+func setOp(field, value string) (model.FieldOp, error) {
+	op := model.FieldOp{Op: model.OpSet, Field: field, Value: value}
+
+	switch field {
+	case "age", "id", "version":
+		n, err := strconv.ParseInt(value, 10, 64)
+		if err != nil {
+			return op, fmt.Errorf("%w: field %q expects an integer", model.ErrInvalidOp, field)
+		}
+		op.Value = n
+	}
+
+	return op, nil
+}
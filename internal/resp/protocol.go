@@ -0,0 +1,136 @@
+package resp
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"io"
+	"strconv"
+	"strings"
+)
+
+// Limits on a single request, persons are small so these are far below Redis' own
+const (
+	maxArgs     = 1 << 16
+	maxBulkLen  = 1 << 20
+	maxLineSize = 64 * 1024
+)
+
+// Limits before a connection authenticates, enough for AUTH and HELLO, so an unauthenticated client can't make the
+// server buffer large requests. Redis uses the same ones.
+const (
+	maxUnauthenticatedArgs    = 10
+	maxUnauthenticatedBulkLen = 16 * 1024
+)
+
+// errProtocol marks malformed input, the connection is closed after reporting it
+var errProtocol = errors.New("Protocol error")
+
+// readCommand reads one command, either a RESP array of bulk strings or an inline command line. Until the connection
+// is authenticated the smaller unauthenticated limits apply.
+func readCommand(r *bufio.Reader, authenticated bool) ([]string, error) {
+	line, err := readLine(r)
+	if err != nil {
+		return nil, err
+	}
+
+	if len(line) == 0 || line[0] != '*' {
+		// Inline commands, as typed into telnet or sent by redis-cli for simple commands
+		return strings.Fields(line), nil
+	}
+
+	n, err := strconv.Atoi(line[1:])
+	if err != nil || n > maxArgs {
+		return nil, fmt.Errorf("%w: invalid multibulk length", errProtocol)
+	}
+	if !authenticated && n > maxUnauthenticatedArgs {
+		return nil, fmt.Errorf("%w: unauthenticated multibulk length", errProtocol)
+	}
+
+	args := make([]string, 0, max(n, 0))
+	for i := 0; i < n; i++ {
+		header, err := readLine(r)
+		if err != nil {
+			return nil, err
+		}
+		if len(header) == 0 || header[0] != '$' {
+			return nil, fmt.Errorf("%w: expected '$', got %q", errProtocol, header)
+		}
+
+		size, err := strconv.Atoi(header[1:])
+		if err != nil || size < 0 || size > maxBulkLen {
+			return nil, fmt.Errorf("%w: invalid bulk length", errProtocol)
+		}
+		if !authenticated && size > maxUnauthenticatedBulkLen {
+			return nil, fmt.Errorf("%w: unauthenticated bulk length", errProtocol)
+		}
+
+		buf := make([]byte, size+2)
+		if _, err := io.ReadFull(r, buf); err != nil {
+			return nil, err
+		}
+		if buf[size] != '\r' || buf[size+1] != '\n' {
+			return nil, fmt.Errorf("%w: bulk string not terminated by CRLF", errProtocol)
+		}
+		args = append(args, string(buf[:size]))
+	}
+
+	return args, nil
+}
+
+func readLine(r *bufio.Reader) (string, error) {
+	line, err := r.ReadSlice('\n')
+	if errors.Is(err, bufio.ErrBufferFull) || len(line) > maxLineSize {
+		return "", fmt.Errorf("%w: line too long", errProtocol)
+	}
+	if err != nil {
+		return "", err
+	}
+
+	return strings.TrimRight(string(line), "\r\n"), nil
+}
+
+// writer encodes replies for the protocol version the client negotiated with HELLO
+type writer struct {
+	*bufio.Writer
+	proto int
+}
+
+func (w *writer) simple(s string) {
+	w.WriteString("+" + s + "\r\n")
+}
+
+// errorf writes an error reply, the message must start with an error code such as ERR
+func (w *writer) errorf(format string, args ...any) {
+	msg := strings.NewReplacer("\r", " ", "\n", " ").Replace(fmt.Sprintf(format, args...))
+	w.WriteString("-" + msg + "\r\n")
+}
+
+func (w *writer) integer(n int64) {
+	w.WriteString(":" + strconv.FormatInt(n, 10) + "\r\n")
+}
+
+func (w *writer) bulk(s string) {
+	w.WriteString("$" + strconv.Itoa(len(s)) + "\r\n" + s + "\r\n")
+}
+
+func (w *writer) null() {
+	if w.proto >= 3 {
+		w.WriteString("_\r\n")
+		return
+	}
+	w.WriteString("$-1\r\n")
+}
+
+func (w *writer) array(n int) {
+	w.WriteString("*" + strconv.Itoa(n) + "\r\n")
+}
+
+// mapHeader starts a map of n pairs, RESP2 has no map type so it becomes a flat array of keys and values
+func (w *writer) mapHeader(n int) {
+	if w.proto >= 3 {
+		w.WriteString("%" + strconv.Itoa(n) + "\r\n")
+		return
+	}
+	w.array(2 * n)
+}
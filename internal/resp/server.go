@@ -0,0 +1,200 @@
+// Package resp serves the person cache over the Redis serialization protocol (RESP2 and RESP3),
+// so existing Redis clients can read and write persons as hashes keyed by person:<id>
+package resp
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"gocache/internal/auth"
+	"gocache/internal/controller"
+	"gocache/internal/expiry"
+	"gocache/internal/logger"
+	"io"
+	"net"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// Server accepts RESP connections and maps their commands onto a PersonController
+type Server struct {
+	pc      controller.PersonController
+	expires *expiry.Expirer
+	authn   auth.Authenticator
+	mask    auth.Mask
+
+	mu       sync.Mutex
+	listener net.Listener
+	conns    map[net.Conn]struct{}
+	closed   bool
+	wg       sync.WaitGroup
+	nextID   atomic.Int64
+}
+
+// NewServer creates a RESP server backed by pc, whose EXPIRE TTLs are tracked by expires.
+// Connections must AUTH with authn before running commands unless it's nil, and see persons through mask.
+func NewServer(pc controller.PersonController, expires *expiry.Expirer, authn auth.Authenticator, mask auth.Mask) *Server {
+	return &Server{
+		pc:      pc,
+		expires: expires,
+		authn:   authn,
+		mask:    mask,
+		conns:   make(map[net.Conn]struct{}),
+	}
+}
+
+// ListenAndServe listens on the TCP address addr and serves connections until Close is called
+func (s *Server) ListenAndServe(addr string) error {
+	l, err := net.Listen("tcp", addr)
+	if err != nil {
+		return err
+	}
+	return s.Serve(l)
+}
+
+// Serve accepts connections on l until Close is called, it always returns a non-nil error
+func (s *Server) Serve(l net.Listener) error {
+	s.mu.Lock()
+	if s.closed {
+		s.mu.Unlock()
+		l.Close()
+		return net.ErrClosed
+	}
+	s.listener = l
+	s.mu.Unlock()
+
+	logger.Logger.Infof("RESP: listening on %v", l.Addr())
+
+	for {
+		conn, err := l.Accept()
+		if err != nil {
+			return err
+		}
+
+		s.mu.Lock()
+		if s.closed {
+			s.mu.Unlock()
+			conn.Close()
+			return net.ErrClosed
+		}
+		s.conns[conn] = struct{}{}
+		s.wg.Add(1)
+		s.mu.Unlock()
+
+		go s.serveConn(conn)
+	}
+}
+
+// Close stops accepting connections and closes open ones, the expirer is left to its owner
+func (s *Server) Close() error {
+	s.mu.Lock()
+	s.closed = true
+	var err error
+	if s.listener != nil {
+		err = s.listener.Close()
+	}
+	for conn := range s.conns {
+		conn.Close()
+	}
+	s.mu.Unlock()
+
+	s.wg.Wait()
+	return err
+}
+
+// session is the per-connection state
+type session struct {
+	id  int64
+	w   *writer
+	cmd string // upper-cased name of the command being run, for handlers shared by several commands
+	// ctx carries the caller once the connection has authenticated
+	ctx context.Context
+}
+
+func (sess *session) authenticated() bool {
+	_, ok := auth.FromContext(sess.ctx)
+	return ok
+}
+
+func (s *Server) serveConn(conn net.Conn) {
+	defer func() {
+		conn.Close()
+		s.mu.Lock()
+		delete(s.conns, conn)
+		s.mu.Unlock()
+		s.wg.Done()
+	}()
+
+	r := bufio.NewReader(conn)
+	sess := &session{id: s.nextID.Add(1), w: &writer{Writer: bufio.NewWriter(conn), proto: 2}, ctx: context.Background()}
+
+	for {
+		args, err := readCommand(r, s.authn == nil || sess.authenticated())
+		if errors.Is(err, errProtocol) {
+			sess.w.errorf("ERR %v", err)
+			sess.w.Flush()
+			return
+		}
+		if err != nil {
+			if !errors.Is(err, io.EOF) && !errors.Is(err, net.ErrClosed) {
+				logger.Logger.Warnf("RESP: Error reading from %v: %v", conn.RemoteAddr(), err)
+			}
+			return
+		}
+
+		if len(args) == 0 {
+			continue
+		}
+
+		quit := s.dispatch(sess, args)
+
+		// Flush once the pipeline is drained rather than after every reply
+		if r.Buffered() == 0 || quit {
+			conn.SetWriteDeadline(time.Now().Add(10 * time.Second))
+			if err := sess.w.Flush(); err != nil {
+				return
+			}
+		}
+		if quit {
+			return
+		}
+	}
+}
+
+// dispatch runs one command and reports whether the connection should close
+func (s *Server) dispatch(sess *session, args []string) bool {
+	name := strings.ToUpper(args[0])
+	cmd, ok := commands[name]
+	if !ok {
+		sess.w.errorf("ERR unknown command '%s'", args[0])
+		return false
+	}
+
+	if len(args) < cmd.minArgs || (cmd.maxArgs > 0 && len(args) > cmd.maxArgs) {
+		sess.w.errorf("ERR wrong number of arguments for '%s' command", strings.ToLower(name))
+		return false
+	}
+
+	if s.authn != nil && !sess.authenticated() && !unauthenticated[name] {
+		sess.w.errorf("NOAUTH Authentication required.")
+		return false
+	}
+	if role, ok := commandRoles[name]; ok {
+		if err := auth.Authorize(sess.ctx, role); err != nil {
+			logger.Logger.Warnf("RESP: Rejected %s on connection %d: %v", name, sess.id, err)
+			sess.w.errorf("NOPERM this user has no permissions to run the '%s' command", strings.ToLower(name))
+			return false
+		}
+	}
+
+	if name == "QUIT" {
+		sess.w.simple("OK")
+		return true
+	}
+
+	sess.cmd = name
+	cmd.run(s, sess, args[1:])
+	return false
+}
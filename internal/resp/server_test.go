@@ -0,0 +1,408 @@
+package resp
+
+import (
+	"bufio"
+	"context"
+	"fmt"
+	"gocache/internal/auth"
+	"gocache/internal/controller"
+	"gocache/internal/datasource"
+	"gocache/internal/expiry"
+	"io"
+	"net"
+	"reflect"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+// respError is an error reply decoded by the test client
+type respError string
+
+// client is a minimal RESP client that decodes replies into strings, int64s, nil, []any, map[string]any and respError
+type client struct {
+	conn net.Conn
+	r    *bufio.Reader
+}
+
+func newTestServer(t *testing.T) (string, controller.PersonController) {
+	t.Helper()
+	return newAuthServer(t, nil, auth.Mask{})
+}
+
+// newAuthServer starts a server whose connections must authenticate with authn and see persons through mask
+func newAuthServer(t *testing.T, authn auth.Authenticator, mask auth.Mask) (string, controller.PersonController) {
+	t.Helper()
+
+	pc, err := controller.NewPersonController(datasource.NewMockDataSource())
+	if err != nil {
+		t.Fatalf("NewPersonController() error: %v", err)
+	}
+
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("failed to listen: %v", err)
+	}
+
+	expires := expiry.NewExpirer(pc)
+	s := NewServer(pc, expires, authn, mask)
+	go s.Serve(l)
+	t.Cleanup(func() {
+		s.Close()
+		expires.Stop()
+	})
+
+	return l.Addr().String(), pc
+}
+
+func dial(t *testing.T, addr string) *client {
+	t.Helper()
+
+	conn, err := net.Dial("tcp", addr)
+	if err != nil {
+		t.Fatalf("failed to dial: %v", err)
+	}
+	conn.SetDeadline(time.Now().Add(5 * time.Second))
+	t.Cleanup(func() { conn.Close() })
+
+	return &client{conn: conn, r: bufio.NewReader(conn)}
+}
+
+func (c *client) send(args ...string) {
+	var b strings.Builder
+	fmt.Fprintf(&b, "*%d\r\n", len(args))
+	for _, arg := range args {
+		fmt.Fprintf(&b, "$%d\r\n%s\r\n", len(arg), arg)
+	}
+	c.conn.Write([]byte(b.String()))
+}
+
+func (c *client) do(t *testing.T, args ...string) any {
+	t.Helper()
+
+	c.send(args...)
+	reply, err := c.read()
+	if err != nil {
+		t.Fatalf("%v: failed to read reply: %v", args, err)
+	}
+	return reply
+}
+
+func (c *client) read() (any, error) {
+	line, err := c.r.ReadString('\n')
+	if err != nil {
+		return nil, err
+	}
+	line = strings.TrimSuffix(line, "\r\n")
+	if line == "" {
+		return nil, fmt.Errorf("empty reply line")
+	}
+
+	body := line[1:]
+	switch line[0] {
+	case '+':
+		return body, nil
+	case '-':
+		return respError(body), nil
+	case ':':
+		return strconv.ParseInt(body, 10, 64)
+	case '_':
+		return nil, nil
+	case '$':
+		n, _ := strconv.Atoi(body)
+		if n < 0 {
+			return nil, nil
+		}
+		buf := make([]byte, n+2)
+		if _, err := io.ReadFull(c.r, buf); err != nil {
+			return nil, err
+		}
+		return string(buf[:n]), nil
+	case '*':
+		n, _ := strconv.Atoi(body)
+		items := make([]any, n)
+		for i := range items {
+			if items[i], err = c.read(); err != nil {
+				return nil, err
+			}
+		}
+		return items, nil
+	case '%':
+		n, _ := strconv.Atoi(body)
+		m := make(map[string]any, n)
+		for i := 0; i < n; i++ {
+			k, err := c.read()
+			if err != nil {
+				return nil, err
+			}
+			if m[k.(string)], err = c.read(); err != nil {
+				return nil, err
+			}
+		}
+		return m, nil
+	}
+	return nil, fmt.Errorf("unknown reply type %q", line)
+}
+
+func expect(t *testing.T, got, want any) {
+	t.Helper()
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("expected %#v, got %#v", want, got)
+	}
+}
+
+func TestBasicCommands(t *testing.T) {
+	addr, _ := newTestServer(t)
+	c := dial(t, addr)
+
+	expect(t, c.do(t, "PING"), "PONG")
+	expect(t, c.do(t, "echo", "hi"), "hi")
+	if err, ok := c.do(t, "GET", "person:1").(respError); !ok || !strings.HasPrefix(string(err), "WRONGTYPE") {
+		t.Errorf("expected GET on a hash to fail with WRONGTYPE, got %#v", err)
+	}
+	expect(t, c.do(t, "GET", "person:9"), nil)
+	expect(t, c.do(t, "GET", "other"), nil)
+	expect(t, c.do(t, "EXISTS", "person:1", "person:2", "person:9"), int64(2))
+	expect(t, c.do(t, "TYPE", "person:1"), "hash")
+	expect(t, c.do(t, "DBSIZE"), int64(2))
+
+	if _, ok := c.do(t, "NOPE").(respError); !ok {
+		t.Error("expected an error for an unknown command")
+	}
+	if _, ok := c.do(t, "GET").(respError); !ok {
+		t.Error("expected an arity error")
+	}
+}
+
+func TestInlineAndPipelinedCommands(t *testing.T) {
+	addr, _ := newTestServer(t)
+	c := dial(t, addr)
+
+	c.conn.Write([]byte("PING\r\nEXISTS person:1\r\n"))
+	c.send("HGET", "person:2", "name")
+
+	for _, want := range []any{"PONG", int64(1), "Jane Smith"} {
+		got, err := c.read()
+		if err != nil {
+			t.Fatalf("failed to read reply: %v", err)
+		}
+		expect(t, got, want)
+	}
+}
+
+func TestHashCommands(t *testing.T) {
+	addr, pc := newTestServer(t)
+	c := dial(t, addr)
+
+	expect(t, c.do(t, "HGETALL", "person:1"), []any{
+		"id", "1", "name", "John Doe", "age", "30", "email", "john.doe@example.com", "version", "0",
+	})
+	expect(t, c.do(t, "HMGET", "person:1", "name", "missing"), []any{"John Doe", nil})
+
+	expect(t, c.do(t, "HSET", "person:1", "name", "John Smith", "age", "31"), int64(0))
+	expect(t, c.do(t, "HINCRBY", "person:1", "age", "2"), int64(33))
+
+	if p, _ := pc.GetPerson(context.Background(), 1); p.Name != "John Smith" || p.Age != 33 || p.Version != 2 {
+		t.Errorf("expected the writes to reach the controller, got %+v", p)
+	}
+
+	// HSET on a missing key creates the person, which must be valid
+	expect(t, c.do(t, "HSET", "person:3", "name", "Alice Johnson", "age", "8", "email", "alice@example.com"), int64(3))
+	expect(t, c.do(t, "HGET", "person:3", "name"), "Alice Johnson")
+
+	if _, ok := c.do(t, "HSET", "person:1", "version", "9").(respError); !ok {
+		t.Error("expected an error setting the version")
+	}
+	if _, ok := c.do(t, "HSET", "person:1", "age", "old").(respError); !ok {
+		t.Error("expected an error setting a non-integer age")
+	}
+}
+
+func TestSetAndDel(t *testing.T) {
+	addr, pc := newTestServer(t)
+	c := dial(t, addr)
+
+	expect(t, c.do(t, "SET", "person:1", `{"name":"John Smith","age":31,"email":"john@example.com"}`), "OK")
+	expect(t, c.do(t, "SET", "person:5", `{"name":"New Person","age":40,"email":"new@example.com"}`), "OK")
+
+	if p, _ := pc.GetPerson(context.Background(), 1); p.Name != "John Smith" || p.Version != 1 {
+		t.Errorf("expected person 1 to be replaced, got %+v", p)
+	}
+	if p, _ := pc.GetPerson(context.Background(), 5); p.Name != "New Person" {
+		t.Errorf("expected person 5 to be inserted, got %+v", p)
+	}
+
+	if _, ok := c.do(t, "SET", "person:1", `{"id":2}`).(respError); !ok {
+		t.Error("expected an error for a mismatched id")
+	}
+
+	expect(t, c.do(t, "DEL", "person:1", "person:5", "person:9", "person:1"), int64(2))
+	expect(t, c.do(t, "DBSIZE"), int64(1))
+}
+
+func TestExpire(t *testing.T) {
+	addr, pc := newTestServer(t)
+	c := dial(t, addr)
+
+	expect(t, c.do(t, "TTL", "person:1"), int64(-1))
+	expect(t, c.do(t, "TTL", "person:9"), int64(-2))
+	expect(t, c.do(t, "EXPIRE", "person:9", "10"), int64(0))
+
+	expect(t, c.do(t, "EXPIRE", "person:2", "100"), int64(1))
+	expect(t, c.do(t, "TTL", "person:2"), int64(100))
+	expect(t, c.do(t, "PERSIST", "person:2"), int64(1))
+	expect(t, c.do(t, "TTL", "person:2"), int64(-1))
+
+	expect(t, c.do(t, "PEXPIRE", "person:1", "20"), int64(1))
+
+	deadline := time.Now().Add(2 * time.Second)
+	for {
+		if _, err := pc.GetPerson(context.Background(), 1); err != nil {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatal("expected person 1 to expire")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	expect(t, c.do(t, "EXISTS", "person:1"), int64(0))
+	expect(t, c.do(t, "EXISTS", "person:2"), int64(1))
+}
+
+func TestScan(t *testing.T) {
+	addr, _ := newTestServer(t)
+	c := dial(t, addr)
+
+	c.do(t, "HSET", "person:3", "name", "Alice Johnson", "email", "alice@example.com")
+	c.do(t, "HSET", "person:10", "name", "Bob Brown", "email", "bob@example.com")
+
+	expect(t, c.do(t, "SCAN", "0", "COUNT", "3"), []any{"3", []any{"person:1", "person:2", "person:3"}})
+	expect(t, c.do(t, "SCAN", "3", "COUNT", "3"), []any{"0", []any{"person:10"}})
+	expect(t, c.do(t, "SCAN", "0", "MATCH", "person:1*"), []any{"0", []any{"person:1", "person:10"}})
+	expect(t, c.do(t, "SCAN", "0", "TYPE", "string"), []any{"0", []any{}})
+	expect(t, c.do(t, "KEYS", "person:?"), []any{"person:1", "person:2", "person:3"})
+
+	// The cursor is the last ID returned, so a delete before it doesn't make the next page skip a key
+	expect(t, c.do(t, "SCAN", "0", "COUNT", "2"), []any{"2", []any{"person:1", "person:2"}})
+	c.do(t, "DEL", "person:1")
+	expect(t, c.do(t, "SCAN", "2", "COUNT", "2"), []any{"0", []any{"person:3", "person:10"}})
+}
+
+func TestHelloNegotiatesRESP3(t *testing.T) {
+	addr, _ := newTestServer(t)
+	c := dial(t, addr)
+
+	hello, ok := c.do(t, "HELLO", "3").(map[string]any)
+	if !ok || hello["proto"] != int64(3) || hello["server"] != "gocache" {
+		t.Fatalf("unexpected HELLO reply %#v", hello)
+	}
+
+	expect(t, c.do(t, "GET", "person:9"), nil)
+	all, ok := c.do(t, "HGETALL", "person:2").(map[string]any)
+	if !ok || all["name"] != "Jane Smith" || all["age"] != "25" {
+		t.Errorf("expected a RESP3 map, got %#v", all)
+	}
+
+	if err, ok := c.do(t, "HELLO", "4").(respError); !ok || !strings.HasPrefix(string(err), "NOPROTO") {
+		t.Errorf("expected NOPROTO, got %#v", err)
+	}
+}
+
+func TestProtocolErrorClosesConnection(t *testing.T) {
+	addr, _ := newTestServer(t)
+	c := dial(t, addr)
+
+	c.conn.Write([]byte("*1\r\n+PING\r\n"))
+	if reply, _ := c.read(); reply == nil {
+		t.Fatal("expected a protocol error reply")
+	} else if _, ok := reply.(respError); !ok {
+		t.Errorf("expected a protocol error, got %#v", reply)
+	}
+
+	if _, err := c.read(); err == nil {
+		t.Error("expected the connection to be closed")
+	}
+}
+
+func TestAuth(t *testing.T) {
+	addr, _ := newAuthServer(t, auth.NewAPIKeys(map[string]auth.Principal{"key-1": {ID: "ci", Roles: []string{auth.RoleRead}}}), auth.Mask{})
+	c := dial(t, addr)
+
+	if err, ok := c.do(t, "GET", "person:1").(respError); !ok || !strings.HasPrefix(string(err), "NOAUTH") {
+		t.Errorf("expected NOAUTH before authenticating, got %#v", err)
+	}
+	if err, ok := c.do(t, "HELLO", "3").(respError); !ok || !strings.HasPrefix(string(err), "NOAUTH") {
+		t.Errorf("expected NOAUTH for HELLO without AUTH, got %#v", err)
+	}
+	if err, ok := c.do(t, "AUTH", "key-2").(respError); !ok || !strings.HasPrefix(string(err), "WRONGPASS") {
+		t.Errorf("expected WRONGPASS for a bad key, got %#v", err)
+	}
+
+	expect(t, c.do(t, "AUTH", "default", "key-1"), "OK")
+	expect(t, c.do(t, "EXISTS", "person:1"), int64(1))
+
+	c = dial(t, addr)
+	hello, ok := c.do(t, "HELLO", "3", "AUTH", "default", "key-1").(map[string]any)
+	if !ok || hello["proto"] != int64(3) {
+		t.Fatalf("expected HELLO AUTH to authenticate, got %#v", hello)
+	}
+	expect(t, c.do(t, "EXISTS", "person:1"), int64(1))
+}
+
+func TestUnauthenticatedLimits(t *testing.T) {
+	addr, _ := newAuthServer(t, auth.NewAPIKeys(map[string]auth.Principal{"key-1": {ID: "ci", Roles: []string{auth.RoleRead}}}), auth.Mask{})
+
+	// The headers alone are rejected, before the server reads or allocates what they announce
+	for header, want := range map[string]string{
+		"*65536\r\n":                       "ERR Protocol error: unauthenticated multibulk length",
+		"*2\r\n$4\r\nAUTH\r\n$1048576\r\n": "ERR Protocol error: unauthenticated bulk length",
+	} {
+		c := dial(t, addr)
+		c.conn.Write([]byte(header))
+		if reply, err := c.read(); err != nil || reply != respError(want) {
+			t.Errorf("%q: expected %q, got %#v, %v", header, want, reply, err)
+		}
+	}
+
+	c := dial(t, addr)
+	expect(t, c.do(t, "AUTH", "key-1"), "OK")
+	expect(t, c.do(t, "EXISTS", "person:"+strings.Repeat("1", 32*1024)), int64(0))
+}
+
+func TestAuthWithoutAuthenticator(t *testing.T) {
+	addr, _ := newTestServer(t)
+	c := dial(t, addr)
+
+	if _, ok := c.do(t, "AUTH", "key-1").(respError); !ok {
+		t.Error("expected AUTH to fail when no credentials are configured")
+	}
+	expect(t, c.do(t, "EXISTS", "person:1"), int64(1))
+}
+
+func TestRolesAndMask(t *testing.T) {
+	authn := auth.NewAPIKeys(map[string]auth.Principal{
+		"reader": {ID: "reader", Roles: []string{auth.RoleRead}},
+		"admin":  {ID: "admin", Roles: []string{auth.RoleAdmin}},
+	})
+	addr, _ := newAuthServer(t, authn, auth.Mask{PII: true})
+
+	c := dial(t, addr)
+	expect(t, c.do(t, "AUTH", "reader"), "OK")
+	expect(t, c.do(t, "HGET", "person:1", "email"), auth.RedactedEmail)
+	expect(t, c.do(t, "HMGET", "person:1", "name", "email"), []any{"John Doe", auth.RedactedEmail})
+	expect(t, c.do(t, "HVALS", "person:1"), []any{"1", "John Doe", "30", auth.RedactedEmail, "0"})
+	if all := c.do(t, "HGETALL", "person:1"); strings.Contains(fmt.Sprint(all), "@") {
+		t.Errorf("expected HGETALL to redact the email, got %#v", all)
+	}
+	for _, args := range [][]string{{"DEL", "person:1"}, {"HSET", "person:1", "age", "31"}, {"EXPIRE", "person:1", "10"}} {
+		if err, ok := c.do(t, args...).(respError); !ok || !strings.HasPrefix(string(err), "NOPERM") {
+			t.Errorf("%v: expected NOPERM for a reader, got %#v", args, err)
+		}
+	}
+
+	c = dial(t, addr)
+	expect(t, c.do(t, "AUTH", "admin"), "OK")
+	expect(t, c.do(t, "HGET", "person:1", "email"), "john.doe@example.com")
+	expect(t, c.do(t, "DEL", "person:1"), int64(1))
+}
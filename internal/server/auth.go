@@ -0,0 +1,144 @@
+package server
+
+import (
+	"errors"
+	"fmt"
+	"gocache/internal/auth"
+	"gocache/internal/logger"
+	"net/http"
+	"os"
+
+	"github.com/gin-gonic/gin"
+	"github.com/gorilla/websocket"
+)
+
+// accessTokenParam carries an API key or JWT in the query of the tokenRoutes, browsers can't set headers on an
+// EventSource or a WebSocket
+const accessTokenParam = "access_token"
+
+// publicRoutes are served without credentials so probes and clients can reach them before authenticating
+var publicRoutes = map[string]bool{
+	"/health":       true,
+	"/openapi.json": true,
+}
+
+// tokenRoutes accept credentials in the access_token query parameter when the request has none in its headers
+var tokenRoutes = map[string]bool{
+	"/persons/watch":    true,
+	"/persons/watch/ws": true,
+}
+
+// takeAccessToken moves the access_token query parameter out of the URL before anything logs or traces it
+func takeAccessToken(c *gin.Context) {
+	q := c.Request.URL.Query()
+	if q.Has(accessTokenParam) {
+		c.Set(accessTokenParam, q.Get(accessTokenParam))
+		q.Del(accessTokenParam)
+		c.Request.URL.RawQuery = q.Encode()
+	}
+	c.Next()
+}
+
+// authenticate rejects requests without valid credentials and attaches the caller to the request context
+func (s *Server) authenticate(c *gin.Context) {
+	if s.authn == nil || publicRoutes[c.FullPath()] {
+		c.Next()
+		return
+	}
+
+	p, err := s.authn.Authenticate(c.Request.Header)
+	if token := c.GetString(accessTokenParam); errors.Is(err, auth.ErrNoCredentials) && token != "" && tokenRoutes[c.FullPath()] {
+		p, err = s.authn.Authenticate(auth.SecretHeader(token))
+	}
+	if errors.Is(err, auth.ErrNoCredentials) && c.FullPath() == "/graphql" && websocket.IsWebSocketUpgrade(c.Request) {
+		// graphql-ws clients may authenticate in their connection_init message instead, the handler checks it
+		c.Next()
+		return
+	}
+	if err != nil {
+		logger.Logger.WithContext(c.Request.Context()).Warnf("ROUTE: Rejected %v %v: %v", c.Request.Method, c.Request.URL.Path, err)
+		// Rejected requests count against the client's IP, so guessing credentials is rate limited like anonymous calls
+		if !s.allow(c, "ip:"+c.ClientIP()) {
+			return
+		}
+		msg := "authentication required"
+		if !errors.Is(err, auth.ErrNoCredentials) {
+			msg = "invalid credentials"
+		}
+		c.Header("WWW-Authenticate", `Bearer realm="gocache"`)
+		c.AbortWithStatusJSON(http.StatusUnauthorized, gin.H{"error": msg})
+		return
+	}
+
+	logger.Logger.WithContext(c.Request.Context()).Debugf("ROUTE: %v %v authenticated as %v (%v)", c.Request.Method, c.Request.URL.Path, p.ID, p.Method)
+	c.Request = c.Request.WithContext(auth.WithPrincipal(c.Request.Context(), p))
+	c.Next()
+}
+
+// private marks responses as depending on the caller when AUTH_MASK_PII is set, since the same version of a person
+// is sent with or without its email and must not be served from a cache to another caller
+func (s *Server) private(c *gin.Context) {
+	if s.mask.PII {
+		c.Header("Cache-Control", "private")
+		c.Writer.Header().Add("Vary", "Authorization, "+auth.APIKeyHeader)
+	}
+	c.Next()
+}
+
+// authorize rejects callers without role with 403 Forbidden
+func (s *Server) authorize(role string) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		if err := auth.Authorize(c.Request.Context(), role); err != nil {
+			logger.Logger.WithContext(c.Request.Context()).Warnf("ROUTE: Rejected %v %v: %v", c.Request.Method, c.Request.URL.Path, err)
+			c.AbortWithStatusJSON(http.StatusForbidden, gin.H{"error": err.Error()})
+			return
+		}
+		c.Next()
+	}
+}
+
+// newAuthenticator builds the authenticator from AUTH_API_KEYS and the AUTH_JWT_* settings,
+// it returns nil, leaving the API open, when none are set
+func newAuthenticator() (auth.Authenticator, error) {
+	var authenticators []auth.Authenticator
+
+	if v := os.Getenv("AUTH_API_KEYS"); v != "" {
+		keys, err := auth.ParseAPIKeys(v)
+		if err != nil {
+			return nil, err
+		}
+		authenticators = append(authenticators, auth.NewAPIKeys(keys))
+	}
+
+	cfg := auth.JWTConfig{
+		Secret:   []byte(os.Getenv("AUTH_JWT_SECRET")),
+		JWKSFile: os.Getenv("AUTH_JWKS_FILE"),
+		Issuer:   os.Getenv("AUTH_JWT_ISSUER"),
+		Audience: os.Getenv("AUTH_JWT_AUDIENCE"),
+	}
+	if len(cfg.Secret) > 0 || cfg.JWKSFile != "" {
+		jwt, err := auth.NewJWT(cfg)
+		if err != nil {
+			return nil, err
+		}
+		authenticators = append(authenticators, jwt)
+	}
+
+	switch len(authenticators) {
+	case 0:
+		logger.Logger.Warn("ROUTE: No AUTH_API_KEYS or AUTH_JWT_* settings, the API is open to anyone")
+		return nil, nil
+	case 1:
+		return authenticators[0], nil
+	default:
+		return auth.Chain(authenticators...), nil
+	}
+}
+
+// principalID names the caller of a request for logs
+func principalID(c *gin.Context) string {
+	if p, ok := auth.FromContext(c.Request.Context()); ok {
+		return fmt.Sprintf("%v (%v)", p.ID, p.Method)
+	}
+	return "anonymous"
+}
@@ -0,0 +1,157 @@
+package server
+
+import (
+	"context"
+	"encoding/json"
+	"gocache/internal/auth"
+	"gocache/pkg/model"
+	"net/http"
+	"strings"
+	"testing"
+
+	"github.com/gin-gonic/gin"
+)
+
+// withAPIKeys serves the API to the callers of keys only
+func withAPIKeys(keys map[string]auth.Principal) func(*Server) {
+	return func(s *Server) { s.authn = auth.NewAPIKeys(keys) }
+}
+
+// withMaskedPII masks personal data from callers without the pii role
+func withMaskedPII(s *Server) {
+	s.mask = auth.Mask{PII: true}
+}
+
+func TestAuthentication(t *testing.T) {
+	s := newTestAPI(t, withAPIKeys(map[string]auth.Principal{"key-1": {ID: "ci", Roles: []string{auth.RoleRead}}}))
+	r := s.RegisterRoutes().(*gin.Engine)
+	r.GET("/whoami", func(c *gin.Context) {
+		c.String(http.StatusOK, principalID(c))
+	})
+
+	for _, path := range []string{"/health", "/openapi.json"} {
+		if w := doRequest(r, http.MethodGet, path, "", nil); w.Code != http.StatusOK {
+			t.Errorf("%s: expected 200 without credentials, got %d", path, w.Code)
+		}
+	}
+
+	w := doRequest(r, http.MethodGet, "/persons/1", "", nil)
+	if w.Code != http.StatusUnauthorized {
+		t.Fatalf("expected 401 without credentials, got %d", w.Code)
+	}
+	if got := w.Header().Get("WWW-Authenticate"); got != `Bearer realm="gocache"` {
+		t.Errorf("expected a Bearer challenge, got %q", got)
+	}
+
+	body := `{"id":1,"name":"John Smith","age":31,"email":"john.smith@example.com"}`
+	if w := doRequest(r, http.MethodPost, "/persons/update", body, map[string]string{"X-API-Key": "key-2"}); w.Code != http.StatusUnauthorized {
+		t.Errorf("expected 401 for an unknown key, got %d", w.Code)
+	}
+	if p, _ := s.pc.GetPerson(context.Background(), 1); p.Name == "John Smith" {
+		t.Error("expected the rejected update not to be applied")
+	}
+
+	if w := doRequest(r, http.MethodGet, "/persons/1", "", map[string]string{"X-API-Key": "key-1"}); w.Code != http.StatusOK {
+		t.Errorf("expected 200 with a valid key, got %d", w.Code)
+	}
+
+	w = doRequest(r, http.MethodGet, "/whoami", "", map[string]string{"X-API-Key": "key-1"})
+	if w.Body.String() != "ci (api_key)" {
+		t.Errorf("expected the principal on the request context, got %q", w.Body.String())
+	}
+}
+
+func TestAuthorization(t *testing.T) {
+	r := newTestServer(t, withAPIKeys(map[string]auth.Principal{
+		"reader": {ID: "reader", Roles: []string{auth.RoleRead}},
+		"writer": {ID: "writer", Roles: []string{auth.RoleRead, auth.RoleWrite}},
+		"pii":    {ID: "pii", Roles: []string{auth.RoleRead, auth.RolePII}},
+		"admin":  {ID: "admin", Roles: []string{auth.RoleAdmin}},
+	}), withMaskedPII)
+	as := func(key string) map[string]string { return map[string]string{"X-API-Key": key} }
+	body := `{"id":1,"name":"John Smith","age":31,"email":"john.smith@example.com"}`
+
+	cases := []struct {
+		key, method, path, body string
+		want                    int
+	}{
+		{"reader", http.MethodGet, "/persons/1", "", http.StatusOK},
+		{"reader", http.MethodGet, "/persons/filter?name=John+Doe", "", http.StatusOK},
+		{"reader", http.MethodGet, "/persons/filter?email=john.doe@example.com", "", http.StatusForbidden},
+		{"pii", http.MethodGet, "/persons/filter?email=john.doe@example.com", "", http.StatusOK},
+		{"reader", http.MethodGet, "/persons/watch?email=john.doe@example.com", "", http.StatusForbidden},
+		{"reader", http.MethodPost, "/persons/update", body, http.StatusForbidden},
+		{"reader", http.MethodGet, "/persons/queue", "", http.StatusForbidden},
+		{"writer", http.MethodPost, "/persons/update", body, http.StatusOK},
+		{"writer", http.MethodGet, "/persons/queue", "", http.StatusForbidden},
+		{"admin", http.MethodGet, "/persons/queue", "", http.StatusOK},
+	}
+	for _, tc := range cases {
+		if w := doRequest(r, tc.method, tc.path, tc.body, as(tc.key)); w.Code != tc.want {
+			t.Errorf("%s %s as %s: expected %d, got %d: %s", tc.method, tc.path, tc.key, tc.want, w.Code, w.Body.String())
+		}
+	}
+
+	// Whether a test passes would reveal the email, and a failed one must not quote it
+	for key, want := range map[string]int{"writer": http.StatusForbidden, "admin": http.StatusConflict} {
+		patch := `[{"op":"test","path":"/email","value":"x@y.z"}]`
+		w := doRequest(r, http.MethodPatch, "/persons/1", patch, map[string]string{"X-API-Key": key, "Content-Type": contentTypeJSONPatch})
+		var body struct{ Error string }
+		json.Unmarshal(w.Body.Bytes(), &body)
+		if w.Code != want || strings.Contains(body.Error, "@") {
+			t.Errorf("email test as %s: expected %d without an email in the error, got %d: %s", key, want, w.Code, w.Body.String())
+		}
+	}
+
+	emails := map[string]string{
+		"reader": auth.RedactedEmail,
+		"writer": auth.RedactedEmail,
+		"pii":    "john.smith@example.com",
+		"admin":  "john.smith@example.com",
+	}
+	for key, want := range emails {
+		for _, path := range []string{"/persons/1", "/persons", "/persons/export"} {
+			w := doRequest(r, http.MethodGet, path, "", as(key))
+			var persons []model.Person
+			switch path {
+			case "/persons":
+				json.Unmarshal(w.Body.Bytes(), &persons)
+			case "/persons/export":
+				for dec := json.NewDecoder(w.Body); dec.More(); {
+					var p model.Person
+					dec.Decode(&p)
+					persons = append(persons, p)
+				}
+			default:
+				var p model.Person
+				json.Unmarshal(w.Body.Bytes(), &p)
+				persons = append(persons, p)
+			}
+
+			for _, p := range persons {
+				if p.ID == 1 && p.Email != want {
+					t.Errorf("GET %s as %s: expected email %q, got %q", path, key, want, p.Email)
+				}
+			}
+		}
+	}
+}
+
+func TestMaskedResponsesArePrivate(t *testing.T) {
+	keys := withAPIKeys(map[string]auth.Principal{"reader": {ID: "reader", Roles: []string{auth.RoleRead}}})
+	as := map[string]string{"X-API-Key": "reader"}
+
+	// The ETag only follows the version, so a cache mustn't hand one caller's body to another
+	w := doRequest(newTestServer(t, keys, withMaskedPII), http.MethodGet, "/persons/1", "", as)
+	if cc := w.Header().Get("Cache-Control"); cc != "private" {
+		t.Errorf("expected Cache-Control private, got %q", cc)
+	}
+	if vary := strings.Join(w.Header().Values("Vary"), ", "); !strings.Contains(vary, "Authorization") || !strings.Contains(vary, "X-API-Key") {
+		t.Errorf("expected Vary to cover Authorization and X-API-Key, got %q", vary)
+	}
+
+	w = doRequest(newTestServer(t, keys), http.MethodGet, "/persons/1", "", as)
+	if cc := w.Header().Get("Cache-Control"); cc != "" {
+		t.Errorf("expected no Cache-Control without masking, got %q", cc)
+	}
+}
@@ -0,0 +1,225 @@
+package server
+
+import (
+	"fmt"
+	"io"
+	"mime"
+	"net/http"
+	"strings"
+	"sync"
+
+	"github.com/gin-gonic/gin"
+	"github.com/klauspost/compress/gzip"
+	"github.com/klauspost/compress/zstd"
+)
+
+// Content codings responses can be compressed with
+const (
+	encodingZstd = "zstd"
+	encodingGzip = "gzip"
+)
+
+// defaultCompressMinSize is the smallest body worth compressing, smaller ones are sent as they are
+const defaultCompressMinSize = 1024
+
+// encoder is a pooled compressor, both gzip and zstd writers can be reset onto a new response
+type encoder interface {
+	io.WriteCloser
+	Flush() error
+	Reset(io.Writer)
+}
+
+var encoderPools = map[string]*sync.Pool{
+	encodingGzip: {New: func() any { return gzip.NewWriter(nil) }},
+	encodingZstd: {New: func() any {
+		// Concurrency 1 keeps each pooled encoder to a single goroutine and window
+		w, _ := zstd.NewWriter(nil, zstd.WithEncoderConcurrency(1))
+		return w
+	}},
+}
+
+// compressor compresses responses with the first of its encodings the client accepts, nil compresses nothing
+type compressor struct {
+	encodings []string
+	minSize   int
+}
+
+// parseCompression parses a comma separated list of encodings in order of preference, none disables compression
+func parseCompression(encodings string, minSize int) (*compressor, error) {
+	if strings.TrimSpace(encodings) == "none" {
+		return nil, nil
+	}
+	if minSize < 0 {
+		return nil, fmt.Errorf("COMPRESSION_MIN_SIZE must not be negative, got %v", minSize)
+	}
+
+	c := &compressor{minSize: minSize}
+	for _, encoding := range splitList(encodings) {
+		encoding = strings.ToLower(encoding)
+		if encoderPools[encoding] == nil {
+			return nil, fmt.Errorf("unknown compression %q, expected %q, %q or none", encoding, encodingZstd, encodingGzip)
+		}
+		c.encodings = append(c.encodings, encoding)
+	}
+	if len(c.encodings) == 0 {
+		return nil, nil
+	}
+	return c, nil
+}
+
+// compress encodes response bodies with the encoding negotiated through Accept-Encoding. Websocket upgrades,
+// event streams and bodies shorter than the minimum size are left alone.
+func (s *Server) compress(c *gin.Context) {
+	if s.compression == nil || c.GetHeader("Upgrade") != "" {
+		c.Next()
+		return
+	}
+
+	c.Writer.Header().Add("Vary", "Accept-Encoding")
+	accept := c.GetHeader("Accept-Encoding")
+	if accept == "" {
+		c.Next()
+		return
+	}
+	encoding := negotiate(accept, s.compression.encodings, encodingSpecificity)
+	if encoding == "" {
+		c.Next()
+		return
+	}
+
+	w := &compressWriter{ResponseWriter: c.Writer, encoding: encoding, minSize: s.compression.minSize}
+	c.Writer = w
+	defer func() {
+		c.Writer = w.ResponseWriter
+		if err := w.close(); err != nil {
+			c.Error(err)
+		}
+	}()
+	c.Next()
+}
+
+// encodingSpecificity matches Accept-Encoding values, an exact coding beats *
+func encodingSpecificity(value, offer string) int {
+	switch {
+	case value == offer, value == "x-"+offer:
+		return 1
+	case value == "*":
+		return 0
+	}
+	return -1
+}
+
+// compressible reports whether a response of this content type benefits from compression and is safe to buffer
+func compressible(contentType string) bool {
+	mediaType, _, _ := mime.ParseMediaType(contentType)
+	switch {
+	case mediaType == "text/event-stream":
+		// Events must reach the client as soon as they are written
+		return false
+	case strings.HasPrefix(mediaType, "text/"), strings.HasSuffix(mediaType, "+json"):
+		return true
+	}
+	switch mediaType {
+	case contentTypeJSON, contentTypeNDJSON, contentTypeMsgPack:
+		return true
+	}
+	return false
+}
+
+// compressWriter holds back the start of a body until it is long enough to compress, then either sends it
+// through an encoder or as it is
+type compressWriter struct {
+	gin.ResponseWriter
+	encoding string
+	minSize  int
+
+	decided bool
+	buf     []byte
+	enc     encoder
+}
+
+func (w *compressWriter) Write(b []byte) (int, error) {
+	if !w.decided {
+		if !compressible(w.Header().Get("Content-Type")) || w.Header().Get("Content-Encoding") != "" {
+			w.decided = true
+			return w.ResponseWriter.Write(b)
+		}
+		w.buf = append(w.buf, b...)
+		if len(w.buf) < w.minSize {
+			return len(b), nil
+		}
+		if err := w.decide(true); err != nil {
+			return 0, err
+		}
+		return len(b), nil
+	}
+
+	if w.enc != nil {
+		return w.enc.Write(b)
+	}
+	return w.ResponseWriter.Write(b)
+}
+
+// Unwrap lets http.ResponseController reach the connection, to set write deadlines
+func (w *compressWriter) Unwrap() http.ResponseWriter {
+	return w.ResponseWriter
+}
+
+func (w *compressWriter) WriteString(s string) (int, error) {
+	return w.Write([]byte(s))
+}
+
+// Flush sends what was written so far, a body flushed before reaching the minimum size is compressed anyway
+// since more is likely to follow
+func (w *compressWriter) Flush() {
+	if !w.decided && len(w.buf) > 0 {
+		w.decide(true)
+	}
+	if w.enc != nil {
+		w.enc.Flush()
+	}
+	w.ResponseWriter.Flush()
+}
+
+// decide starts compressing, or sends the body uncompressed, and writes what was held back
+func (w *compressWriter) decide(compress bool) error {
+	w.decided = true
+	buf := w.buf
+	w.buf = nil
+
+	if compress {
+		h := w.Header()
+		h.Set("Content-Encoding", w.encoding)
+		h.Del("Content-Length")
+		// The compressed bytes differ from the identity ones, so the entity tag can only be weak
+		if etag := h.Get("ETag"); etag != "" && !strings.HasPrefix(etag, "W/") {
+			h.Set("ETag", "W/"+etag)
+		}
+
+		w.enc = encoderPools[w.encoding].Get().(encoder)
+		w.enc.Reset(w.ResponseWriter)
+		_, err := w.enc.Write(buf)
+		return err
+	}
+	_, err := w.ResponseWriter.Write(buf)
+	return err
+}
+
+// close sends a body too short to compress, or ends the compressed one and returns the encoder to its pool
+func (w *compressWriter) close() error {
+	if !w.decided {
+		if len(w.buf) == 0 {
+			return nil
+		}
+		return w.decide(false)
+	}
+	if w.enc == nil {
+		return nil
+	}
+
+	err := w.enc.Close()
+	w.enc.Reset(io.Discard)
+	encoderPools[w.encoding].Put(w.enc)
+	w.enc = nil
+	return err
+}
@@ -0,0 +1,100 @@
+package server
+
+import (
+	"encoding/json"
+	"gocache/pkg/model"
+	"io"
+	"net/http"
+	"testing"
+
+	"github.com/klauspost/compress/gzip"
+	"github.com/klauspost/compress/zstd"
+)
+
+// withCompression configures the server like COMPRESSION and COMPRESSION_MIN_SIZE
+func withCompression(t *testing.T, encodings string, minSize int) func(*Server) {
+	t.Helper()
+	compression, err := parseCompression(encodings, minSize)
+	if err != nil {
+		t.Fatalf("parseCompression() error: %v", err)
+	}
+	return func(s *Server) { s.compression = compression }
+}
+
+func TestParseCompression(t *testing.T) {
+	c, err := parseCompression("gzip, ZSTD", 10)
+	if err != nil || len(c.encodings) != 2 || c.encodings[0] != encodingGzip || c.encodings[1] != encodingZstd {
+		t.Errorf("expected gzip then zstd, got %+v, %v", c, err)
+	}
+	for _, off := range []string{"none", " "} {
+		if c, err := parseCompression(off, 10); c != nil || err != nil {
+			t.Errorf("expected %q to disable compression, got %+v, %v", off, c, err)
+		}
+	}
+	if _, err := parseCompression("brotli", 10); err == nil {
+		t.Error("expected an error for an unknown encoding")
+	}
+	if _, err := parseCompression("gzip", -1); err == nil {
+		t.Error("expected an error for a negative minimum size")
+	}
+}
+
+func TestCompression(t *testing.T) {
+	h := newTestServer(t, withCompression(t, "zstd,gzip", 1))
+
+	want := doRequest(h, http.MethodGet, "/persons", "", nil)
+	if enc := want.Header().Get("Content-Encoding"); enc != "" {
+		t.Fatalf("expected no compression without Accept-Encoding, got %q", enc)
+	}
+
+	decoders := map[string]func(io.Reader) (io.Reader, error){
+		encodingGzip: func(r io.Reader) (io.Reader, error) { return gzip.NewReader(r) },
+		encodingZstd: func(r io.Reader) (io.Reader, error) { return zstd.NewReader(r) },
+	}
+	for accept, encoding := range map[string]string{"gzip, zstd": encodingZstd, "gzip": encodingGzip, "zstd;q=0.5, gzip": encodingGzip, "*": encodingZstd} {
+		w := doRequest(h, http.MethodGet, "/persons", "", map[string]string{"Accept-Encoding": accept})
+		if got := w.Header().Get("Content-Encoding"); got != encoding {
+			t.Errorf("Accept-Encoding %q: expected %v, got %q", accept, encoding, got)
+			continue
+		}
+		r, err := decoders[encoding](w.Body)
+		if err != nil {
+			t.Fatalf("error reading %v body: %v", encoding, err)
+		}
+		body, err := io.ReadAll(r)
+		if err != nil || string(body) != want.Body.String() {
+			t.Errorf("expected the %v body to decode to %s, got %s (%v)", encoding, want.Body.String(), body, err)
+		}
+	}
+
+	w := doRequest(h, http.MethodGet, "/persons", "", map[string]string{"Accept-Encoding": "br, identity"})
+	if enc := w.Header().Get("Content-Encoding"); enc != "" || w.Body.String() != want.Body.String() {
+		t.Errorf("expected an uncompressed body for unsupported encodings, got %q", enc)
+	}
+
+	// A compressed single person keeps a weak ETag, which still matches If-None-Match
+	w = doRequest(h, http.MethodGet, "/persons/1", "", map[string]string{"Accept-Encoding": "gzip"})
+	if etag := w.Header().Get("ETag"); etag != `W/"0"` {
+		t.Errorf(`expected ETag W/"0", got %q`, etag)
+	}
+	w = doRequest(h, http.MethodGet, "/persons/1", "", map[string]string{"Accept-Encoding": "gzip", "If-None-Match": `W/"0"`})
+	if w.Code != http.StatusNotModified {
+		t.Errorf("expected 304, got %d", w.Code)
+	}
+}
+
+func TestCompressionMinSize(t *testing.T) {
+	h := newTestServer(t, withCompression(t, "gzip", 1<<20))
+
+	w := doRequest(h, http.MethodGet, "/persons", "", map[string]string{"Accept-Encoding": "gzip"})
+	if enc := w.Header().Get("Content-Encoding"); enc != "" {
+		t.Errorf("expected a short body to be sent uncompressed, got %q", enc)
+	}
+	var persons []model.Person
+	if err := json.Unmarshal(w.Body.Bytes(), &persons); err != nil || len(persons) == 0 {
+		t.Errorf("expected the plain list, got %s (%v)", w.Body.String(), err)
+	}
+	if vary := w.Header().Values("Vary"); len(vary) == 0 {
+		t.Error("expected Vary: Accept-Encoding")
+	}
+}
@@ -0,0 +1,94 @@
+package server
+
+import (
+	"fmt"
+	"net/http"
+	"slices"
+	"strings"
+
+	"github.com/gin-contrib/cors"
+)
+
+// By default only the frontend's dev server may call the API from a browser
+var (
+	defaultAllowedOrigins = []string{"http://localhost:5173"}
+	defaultAllowedMethods = []string{http.MethodGet, http.MethodPost, http.MethodPatch}
+)
+
+// anyOrigin allows every origin, browsers then refuse to send credentials
+const anyOrigin = "*"
+
+// corsSettings are the origins browsers may call the API from and the methods they may use,
+// the zero value uses the defaults
+type corsSettings struct {
+	origins []string
+	methods []string
+}
+
+// parseCORS parses comma separated lists of origins and methods, either may be empty to keep the default
+func parseCORS(origins, methods string) (corsSettings, error) {
+	var s corsSettings
+	for _, origin := range splitList(origins) {
+		if origin != anyOrigin && !strings.HasPrefix(origin, "http://") && !strings.HasPrefix(origin, "https://") {
+			return corsSettings{}, fmt.Errorf("error parsing CORS origin %q: expected * or a scheme://host[:port] origin", origin)
+		}
+		s.origins = append(s.origins, strings.TrimSuffix(origin, "/"))
+	}
+	for _, method := range splitList(methods) {
+		method = strings.ToUpper(method)
+		if !slices.Contains([]string{http.MethodGet, http.MethodHead, http.MethodPost, http.MethodPut, http.MethodPatch, http.MethodDelete}, method) {
+			return corsSettings{}, fmt.Errorf("error parsing CORS method %q", method)
+		}
+		s.methods = append(s.methods, method)
+	}
+	return s, nil
+}
+
+// splitList splits a comma separated list, dropping blank entries
+func splitList(s string) []string {
+	var items []string
+	for _, item := range strings.Split(s, ",") {
+		if item = strings.TrimSpace(item); item != "" {
+			items = append(items, item)
+		}
+	}
+	return items
+}
+
+func (s corsSettings) allowedOrigins() []string {
+	if len(s.origins) == 0 {
+		return defaultAllowedOrigins
+	}
+	return s.origins
+}
+
+func (s corsSettings) allowedMethods() []string {
+	if len(s.methods) == 0 {
+		return defaultAllowedMethods
+	}
+	return s.methods
+}
+
+// config returns the CORS middleware configuration
+func (s corsSettings) config() cors.Config {
+	cfg := cors.Config{
+		AllowMethods:  s.allowedMethods(),
+		AllowHeaders:  []string{"Accept", "Authorization", "X-API-Key", "Content-Type", "If-Match", "If-None-Match", "Last-Event-ID", "traceparent", "tracestate"},
+		ExposeHeaders: []string{"ETag"},
+	}
+	if slices.Contains(s.allowedOrigins(), anyOrigin) {
+		cfg.AllowAllOrigins = true
+	} else {
+		cfg.AllowOrigins = s.allowedOrigins()
+		cfg.AllowCredentials = true // Enable cookies/auth
+	}
+	return cfg
+}
+
+// checkOrigin reports whether a browser on the request's origin may open a websocket, requests without an
+// Origin header don't come from a browser
+func (s corsSettings) checkOrigin(r *http.Request) bool {
+	origin := r.Header.Get("Origin")
+	origins := s.allowedOrigins()
+	return origin == "" || slices.Contains(origins, anyOrigin) || slices.Contains(origins, origin)
+}
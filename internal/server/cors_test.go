@@ -0,0 +1,89 @@
+package server
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"slices"
+	"testing"
+)
+
+// withCORS configures the server like CORS_ALLOWED_ORIGINS and CORS_ALLOWED_METHODS
+func withCORS(t *testing.T, origins, methods string) func(*Server) {
+	t.Helper()
+	settings, err := parseCORS(origins, methods)
+	if err != nil {
+		t.Fatalf("parseCORS() error: %v", err)
+	}
+	return func(s *Server) { s.cors = settings }
+}
+
+func TestParseCORS(t *testing.T) {
+	s, err := parseCORS(" https://app.example.com/, http://localhost:3000 ", "get,patch")
+	if err != nil {
+		t.Fatalf("parseCORS() error: %v", err)
+	}
+	if want := []string{"https://app.example.com", "http://localhost:3000"}; !slices.Equal(s.allowedOrigins(), want) {
+		t.Errorf("expected origins %v, got %v", want, s.allowedOrigins())
+	}
+	if want := []string{http.MethodGet, http.MethodPatch}; !slices.Equal(s.allowedMethods(), want) {
+		t.Errorf("expected methods %v, got %v", want, s.allowedMethods())
+	}
+
+	if s, err := parseCORS("", ""); err != nil || !slices.Equal(s.allowedOrigins(), defaultAllowedOrigins) || !slices.Equal(s.allowedMethods(), defaultAllowedMethods) {
+		t.Errorf("expected the defaults, got %+v, %v", s, err)
+	}
+	for _, bad := range [][2]string{{"app.example.com", ""}, {"", "FETCH"}} {
+		if _, err := parseCORS(bad[0], bad[1]); err == nil {
+			t.Errorf("expected an error for %q", bad)
+		}
+	}
+}
+
+func TestCORSPreflight(t *testing.T) {
+	h := newTestServer(t, withCORS(t, "https://app.example.com", "GET,POST,PATCH,DELETE"))
+
+	preflight := func(origin, method string) *httptest.ResponseRecorder {
+		return doRequest(h, http.MethodOptions, "/persons/1", "", map[string]string{"Origin": origin, "Access-Control-Request-Method": method})
+	}
+
+	w := preflight("https://app.example.com", http.MethodDelete)
+	if w.Code != http.StatusNoContent {
+		t.Fatalf("expected 204, got %d", w.Code)
+	}
+	if got := w.Header().Get("Access-Control-Allow-Origin"); got != "https://app.example.com" {
+		t.Errorf("expected the origin to be allowed, got %q", got)
+	}
+	if got := w.Header().Get("Access-Control-Allow-Methods"); got != "GET,POST,PATCH,DELETE" {
+		t.Errorf("expected the configured methods, got %q", got)
+	}
+
+	if w := preflight("http://localhost:5173", http.MethodGet); w.Code != http.StatusForbidden {
+		t.Errorf("expected the default origin to be replaced, got %d", w.Code)
+	}
+
+	// Any origin is allowed without credentials
+	h = newTestServer(t, withCORS(t, "*", ""))
+	w = doRequest(h, http.MethodGet, "/persons/1", "", map[string]string{"Origin": "https://elsewhere.example.com"})
+	if got := w.Header().Get("Access-Control-Allow-Origin"); got != "*" {
+		t.Errorf("expected every origin to be allowed, got %q", got)
+	}
+	if got := w.Header().Get("Access-Control-Allow-Credentials"); got != "" {
+		t.Errorf("expected no credentials for any origin, got %q", got)
+	}
+}
+
+func TestCORSCheckOrigin(t *testing.T) {
+	s, err := parseCORS("https://app.example.com", "")
+	if err != nil {
+		t.Fatalf("parseCORS() error: %v", err)
+	}
+	for origin, want := range map[string]bool{"https://app.example.com": true, "http://localhost:5173": false, "": true} {
+		r := httptest.NewRequest(http.MethodGet, "/persons/watch/ws", nil)
+		if origin != "" {
+			r.Header.Set("Origin", origin)
+		}
+		if got := s.checkOrigin(r); got != want {
+			t.Errorf("checkOrigin(%q) = %v, expected %v", origin, got, want)
+		}
+	}
+}
@@ -1,10 +1,13 @@
 package server
 
 import (
+	"errors"
+	"gocache/internal/datasource"
 	"gocache/internal/logger"
 	"gocache/pkg/model"
 	"net/http"
 	"strconv"
+	"strings"
 
 	"github.com/gin-gonic/gin"
 )
@@ -20,62 +23,307 @@ func (s *Server) healthHandler(c *gin.Context) {
 }
 
 func (s *Server) getPersonsHandler(c *gin.Context) {
-	logger.Logger.Infof("ROUTE: getPersonsHandler called: %v %v ", c.Request.Method, c.Request.URL.Path)
-	persons, err := s.pc.GetAllPersons()
+	logger.Logger.WithContext(c.Request.Context()).Infof("ROUTE: getPersonsHandler called: %v %v ", c.Request.Method, c.Request.URL.Path)
+	persons, err := s.pc.GetAllPersons(c.Request.Context())
 	if err != nil {
-		logger.Logger.Errorf("ROUTE: getPersonsHandler error: %v", err)
+		logger.Logger.WithContext(c.Request.Context()).Errorf("ROUTE: getPersonsHandler error: %v", err)
 		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
 		return
 	}
 
-	logger.Logger.Infof("ROUTE: getPersonsHandler success: found %v persons", len(persons))
+	logger.Logger.WithContext(c.Request.Context()).Infof("ROUTE: getPersonsHandler success: found %v persons", len(persons))
 
-	c.JSON(http.StatusOK, persons)
+	s.respondPersons(c, persons)
 }
 
 func (s *Server) queryPersonsHandler(c *gin.Context) {
 	name := c.Query("name")
 	email := c.Query("email")
 	ageStr := c.QueryArray("ages")
-	logger.Logger.Infof("ROUTE: queryPersonsHandler called: %v %v name=%v, email=%v, ages=%v", c.Request.Method, c.Request.URL.Path, name, email, ageStr)
+	logger.Logger.WithContext(c.Request.Context()).Infof("ROUTE: queryPersonsHandler called: %v %v name=%v, email=%v, ages=%v", c.Request.Method, c.Request.URL.Path, name, email, ageStr)
 
 	ages, err := stringSliceToIntSlice(ageStr)
 	if err != nil {
-		logger.Logger.Errorf("ROUTE: queryPersonsHandler error converting string slice to int slice: %v", err)
+		logger.Logger.WithContext(c.Request.Context()).Errorf("ROUTE: queryPersonsHandler error converting string slice to int slice: %v", err)
 		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid ages parameter"})
 		return
 	}
 
-	persons, err := s.pc.Query(name, email, ages)
+	if err := s.mask.Filter(c.Request.Context(), model.Filter{Email: email}); err != nil {
+		logger.Logger.WithContext(c.Request.Context()).Errorf("ROUTE: queryPersonsHandler error: %v", err)
+		c.JSON(http.StatusForbidden, gin.H{"error": err.Error()})
+		return
+	}
+
+	persons, err := s.pc.Query(c.Request.Context(), name, email, ages)
 	if err != nil {
-		logger.Logger.Errorf("ROUTE: queryPersonsHandler error: %v", err)
+		logger.Logger.WithContext(c.Request.Context()).Errorf("ROUTE: queryPersonsHandler error: %v", err)
 		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to query persons"})
 		return
 	}
 
-	logger.Logger.Infof("ROUTE: queryPersonsHandler success: found %v persons", len(persons))
-	c.JSON(http.StatusOK, persons)
+	logger.Logger.WithContext(c.Request.Context()).Infof("ROUTE: queryPersonsHandler success: found %v persons", len(persons))
+	s.respondPersons(c, persons)
+}
+
+// exportFormats maps the format parameter of an export to the media type it is streamed as
+var exportFormats = map[string]string{
+	datasource.FormatNDJSON: contentTypeNDJSON,
+	datasource.FormatCSV:    contentTypeCSV,
+}
+
+// exportPersonsHandler streams the persons matching the filter parameters from a view of the store, so the
+// export is consistent and takes constant memory however many persons it holds
+func (s *Server) exportPersonsHandler(c *gin.Context) {
+	format := c.DefaultQuery("format", datasource.FormatNDJSON)
+	name := c.Query("name")
+	email := c.Query("email")
+	ageStr := c.QueryArray("ages")
+	logger.Logger.WithContext(c.Request.Context()).Infof("ROUTE: exportPersonsHandler called: %v %v format=%v, name=%v, email=%v, ages=%v", c.Request.Method, c.Request.URL.Path, format, name, email, ageStr)
+
+	mediaType, ok := exportFormats[format]
+	if !ok {
+		logger.Logger.WithContext(c.Request.Context()).Errorf("ROUTE: exportPersonsHandler unknown format: %v", format)
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid format parameter"})
+		return
+	}
+
+	ages, err := stringSliceToIntSlice(ageStr)
+	if err != nil {
+		logger.Logger.WithContext(c.Request.Context()).Errorf("ROUTE: exportPersonsHandler error converting string slice to int slice: %v", err)
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid ages parameter"})
+		return
+	}
+
+	filter := model.Filter{Name: name, Email: email, Ages: ages}
+	if err := s.mask.Filter(c.Request.Context(), filter); err != nil {
+		logger.Logger.WithContext(c.Request.Context()).Errorf("ROUTE: exportPersonsHandler error: %v", err)
+		c.JSON(http.StatusForbidden, gin.H{"error": err.Error()})
+		return
+	}
+
+	persons, err := s.pc.Export(c.Request.Context(), filter)
+	if err != nil {
+		logger.Logger.WithContext(c.Request.Context()).Errorf("ROUTE: exportPersonsHandler error: %v", err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to export persons"})
+		return
+	}
+
+	masked := func(yield func(model.Person) bool) {
+		for p := range persons {
+			if !yield(s.mask.Person(c.Request.Context(), p)) {
+				return
+			}
+		}
+	}
+	c.Header("Content-Disposition", `attachment; filename="persons.`+format+`"`)
+	count, err := streamPersons(c, mediaType, masked)
+	if err != nil {
+		// The status is sent by now, so a client that went away is only logged
+		logger.Logger.WithContext(c.Request.Context()).Errorf("ROUTE: exportPersonsHandler error after %v persons: %v", count, err)
+		return
+	}
+	logger.Logger.WithContext(c.Request.Context()).Infof("ROUTE: exportPersonsHandler success: exported %v persons", count)
+}
+
+func (s *Server) getPersonHandler(c *gin.Context) {
+	logger.Logger.WithContext(c.Request.Context()).Infof("ROUTE: getPersonHandler called: %v %v", c.Request.Method, c.Request.URL.Path)
+	id, err := strconv.Atoi(c.Param("id"))
+	if err != nil {
+		logger.Logger.WithContext(c.Request.Context()).Errorf("ROUTE: getPersonHandler error converting id: %v", err)
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid id parameter"})
+		return
+	}
+
+	person, err := s.pc.GetPerson(c.Request.Context(), id)
+	if err != nil {
+		logger.Logger.WithContext(c.Request.Context()).Errorf("ROUTE: getPersonHandler error: %v", err)
+		c.JSON(http.StatusNotFound, gin.H{"error": err.Error()})
+		return
+	}
+
+	etag := personETag(person)
+	c.Header("ETag", etag)
+	if etagMatches(c.GetHeader("If-None-Match"), etag, true) {
+		logger.Logger.WithContext(c.Request.Context()).Infof("ROUTE: getPersonHandler not modified: person %v", id)
+		c.Status(http.StatusNotModified)
+		return
+	}
+
+	logger.Logger.WithContext(c.Request.Context()).Infof("ROUTE: getPersonHandler success: found person %v", id)
+	c.JSON(http.StatusOK, s.mask.Person(c.Request.Context(), person))
 }
 
 func (s *Server) updatePersonHandler(c *gin.Context) {
-	logger.Logger.Infof("ROUTE: updatePersonHandler called: %v %v", c.Request.Method, c.Request.URL.Path)
-	var person model.Person
-	if err := c.BindJSON(&person); err != nil {
-		logger.Logger.Errorf("ROUTE: updatePersonHandler error binding JSON: %v", err)
+	logger.Logger.WithContext(c.Request.Context()).Infof("ROUTE: updatePersonHandler called: %v %v by %v", c.Request.Method, c.Request.URL.Path, principalID(c))
+	var body struct {
+		model.Person
+		// Version shadows the person's so a body without one can be told apart from version 0
+		Version *int64 `json:"version"`
+	}
+	if err := c.BindJSON(&body); err != nil {
+		logger.Logger.WithContext(c.Request.Context()).Errorf("ROUTE: updatePersonHandler error binding JSON: %v", err)
 		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
 		return
 	}
+	person := body.Person
+	if err := person.Validate(); err != nil {
+		logger.Logger.WithContext(c.Request.Context()).Errorf("ROUTE: updatePersonHandler invalid person: %v", err)
+		respondInvalid(c, err)
+		return
+	}
 
-	err := s.pc.UpdatePerson(person)
+	// If-Match takes precedence over the version in the body, and without either the update is last-write-wins as it
+	// was before persons had versions
+	ifMatch := c.GetHeader("If-Match")
+	switch {
+	case ifMatch != "":
+		current, err := s.pc.GetPerson(c.Request.Context(), person.ID)
+		if err != nil || !etagMatches(ifMatch, personETag(current), false) {
+			logger.Logger.WithContext(c.Request.Context()).Errorf("ROUTE: updatePersonHandler precondition failed: If-Match=%v", ifMatch)
+			c.JSON(http.StatusPreconditionFailed, gin.H{"error": "If-Match does not match the current version"})
+			return
+		}
+		person.Version = current.Version
+	case body.Version != nil:
+		person.Version = *body.Version
+	default:
+		// A missing person is left for the update to report
+		if current, err := s.pc.GetPerson(c.Request.Context(), person.ID); err == nil {
+			person.Version = current.Version
+		}
+	}
+
+	updated, err := s.pc.UpdatePerson(c.Request.Context(), person)
+	if errors.Is(err, model.ErrNotFound) {
+		logger.Logger.WithContext(c.Request.Context()).Errorf("ROUTE: updatePersonHandler error: %v", err)
+		c.JSON(http.StatusNotFound, gin.H{"error": err.Error()})
+		return
+	}
+	if errors.Is(err, model.ErrConflict) {
+		logger.Logger.WithContext(c.Request.Context()).Errorf("ROUTE: updatePersonHandler error: %v", err)
+		s.respondConflict(c, person.ID, ifMatch != "", err)
+		return
+	}
 	if err != nil {
-		logger.Logger.Errorf("ROUTE: updatePersonHandler error: %v", err)
+		logger.Logger.WithContext(c.Request.Context()).Errorf("ROUTE: updatePersonHandler error: %v", err)
 		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
 		return
 	}
 
-	logger.Logger.Info("ROUTE: updatePersonHandler success")
+	logger.Logger.WithContext(c.Request.Context()).Info("ROUTE: updatePersonHandler success")
 
-	c.JSON(http.StatusOK, gin.H{"message": "Person updated successfully"})
+	c.Header("ETag", personETag(updated))
+	c.JSON(http.StatusOK, gin.H{"message": "Person updated successfully", "person": s.mask.Person(c.Request.Context(), updated)})
+}
+
+func (s *Server) patchPersonHandler(c *gin.Context) {
+	logger.Logger.WithContext(c.Request.Context()).Infof("ROUTE: patchPersonHandler called: %v %v by %v", c.Request.Method, c.Request.URL.Path, principalID(c))
+	id, err := strconv.Atoi(c.Param("id"))
+	if err != nil {
+		logger.Logger.WithContext(c.Request.Context()).Errorf("ROUTE: patchPersonHandler error converting id: %v", err)
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid id parameter"})
+		return
+	}
+
+	body, err := c.GetRawData()
+	if err != nil {
+		logger.Logger.WithContext(c.Request.Context()).Errorf("ROUTE: patchPersonHandler error reading body: %v", err)
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	ops, err := parsePatch(c.ContentType(), body)
+	if err != nil {
+		logger.Logger.WithContext(c.Request.Context()).Errorf("ROUTE: patchPersonHandler error parsing patch: %v", err)
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	if err := s.mask.Ops(c.Request.Context(), ops); err != nil {
+		logger.Logger.WithContext(c.Request.Context()).Errorf("ROUTE: patchPersonHandler error: %v", err)
+		c.JSON(http.StatusForbidden, gin.H{"error": err.Error()})
+		return
+	}
+
+	// If-Match becomes a version test so the patch only applies to the version the client saw
+	ifMatch := c.GetHeader("If-Match")
+	if ifMatch != "" && ifMatch != "*" {
+		current, err := s.pc.GetPerson(c.Request.Context(), id)
+		if err != nil || !etagMatches(ifMatch, personETag(current), false) {
+			logger.Logger.WithContext(c.Request.Context()).Errorf("ROUTE: patchPersonHandler precondition failed: If-Match=%v", ifMatch)
+			c.JSON(http.StatusPreconditionFailed, gin.H{"error": "If-Match does not match the current version"})
+			return
+		}
+		ops = append([]model.FieldOp{{Op: model.OpTest, Field: "version", Value: current.Version}}, ops...)
+	}
+
+	updated, err := s.pc.PatchPerson(c.Request.Context(), id, ops)
+	if errors.Is(err, model.ErrInvalidPerson) {
+		logger.Logger.WithContext(c.Request.Context()).Errorf("ROUTE: patchPersonHandler error: %v", err)
+		respondInvalid(c, err)
+		return
+	}
+	if errors.Is(err, model.ErrInvalidOp) {
+		logger.Logger.WithContext(c.Request.Context()).Errorf("ROUTE: patchPersonHandler error: %v", err)
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	if errors.Is(err, model.ErrNotFound) {
+		logger.Logger.WithContext(c.Request.Context()).Errorf("ROUTE: patchPersonHandler error: %v", err)
+		c.JSON(http.StatusNotFound, gin.H{"error": err.Error()})
+		return
+	}
+	if errors.Is(err, model.ErrTestFailed) {
+		logger.Logger.WithContext(c.Request.Context()).Errorf("ROUTE: patchPersonHandler error: %v", err)
+		s.respondConflict(c, id, ifMatch != "", err)
+		return
+	}
+	if err != nil {
+		logger.Logger.WithContext(c.Request.Context()).Errorf("ROUTE: patchPersonHandler error: %v", err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+
+	logger.Logger.WithContext(c.Request.Context()).Infof("ROUTE: patchPersonHandler success: person %v now at version %v", id, updated.Version)
+
+	c.Header("ETag", personETag(updated))
+	c.JSON(http.StatusOK, s.mask.Person(c.Request.Context(), updated))
+}
+
+func (s *Server) batchPersonsHandler(c *gin.Context) {
+	logger.Logger.WithContext(c.Request.Context()).Infof("ROUTE: batchPersonsHandler called: %v %v by %v", c.Request.Method, c.Request.URL.Path, principalID(c))
+	var ops []model.WriteOp
+	if err := c.BindJSON(&ops); err != nil {
+		logger.Logger.WithContext(c.Request.Context()).Errorf("ROUTE: batchPersonsHandler error binding JSON: %v", err)
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	results, err := s.pc.ApplyBatch(c.Request.Context(), ops)
+	if err != nil {
+		logger.Logger.WithContext(c.Request.Context()).Errorf("ROUTE: batchPersonsHandler error: %v", err)
+		body := gin.H{"error": err.Error()}
+		var opErr *model.OpError
+		if errors.As(err, &opErr) {
+			body["index"] = opErr.Index
+		}
+		var invalid *model.ValidationError
+		if errors.As(err, &invalid) {
+			body["fields"] = invalid.Fields
+		}
+		c.JSON(batchErrorStatus(err), body)
+		return
+	}
+
+	logger.Logger.WithContext(c.Request.Context()).Infof("ROUTE: batchPersonsHandler success: committed %v operations", len(results))
+	c.JSON(http.StatusOK, gin.H{"results": s.mask.Persons(c.Request.Context(), results)})
+}
+
+func (s *Server) queueHandler(c *gin.Context) {
+	depth := s.pc.QueueDepth()
+	logger.Logger.WithContext(c.Request.Context()).Infof("ROUTE: queueHandler called: %v %v depth=%v", c.Request.Method, c.Request.URL.Path, depth)
+
+	c.JSON(http.StatusOK, gin.H{"mode": s.writeMode, "depth": depth})
 }
 
 // Given a slice of strings, convert them to a slice of integers, if conversion fails return an error
@@ -100,3 +348,72 @@ func stringSliceToIntSlice(strSlice []string) ([]int, error) {
 	}
 	return intSlice, nil
 }
+
+// batchErrorStatus maps the error that aborted a batch to an HTTP status
+func batchErrorStatus(err error) int {
+	switch {
+	case errors.Is(err, model.ErrInvalidOp):
+		return http.StatusBadRequest
+	case errors.Is(err, model.ErrInvalidPerson):
+		return http.StatusUnprocessableEntity
+	case errors.Is(err, model.ErrNotFound):
+		return http.StatusNotFound
+	case errors.Is(err, model.ErrConflict), errors.Is(err, model.ErrAlreadyExists):
+		return http.StatusConflict
+	}
+	return http.StatusInternalServerError
+}
+
+// respondInvalid reports a person breaking the validation rules with 422 Unprocessable Entity and the invalid fields
+func respondInvalid(c *gin.Context, err error) {
+	body := gin.H{"error": err.Error()}
+	var invalid *model.ValidationError
+	if errors.As(err, &invalid) {
+		body["fields"] = invalid.Fields
+	}
+	c.JSON(http.StatusUnprocessableEntity, body)
+}
+
+// respondConflict reports a rejected write along with the person's current version so the client can retry,
+// conditional requests get 412 Precondition Failed and everything else 409 Conflict
+func (s *Server) respondConflict(c *gin.Context, id int, conditional bool, err error) {
+	status := http.StatusConflict
+	if conditional {
+		status = http.StatusPreconditionFailed
+	}
+
+	body := gin.H{"error": err.Error()}
+	if current, err := s.pc.GetPerson(c.Request.Context(), id); err == nil {
+		c.Header("ETag", personETag(current))
+		body["current"] = s.mask.Person(c.Request.Context(), current)
+	}
+	c.JSON(status, body)
+}
+
+// personETag returns the strong entity tag for a person, derived from its version
+func personETag(p model.Person) string {
+	return `"` + strconv.FormatInt(p.Version, 10) + `"`
+}
+
+// etagMatches reports whether an If-Match/If-None-Match header value matches the strong tag etag.
+// The header may list several tags or be "*". RFC 9110 compares If-None-Match weakly, so with weak set a weak tag
+// compares equal to its strong form, and If-Match strongly, where a weak tag such as a compressed response's never matches.
+func etagMatches(header, etag string, weak bool) bool {
+	if header == "" {
+		return false
+	}
+
+	for _, tag := range strings.Split(header, ",") {
+		tag = strings.TrimSpace(tag)
+		if strings.HasPrefix(tag, "W/") {
+			if !weak {
+				continue
+			}
+			tag = strings.TrimPrefix(tag, "W/")
+		}
+		if tag == "*" || tag == etag {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,452 @@
+package server
+
+import (
+	"encoding/json"
+	"gocache/internal/controller"
+	"gocache/internal/datasource"
+	"gocache/pkg/model"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/gin-gonic/gin"
+)
+
+// newTestServer serves the API in write-through mode, checking responses against the OpenAPI spec
+func newTestServer(t *testing.T, configure ...func(*Server)) http.Handler {
+	t.Helper()
+	return newTestAPI(t, configure...).RegisterRoutes()
+}
+
+// newTestAPI builds the server behind newTestServer for tests that reach into it. Each configure func adjusts the
+// server before its routes are registered, the controller reads a mock data source unless one of them sets it.
+func newTestAPI(t *testing.T, configure ...func(*Server)) *Server {
+	t.Helper()
+	gin.SetMode(gin.TestMode)
+
+	s := &Server{writeMode: writeModeThrough, watchDone: make(chan struct{}), onInvalidResponse: responseValidator(t)}
+	for _, c := range configure {
+		c(s)
+	}
+	if s.pc == nil {
+		pc, err := controller.NewPersonController(datasource.NewMockDataSource())
+		if err != nil {
+			t.Fatalf("NewPersonController() returned an error: %v", err)
+		}
+		s.pc = pc
+	}
+	t.Cleanup(s.stopWatches)
+	return s
+}
+
+func doRequest(h http.Handler, method, path, body string, headers map[string]string) *httptest.ResponseRecorder {
+	req := httptest.NewRequest(method, path, strings.NewReader(body))
+	req.Header.Set("Content-Type", "application/json")
+	for k, v := range headers {
+		req.Header.Set(k, v)
+	}
+
+	w := httptest.NewRecorder()
+	h.ServeHTTP(w, req)
+	return w
+}
+
+func TestGetPersonETag(t *testing.T) {
+	h := newTestServer(t)
+
+	w := doRequest(h, http.MethodGet, "/persons/1", "", nil)
+	if w.Code != http.StatusOK {
+		t.Fatalf("expected 200, got %d", w.Code)
+	}
+
+	etag := w.Header().Get("ETag")
+	if etag != `"0"` {
+		t.Fatalf(`expected ETag "0", got %q`, etag)
+	}
+
+	w = doRequest(h, http.MethodGet, "/persons/1", "", map[string]string{"If-None-Match": etag})
+	if w.Code != http.StatusNotModified {
+		t.Errorf("expected 304, got %d", w.Code)
+	}
+
+	w = doRequest(h, http.MethodGet, "/persons/999", "", nil)
+	if w.Code != http.StatusNotFound {
+		t.Errorf("expected 404, got %d", w.Code)
+	}
+}
+
+func TestUpdatePersonVersions(t *testing.T) {
+	h := newTestServer(t)
+
+	body := `{"id":1,"name":"John Smith","age":31,"email":"john.smith@example.com","version":0}`
+	w := doRequest(h, http.MethodPost, "/persons/update", body, nil)
+	if w.Code != http.StatusOK {
+		t.Fatalf("expected 200, got %d: %s", w.Code, w.Body.String())
+	}
+	if etag := w.Header().Get("ETag"); etag != `"1"` {
+		t.Errorf(`expected ETag "1", got %q`, etag)
+	}
+
+	// Replaying the same version is now stale
+	w = doRequest(h, http.MethodPost, "/persons/update", body, nil)
+	if w.Code != http.StatusConflict {
+		t.Fatalf("expected 409, got %d: %s", w.Code, w.Body.String())
+	}
+
+	var conflict struct {
+		Current struct {
+			Version int64 `json:"version"`
+		} `json:"current"`
+	}
+	if err := json.Unmarshal(w.Body.Bytes(), &conflict); err != nil || conflict.Current.Version != 1 {
+		t.Errorf("expected conflict body to carry current version 1, got %s", w.Body.String())
+	}
+}
+
+func TestUpdatePersonWithoutVersion(t *testing.T) {
+	h := newTestServer(t)
+
+	// Clients from before versions keep replacing whatever version is current
+	body := `{"id":1,"name":"John Smith","age":31,"email":"john.smith@example.com"}`
+	for _, want := range []string{`"1"`, `"2"`} {
+		w := doRequest(h, http.MethodPost, "/persons/update", body, nil)
+		if w.Code != http.StatusOK {
+			t.Fatalf("expected 200, got %d: %s", w.Code, w.Body.String())
+		}
+		if etag := w.Header().Get("ETag"); etag != want {
+			t.Errorf("expected ETag %s, got %q", want, etag)
+		}
+	}
+
+	body = `{"id":9,"name":"Nobody","age":31,"email":"nobody@example.com"}`
+	if w := doRequest(h, http.MethodPost, "/persons/update", body, nil); w.Code != http.StatusNotFound {
+		t.Errorf("expected 404 for a missing person, got %d", w.Code)
+	}
+}
+
+func TestUpdatePersonIfMatch(t *testing.T) {
+	h := newTestServer(t)
+
+	body := `{"id":2,"name":"Jane Doe","age":26,"email":"jane.doe@example.com"}`
+	w := doRequest(h, http.MethodPost, "/persons/update", body, map[string]string{"If-Match": `"5"`})
+	if w.Code != http.StatusPreconditionFailed {
+		t.Fatalf("expected 412, got %d", w.Code)
+	}
+
+	// A weak tag, such as a compressed response's, never satisfies If-Match
+	w = doRequest(h, http.MethodPost, "/persons/update", body, map[string]string{"If-Match": `W/"0"`})
+	if w.Code != http.StatusPreconditionFailed {
+		t.Fatalf("expected 412 for a weak tag, got %d", w.Code)
+	}
+
+	w = doRequest(h, http.MethodPost, "/persons/update", body, map[string]string{"If-Match": `"0"`})
+	if w.Code != http.StatusOK {
+		t.Fatalf("expected 200, got %d: %s", w.Code, w.Body.String())
+	}
+
+	w = doRequest(h, http.MethodPost, "/persons/update", body, map[string]string{"If-Match": "*"})
+	if w.Code != http.StatusOK {
+		t.Fatalf("expected 200 for If-Match *, got %d: %s", w.Code, w.Body.String())
+	}
+	if etag := w.Header().Get("ETag"); etag != `"2"` {
+		t.Errorf(`expected ETag "2", got %q`, etag)
+	}
+}
+
+func TestEtagMatches(t *testing.T) {
+	cases := []struct {
+		header     string
+		wantWeak   bool
+		wantStrong bool
+	}{
+		{header: ""},
+		{header: `"3"`, wantWeak: true, wantStrong: true},
+		{header: `W/"3"`, wantWeak: true},
+		{header: `W/"1", "3"`, wantWeak: true, wantStrong: true},
+		{header: "*", wantWeak: true, wantStrong: true},
+		{header: `"4"`},
+	}
+
+	for _, tc := range cases {
+		if got := etagMatches(tc.header, `"3"`, true); got != tc.wantWeak {
+			t.Errorf("weak etagMatches(%q) = %v, want %v", tc.header, got, tc.wantWeak)
+		}
+		if got := etagMatches(tc.header, `"3"`, false); got != tc.wantStrong {
+			t.Errorf("strong etagMatches(%q) = %v, want %v", tc.header, got, tc.wantStrong)
+		}
+	}
+}
+
+func TestPatchPersonJSONPatch(t *testing.T) {
+	h := newTestServer(t)
+
+	patch := `[{"op":"test","path":"/version","value":0},{"op":"inc","path":"/age","value":5},{"op":"replace","path":"/email","value":"john.new@example.com"}]`
+	w := doRequest(h, http.MethodPatch, "/persons/1", patch, map[string]string{"Content-Type": contentTypeJSONPatch})
+	if w.Code != http.StatusOK {
+		t.Fatalf("expected 200, got %d: %s", w.Code, w.Body.String())
+	}
+
+	var person struct {
+		Age     int    `json:"age"`
+		Email   string `json:"email"`
+		Version int64  `json:"version"`
+	}
+	json.Unmarshal(w.Body.Bytes(), &person)
+	if person.Age != 35 || person.Email != "john.new@example.com" || person.Version != 1 {
+		t.Errorf("expected age 35, new email and version 1, got %+v", person)
+	}
+
+	// The same test op is now stale
+	w = doRequest(h, http.MethodPatch, "/persons/1", patch, map[string]string{"Content-Type": contentTypeJSONPatch})
+	if w.Code != http.StatusConflict {
+		t.Errorf("expected 409, got %d: %s", w.Code, w.Body.String())
+	}
+}
+
+func TestPatchPersonMergePatch(t *testing.T) {
+	h := newTestServer(t)
+
+	w := doRequest(h, http.MethodPatch, "/persons/2", `{"name":"Jane Doe"}`, map[string]string{"Content-Type": contentTypeMergePatch, "If-Match": `"0"`})
+	if w.Code != http.StatusOK {
+		t.Fatalf("expected 200, got %d: %s", w.Code, w.Body.String())
+	}
+	if etag := w.Header().Get("ETag"); etag != `"1"` {
+		t.Errorf(`expected ETag "1", got %q`, etag)
+	}
+
+	w = doRequest(h, http.MethodPatch, "/persons/2", `{"name":"Jane Again"}`, map[string]string{"Content-Type": contentTypeMergePatch, "If-Match": `"0"`})
+	if w.Code != http.StatusPreconditionFailed {
+		t.Errorf("expected 412, got %d", w.Code)
+	}
+}
+
+func TestPatchPersonInvalid(t *testing.T) {
+	h := newTestServer(t)
+
+	cases := []struct {
+		body        string
+		contentType string
+		want        int
+	}{
+		{`{"id":5}`, contentTypeMergePatch, http.StatusBadRequest},
+		{`{"age":"old"}`, contentTypeMergePatch, http.StatusBadRequest},
+		{`{"name":null}`, contentTypeMergePatch, http.StatusBadRequest},
+		{`[{"op":"remove","path":"/name"}]`, contentTypeJSONPatch, http.StatusBadRequest},
+		{`name=x`, "text/plain", http.StatusBadRequest},
+	}
+
+	for _, tc := range cases {
+		w := doRequest(h, http.MethodPatch, "/persons/1", tc.body, map[string]string{"Content-Type": tc.contentType})
+		if w.Code != tc.want {
+			t.Errorf("PATCH %s (%s): expected %d, got %d", tc.body, tc.contentType, tc.want, w.Code)
+		}
+	}
+
+	w := doRequest(h, http.MethodPatch, "/persons/999", `{"name":"Nobody"}`, map[string]string{"Content-Type": contentTypeMergePatch})
+	if w.Code != http.StatusNotFound {
+		t.Errorf("expected 404, got %d", w.Code)
+	}
+}
+
+func TestBatchPersons(t *testing.T) {
+	h := newTestServer(t)
+
+	batch := `[
+		{"op":"update","person":{"id":1,"name":"John Doe","age":30,"email":"doe.household@example.com","version":0}},
+		{"op":"insert","person":{"id":3,"name":"Alice Doe","age":8,"email":"doe.household@example.com"}},
+		{"op":"delete","id":2}
+	]`
+	w := doRequest(h, http.MethodPost, "/persons/batch", batch, nil)
+	if w.Code != http.StatusOK {
+		t.Fatalf("expected 200, got %d: %s", w.Code, w.Body.String())
+	}
+
+	w = doRequest(h, http.MethodGet, "/persons/filter?email=doe.household@example.com", "", nil)
+	var persons []map[string]interface{}
+	json.Unmarshal(w.Body.Bytes(), &persons)
+	if len(persons) != 2 {
+		t.Errorf("expected 2 persons on the household email, got %s", w.Body.String())
+	}
+
+	if w = doRequest(h, http.MethodGet, "/persons/2", "", nil); w.Code != http.StatusNotFound {
+		t.Errorf("expected deleted person to be gone, got %d", w.Code)
+	}
+}
+
+func TestBatchPersonsAbortsOnFailure(t *testing.T) {
+	h := newTestServer(t)
+
+	batch := `[
+		{"op":"update","person":{"id":1,"name":"John Changed","age":30,"email":"john.doe@example.com","version":0}},
+		{"op":"insert","person":{"id":2,"name":"Duplicate","age":1,"email":"dup@example.com"}}
+	]`
+	w := doRequest(h, http.MethodPost, "/persons/batch", batch, nil)
+	if w.Code != http.StatusConflict {
+		t.Fatalf("expected 409, got %d: %s", w.Code, w.Body.String())
+	}
+
+	var body struct {
+		Index int `json:"index"`
+	}
+	if json.Unmarshal(w.Body.Bytes(), &body); body.Index != 1 {
+		t.Errorf("expected failing index 1, got %s", w.Body.String())
+	}
+
+	w = doRequest(h, http.MethodGet, "/persons/1", "", nil)
+	if strings.Contains(w.Body.String(), "John Changed") {
+		t.Errorf("expected aborted batch to leave person 1 untouched, got %s", w.Body.String())
+	}
+
+	if w = doRequest(h, http.MethodPost, "/persons/batch", `[{"op":"upsert","id":1}]`, nil); w.Code != http.StatusBadRequest {
+		t.Errorf("expected 400 for an unknown op, got %d", w.Code)
+	}
+}
+
+func TestInvalidPersonsAreUnprocessable(t *testing.T) {
+	h := newTestServer(t)
+
+	type response struct {
+		Index  *int `json:"index"`
+		Fields []struct {
+			Field string `json:"field"`
+		} `json:"fields"`
+	}
+	cases := []struct {
+		method, path, body, contentType string
+		fields                          []string
+	}{
+		{http.MethodPost, "/persons/update", `{"id":1,"name":"","age":-3,"email":"john","version":0}`, "application/json", []string{"name", "age", "email"}},
+		{http.MethodPatch, "/persons/1", `[{"op":"inc","path":"/age","value":200}]`, contentTypeJSONPatch, []string{"age"}},
+		{http.MethodPatch, "/persons/1", `{"email":"not an email"}`, contentTypeMergePatch, []string{"email"}},
+		{http.MethodPost, "/persons/batch", `[{"op":"delete","id":2},{"op":"insert","person":{"id":3,"name":"Alice","email":"alice"}}]`, "application/json", []string{"email"}},
+	}
+
+	for _, tc := range cases {
+		w := doRequest(h, tc.method, tc.path, tc.body, map[string]string{"Content-Type": tc.contentType})
+		if w.Code != http.StatusUnprocessableEntity {
+			t.Errorf("%v %v %v: expected 422, got %d: %s", tc.method, tc.path, tc.body, w.Code, w.Body.String())
+			continue
+		}
+
+		var body response
+		json.Unmarshal(w.Body.Bytes(), &body)
+		var fields []string
+		for _, f := range body.Fields {
+			fields = append(fields, f.Field)
+		}
+		if strings.Join(fields, ",") != strings.Join(tc.fields, ",") {
+			t.Errorf("%v %v: expected invalid fields %v, got %s", tc.method, tc.path, tc.fields, w.Body.String())
+		}
+		if tc.path == "/persons/batch" && (body.Index == nil || *body.Index != 1) {
+			t.Errorf("expected the failing batch index 1, got %s", w.Body.String())
+		}
+	}
+
+	// Nothing was written
+	w := doRequest(h, http.MethodGet, "/persons/1", "", nil)
+	if w.Header().Get("ETag") != `"0"` {
+		t.Errorf("expected person 1 to be untouched, got %s", w.Body.String())
+	}
+	if w = doRequest(h, http.MethodGet, "/persons/2", "", nil); w.Code != http.StatusOK {
+		t.Errorf("expected the rolled back batch to keep person 2, got %d", w.Code)
+	}
+}
+
+func TestExportPersons(t *testing.T) {
+	h := newTestServer(t)
+
+	w := doRequest(h, http.MethodGet, "/persons/export", "", nil)
+	if w.Code != http.StatusOK {
+		t.Fatalf("expected 200, got %d: %s", w.Code, w.Body.String())
+	}
+	if ct := w.Header().Get("Content-Type"); ct != contentTypeNDJSON {
+		t.Errorf("expected NDJSON by default, got %q", ct)
+	}
+	if cd := w.Header().Get("Content-Disposition"); cd != `attachment; filename="persons.ndjson"` {
+		t.Errorf("expected an attachment, got %q", cd)
+	}
+	var persons []model.Person
+	for dec := json.NewDecoder(w.Body); dec.More(); {
+		var p model.Person
+		if err := dec.Decode(&p); err != nil {
+			t.Fatalf("expected a person per line, got %v", err)
+		}
+		persons = append(persons, p)
+	}
+	if len(persons) != 2 {
+		t.Errorf("expected every person, got %+v", persons)
+	}
+
+	w = doRequest(h, http.MethodGet, "/persons/export?format=csv&name=Jane+Smith&ages=25&ages=40", "", nil)
+	if ct := w.Header().Get("Content-Type"); !strings.HasPrefix(ct, contentTypeCSV) {
+		t.Errorf("expected CSV, got %q", ct)
+	}
+	if want := "id,name,age,email,version\n2,Jane Smith,25,jane.smith@example.com,0\n"; w.Body.String() != want {
+		t.Errorf("expected %q, got %q", want, w.Body.String())
+	}
+
+	for _, path := range []string{"/persons/export?format=xml", "/persons/export?ages=old"} {
+		if w := doRequest(h, http.MethodGet, path, "", nil); w.Code != http.StatusBadRequest {
+			t.Errorf("%v: expected 400, got %d", path, w.Code)
+		}
+	}
+}
+
+func TestImportPersons(t *testing.T) {
+	h := newTestServer(t)
+	csvUpload := "id,name,age,email\n" +
+		"3,Alice Johnson,8,alice@example.com\n" +
+		"4,Bob Brown,old,bob@example.com\n" +
+		"5,Carol White,41,not-an-email\n" +
+		"1,John Doe,30,john@example.com\n"
+
+	w := doRequest(h, http.MethodPost, "/persons/import?dry_run=true", csvUpload, map[string]string{"Content-Type": "text/csv"})
+	if w.Code != http.StatusOK {
+		t.Fatalf("expected 200, got %d: %s", w.Code, w.Body.String())
+	}
+	var report importReport
+	if err := json.Unmarshal(w.Body.Bytes(), &report); err != nil {
+		t.Fatalf("error decoding report: %v", err)
+	}
+	if !report.DryRun || report.Rows != 4 || report.Imported != 1 || report.Failed != 3 {
+		t.Fatalf("unexpected report %+v", report)
+	}
+	for i, line := range []int{3, 4, 5} {
+		if report.Errors[i].Line != line {
+			t.Errorf("expected errors on lines 3, 4 and 5, got %+v", report.Errors)
+		}
+	}
+	if fields := report.Errors[1].Fields; len(fields) != 1 || fields[0].Field != "email" || report.Errors[1].ID != 5 {
+		t.Errorf("expected the invalid email of person 5 to be reported, got %+v", report.Errors[1])
+	}
+	if w := doRequest(h, http.MethodGet, "/persons/3", "", nil); w.Code != http.StatusNotFound {
+		t.Fatalf("expected a dry run to write nothing, got %d", w.Code)
+	}
+
+	ndjson := "{\"id\":3,\"name\":\"Alice Johnson\",\"age\":8,\"email\":\"alice@example.com\"}\n{\"id\":\n"
+	w = doRequest(h, http.MethodPost, "/persons/import", ndjson, map[string]string{"Content-Type": "application/x-ndjson"})
+	json.Unmarshal(w.Body.Bytes(), &report)
+	if w.Code != http.StatusOK || report.DryRun || report.Imported != 1 || report.Failed != 1 || report.Errors[0].Line != 2 {
+		t.Fatalf("expected one row imported and line 2 rejected, got %d: %s", w.Code, w.Body.String())
+	}
+	if w := doRequest(h, http.MethodGet, "/persons/3", "", nil); w.Code != http.StatusOK {
+		t.Fatalf("expected the imported person, got %d", w.Code)
+	}
+
+	if w := doRequest(h, http.MethodPost, "/persons/import", "[]", nil); w.Code != http.StatusUnsupportedMediaType {
+		t.Errorf("expected 415 for JSON, got %d", w.Code)
+	}
+	if w := doRequest(h, http.MethodPost, "/persons/import", "id,name\n", map[string]string{"Content-Type": "text/csv"}); w.Code != http.StatusBadRequest {
+		t.Errorf("expected 400 for missing columns, got %d", w.Code)
+	}
+}
+
+func TestImportPersonsSizeLimit(t *testing.T) {
+	h := newTestServer(t, func(s *Server) { s.importMaxBytes = 64 })
+
+	upload := "id,name,age,email\n" + strings.Repeat("3,Alice Johnson,8,alice@example.com\n", 4)
+	if w := doRequest(h, http.MethodPost, "/persons/import", upload, map[string]string{"Content-Type": "text/csv"}); w.Code != http.StatusRequestEntityTooLarge {
+		t.Errorf("expected 413, got %d: %s", w.Code, w.Body.String())
+	}
+}
@@ -0,0 +1,147 @@
+package server
+
+import (
+	"errors"
+	"gocache/internal/datasource"
+	"gocache/internal/logger"
+	"gocache/pkg/model"
+	"io"
+	"net/http"
+	"slices"
+	"strconv"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// defaultImportMaxBytes bounds an import upload unless IMPORT_MAX_BYTES is set
+const defaultImportMaxBytes = 64 << 20
+
+const (
+	// importReadEvery is how many rows are read between extensions of the connection deadlines
+	importReadEvery = 1000
+	// importReadTimeout bounds reading each batch of rows and writing the report, so a large upload isn't cut off by
+	// the server's timeouts while a client that stops sending still is
+	importReadTimeout = 10 * time.Second
+)
+
+// importFormats maps the media types an import can be uploaded as to their row format
+var importFormats = map[string]string{
+	contentTypeNDJSON: datasource.FormatNDJSON,
+	contentTypeCSV:    datasource.FormatCSV,
+}
+
+// importRowError is one rejected row of an import report
+type importRowError struct {
+	Line   int                `json:"line"`
+	ID     int                `json:"id,omitempty"`
+	Error  string             `json:"error"`
+	Fields []model.FieldError `json:"fields,omitempty"`
+}
+
+// importReport is the response to an import, rows that aren't listed in Errors were (or would be) imported
+type importReport struct {
+	DryRun   bool             `json:"dry_run"`
+	Rows     int              `json:"rows"`
+	Imported int              `json:"imported"`
+	Failed   int              `json:"failed"`
+	Errors   []importRowError `json:"errors"`
+}
+
+// importPersonsHandler inserts the persons of an NDJSON or CSV upload. Each row is decoded and validated on its
+// own, so bad rows are listed in the report by line while the others are imported. With dry_run nothing is written.
+func (s *Server) importPersonsHandler(c *gin.Context) {
+	ctx := c.Request.Context()
+	logger.Logger.WithContext(ctx).Infof("ROUTE: importPersonsHandler called: %v %v by %v", c.Request.Method, c.Request.URL.Path, principalID(c))
+
+	dryRun, err := strconv.ParseBool(c.DefaultQuery("dry_run", "false"))
+	if err != nil {
+		logger.Logger.WithContext(ctx).Errorf("ROUTE: importPersonsHandler error parsing dry_run: %v", err)
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid dry_run parameter"})
+		return
+	}
+
+	mediaType := c.ContentType()
+	if alias, ok := mediaTypeAliases[mediaType]; ok {
+		mediaType = alias
+	}
+	format, ok := importFormats[mediaType]
+	if !ok {
+		logger.Logger.WithContext(ctx).Errorf("ROUTE: importPersonsHandler unsupported Content-Type=%v", c.ContentType())
+		c.JSON(http.StatusUnsupportedMediaType, gin.H{"error": "Supported types are " + contentTypeNDJSON + ", " + contentTypeCSV})
+		return
+	}
+
+	body := c.Request.Body
+	if s.importMaxBytes > 0 {
+		body = http.MaxBytesReader(c.Writer, body, s.importMaxBytes)
+	}
+	rc := http.NewResponseController(c.Writer)
+	extendDeadlines := func() {
+		rc.SetReadDeadline(time.Now().Add(importReadTimeout))
+		rc.SetWriteDeadline(time.Now().Add(importReadTimeout))
+	}
+	extendDeadlines()
+
+	report := importReport{DryRun: dryRun, Errors: make([]importRowError, 0)}
+	pr, err := datasource.NewPersonReader(body, format)
+	if err != nil {
+		respondImportReadError(c, err)
+		return
+	}
+	var persons []model.Person
+	var lines []int
+	for {
+		p, err := pr.Read()
+		if errors.Is(err, io.EOF) {
+			break
+		}
+		var rowErr *datasource.RowError
+		if errors.As(err, &rowErr) {
+			report.Errors = append(report.Errors, importRowError{Line: rowErr.Line, Error: rowErr.Err.Error()})
+		} else if err != nil {
+			respondImportReadError(c, err)
+			return
+		} else {
+			persons = append(persons, p)
+			lines = append(lines, pr.Line())
+		}
+		if report.Rows++; report.Rows%importReadEvery == 0 {
+			extendDeadlines()
+		}
+	}
+
+	result, err := s.pc.Import(ctx, persons, dryRun)
+	if err != nil {
+		logger.Logger.WithContext(ctx).Errorf("ROUTE: importPersonsHandler error: %v", err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to import persons"})
+		return
+	}
+
+	rc.SetWriteDeadline(time.Now().Add(importReadTimeout))
+	for _, failed := range result.Failed {
+		rowErr := importRowError{Line: lines[failed.Index], ID: persons[failed.Index].ID, Error: failed.Err.Error()}
+		var invalid *model.ValidationError
+		if errors.As(failed.Err, &invalid) {
+			rowErr.Fields = invalid.Fields
+		}
+		report.Errors = append(report.Errors, rowErr)
+	}
+	slices.SortStableFunc(report.Errors, func(a, b importRowError) int { return a.Line - b.Line })
+	report.Imported = result.Imported
+	report.Failed = len(report.Errors)
+
+	logger.Logger.WithContext(ctx).Infof("ROUTE: importPersonsHandler success: %v rows, imported %v, failed %v, dryRun=%v", report.Rows, report.Imported, report.Failed, dryRun)
+	c.JSON(http.StatusOK, report)
+}
+
+// respondImportReadError reports an upload that can't be read row by row, 413 when it is over the size limit
+func respondImportReadError(c *gin.Context, err error) {
+	logger.Logger.WithContext(c.Request.Context()).Errorf("ROUTE: importPersonsHandler error reading upload: %v", err)
+	var tooLarge *http.MaxBytesError
+	if errors.As(err, &tooLarge) {
+		c.JSON(http.StatusRequestEntityTooLarge, gin.H{"error": "Upload is larger than " + strconv.FormatInt(tooLarge.Limit, 10) + " bytes"})
+		return
+	}
+	c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+}
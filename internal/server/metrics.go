@@ -0,0 +1,33 @@
+package server
+
+import (
+	"gocache/internal/metrics"
+	"strconv"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+)
+
+// unmatchedRoute labels requests no route matched, so scans of random paths can't create a series each
+const unmatchedRoute = "unmatched"
+
+// instrument records the count and latency of every request by route and status
+func (s *Server) instrument(c *gin.Context) {
+	start := time.Now()
+	c.Next()
+
+	route := c.FullPath()
+	if route == "" {
+		route = unmatchedRoute
+	}
+	status := strconv.Itoa(c.Writer.Status())
+	metrics.HTTPRequests.WithLabelValues(c.Request.Method, route, status).Inc()
+	metrics.HTTPDuration.WithLabelValues(c.Request.Method, route, status).Observe(time.Since(start).Seconds())
+}
+
+// metricsHandler serves the metrics of the server, the store of its person controller included
+func (s *Server) metricsHandler() gin.HandlerFunc {
+	registry := metrics.NewRegistry(metrics.NewStoreCollector(s.pc.StoreStats, s.pc.QueueDepth))
+	return gin.WrapH(promhttp.HandlerFor(registry, promhttp.HandlerOpts{}))
+}
@@ -0,0 +1,46 @@
+package server
+
+import (
+	"fmt"
+	"net/http"
+	"strings"
+	"testing"
+)
+
+func TestMetrics(t *testing.T) {
+	h := newTestServer(t)
+
+	doRequest(h, http.MethodGet, "/persons/1", "", nil)
+	doRequest(h, http.MethodGet, "/persons/999", "", nil)
+	doRequest(h, http.MethodGet, "/no/such/route", "", nil)
+	persons := doRequest(h, http.MethodGet, "/persons", "", nil)
+	count := strings.Count(persons.Body.String(), `"id":`)
+
+	w := doRequest(h, http.MethodGet, "/metrics", "", nil)
+	if w.Code != http.StatusOK {
+		t.Fatalf("expected 200, got %d", w.Code)
+	}
+	if ct := w.Header().Get("Content-Type"); !strings.HasPrefix(ct, "text/plain") {
+		t.Errorf("expected the Prometheus text format, got %q", ct)
+	}
+
+	body := w.Body.String()
+	for _, series := range []string{
+		`gocache_http_requests_total{method="GET",route="/persons/:id",status="200"}`,
+		`gocache_http_requests_total{method="GET",route="/persons/:id",status="404"}`,
+		`gocache_http_requests_total{method="GET",route="unmatched",status="404"}`,
+		`gocache_http_request_duration_seconds_bucket{method="GET",route="/persons",status="200",le="+Inf"}`,
+		`gocache_cache_lookups_total{result="hit"}`,
+		`gocache_cache_lookups_total{result="miss"}`,
+		`gocache_warmup_persons_total{phase="full"}`,
+		`gocache_warmup_duration_seconds`,
+		fmt.Sprintf("gocache_store_persons %d\n", count),
+		fmt.Sprintf("gocache_store_index_keys{index=\"id\"} %d\n", count),
+		"gocache_write_queue_depth 0\n",
+		"go_goroutines",
+	} {
+		if !strings.Contains(body, series) {
+			t.Errorf("expected %s in the metrics", series)
+		}
+	}
+}
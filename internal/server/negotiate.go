@@ -0,0 +1,185 @@
+package server
+
+import (
+	"gocache/internal/datasource"
+	"gocache/internal/logger"
+	"gocache/pkg/model"
+	"iter"
+	"net/http"
+	"slices"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/gin-gonic/gin/render"
+)
+
+const (
+	contentTypeJSON    = "application/json"
+	contentTypeNDJSON  = "application/x-ndjson"
+	contentTypeCSV     = "text/csv"
+	contentTypeMsgPack = "application/msgpack"
+)
+
+// personListTypes are the media types person lists can be sent as, JSON first as the default
+var personListTypes = []string{contentTypeJSON, contentTypeNDJSON, contentTypeCSV, contentTypeMsgPack}
+
+// mediaTypeAliases maps unregistered names clients use to the media type offered
+var mediaTypeAliases = map[string]string{
+	"application/ndjson":    contentTypeNDJSON,
+	"application/jsonl":     contentTypeNDJSON,
+	"application/x-msgpack": contentTypeMsgPack,
+}
+
+// respondPersons sends a person list in the media type the Accept header prefers, 406 Not Acceptable when it
+// accepts none. NDJSON and CSV are written a person at a time.
+func (s *Server) respondPersons(c *gin.Context, persons []model.Person) {
+	c.Writer.Header().Add("Vary", "Accept")
+	persons = s.mask.Persons(c.Request.Context(), persons)
+
+	switch mediaType := negotiate(c.GetHeader("Accept"), personListTypes, mediaRangeSpecificity); mediaType {
+	case contentTypeJSON:
+		c.JSON(http.StatusOK, persons)
+	case contentTypeNDJSON, contentTypeCSV:
+		if _, err := streamPersons(c, mediaType, slices.Values(persons)); err != nil {
+			// The status is sent by now, so a client that went away is only logged
+			logger.Logger.WithContext(c.Request.Context()).Errorf("ROUTE: error writing %v persons: %v", mediaType, err)
+		}
+	case contentTypeMsgPack:
+		c.Render(http.StatusOK, render.MsgPack{Data: persons})
+	default:
+		logger.Logger.WithContext(c.Request.Context()).Errorf("ROUTE: no acceptable person list type for Accept=%v", c.GetHeader("Accept"))
+		c.JSON(http.StatusNotAcceptable, gin.H{"error": "Acceptable types are " + strings.Join(personListTypes, ", ")})
+	}
+}
+
+// streamFormats maps the media types persons are streamed as to their data file format
+var streamFormats = map[string]string{
+	contentTypeNDJSON: datasource.FormatNDJSON,
+	contentTypeCSV:    datasource.FormatCSV,
+}
+
+const (
+	// streamFlushEvery is how many persons are written between flushes to the client
+	streamFlushEvery = 1000
+	// streamWriteTimeout bounds writing each batch of persons, so a long list isn't cut off by the server's write
+	// timeout while a client that stops reading still is
+	streamWriteTimeout = 10 * time.Second
+)
+
+// streamPersons sends persons with a 200 status as NDJSON or CSV a batch at a time, and returns how many it wrote.
+// It stops early when the client goes away.
+func streamPersons(c *gin.Context, mediaType string, persons iter.Seq[model.Person]) (int, error) {
+	if mediaType == contentTypeCSV {
+		c.Header("Content-Type", contentTypeCSV+"; charset=utf-8")
+	} else {
+		c.Header("Content-Type", mediaType)
+	}
+	c.Status(http.StatusOK)
+	rc := http.NewResponseController(c.Writer)
+	rc.SetWriteDeadline(time.Now().Add(streamWriteTimeout))
+
+	pw, err := datasource.NewPersonWriter(c.Writer, streamFormats[mediaType])
+	if err != nil {
+		return 0, err
+	}
+	count := 0
+	for p := range persons {
+		if err := pw.Write(p); err != nil {
+			return count, err
+		}
+		if count++; count%streamFlushEvery != 0 {
+			continue
+		}
+		if err := c.Request.Context().Err(); err != nil {
+			return count, err
+		}
+		if err := pw.Flush(); err != nil {
+			return count, err
+		}
+		rc.Flush()
+		rc.SetWriteDeadline(time.Now().Add(streamWriteTimeout))
+	}
+	return count, pw.Close()
+}
+
+// preference is one value of an Accept or Accept-Encoding header with its quality
+type preference struct {
+	value string
+	q     float64
+}
+
+// parsePreferences parses a comma separated list of values weighted by q parameters, values without one weigh 1
+func parsePreferences(header string) []preference {
+	var prefs []preference
+	for _, item := range strings.Split(header, ",") {
+		value, params, _ := strings.Cut(item, ";")
+		value = strings.ToLower(strings.TrimSpace(value))
+		if value == "" {
+			continue
+		}
+
+		p := preference{value: value, q: 1}
+		for _, param := range strings.Split(params, ";") {
+			k, v, _ := strings.Cut(param, "=")
+			if strings.TrimSpace(k) != "q" {
+				continue
+			}
+			q, err := strconv.ParseFloat(strings.TrimSpace(v), 64)
+			if err != nil || q < 0 || q > 1 {
+				q = 0
+			}
+			p.q = q
+		}
+		prefs = append(prefs, p)
+	}
+	return prefs
+}
+
+// negotiate returns the offer the header weighs highest, earlier offers winning ties. An offer weighs the q of the
+// most specific value matching it, specificity returning -1 for values that don't. An empty header accepts the
+// first offer, "" means no offer is acceptable.
+func negotiate(header string, offers []string, specificity func(value, offer string) int) string {
+	if strings.TrimSpace(header) == "" {
+		return offers[0]
+	}
+	prefs := parsePreferences(header)
+
+	weights := make([]float64, len(offers))
+	for i, offer := range offers {
+		best := -1
+		for _, p := range prefs {
+			if s := specificity(p.value, offer); s > best {
+				best, weights[i] = s, p.q
+			}
+		}
+	}
+
+	order := make([]int, len(offers))
+	for i := range order {
+		order[i] = i
+	}
+	sort.SliceStable(order, func(a, b int) bool { return weights[order[a]] > weights[order[b]] })
+	if weights[order[0]] <= 0 {
+		return ""
+	}
+	return offers[order[0]]
+}
+
+// mediaRangeSpecificity matches Accept media ranges: an exact type beats type/* which beats */*
+func mediaRangeSpecificity(value, offer string) int {
+	if alias, ok := mediaTypeAliases[value]; ok {
+		value = alias
+	}
+	switch {
+	case value == offer:
+		return 2
+	case value == "*/*":
+		return 0
+	case strings.HasSuffix(value, "/*") && strings.HasPrefix(offer, strings.TrimSuffix(value, "*")):
+		return 1
+	}
+	return -1
+}
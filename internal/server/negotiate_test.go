@@ -0,0 +1,85 @@
+package server
+
+import (
+	"bytes"
+	"encoding/csv"
+	"encoding/json"
+	"gocache/pkg/model"
+	"net/http"
+	"net/url"
+	"strings"
+	"testing"
+
+	"github.com/ugorji/go/codec"
+)
+
+func TestNegotiate(t *testing.T) {
+	cases := map[string]string{
+		"":                                     contentTypeJSON,
+		"*/*":                                  contentTypeJSON,
+		"text/*":                               contentTypeCSV,
+		"application/x-msgpack":                contentTypeMsgPack,
+		"text/csv;q=0.5, application/x-ndjson": contentTypeNDJSON,
+		"*/*;q=0.1, text/csv":                  contentTypeCSV,
+		"*/*, application/json;q=0":            contentTypeNDJSON,
+		"text/html":                            "",
+		"application/json;q=0":                 "",
+	}
+	for header, want := range cases {
+		if got := negotiate(header, personListTypes, mediaRangeSpecificity); got != want {
+			t.Errorf("negotiate(%q) = %q, expected %q", header, got, want)
+		}
+	}
+}
+
+func TestGetPersonsContentTypes(t *testing.T) {
+	h := newTestServer(t)
+
+	w := doRequest(h, http.MethodGet, "/persons", "", nil)
+	var want []model.Person
+	if err := json.Unmarshal(w.Body.Bytes(), &want); err != nil || len(want) == 0 {
+		t.Fatalf("expected a JSON list, got %s (%v)", w.Body.String(), err)
+	}
+
+	w = doRequest(h, http.MethodGet, "/persons", "", map[string]string{"Accept": contentTypeNDJSON})
+	if ct := w.Header().Get("Content-Type"); ct != contentTypeNDJSON {
+		t.Errorf("expected NDJSON, got %q", ct)
+	}
+	lines := strings.Split(strings.TrimSpace(w.Body.String()), "\n")
+	if len(lines) != len(want) {
+		t.Fatalf("expected %d lines, got %d", len(want), len(lines))
+	}
+	var first model.Person
+	if err := json.Unmarshal([]byte(lines[0]), &first); err != nil || first != want[0] {
+		t.Errorf("expected the first line to be %+v, got %+v (%v)", want[0], first, err)
+	}
+
+	w = doRequest(h, http.MethodGet, "/persons", "", map[string]string{"Accept": "text/csv"})
+	if ct := w.Header().Get("Content-Type"); !strings.HasPrefix(ct, contentTypeCSV) {
+		t.Errorf("expected CSV, got %q", ct)
+	}
+	records, err := csv.NewReader(w.Body).ReadAll()
+	if err != nil {
+		t.Fatalf("expected valid CSV, got %v", err)
+	}
+	if len(records) != len(want)+1 || strings.Join(records[0], ",") != "id,name,age,email,version" {
+		t.Errorf("expected a header and %d rows, got %v", len(want), records)
+	}
+
+	w = doRequest(h, http.MethodGet, "/persons/filter?name="+url.QueryEscape(want[0].Name), "", map[string]string{"Accept": contentTypeMsgPack})
+	var decoded []model.Person
+	if err := codec.NewDecoder(bytes.NewReader(w.Body.Bytes()), &codec.MsgpackHandle{}).Decode(&decoded); err != nil {
+		t.Fatalf("expected MessagePack, got %v", err)
+	}
+	if len(decoded) == 0 || decoded[0].Name != want[0].Name {
+		t.Errorf("expected persons named %q, got %+v", want[0].Name, decoded)
+	}
+
+	w = doRequest(h, http.MethodGet, "/persons", "", map[string]string{"Accept": "text/html"})
+	if w.Code != http.StatusNotAcceptable {
+		t.Errorf("expected 406, got %d", w.Code)
+	}
+	if vary := w.Header().Values("Vary"); !strings.Contains(strings.Join(vary, ","), "Accept") {
+		t.Errorf("expected Vary: Accept, got %v", vary)
+	}
+}
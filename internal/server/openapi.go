@@ -0,0 +1,167 @@
+package server
+
+import (
+	"bytes"
+	"context"
+	_ "embed"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"gocache/internal/logger"
+	"io"
+	"net/http"
+	"reflect"
+
+	"github.com/getkin/kin-openapi/openapi3"
+	"github.com/getkin/kin-openapi/openapi3filter"
+	"github.com/getkin/kin-openapi/routers"
+	"github.com/getkin/kin-openapi/routers/gorillamux"
+	"github.com/gin-gonic/gin"
+	"github.com/ugorji/go/codec"
+)
+
+// openAPISpec describes every route registered in RegisterRoutes, TestOpenAPIMatchesRoutes keeps them in lockstep
+//
+//go:embed openapi.yaml
+var openAPISpec []byte
+
+// openAPI is the parsed spec, its JSON form and the router matching requests to its operations
+type openAPI struct {
+	doc    *openapi3.T
+	json   []byte
+	router routers.Router
+}
+
+func init() {
+	// Merge patches are JSON, but the validator only knows the JSON Patch media type
+	openapi3filter.RegisterBodyDecoder(contentTypeMergePatch, openapi3filter.JSONBodyDecoder)
+	openapi3filter.RegisterBodyDecoder(contentTypeNDJSON, ndjsonBodyDecoder)
+	openapi3filter.RegisterBodyDecoder(contentTypeMsgPack, msgpackBodyDecoder)
+}
+
+// ndjsonBodyDecoder decodes an NDJSON body as the array of its lines
+func ndjsonBodyDecoder(body io.Reader, _ http.Header, _ *openapi3.SchemaRef, _ openapi3filter.EncodingFn) (any, error) {
+	values := make([]any, 0)
+	dec := json.NewDecoder(body)
+	for {
+		var v any
+		if err := dec.Decode(&v); errors.Is(err, io.EOF) {
+			return values, nil
+		} else if err != nil {
+			return nil, err
+		}
+		values = append(values, v)
+	}
+}
+
+// msgpackBodyDecoder decodes a MessagePack body into the values JSON decodes to, which the validator checks
+func msgpackBodyDecoder(body io.Reader, _ http.Header, _ *openapi3.SchemaRef, _ openapi3filter.EncodingFn) (any, error) {
+	h := &codec.MsgpackHandle{}
+	h.MapType = reflect.TypeOf(map[string]any(nil))
+	h.RawToString = true
+
+	var v any
+	if err := codec.NewDecoder(body, h).Decode(&v); err != nil {
+		return nil, err
+	}
+	data, err := json.Marshal(v)
+	if err != nil {
+		return nil, err
+	}
+	var normalized any
+	return normalized, json.Unmarshal(data, &normalized)
+}
+
+// loadOpenAPI parses and validates the embedded spec
+func loadOpenAPI() (*openAPI, error) {
+	doc, err := openapi3.NewLoader().LoadFromData(openAPISpec)
+	if err != nil {
+		return nil, fmt.Errorf("error loading OpenAPI spec: %w", err)
+	}
+	if err := doc.Validate(context.Background()); err != nil {
+		return nil, fmt.Errorf("error validating OpenAPI spec: %w", err)
+	}
+
+	data, err := doc.MarshalJSON()
+	if err != nil {
+		return nil, fmt.Errorf("error encoding OpenAPI spec: %w", err)
+	}
+	router, err := gorillamux.NewRouter(doc)
+	if err != nil {
+		return nil, fmt.Errorf("error creating OpenAPI router: %w", err)
+	}
+	return &openAPI{doc: doc, json: data, router: router}, nil
+}
+
+func (o *openAPI) handler(c *gin.Context) {
+	c.Data(http.StatusOK, "application/json", o.json)
+}
+
+// validate rejects requests that don't match the spec with 400 Bad Request, bodies of x-stream-body operations are
+// left to their handler. When onInvalidResponse is set the responses of non-streaming operations are checked as
+// well, tests use it to keep handlers honest.
+func (o *openAPI) validate(onInvalidResponse func(c *gin.Context, err error)) gin.HandlerFunc {
+	// Credentials are checked by the authenticate middleware, which knows whether auth is configured
+	options := &openapi3filter.Options{MultiError: false, AuthenticationFunc: openapi3filter.NoopAuthenticationFunc}
+
+	return func(c *gin.Context) {
+		route, pathParams, err := o.router.FindRoute(c.Request)
+		if err != nil {
+			// Unknown paths and methods are left to gin
+			c.Next()
+			return
+		}
+
+		input := &openapi3filter.RequestValidationInput{
+			Request:    c.Request,
+			PathParams: pathParams,
+			Route:      route,
+			Options:    options,
+		}
+		if route.Operation.Extensions["x-stream-body"] == true {
+			// The handler reads the body row by row and reports bad rows itself, buffering it here would defeat that
+			input.Options = &openapi3filter.Options{ExcludeRequestBody: true, AuthenticationFunc: options.AuthenticationFunc}
+		}
+		if err := openapi3filter.ValidateRequest(c.Request.Context(), input); err != nil {
+			logger.Logger.WithContext(c.Request.Context()).Errorf("ROUTE: request doesn't match the OpenAPI spec: %v %v: %v", c.Request.Method, c.Request.URL.Path, err)
+			c.AbortWithStatusJSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+			return
+		}
+
+		if onInvalidResponse == nil || route.Operation.Extensions["x-stream"] == true {
+			c.Next()
+			return
+		}
+
+		w := &teeWriter{ResponseWriter: c.Writer}
+		c.Writer = w
+		c.Next()
+
+		err = openapi3filter.ValidateResponse(c.Request.Context(), &openapi3filter.ResponseValidationInput{
+			RequestValidationInput: input,
+			Status:                 w.Status(),
+			Header:                 w.Header(),
+			Body:                   io.NopCloser(bytes.NewReader(w.body.Bytes())),
+			Options:                options,
+		})
+		if err != nil {
+			onInvalidResponse(c, err)
+		}
+	}
+}
+
+// teeWriter keeps a copy of the response body for validation
+type teeWriter struct {
+	gin.ResponseWriter
+	body bytes.Buffer
+}
+
+func (w *teeWriter) Write(b []byte) (int, error) {
+	w.body.Write(b)
+	return w.ResponseWriter.Write(b)
+}
+
+func (w *teeWriter) WriteString(s string) (int, error) {
+	w.body.WriteString(s)
+	return w.ResponseWriter.WriteString(s)
+}
@@ -0,0 +1,90 @@
+package server
+
+import (
+	"encoding/json"
+	"net/http"
+	"regexp"
+	"sort"
+	"strings"
+	"testing"
+
+	"github.com/gin-gonic/gin"
+)
+
+// responseValidator fails the test for every response that doesn't match the OpenAPI spec
+func responseValidator(t *testing.T) func(c *gin.Context, err error) {
+	return func(c *gin.Context, err error) {
+		t.Errorf("%v %v: response doesn't match the OpenAPI spec: %v", c.Request.Method, c.Request.URL, err)
+	}
+}
+
+func TestOpenAPIMatchesRoutes(t *testing.T) {
+	api, err := loadOpenAPI()
+	if err != nil {
+		t.Fatalf("loadOpenAPI() returned an error: %v", err)
+	}
+
+	// gin's :param segments are {param} in the spec
+	param := regexp.MustCompile(`:(\w+)`)
+	var registered []string
+	for _, route := range newTestServer(t).(*gin.Engine).Routes() {
+		registered = append(registered, route.Method+" "+param.ReplaceAllString(route.Path, "{$1}"))
+	}
+
+	var documented []string
+	for path, item := range api.doc.Paths.Map() {
+		for method := range item.Operations() {
+			documented = append(documented, method+" "+path)
+		}
+	}
+
+	sort.Strings(registered)
+	sort.Strings(documented)
+	if strings.Join(registered, "\n") != strings.Join(documented, "\n") {
+		t.Errorf("routes and spec differ\nregistered:\n%v\n\ndocumented:\n%v", strings.Join(registered, "\n"), strings.Join(documented, "\n"))
+	}
+}
+
+func TestOpenAPIServesSpec(t *testing.T) {
+	h := newTestServer(t)
+
+	w := doRequest(h, http.MethodGet, "/openapi.json", "", nil)
+	var spec struct {
+		OpenAPI string                     `json:"openapi"`
+		Paths   map[string]json.RawMessage `json:"paths"`
+	}
+	if err := json.Unmarshal(w.Body.Bytes(), &spec); err != nil || w.Code != http.StatusOK {
+		t.Fatalf("expected the spec as JSON, got %d: %v", w.Code, err)
+	}
+	if spec.OpenAPI != "3.0.3" || spec.Paths["/persons/filter"] == nil {
+		t.Errorf("expected an OpenAPI 3 document describing /persons/filter, got %v %v", spec.OpenAPI, len(spec.Paths))
+	}
+}
+
+func TestOpenAPIRejectsInvalidRequests(t *testing.T) {
+	h := newTestServer(t)
+
+	cases := []struct {
+		method, path, body string
+	}{
+		{http.MethodGet, "/persons/abc", ""},
+		{http.MethodGet, "/persons/filter?ages=25&ages=old", ""},
+		{http.MethodGet, "/persons/watch?since=-1", ""},
+		{http.MethodPost, "/persons/update", `{"name":"No Id"}`},
+		{http.MethodPost, "/persons/update", `{"id":1,"age":"thirty"}`},
+		{http.MethodPost, "/persons/batch", `{"op":"insert"}`},
+		{http.MethodPost, "/graphql", `{"variables":{}}`},
+	}
+
+	for _, tc := range cases {
+		w := doRequest(h, tc.method, tc.path, tc.body, nil)
+		if w.Code != http.StatusBadRequest || !strings.Contains(w.Body.String(), `"error"`) {
+			t.Errorf("%v %v %v: expected 400 with an error, got %d: %s", tc.method, tc.path, tc.body, w.Code, w.Body.String())
+		}
+	}
+
+	// Paths outside the spec are left to the router
+	if w := doRequest(h, http.MethodGet, "/data", "", nil); w.Code != http.StatusNotFound {
+		t.Errorf("expected 404 for an unknown path, got %d", w.Code)
+	}
+}
@@ -0,0 +1,99 @@
+package server
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"gocache/pkg/model"
+	"mime"
+	"sort"
+	"strings"
+)
+
+const (
+	contentTypeJSONPatch  = "application/json-patch+json"
+	contentTypeMergePatch = "application/merge-patch+json"
+)
+
+// jsonPatchOp is one operation of an RFC 6902 JSON Patch document
+type jsonPatchOp struct {
+	Op    string      `json:"op"`
+	Path  string      `json:"path"`
+	Value interface{} `json:"value"`
+}
+
+// parsePatch converts a PATCH body into field operations based on its content type.
+// JSON Patch supports replace, add and test plus an "inc" extension for atomic increments.
+// Merge patch (and plain JSON) sets every field present, a "version" member becomes a test.
+func parsePatch(contentType string, body []byte) ([]model.FieldOp, error) {
+	mediaType, _, err := mime.ParseMediaType(contentType)
+	if err != nil {
+		mediaType = contentTypeMergePatch
+	}
+
+	dec := json.NewDecoder(bytes.NewReader(body))
+	dec.UseNumber()
+
+	switch mediaType {
+	case contentTypeJSONPatch:
+		var patch []jsonPatchOp
+		if err := dec.Decode(&patch); err != nil {
+			return nil, fmt.Errorf("invalid JSON Patch document: %v", err)
+		}
+		return jsonPatchToOps(patch)
+	case contentTypeMergePatch, "application/json":
+		var patch map[string]interface{}
+		if err := dec.Decode(&patch); err != nil {
+			return nil, fmt.Errorf("invalid merge patch document: %v", err)
+		}
+		return mergePatchToOps(patch)
+	}
+
+	return nil, fmt.Errorf("unsupported patch content type %q", mediaType)
+}
+
+func jsonPatchToOps(patch []jsonPatchOp) ([]model.FieldOp, error) {
+	ops := make([]model.FieldOp, 0, len(patch))
+	for _, p := range patch {
+		field := strings.TrimPrefix(p.Path, "/")
+		if field == p.Path || strings.Contains(field, "/") {
+			return nil, fmt.Errorf("unsupported JSON Patch path %q", p.Path)
+		}
+
+		switch p.Op {
+		case "replace", "add":
+			ops = append(ops, model.FieldOp{Op: model.OpSet, Field: field, Value: p.Value})
+		case "test":
+			ops = append(ops, model.FieldOp{Op: model.OpTest, Field: field, Value: p.Value})
+		case "inc":
+			ops = append(ops, model.FieldOp{Op: model.OpIncrement, Field: field, Value: p.Value})
+		default:
+			return nil, fmt.Errorf("unsupported JSON Patch op %q", p.Op)
+		}
+	}
+	return ops, nil
+}
+
+func mergePatchToOps(patch map[string]interface{}) ([]model.FieldOp, error) {
+	// Sort so the resulting ops, and any error, are deterministic
+	fields := make([]string, 0, len(patch))
+	for field := range patch {
+		fields = append(fields, field)
+	}
+	sort.Strings(fields)
+
+	ops := make([]model.FieldOp, 0, len(patch))
+	for _, field := range fields {
+		value := patch[field]
+		if value == nil {
+			return nil, fmt.Errorf("field %q can't be removed", field)
+		}
+
+		op := model.OpSet
+		if field == "version" {
+			op = model.OpTest
+		}
+		ops = append(ops, model.FieldOp{Op: op, Field: field, Value: value})
+	}
+	return ops, nil
+}
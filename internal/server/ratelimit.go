@@ -0,0 +1,108 @@
+package server
+
+import (
+	"fmt"
+	"gocache/internal/auth"
+	"gocache/internal/logger"
+	"gocache/internal/ratelimit"
+	"math"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// defaultRoute configures the limit of every route without one of its own
+const defaultRoute = "*"
+
+// rateLimits holds a limiter per configured route, keyed by "METHOD /path" or "/path" as registered with gin
+type rateLimits struct {
+	routes map[string]*ratelimit.Limiter
+}
+
+// parseRateLimits parses a comma separated list of route=limit entries, e.g. "*=20/s:40,/persons=1/s:5,PATCH /persons/:id=5/s".
+// It returns nil when s is empty.
+func parseRateLimits(s string) (*rateLimits, error) {
+	limits := &rateLimits{routes: make(map[string]*ratelimit.Limiter)}
+	for _, entry := range strings.Split(s, ",") {
+		entry = strings.TrimSpace(entry)
+		if entry == "" {
+			continue
+		}
+
+		route, spec, ok := strings.Cut(entry, "=")
+		route = strings.TrimSpace(route)
+		path := route
+		if _, p, hasMethod := strings.Cut(route, " "); hasMethod {
+			path = p
+		}
+		if !ok || (route != defaultRoute && !strings.HasPrefix(path, "/")) {
+			return nil, fmt.Errorf("error parsing rate limit %q: expected [METHOD ]/path=limit or *=limit", entry)
+		}
+		limit, err := ratelimit.ParseLimit(spec)
+		if err != nil {
+			return nil, err
+		}
+		limits.routes[route] = ratelimit.NewLimiter(limit)
+	}
+
+	if len(limits.routes) == 0 {
+		return nil, nil
+	}
+	return limits, nil
+}
+
+// limiter returns the limiter of the request's route and the route its buckets are kept under
+func (l *rateLimits) limiter(c *gin.Context) (*ratelimit.Limiter, string) {
+	for _, route := range []string{c.Request.Method + " " + c.FullPath(), c.FullPath()} {
+		if limiter, ok := l.routes[route]; ok {
+			return limiter, route
+		}
+	}
+	// Each route gets its own buckets of the default size, so a client busy on one isn't blocked on the others
+	return l.routes[defaultRoute], c.Request.Method + " " + c.FullPath()
+}
+
+// rateLimit rejects clients that call a route faster than its limit with 429 Too Many Requests.
+// Authenticated clients are limited by principal and the others by IP address.
+func (s *Server) rateLimit(c *gin.Context) {
+	client := "ip:" + c.ClientIP()
+	if p, ok := auth.FromContext(c.Request.Context()); ok {
+		client = "principal:" + p.ID
+	}
+
+	if s.allow(c, client) {
+		c.Next()
+	}
+}
+
+// allow charges a request of client to its bucket for the route, it aborts with 429 and returns false over the limit
+func (s *Server) allow(c *gin.Context, client string) bool {
+	if s.rateLimits == nil || publicRoutes[c.FullPath()] {
+		return true
+	}
+
+	limiter, route := s.rateLimits.limiter(c)
+	if limiter == nil {
+		return true
+	}
+
+	res := limiter.Allow(route + " " + client)
+	c.Header("RateLimit-Limit", strconv.Itoa(res.Limit))
+	c.Header("RateLimit-Remaining", strconv.Itoa(res.Remaining))
+	c.Header("RateLimit-Reset", strconv.Itoa(seconds(res.Reset)))
+	if !res.Allowed {
+		logger.Logger.WithContext(c.Request.Context()).Warnf("ROUTE: Rate limited %v %v for %v", c.Request.Method, c.Request.URL.Path, client)
+		c.Header("Retry-After", strconv.Itoa(max(seconds(res.RetryAfter), 1)))
+		c.AbortWithStatusJSON(http.StatusTooManyRequests, gin.H{"error": "rate limit exceeded"})
+		return false
+	}
+	return true
+}
+
+// seconds rounds d up to whole seconds, as the rate limit headers count
+func seconds(d time.Duration) int {
+	return int(math.Ceil(d.Seconds()))
+}
@@ -0,0 +1,139 @@
+package server
+
+import (
+	"gocache/internal/auth"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"testing"
+)
+
+// withRateLimits configures the server like RATE_LIMITS
+func withRateLimits(t *testing.T, limits string) func(*Server) {
+	t.Helper()
+	rl, err := parseRateLimits(limits)
+	if err != nil {
+		t.Fatalf("parseRateLimits() error: %v", err)
+	}
+	return func(s *Server) { s.rateLimits = rl }
+}
+
+// requestFrom sends a GET from the client at addr
+func requestFrom(h http.Handler, path, addr string, headers map[string]string) *httptest.ResponseRecorder {
+	req := httptest.NewRequest(http.MethodGet, path, nil)
+	req.RemoteAddr = addr + ":1234"
+	for k, v := range headers {
+		req.Header.Set(k, v)
+	}
+
+	w := httptest.NewRecorder()
+	h.ServeHTTP(w, req)
+	return w
+}
+
+func TestParseRateLimits(t *testing.T) {
+	rl, err := parseRateLimits("*=20/s:40, /persons=1/s:5, PATCH /persons/:id=5/s")
+	if err != nil {
+		t.Fatalf("parseRateLimits() error: %v", err)
+	}
+	for _, route := range []string{"*", "/persons", "PATCH /persons/:id"} {
+		if rl.routes[route] == nil {
+			t.Errorf("expected a limit for %q", route)
+		}
+	}
+
+	if rl, err := parseRateLimits(" "); rl != nil || err != nil {
+		t.Errorf("expected no limits, got %v, %v", rl, err)
+	}
+	for _, bad := range []string{"/persons", "persons=1/s", "GET persons=1/s", "/persons=fast"} {
+		if _, err := parseRateLimits(bad); err == nil {
+			t.Errorf("expected %q to be rejected", bad)
+		}
+	}
+}
+
+func TestRateLimitBurst(t *testing.T) {
+	h := newTestServer(t, withRateLimits(t, "*=100/s,/persons=1/m:3"))
+
+	for i := 0; i < 3; i++ {
+		w := requestFrom(h, "/persons", "192.0.2.1", nil)
+		if w.Code != http.StatusOK {
+			t.Fatalf("request %d: expected 200, got %d", i, w.Code)
+		}
+		if got := w.Header().Get("RateLimit-Remaining"); got != strconv.Itoa(2-i) {
+			t.Errorf("request %d: expected %d remaining, got %q", i, 2-i, got)
+		}
+		if got := w.Header().Get("RateLimit-Limit"); got != "3" {
+			t.Errorf("request %d: expected a limit of 3, got %q", i, got)
+		}
+	}
+
+	w := requestFrom(h, "/persons", "192.0.2.1", nil)
+	if w.Code != http.StatusTooManyRequests {
+		t.Fatalf("expected 429 once the burst is spent, got %d", w.Code)
+	}
+	if got := w.Header().Get("Retry-After"); got != "60" {
+		t.Errorf("expected to retry after 60s, got %q", got)
+	}
+	if got := w.Header().Get("RateLimit-Reset"); got != "180" {
+		t.Errorf("expected the burst back after 180s, got %q", got)
+	}
+	if !strings.Contains(w.Body.String(), "rate limit exceeded") {
+		t.Errorf("expected an error body, got %s", w.Body.String())
+	}
+
+	// Other routes, other clients and public routes aren't affected
+	if w := requestFrom(h, "/persons/1", "192.0.2.1", nil); w.Code != http.StatusOK {
+		t.Errorf("expected another route to be allowed, got %d", w.Code)
+	}
+	if w := requestFrom(h, "/persons", "192.0.2.2", nil); w.Code != http.StatusOK {
+		t.Errorf("expected another client to be allowed, got %d", w.Code)
+	}
+	if w := requestFrom(h, "/health", "192.0.2.1", nil); w.Code != http.StatusOK || w.Header().Get("RateLimit-Limit") != "" {
+		t.Errorf("expected the health check not to be limited, got %d", w.Code)
+	}
+
+	// X-Forwarded-For isn't believed from an untrusted peer
+	if w := requestFrom(h, "/persons", "192.0.2.1", map[string]string{"X-Forwarded-For": "198.51.100.7"}); w.Code != http.StatusTooManyRequests {
+		t.Errorf("expected a spoofed client IP to be ignored, got %d", w.Code)
+	}
+}
+
+func TestRateLimitByPrincipal(t *testing.T) {
+	h := newTestServer(t, withRateLimits(t, "*=1/m:2"), withAPIKeys(map[string]auth.Principal{
+		"key-1": {ID: "ci", Roles: []string{auth.RoleRead}},
+		"key-2": {ID: "other", Roles: []string{auth.RoleRead}},
+	}))
+	as := func(key string) map[string]string { return map[string]string{"X-API-Key": key} }
+
+	// The principal's bucket follows it across addresses
+	requestFrom(h, "/persons/1", "192.0.2.1", as("key-1"))
+	requestFrom(h, "/persons/1", "192.0.2.2", as("key-1"))
+	if w := requestFrom(h, "/persons/1", "192.0.2.3", as("key-1")); w.Code != http.StatusTooManyRequests {
+		t.Errorf("expected the principal to be limited on a new address, got %d", w.Code)
+	}
+
+	if w := requestFrom(h, "/persons/1", "192.0.2.1", as("key-2")); w.Code != http.StatusOK {
+		t.Errorf("expected another principal on the same address to be allowed, got %d", w.Code)
+	}
+}
+
+func TestRateLimitCountsRejectedCredentials(t *testing.T) {
+	h := newTestServer(t, withRateLimits(t, "*=1/m:2"), withAPIKeys(map[string]auth.Principal{"key-1": {ID: "ci", Roles: []string{auth.RoleRead}}}))
+	bad := map[string]string{"X-API-Key": "guess"}
+
+	for i := 0; i < 2; i++ {
+		if w := requestFrom(h, "/persons/1", "192.0.2.1", bad); w.Code != http.StatusUnauthorized {
+			t.Fatalf("attempt %d: expected 401, got %d", i, w.Code)
+		}
+	}
+	if w := requestFrom(h, "/persons/1", "192.0.2.1", bad); w.Code != http.StatusTooManyRequests {
+		t.Errorf("expected further guesses from the address to be limited, got %d", w.Code)
+	}
+
+	// Valid credentials are limited by principal, so the address' failures don't lock them out
+	if w := requestFrom(h, "/persons/1", "192.0.2.1", map[string]string{"X-API-Key": "key-1"}); w.Code != http.StatusOK {
+		t.Errorf("expected the principal to be allowed, got %d", w.Code)
+	}
+}
@@ -1,6 +1,8 @@
 package server
 
 import (
+	"gocache/internal/auth"
+	"gocache/internal/graphqlapi"
 	"net/http"
 
 	"github.com/gin-contrib/cors"
@@ -8,20 +10,54 @@ import (
 )
 
 func (s *Server) RegisterRoutes() http.Handler {
-	r := gin.Default()
+	// The spec is embedded, so it can only fail to load in a broken build
+	api, err := loadOpenAPI()
+	if err != nil {
+		panic(err)
+	}
 
-	r.Use(cors.New(cors.Config{
-		AllowOrigins:     []string{"http://localhost:5173"}, // Add your frontend URL
-		AllowMethods:     []string{"GET", "POST"},
-		AllowHeaders:     []string{"Accept", "Authorization", "Content-Type"},
-		AllowCredentials: true, // Enable cookies/auth
-	}))
+	// The access token is taken out of the URL before the request is logged
+	r := gin.New()
+	r.Use(takeAccessToken, gin.Logger(), gin.Recovery())
+	r.Use(s.trace, s.instrument)
+	// Client IPs key rate limits, so X-Forwarded-For is only believed from known proxies, checked by NewServer
+	if err := r.SetTrustedProxies(s.trustedProxies); err != nil {
+		panic(err)
+	}
+
+	r.Use(cors.New(s.cors.config()))
+	r.Use(s.authenticate)
+	r.Use(s.rateLimit)
+	// Compression wraps the writer before validation, so responses are validated before they are encoded
+	r.Use(s.compress)
+	r.Use(api.validate(s.onInvalidResponse))
 
 	r.GET("/health", s.healthHandler)
-	r.GET("/persons", s.getPersonsHandler)
-	r.GET("/persons/filter", s.queryPersonsHandler)
+	r.GET("/openapi.json", api.handler)
+
+	// Masked responses vary by caller
+	read := r.Group("", s.authorize(auth.RoleRead), s.private)
+	read.GET("/persons", s.getPersonsHandler)
+	read.GET("/persons/filter", s.queryPersonsHandler)
+	read.GET("/persons/export", s.exportPersonsHandler)
+	read.GET("/persons/watch", s.watchPersonsHandler)
+	read.GET("/persons/watch/ws", s.watchPersonsWSHandler)
+	read.GET("/persons/:id", s.getPersonHandler)
+
+	write := r.Group("", s.authorize(auth.RoleWrite), s.private)
+	write.POST("/persons/update", s.updatePersonHandler)
+	write.POST("/persons/batch", s.batchPersonsHandler)
+	write.POST("/persons/import", s.importPersonsHandler)
+	write.PATCH("/persons/:id", s.patchPersonHandler)
+
+	admin := r.Group("", s.authorize(auth.RoleAdmin))
+	admin.GET("/persons/queue", s.queueHandler)
+	admin.GET("/metrics", s.metricsHandler())
 
-	r.POST("/persons/update", s.updatePersonHandler)
+	// GraphQL operations are authorized by their resolvers, queries need read and mutations write
+	graphql := gin.WrapH(graphqlapi.NewHandler(s.pc, s.authn, s.mask, s.watchDone, s.cors.checkOrigin))
+	r.GET("/graphql", s.private, graphql)
+	r.POST("/graphql", s.private, graphql)
 
 	return r
 }
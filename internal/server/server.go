@@ -1,64 +1,380 @@
 package server
 
 import (
+	"context"
+	"crypto/tls"
+	"errors"
 	"fmt"
+	"gocache/internal/auth"
+	"gocache/internal/certs"
 	"gocache/internal/controller"
 	"gocache/internal/datasource"
+	"gocache/internal/expiry"
+	"gocache/internal/grpcapi"
+	"gocache/internal/logger"
+	"gocache/internal/memcache"
+	"gocache/internal/queue"
+	"gocache/internal/resp"
+	"gocache/pkg/store"
+	"net"
 	"net/http"
 	"os"
 	"strconv"
+	"strings"
+	"sync"
 	"time"
 
+	"github.com/gin-gonic/gin"
 	_ "github.com/joho/godotenv/autoload"
 )
 
+const (
+	writeModeThrough = "write-through"
+	writeModeBehind  = "write-behind"
+
+	dataSourceMongo = "mongo"
+	dataSourceFile  = "file"
+	dataSourceSQL   = "sql"
+)
+
 type Server struct {
-	port int
+	port      int
+	writeMode string
+
+	pc       controller.PersonController
+	expires  *expiry.Expirer    // TTLs shared by the cache protocols
+	resp     *resp.Server       // nil unless RESP_ADDR is set
+	memcache *memcache.Server   // nil unless MEMCACHE_ADDR is set
+	grpc     *grpcapi.Server    // nil unless GRPC_ADDR is set
+	authn    auth.Authenticator // nil leaves the HTTP and gRPC APIs open
+	mask     auth.Mask          // redacts personal data for callers without the pii role when AUTH_MASK_PII is set
+
+	rateLimits     *rateLimits // nil unless RATE_LIMITS is set
+	trustedProxies []string    // may set the client IP through X-Forwarded-For, none by default
 
-	pc controller.PersonController
+	watchDone     chan struct{} // closed when the HTTP server shuts down to end watch feeds
+	stopWatchOnce sync.Once
+
+	stopTracing func(context.Context) error // flushes buffered spans, nil in tests
+
+	cors            corsSettings    // browser origins and methods allowed, the defaults when zero
+	compression     *compressor     // nil sends every response uncompressed
+	importMaxBytes  int64           // largest import upload accepted, zero for no limit
+	certs           *certs.Reloader // nil unless TLS_CERT_FILE is set
+	shutdownTimeout time.Duration
+
+	onInvalidResponse func(c *gin.Context, err error) // set by tests to check responses against the OpenAPI spec
 }
 
-func NewServer() (*http.Server, error) {
+// defaultShutdownTimeout bounds shutting down unless SHUTDOWN_TIMEOUT is set
+const defaultShutdownTimeout = 5 * time.Second
+
+func NewServer() (_ *http.Server, _ *Server, err error) {
 	if err := validateEnvVars(); err != nil {
-		return nil, err
+		return nil, nil, err
 	}
 
 	port, err := strconv.Atoi(os.Getenv("PORT"))
 	if err != nil {
 
-		return nil, fmt.Errorf("error converting PORT to integer: %v", err)
+		return nil, nil, fmt.Errorf("error converting PORT to integer: %v", err)
 	}
 
-	db, err := datasource.NewMongo()
+	// Tracing comes first so the warm-up is traced too
+	stopTracing, err := setupTracing()
+	if err != nil {
+		return nil, nil, err
+	}
 
+	serverInstance := &Server{port: port, stopTracing: stopTracing, watchDone: make(chan struct{})}
+	// Release whatever was started, the controller's queue and log, listeners and the certificate reloader, if any
+	// later step fails
+	defer func() {
+		if err == nil {
+			return
+		}
+		ctx, cancel := context.WithTimeout(context.Background(), defaultShutdownTimeout)
+		defer cancel()
+		if shutdownErr := serverInstance.Shutdown(ctx); shutdownErr != nil {
+			logger.Logger.Errorf("ROUTE: Error releasing resources after failed startup: %v", shutdownErr)
+		}
+	}()
+
+	db, err := newDataSource()
 	if err != nil {
-		return nil, fmt.Errorf("error creating mongo data source: %v", err)
+		return nil, nil, err
 	}
+	db = datasource.Instrument(db)
 
 	// Create controllers
-	pc, err := controller.NewPersonController(db)
+	writeMode := getEnv("WRITE_MODE", writeModeThrough)
+	pc, err := newPersonController(db, writeMode)
 	if err != nil {
-		return nil, fmt.Errorf("error creating person controller: %v", err)
+		return nil, nil, fmt.Errorf("error creating person controller: %v", err)
 	}
+	pc = controller.Trace(pc)
+	serverInstance.pc = pc
 
-	serverInstance := &Server{
-		port: port,
-		pc:   pc,
+	authn, err := newAuthenticator()
+	if err != nil {
+		return nil, nil, fmt.Errorf("error configuring authentication: %v", err)
 	}
 
-	server := &http.Server{
-		Addr:         ":" + strconv.Itoa(port),
-		Handler:      serverInstance.RegisterRoutes(),
-		IdleTimeout:  time.Minute,
-		ReadTimeout:  10 * time.Second,
-		WriteTimeout: 10 * time.Second,
+	maskPII, err := getEnvBool("AUTH_MASK_PII", false)
+	if err != nil {
+		return nil, nil, err
 	}
 
-	return server, nil
+	limits, err := parseRateLimits(os.Getenv("RATE_LIMITS"))
+	if err != nil {
+		return nil, nil, err
+	}
+	proxies, err := parseTrustedProxies(os.Getenv("TRUSTED_PROXIES"))
+	if err != nil {
+		return nil, nil, err
+	}
+	corsSettings, err := parseCORS(os.Getenv("CORS_ALLOWED_ORIGINS"), os.Getenv("CORS_ALLOWED_METHODS"))
+	if err != nil {
+		return nil, nil, err
+	}
+	compressMinSize, err := getEnvInt("COMPRESSION_MIN_SIZE", defaultCompressMinSize)
+	if err != nil {
+		return nil, nil, err
+	}
+	compression, err := parseCompression(getEnv("COMPRESSION", encodingZstd+","+encodingGzip), compressMinSize)
+	if err != nil {
+		return nil, nil, err
+	}
+	shutdownTimeout, err := getEnvDuration("SHUTDOWN_TIMEOUT", defaultShutdownTimeout)
+	if err != nil {
+		return nil, nil, err
+	}
+	importMaxBytes, err := getEnvInt("IMPORT_MAX_BYTES", defaultImportMaxBytes)
+	if err != nil {
+		return nil, nil, err
+	}
+	if importMaxBytes < 0 {
+		return nil, nil, fmt.Errorf("IMPORT_MAX_BYTES must not be negative, got %v", importMaxBytes)
+	}
+
+	server := &http.Server{Addr: ":" + strconv.Itoa(port)}
+	if err := configureTimeouts(server); err != nil {
+		return nil, nil, err
+	}
+	tlsConfig, reloader, err := newTLSConfig()
+	if err != nil {
+		return nil, nil, fmt.Errorf("error configuring TLS: %w", err)
+	}
+	server.TLSConfig = tlsConfig
+	serverInstance.certs = reloader
+
+	serverInstance.writeMode = writeMode
+	serverInstance.authn = authn
+	serverInstance.mask = auth.Mask{PII: maskPII}
+	serverInstance.rateLimits = limits
+	serverInstance.trustedProxies = proxies
+	serverInstance.cors = corsSettings
+	serverInstance.compression = compression
+	serverInstance.shutdownTimeout = shutdownTimeout
+	serverInstance.importMaxBytes = int64(importMaxBytes)
+
+	if err := serverInstance.startProtocols(tlsConfig); err != nil {
+		return nil, nil, err
+	}
+
+	server.Handler = serverInstance.RegisterRoutes()
+	// Shutdown waits for active requests, which watch feeds never finish on their own
+	server.RegisterOnShutdown(serverInstance.stopWatches)
+
+	return server, serverInstance, nil
+}
+
+// stopWatches ends every open watch feed
+func (s *Server) stopWatches() {
+	s.stopWatchOnce.Do(func() { close(s.watchDone) })
+}
+
+// Shutdown releases the server's resources, flushing any queued writes to the data source
+func (s *Server) Shutdown(ctx context.Context) error {
+	if s.resp != nil {
+		s.resp.Close()
+	}
+	if s.memcache != nil {
+		s.memcache.Close()
+	}
+	if s.grpc != nil {
+		s.grpc.Close()
+	}
+	if s.expires != nil {
+		s.expires.Stop()
+	}
+	if s.certs != nil {
+		s.certs.Close()
+	}
+
+	var err error
+	// A server whose startup failed may not have a controller yet
+	if s.pc != nil {
+		err = s.pc.Close(ctx)
+	}
+	// Spans of the final flush are exported too
+	if s.stopTracing != nil {
+		err = errors.Join(err, s.stopTracing(ctx))
+	}
+	return err
+}
+
+// ShutdownTimeout is how long the HTTP server may take to finish requests, and then Shutdown to flush writes, from
+// SHUTDOWN_TIMEOUT
+func (s *Server) ShutdownTimeout() time.Duration {
+	return s.shutdownTimeout
+}
+
+// configureTimeouts sets the timeouts of srv from the HTTP_*_TIMEOUT settings, zero disables a timeout
+func configureTimeouts(srv *http.Server) error {
+	timeouts := []struct {
+		key string
+		def time.Duration
+		dst *time.Duration
+	}{
+		// Unset, the read header timeout is the read timeout
+		{"HTTP_READ_HEADER_TIMEOUT", 0, &srv.ReadHeaderTimeout},
+		{"HTTP_READ_TIMEOUT", 10 * time.Second, &srv.ReadTimeout},
+		{"HTTP_WRITE_TIMEOUT", 10 * time.Second, &srv.WriteTimeout},
+		{"HTTP_IDLE_TIMEOUT", time.Minute, &srv.IdleTimeout},
+	}
+	for _, t := range timeouts {
+		d, err := getEnvDuration(t.key, t.def)
+		if err != nil {
+			return err
+		}
+		if d < 0 {
+			return fmt.Errorf("%s must not be negative, got %v", t.key, d)
+		}
+		*t.dst = d
+	}
+	return nil
+}
+
+// startProtocols starts the optional Redis, memcached and gRPC listeners, gRPC shares the HTTPS tlsConfig
+func (s *Server) startProtocols(tlsConfig *tls.Config) error {
+	s.expires = expiry.NewExpirer(s.pc)
+
+	if addr := os.Getenv("RESP_ADDR"); addr != "" {
+		s.resp = resp.NewServer(s.pc, s.expires, s.authn, s.mask)
+		if err := serveProtocol("RESP", addr, s.resp.Serve); err != nil {
+			return err
+		}
+	}
+
+	if addr := os.Getenv("MEMCACHE_ADDR"); addr != "" {
+		s.memcache = memcache.NewServer(s.pc, s.expires, s.authn, s.mask)
+		if err := serveProtocol("MEMCACHE", addr, s.memcache.Serve); err != nil {
+			return err
+		}
+	}
+
+	if addr := os.Getenv("GRPC_ADDR"); addr != "" {
+		if tlsConfig == nil && s.authn != nil {
+			logger.Logger.Warn("GRPC: No TLS_CERT_FILE, credentials are sent in plaintext")
+		}
+		s.grpc = grpcapi.NewServer(s.pc, s.authn, s.mask, tlsConfig)
+		if err := serveProtocol("GRPC", addr, s.grpc.Serve); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// serveProtocol listens on addr and serves it in the background, so a bad address fails startup
+func serveProtocol(name, addr string, serve func(net.Listener) error) error {
+	l, err := net.Listen("tcp", addr)
+	if err != nil {
+		return fmt.Errorf("error listening for %s on %s: %v", name, addr, err)
+	}
+
+	go func() {
+		if err := serve(l); err != nil && !errors.Is(err, net.ErrClosed) {
+			logger.Logger.Errorf("%s: server stopped: %v", name, err)
+		}
+	}()
+	return nil
+}
+
+// newDataSource opens the data source selected by DATA_SOURCE
+func newDataSource() (datasource.DataSource, error) {
+	switch kind := getEnv("DATA_SOURCE", dataSourceMongo); kind {
+	case dataSourceMongo:
+		db, err := datasource.NewMongo()
+		if err != nil {
+			return nil, fmt.Errorf("error creating mongo data source: %v", err)
+		}
+		return db, nil
+	case dataSourceFile:
+		db, err := datasource.NewFileSource(getEnv("DATA_FILE", "data/persons.json"), os.Getenv("DATA_FILE_FORMAT"))
+		if err != nil {
+			return nil, fmt.Errorf("error creating file data source: %v", err)
+		}
+		return db, nil
+	case dataSourceSQL:
+		db, err := datasource.NewSQL(getEnv("SQL_DRIVER", datasource.DriverSQLite), getEnv("SQL_DSN", "data/gocache.db"))
+		if err != nil {
+			return nil, fmt.Errorf("error creating sql data source: %v", err)
+		}
+		return db, nil
+	default:
+		return nil, fmt.Errorf("unknown DATA_SOURCE %q, expected %q, %q or %q", kind, dataSourceMongo, dataSourceFile, dataSourceSQL)
+	}
+}
+
+// newPersonController builds the person controller for the configured write mode and snapshot settings
+func newPersonController(db datasource.DataSource, writeMode string) (controller.PersonController, error) {
+	opts := controller.Options{SnapshotPath: os.Getenv("SNAPSHOT_PATH")}
+	var err error
+	if opts.SnapshotInterval, err = getEnvDuration("SNAPSHOT_INTERVAL", controller.DefaultSnapshotInterval); err != nil {
+		return nil, err
+	}
+
+	opts.WALPath = os.Getenv("WAL_PATH")
+	opts.WALSync = store.SyncPolicy(getEnv("WAL_FSYNC", string(store.SyncInterval)))
+	if opts.WALSyncInterval, err = getEnvDuration("WAL_FSYNC_INTERVAL", 100*time.Millisecond); err != nil {
+		return nil, err
+	}
+
+	switch writeMode {
+	case writeModeThrough:
+	case writeModeBehind:
+		cfg := controller.DefaultWriteBehindConfig()
+		if cfg.BatchSize, err = getEnvInt("WRITE_BATCH_SIZE", cfg.BatchSize); err != nil {
+			return nil, err
+		}
+		if cfg.MaxRetries, err = getEnvInt("WRITE_MAX_RETRIES", cfg.MaxRetries); err != nil {
+			return nil, err
+		}
+		if cfg.FlushInterval, err = getEnvDuration("WRITE_FLUSH_INTERVAL", cfg.FlushInterval); err != nil {
+			return nil, err
+		}
+
+		q, err := queue.NewWriteQueue(getEnv("WRITE_QUEUE_PATH", "data/write-queue.ndjson"))
+		if err != nil {
+			return nil, fmt.Errorf("error opening write queue: %v", err)
+		}
+		opts.Queue = q
+		opts.WriteBehind = cfg
+	default:
+		return nil, fmt.Errorf("unknown WRITE_MODE %q, expected %q or %q", writeMode, writeModeThrough, writeModeBehind)
+	}
+
+	return controller.NewPersonControllerWithOptions(db, opts)
 }
 
 func validateEnvVars() error {
-	requiredVars := []string{"PORT", "DB_NAME", "DB_HOST", "DB_PORT", "DB_USERNAME", "DB_ROOT_PASSWORD", "COLLECTION_NAME"}
+	requiredVars := []string{"PORT"}
+	// Only Mongo is configured through the DB_* settings
+	if getEnv("DATA_SOURCE", dataSourceMongo) == dataSourceMongo {
+		requiredVars = append(requiredVars, "DB_NAME", "DB_HOST", "DB_PORT", "DB_USERNAME", "DB_ROOT_PASSWORD", "COLLECTION_NAME")
+	}
 	for _, v := range requiredVars {
 		if os.Getenv(v) == "" {
 			return fmt.Errorf("environment variable %s is not set", v)
@@ -66,3 +382,82 @@ func validateEnvVars() error {
 	}
 	return nil
 }
+
+// getEnv returns the value of the environment variable key, or def when it is unset
+func getEnv(key, def string) string {
+	if v := os.Getenv(key); v != "" {
+		return v
+	}
+	return def
+}
+
+// getEnvInt returns the integer value of the environment variable key, or def when it is unset
+func getEnvInt(key string, def int) (int, error) {
+	v := os.Getenv(key)
+	if v == "" {
+		return def, nil
+	}
+
+	i, err := strconv.Atoi(v)
+	if err != nil {
+		return 0, fmt.Errorf("error converting %s to integer: %v", key, err)
+	}
+	return i, nil
+}
+
+// parseTrustedProxies parses a comma separated list of IP addresses and CIDR ranges
+func parseTrustedProxies(s string) ([]string, error) {
+	var proxies []string
+	for _, v := range strings.Split(s, ",") {
+		if v = strings.TrimSpace(v); v == "" {
+			continue
+		}
+		if _, _, err := net.ParseCIDR(v); err != nil && net.ParseIP(v) == nil {
+			return nil, fmt.Errorf("error parsing TRUSTED_PROXIES: %q is not an IP address or CIDR range", v)
+		}
+		proxies = append(proxies, v)
+	}
+	return proxies, nil
+}
+
+// getEnvBool returns the boolean value (e.g. "true" or "0") of the environment variable key, or def when it is unset
+func getEnvBool(key string, def bool) (bool, error) {
+	v := os.Getenv(key)
+	if v == "" {
+		return def, nil
+	}
+
+	b, err := strconv.ParseBool(v)
+	if err != nil {
+		return false, fmt.Errorf("error converting %s to boolean: %v", key, err)
+	}
+	return b, nil
+}
+
+// getEnvFloat returns the floating point value of the environment variable key, or def when it is unset
+func getEnvFloat(key string, def float64) (float64, error) {
+	v := os.Getenv(key)
+	if v == "" {
+		return def, nil
+	}
+
+	f, err := strconv.ParseFloat(v, 64)
+	if err != nil {
+		return 0, fmt.Errorf("error converting %s to float: %v", key, err)
+	}
+	return f, nil
+}
+
+// getEnvDuration returns the duration value (e.g. "500ms") of the environment variable key, or def when it is unset
+func getEnvDuration(key string, def time.Duration) (time.Duration, error) {
+	v := os.Getenv(key)
+	if v == "" {
+		return def, nil
+	}
+
+	d, err := time.ParseDuration(v)
+	if err != nil {
+		return 0, fmt.Errorf("error converting %s to duration: %v", key, err)
+	}
+	return d, nil
+}
@@ -0,0 +1,48 @@
+package server
+
+import (
+	"net"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestNewServerReleasesOnFailure(t *testing.T) {
+	dir := t.TempDir()
+	t.Setenv("PORT", "8080")
+	t.Setenv("DATA_SOURCE", dataSourceFile)
+	t.Setenv("DATA_FILE", filepath.Join(dir, "persons.json"))
+
+	// RESP starts listening, then memcached can't and startup fails
+	free, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("failed to listen: %v", err)
+	}
+	respAddr := free.Addr().String()
+	free.Close()
+	taken, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("failed to listen: %v", err)
+	}
+	defer taken.Close()
+	t.Setenv("RESP_ADDR", respAddr)
+	t.Setenv("MEMCACHE_ADDR", taken.Addr().String())
+
+	if _, _, err := NewServer(); err == nil {
+		t.Fatal("expected NewServer() to fail on a taken address")
+	}
+
+	// The RESP listener is closed once its serving goroutine sees the server was shut down
+	deadline := time.Now().Add(2 * time.Second)
+	for {
+		l, err := net.Listen("tcp", respAddr)
+		if err == nil {
+			l.Close()
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("expected the failed startup to release %v: %v", respAddr, err)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
@@ -0,0 +1,65 @@
+package server
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"gocache/internal/certs"
+	"os"
+)
+
+// Client certificate policies of TLS_CLIENT_AUTH
+const (
+	clientAuthRequire  = "require"
+	clientAuthOptional = "optional"
+)
+
+// newTLSConfig builds the HTTPS configuration from TLS_CERT_FILE and TLS_KEY_FILE, reloading the certificate when
+// the files change, and verifies client certificates against TLS_CLIENT_CA_FILE when set. It returns nil, serving
+// plain HTTP, when no certificate is configured.
+func newTLSConfig() (*tls.Config, *certs.Reloader, error) {
+	certFile, keyFile, caFile := os.Getenv("TLS_CERT_FILE"), os.Getenv("TLS_KEY_FILE"), os.Getenv("TLS_CLIENT_CA_FILE")
+	if certFile == "" && keyFile == "" {
+		if caFile != "" {
+			return nil, nil, errors.New("TLS_CLIENT_CA_FILE requires TLS_CERT_FILE and TLS_KEY_FILE")
+		}
+		return nil, nil, nil
+	}
+	if certFile == "" || keyFile == "" {
+		return nil, nil, errors.New("TLS_CERT_FILE and TLS_KEY_FILE must be set together")
+	}
+
+	interval, err := getEnvDuration("TLS_RELOAD_INTERVAL", certs.DefaultInterval)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	cfg := &tls.Config{MinVersion: tls.VersionTLS12}
+	if caFile != "" {
+		pem, err := os.ReadFile(caFile)
+		if err != nil {
+			return nil, nil, fmt.Errorf("error reading TLS_CLIENT_CA_FILE: %w", err)
+		}
+		cfg.ClientCAs = x509.NewCertPool()
+		if !cfg.ClientCAs.AppendCertsFromPEM(pem) {
+			return nil, nil, fmt.Errorf("no certificates found in TLS_CLIENT_CA_FILE %v", caFile)
+		}
+
+		switch policy := getEnv("TLS_CLIENT_AUTH", clientAuthRequire); policy {
+		case clientAuthRequire:
+			cfg.ClientAuth = tls.RequireAndVerifyClientCert
+		case clientAuthOptional:
+			cfg.ClientAuth = tls.VerifyClientCertIfGiven
+		default:
+			return nil, nil, fmt.Errorf("unknown TLS_CLIENT_AUTH %q, expected %q or %q", policy, clientAuthRequire, clientAuthOptional)
+		}
+	}
+
+	reloader, err := certs.NewReloader(certFile, keyFile, interval)
+	if err != nil {
+		return nil, nil, err
+	}
+	cfg.GetCertificate = reloader.GetCertificate
+	return cfg, reloader, nil
+}
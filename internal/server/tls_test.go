@@ -0,0 +1,207 @@
+package server
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"gocache/internal/auth"
+	"gocache/internal/controller"
+	"gocache/internal/datasource"
+	"gocache/internal/grpcapi"
+	"gocache/pkg/personpb"
+	"io"
+	"log"
+	"math/big"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/credentials"
+	"google.golang.org/grpc/credentials/insecure"
+)
+
+// testCert is a certificate signed by parent, or self-signed when parent is nil
+type testCert struct {
+	cert *x509.Certificate
+	key  *ecdsa.PrivateKey
+	pem  []byte
+}
+
+func newTestCert(t *testing.T, commonName string, parent *testCert, template x509.Certificate) *testCert {
+	t.Helper()
+
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatalf("GenerateKey() error: %v", err)
+	}
+	template.SerialNumber = big.NewInt(time.Now().UnixNano())
+	template.Subject = pkix.Name{CommonName: commonName}
+	template.NotBefore, template.NotAfter = time.Now().Add(-time.Hour), time.Now().Add(time.Hour)
+
+	signer, signerKey := &template, key
+	if parent != nil {
+		signer, signerKey = parent.cert, parent.key
+	}
+	der, err := x509.CreateCertificate(rand.Reader, &template, signer, &key.PublicKey, signerKey)
+	if err != nil {
+		t.Fatalf("CreateCertificate() error: %v", err)
+	}
+	cert, err := x509.ParseCertificate(der)
+	if err != nil {
+		t.Fatalf("ParseCertificate() error: %v", err)
+	}
+	return &testCert{cert: cert, key: key, pem: pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der})}
+}
+
+// write writes the certificate and its key to dir, returning their paths
+func (c *testCert) write(t *testing.T, dir, name string) (string, string) {
+	t.Helper()
+	keyDER, err := x509.MarshalECPrivateKey(c.key)
+	if err != nil {
+		t.Fatalf("MarshalECPrivateKey() error: %v", err)
+	}
+	certFile, keyFile := filepath.Join(dir, name+".pem"), filepath.Join(dir, name+"-key.pem")
+	if err := os.WriteFile(certFile, c.pem, 0o600); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(keyFile, pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDER}), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	return certFile, keyFile
+}
+
+func (c *testCert) tlsCertificate() tls.Certificate {
+	return tls.Certificate{Certificate: [][]byte{c.cert.Raw}, PrivateKey: c.key}
+}
+
+func TestNewTLSConfig(t *testing.T) {
+	if cfg, _, err := newTLSConfig(); cfg != nil || err != nil {
+		t.Errorf("expected plain HTTP without a certificate, got %v, %v", cfg, err)
+	}
+
+	dir := t.TempDir()
+	certFile, keyFile := newTestCert(t, "localhost", nil, x509.Certificate{}).write(t, dir, "server")
+	for name, env := range map[string]map[string]string{
+		"key without cert": {"TLS_KEY_FILE": keyFile},
+		"CA without cert":  {"TLS_CLIENT_CA_FILE": certFile},
+		"unknown policy":   {"TLS_CERT_FILE": certFile, "TLS_KEY_FILE": keyFile, "TLS_CLIENT_CA_FILE": certFile, "TLS_CLIENT_AUTH": "sometimes"},
+		"CA without certs": {"TLS_CERT_FILE": certFile, "TLS_KEY_FILE": keyFile, "TLS_CLIENT_CA_FILE": keyFile},
+	} {
+		t.Run(name, func(t *testing.T) {
+			for k, v := range env {
+				t.Setenv(k, v)
+			}
+			if _, _, err := newTLSConfig(); err == nil {
+				t.Error("expected an error")
+			}
+		})
+	}
+}
+
+func TestMutualTLS(t *testing.T) {
+	dir := t.TempDir()
+	ca := newTestCert(t, "test CA", nil, x509.Certificate{IsCA: true, BasicConstraintsValid: true, KeyUsage: x509.KeyUsageCertSign})
+	server := newTestCert(t, "localhost", ca, x509.Certificate{IPAddresses: []net.IP{net.IPv4(127, 0, 0, 1)}, ExtKeyUsage: []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth}})
+	client := newTestCert(t, "client", ca, x509.Certificate{ExtKeyUsage: []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth}})
+	stranger := newTestCert(t, "stranger", nil, x509.Certificate{ExtKeyUsage: []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth}})
+
+	certFile, keyFile := server.write(t, dir, "server")
+	caFile, _ := ca.write(t, dir, "ca")
+	t.Setenv("TLS_CERT_FILE", certFile)
+	t.Setenv("TLS_KEY_FILE", keyFile)
+	t.Setenv("TLS_CLIENT_CA_FILE", caFile)
+
+	cfg, reloader, err := newTLSConfig()
+	if err != nil {
+		t.Fatalf("newTLSConfig() error: %v", err)
+	}
+	defer reloader.Close()
+
+	ts := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(r.TLS.PeerCertificates[0].Subject.CommonName))
+	}))
+	// StartTLS would serve httptest's own certificate, so the listener is wrapped instead
+	ts.Listener = tls.NewListener(ts.Listener, cfg)
+	ts.Config.ErrorLog = log.New(io.Discard, "", 0)
+	ts.Start()
+	defer ts.Close()
+	url := "https://" + ts.Listener.Addr().String()
+
+	roots := x509.NewCertPool()
+	roots.AddCert(ca.cert)
+	get := func(certs ...tls.Certificate) error {
+		c := &http.Client{Transport: &http.Transport{TLSClientConfig: &tls.Config{RootCAs: roots, Certificates: certs}}}
+		resp, err := c.Get(url)
+		if err != nil {
+			return err
+		}
+		return resp.Body.Close()
+	}
+
+	if err := get(client.tlsCertificate()); err != nil {
+		t.Errorf("expected a client certificate signed by the CA to be accepted, got %v", err)
+	}
+	if err := get(); err == nil {
+		t.Error("expected a client without a certificate to be rejected")
+	}
+	if err := get(stranger.tlsCertificate()); err == nil {
+		t.Error("expected a client certificate from another CA to be rejected")
+	}
+}
+
+func TestGRPCServesTLS(t *testing.T) {
+	dir := t.TempDir()
+	server := newTestCert(t, "localhost", nil, x509.Certificate{IPAddresses: []net.IP{net.IPv4(127, 0, 0, 1)}})
+	certFile, keyFile := server.write(t, dir, "server")
+	t.Setenv("TLS_CERT_FILE", certFile)
+	t.Setenv("TLS_KEY_FILE", keyFile)
+
+	cfg, reloader, err := newTLSConfig()
+	if err != nil {
+		t.Fatalf("newTLSConfig() error: %v", err)
+	}
+	defer reloader.Close()
+
+	pc, err := controller.NewPersonController(datasource.NewMockDataSource())
+	if err != nil {
+		t.Fatalf("NewPersonController() error: %v", err)
+	}
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	s := grpcapi.NewServer(pc, nil, auth.Mask{}, cfg)
+	go s.Serve(l)
+	defer s.Close()
+
+	get := func(creds credentials.TransportCredentials) error {
+		conn, err := grpc.NewClient(l.Addr().String(), grpc.WithTransportCredentials(creds))
+		if err != nil {
+			return err
+		}
+		defer conn.Close()
+		ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		defer cancel()
+		_, err = personpb.NewPersonServiceClient(conn).Get(ctx, &personpb.GetRequest{Id: 1})
+		return err
+	}
+
+	roots := x509.NewCertPool()
+	roots.AddCert(server.cert)
+	if err := get(credentials.NewTLS(&tls.Config{RootCAs: roots})); err != nil {
+		t.Errorf("expected a call over TLS to succeed, got %v", err)
+	}
+	if err := get(insecure.NewCredentials()); err == nil {
+		t.Error("expected a plaintext call to be rejected")
+	}
+}
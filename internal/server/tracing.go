@@ -0,0 +1,63 @@
+package server
+
+import (
+	"context"
+	"fmt"
+	"gocache/internal/tracing"
+	"net/http"
+
+	"github.com/gin-gonic/gin"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/propagation"
+	semconv "go.opentelemetry.io/otel/semconv/v1.24.0"
+	"go.opentelemetry.io/otel/trace"
+)
+
+// setupTracing configures tracing from TRACING_EXPORTER, TRACING_FILE and TRACING_SAMPLE_RATIO
+func setupTracing() (func(context.Context) error, error) {
+	ratio, err := getEnvFloat("TRACING_SAMPLE_RATIO", 1)
+	if err != nil {
+		return nil, err
+	}
+	if ratio < 0 || ratio > 1 {
+		return nil, fmt.Errorf("TRACING_SAMPLE_RATIO must be between 0 and 1, got %v", ratio)
+	}
+
+	stop, err := tracing.Setup(context.Background(), tracing.Config{
+		Exporter:    getEnv("TRACING_EXPORTER", tracing.ExporterNone),
+		File:        getEnv("TRACING_FILE", "traces.jsonl"),
+		SampleRatio: ratio,
+	})
+	if err != nil {
+		return nil, fmt.Errorf("error configuring tracing: %w", err)
+	}
+	return stop, nil
+}
+
+// trace starts the server span of every request, continuing the trace of a caller that sent a traceparent header.
+// Handlers pass c.Request.Context() on, so the controller and data source spans become its children.
+func (s *Server) trace(c *gin.Context) {
+	ctx := otel.GetTextMapPropagator().Extract(c.Request.Context(), propagation.HeaderCarrier(c.Request.Header))
+
+	route := c.FullPath()
+	name := c.Request.Method + " " + route
+	if route == "" {
+		route = unmatchedRoute
+		name = c.Request.Method
+	}
+	ctx, span := tracing.Tracer().Start(ctx, name,
+		trace.WithSpanKind(trace.SpanKindServer),
+		trace.WithAttributes(semconv.HTTPRequestMethodKey.String(c.Request.Method), semconv.HTTPRoute(route), semconv.URLPath(c.Request.URL.Path)))
+	defer span.End()
+
+	c.Request = c.Request.WithContext(ctx)
+	c.Next()
+
+	status := c.Writer.Status()
+	span.SetAttributes(semconv.HTTPResponseStatusCode(status))
+	// Only server errors fail the span, client errors are answers
+	if status >= http.StatusInternalServerError {
+		span.SetStatus(codes.Error, fmt.Sprintf("%d %s", status, http.StatusText(status)))
+	}
+}
@@ -0,0 +1,88 @@
+package server
+
+import (
+	"bytes"
+	"gocache/internal/controller"
+	"gocache/internal/datasource"
+	"gocache/internal/logger"
+	"net/http"
+	"os"
+	"strings"
+	"testing"
+
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/propagation"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/sdk/trace/tracetest"
+)
+
+// newTracingTestServer returns a server whose spans are recorded by the returned recorder
+func newTracingTestServer(t *testing.T) (http.Handler, *tracetest.SpanRecorder) {
+	t.Helper()
+
+	recorder := tracetest.NewSpanRecorder()
+	provider, propagator := otel.GetTracerProvider(), otel.GetTextMapPropagator()
+	otel.SetTracerProvider(sdktrace.NewTracerProvider(sdktrace.WithSpanProcessor(recorder)))
+	otel.SetTextMapPropagator(propagation.TraceContext{})
+	t.Cleanup(func() {
+		otel.SetTracerProvider(provider)
+		otel.SetTextMapPropagator(propagator)
+	})
+
+	pc, err := controller.NewPersonController(datasource.Instrument(datasource.NewMockDataSource()))
+	if err != nil {
+		t.Fatalf("NewPersonController() returned an error: %v", err)
+	}
+	return newTestServer(t, func(s *Server) { s.pc = controller.Trace(pc) }), recorder
+}
+
+func TestTracing(t *testing.T) {
+	h, recorder := newTracingTestServer(t)
+
+	var logs bytes.Buffer
+	logger.Logger.SetOutput(&logs)
+	t.Cleanup(func() { logger.Logger.SetOutput(os.Stderr) })
+
+	const traceID = "4bf92f3577b34da6a3ce929d0e0e4736"
+	w := doRequest(h, http.MethodGet, "/persons/1", "", map[string]string{"traceparent": "00-" + traceID + "-00f067aa0ba902b7-01"})
+	if w.Code != http.StatusOK {
+		t.Fatalf("expected 200, got %d", w.Code)
+	}
+	w = doRequest(h, http.MethodPost, "/persons/update", w.Body.String(), map[string]string{"traceparent": "00-" + traceID + "-00f067aa0ba902b7-01"})
+	if w.Code != http.StatusOK {
+		t.Fatalf("expected 200, got %d: %s", w.Code, w.Body.String())
+	}
+
+	spans := make(map[string]sdktrace.ReadOnlySpan)
+	for _, span := range recorder.Ended() {
+		spans[span.Name()] = span
+	}
+
+	// Each layer's span is a child of the one above it, the warm-up has a trace of its own
+	for child, parent := range map[string]string{
+		"DataSource.GetAllPersons":      "PersonController.Warmup",
+		"PersonController.GetPerson":    "GET /persons/:id",
+		"PersonStore.GetPerson":         "PersonController.GetPerson",
+		"PersonController.UpdatePerson": "POST /persons/update",
+		"DataSource.UpdatePerson":       "PersonController.UpdatePerson",
+	} {
+		c, p := spans[child], spans[parent]
+		if c == nil || p == nil {
+			t.Errorf("expected spans %q and %q, got %v", child, parent, recorder.Ended())
+			continue
+		}
+		if c.Parent().SpanID() != p.SpanContext().SpanID() {
+			t.Errorf("expected %q to be a child of %q", child, parent)
+		}
+		if got := c.SpanContext().TraceID().String(); got != traceID && parent != "PersonController.Warmup" {
+			t.Errorf("expected %q to continue the caller's trace, got trace %v", child, got)
+		}
+	}
+	if root := spans["GET /persons/:id"]; root != nil && root.Parent().SpanID().String() != "00f067aa0ba902b7" {
+		t.Errorf("expected the request span to be a child of the caller's span, got %v", root.Parent().SpanID())
+	}
+
+	if !strings.Contains(logs.String(), `"trace_id":"`+traceID+`"`) {
+		t.Errorf("expected log lines to carry the trace ID, got %s", logs.String())
+	}
+}
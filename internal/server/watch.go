@@ -0,0 +1,211 @@
+package server
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"gocache/internal/controller"
+	"gocache/internal/logger"
+	"gocache/pkg/model"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/gorilla/websocket"
+)
+
+const (
+	// watchKeepAlive is how often an idle feed is pinged so proxies and clients don't time it out
+	watchKeepAlive = 15 * time.Second
+	// watchWriteTimeout bounds each write to a feed, a client that stops reading is disconnected
+	watchWriteTimeout = 10 * time.Second
+)
+
+// Watch feed events
+const (
+	watchEventReady  = "ready"
+	watchEventChange = "change"
+	watchEventError  = "error"
+)
+
+// watchMessage is one message of a watch feed. Seq is the sequence number to resume after: the start of
+// the feed for ready, the change's own for change and the last one delivered for the final error.
+type watchMessage struct {
+	Event  string        `json:"event"`
+	Seq    uint64        `json:"seq"`
+	Change *model.Change `json:"change,omitempty"`
+	Error  string        `json:"error,omitempty"`
+}
+
+// watchPersonsHandler streams changes as server-sent events. Every event carries its sequence number as the
+// event id, so a reconnecting EventSource resumes through Last-Event-ID.
+func (s *Server) watchPersonsHandler(c *gin.Context) {
+	logger.Logger.WithContext(c.Request.Context()).Infof("ROUTE: watchPersonsHandler called: %v %v", c.Request.Method, c.Request.URL.Path)
+	w, ok := s.startWatch(c)
+	if !ok {
+		return
+	}
+	defer w.Stop()
+
+	rc := http.NewResponseController(c.Writer)
+	// The feed is long lived, so it can't be bound by the server's write timeout
+	rc.SetWriteDeadline(time.Time{})
+
+	c.Header("Content-Type", "text/event-stream")
+	c.Header("Cache-Control", "no-cache")
+	c.Header("X-Accel-Buffering", "no")
+	c.Status(http.StatusOK)
+
+	send := func(m watchMessage) error {
+		data, _ := json.Marshal(m)
+		rc.SetWriteDeadline(time.Now().Add(watchWriteTimeout))
+		if _, err := fmt.Fprintf(c.Writer, "id: %d\nevent: %s\ndata: %s\n\n", m.Seq, m.Event, data); err != nil {
+			return err
+		}
+		return rc.Flush()
+	}
+	ping := func() error {
+		rc.SetWriteDeadline(time.Now().Add(watchWriteTimeout))
+		if _, err := c.Writer.WriteString(": keep-alive\n\n"); err != nil {
+			return err
+		}
+		return rc.Flush()
+	}
+
+	s.streamWatch(c.Request.Context(), c.Request.Context().Done(), w, send, ping)
+}
+
+// watchPersonsWSHandler streams changes over a WebSocket as JSON text messages
+func (s *Server) watchPersonsWSHandler(c *gin.Context) {
+	logger.Logger.WithContext(c.Request.Context()).Infof("ROUTE: watchPersonsWSHandler called: %v %v", c.Request.Method, c.Request.URL.Path)
+	w, ok := s.startWatch(c)
+	if !ok {
+		return
+	}
+	defer w.Stop()
+
+	upgrader := websocket.Upgrader{CheckOrigin: s.cors.checkOrigin}
+	conn, err := upgrader.Upgrade(c.Writer, c.Request, nil)
+	if err != nil {
+		// The upgrader has already replied
+		logger.Logger.WithContext(c.Request.Context()).Errorf("ROUTE: watchPersonsWSHandler error upgrading connection: %v", err)
+		return
+	}
+	defer conn.Close()
+
+	// Clients don't send anything, but reading processes pongs and notices when the client goes away
+	gone := make(chan struct{})
+	conn.SetReadDeadline(time.Now().Add(2 * watchKeepAlive))
+	conn.SetPongHandler(func(string) error {
+		return conn.SetReadDeadline(time.Now().Add(2 * watchKeepAlive))
+	})
+	go func() {
+		defer close(gone)
+		for {
+			if _, _, err := conn.ReadMessage(); err != nil {
+				return
+			}
+		}
+	}()
+
+	send := func(m watchMessage) error {
+		conn.SetWriteDeadline(time.Now().Add(watchWriteTimeout))
+		return conn.WriteJSON(m)
+	}
+	ping := func() error {
+		return conn.WriteControl(websocket.PingMessage, nil, time.Now().Add(watchWriteTimeout))
+	}
+
+	code := websocket.CloseNormalClosure
+	switch err := s.streamWatch(c.Request.Context(), gone, w, send, ping); {
+	case errors.Is(err, controller.ErrWatchLagged):
+		code = websocket.CloseTryAgainLater
+	case errors.Is(err, controller.ErrClosed):
+		code = websocket.CloseGoingAway
+	}
+	conn.WriteControl(websocket.CloseMessage, websocket.FormatCloseMessage(code, ""), time.Now().Add(watchWriteTimeout))
+}
+
+// startWatch subscribes with the filter and resume point of the request, replying with an error if it can't
+func (s *Server) startWatch(c *gin.Context) (*controller.Watcher, bool) {
+	ages, err := stringSliceToIntSlice(c.QueryArray("ages"))
+	if err != nil {
+		logger.Logger.WithContext(c.Request.Context()).Errorf("ROUTE: watch error converting string slice to int slice: %v", err)
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid ages parameter"})
+		return nil, false
+	}
+
+	opts := controller.WatchOptions{Filter: model.Filter{Name: c.Query("name"), Email: c.Query("email"), Ages: ages}}
+	if err := s.mask.Filter(c.Request.Context(), opts.Filter); err != nil {
+		logger.Logger.WithContext(c.Request.Context()).Errorf("ROUTE: watch error: %v", err)
+		c.JSON(http.StatusForbidden, gin.H{"error": err.Error()})
+		return nil, false
+	}
+
+	// An explicit since wins over the id a reconnecting EventSource sends
+	since := c.Query("since")
+	if since == "" {
+		since = c.GetHeader("Last-Event-ID")
+	}
+	if since != "" {
+		opts.Resume = true
+		if opts.Since, err = strconv.ParseUint(since, 10, 64); err != nil {
+			logger.Logger.WithContext(c.Request.Context()).Errorf("ROUTE: watch error converting since: %v", err)
+			c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid since parameter"})
+			return nil, false
+		}
+	}
+
+	w, err := s.pc.Watch(opts)
+	if errors.Is(err, controller.ErrWatchExpired) {
+		// The client missed changes it can't be sent, it has to reload and watch again
+		c.JSON(http.StatusGone, gin.H{"error": err.Error()})
+		return nil, false
+	}
+	if err != nil {
+		logger.Logger.WithContext(c.Request.Context()).Errorf("ROUTE: watch error: %v", err)
+		c.JSON(http.StatusServiceUnavailable, gin.H{"error": err.Error()})
+		return nil, false
+	}
+	return w, true
+}
+
+// streamWatch sends a ready message and then every change, as the caller in ctx may see it, until gone is closed,
+// sending fails or the watch ends, returning why the watch ended. A watch ended by the server gets a final error message.
+func (s *Server) streamWatch(ctx context.Context, gone <-chan struct{}, w *controller.Watcher, send func(watchMessage) error, ping func() error) error {
+	seq := w.Seq()
+	if err := send(watchMessage{Event: watchEventReady, Seq: seq}); err != nil {
+		return err
+	}
+
+	keepAlive := time.NewTicker(watchKeepAlive)
+	defer keepAlive.Stop()
+
+	for {
+		select {
+		case <-gone:
+			return nil
+		case <-s.watchDone:
+			send(watchMessage{Event: watchEventError, Seq: seq, Error: controller.ErrClosed.Error()})
+			return controller.ErrClosed
+		case <-keepAlive.C:
+			if err := ping(); err != nil {
+				return err
+			}
+		case change, ok := <-w.Changes():
+			if !ok {
+				err := w.Err()
+				send(watchMessage{Event: watchEventError, Seq: seq, Error: err.Error()})
+				return err
+			}
+
+			seq = change.Seq
+			change = s.mask.Change(ctx, change)
+			if err := send(watchMessage{Event: watchEventChange, Seq: seq, Change: &change}); err != nil {
+				return err
+			}
+		}
+	}
+}
@@ -0,0 +1,232 @@
+package server
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"gocache/internal/auth"
+	"gocache/pkg/model"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+// newWatchTestServer serves newTestAPI over HTTP, ending open watches before the server is closed so closing it
+// doesn't wait on them
+func newWatchTestServer(t *testing.T, configure ...func(*Server)) (*httptest.Server, *Server) {
+	t.Helper()
+
+	s := newTestAPI(t, configure...)
+	ts := httptest.NewServer(s.RegisterRoutes())
+	t.Cleanup(func() {
+		s.stopWatches()
+		ts.Close()
+	})
+	return ts, s
+}
+
+// sseStream reads server-sent events from a watch feed
+type sseStream struct {
+	resp *http.Response
+	r    *bufio.Reader
+}
+
+func openSSE(t *testing.T, url string, headers map[string]string) *sseStream {
+	t.Helper()
+
+	req, _ := http.NewRequest(http.MethodGet, url, nil)
+	for k, v := range headers {
+		req.Header.Set(k, v)
+	}
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatalf("GET %v failed: %v", url, err)
+	}
+	t.Cleanup(func() { resp.Body.Close() })
+
+	return &sseStream{resp: resp, r: bufio.NewReader(resp.Body)}
+}
+
+// next returns the id and message of the next event, skipping keep-alive comments
+func (s *sseStream) next(t *testing.T) (string, watchMessage) {
+	t.Helper()
+
+	fields := make(map[string]string)
+	for {
+		line, err := s.r.ReadString('\n')
+		if err != nil {
+			t.Fatalf("failed to read event: %v", err)
+		}
+		line = strings.TrimSuffix(line, "\n")
+		if line == "" && len(fields) > 0 {
+			break
+		}
+		if name, value, ok := strings.Cut(line, ": "); ok && name != "" {
+			fields[name] = value
+		}
+	}
+
+	var m watchMessage
+	if err := json.Unmarshal([]byte(fields["data"]), &m); err != nil {
+		t.Fatalf("invalid event data %q: %v", fields["data"], err)
+	}
+	if fields["event"] != m.Event {
+		t.Errorf("expected event %q to match the data, got %q", m.Event, fields["event"])
+	}
+	return fields["id"], m
+}
+
+func TestWatchSSE(t *testing.T) {
+	ts, s := newWatchTestServer(t)
+
+	stream := openSSE(t, ts.URL+"/persons/watch?ages=25", nil)
+	if ct := stream.resp.Header.Get("Content-Type"); ct != "text/event-stream" {
+		t.Fatalf("expected an event stream, got %d %q", stream.resp.StatusCode, ct)
+	}
+	id, ready := stream.next(t)
+	if ready.Event != watchEventReady || id != strconv.FormatUint(ready.Seq, 10) {
+		t.Fatalf("expected a ready event, got %v %+v", id, ready)
+	}
+
+	// Only Jane matches the filter
+	john, _ := s.pc.GetPerson(context.Background(), 1)
+	s.pc.UpdatePerson(context.Background(), john)
+	jane, _ := s.pc.GetPerson(context.Background(), 2)
+	jane.Age = 26
+	updated, err := s.pc.UpdatePerson(context.Background(), jane)
+	if err != nil {
+		t.Fatalf("UpdatePerson() returned an error: %v", err)
+	}
+
+	id, m := stream.next(t)
+	if m.Event != watchEventChange || m.Seq != ready.Seq+2 || id != strconv.FormatUint(m.Seq, 10) {
+		t.Fatalf("expected change %v, got %v %+v", ready.Seq+2, id, m)
+	}
+	if m.Change.Op != model.OpUpdate || m.Change.Before.Age != 25 || *m.Change.After != updated {
+		t.Errorf("expected before and after images, got %+v", m.Change)
+	}
+
+	// A reconnecting EventSource resumes through Last-Event-ID
+	resumed := openSSE(t, ts.URL+"/persons/watch", map[string]string{"Last-Event-ID": strconv.FormatUint(ready.Seq, 10)})
+	resumed.next(t)
+	for _, want := range []uint64{ready.Seq + 1, ready.Seq + 2} {
+		if _, m := resumed.next(t); m.Seq != want {
+			t.Errorf("expected replayed change %v, got %+v", want, m)
+		}
+	}
+
+	// Shutting down ends the feed with an error event
+	s.stopWatches()
+	if _, m := stream.next(t); m.Event != watchEventError || m.Seq != ready.Seq+2 {
+		t.Errorf("expected a final error event, got %+v", m)
+	}
+}
+
+func TestWatchRejectsBadResumePoints(t *testing.T) {
+	ts, _ := newWatchTestServer(t)
+
+	cases := map[string]int{
+		"/persons/watch?since=1":     http.StatusGone,
+		"/persons/watch?since=x":     http.StatusBadRequest,
+		"/persons/watch?ages=old":    http.StatusBadRequest,
+		"/persons/watch/ws?since=1":  http.StatusGone,
+		"/persons/watch/ws?ages=old": http.StatusBadRequest,
+	}
+	for path, want := range cases {
+		resp, err := http.Get(ts.URL + path)
+		if err != nil {
+			t.Fatalf("GET %v failed: %v", path, err)
+		}
+		resp.Body.Close()
+		if resp.StatusCode != want {
+			t.Errorf("%v: expected %d, got %d", path, want, resp.StatusCode)
+		}
+	}
+}
+
+func TestWatchWebSocket(t *testing.T) {
+	ts, s := newWatchTestServer(t)
+	url := "ws" + strings.TrimPrefix(ts.URL, "http") + "/persons/watch/ws?name=John+Doe"
+
+	if _, resp, err := websocket.DefaultDialer.Dial(url, http.Header{"Origin": {"http://evil.example.com"}}); err == nil || resp.StatusCode != http.StatusForbidden {
+		t.Errorf("expected a cross-origin upgrade to be rejected, got %v", err)
+	}
+
+	conn, _, err := websocket.DefaultDialer.Dial(url, http.Header{"Origin": {"http://localhost:5173"}})
+	if err != nil {
+		t.Fatalf("Dial() failed: %v", err)
+	}
+	defer conn.Close()
+	conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+
+	var ready, m watchMessage
+	if err := conn.ReadJSON(&ready); err != nil || ready.Event != watchEventReady {
+		t.Fatalf("expected a ready message, got %+v (%v)", ready, err)
+	}
+
+	if _, err := s.pc.ApplyBatch(context.Background(), []model.WriteOp{{Op: model.OpDelete, ID: 1}}); err != nil {
+		t.Fatalf("ApplyBatch() returned an error: %v", err)
+	}
+	if err := conn.ReadJSON(&m); err != nil || m.Change == nil || m.Change.Op != model.OpDelete || m.Change.Before.Name != "John Doe" {
+		t.Fatalf("expected the delete, got %+v (%v)", m, err)
+	}
+
+	s.stopWatches()
+	if err := conn.ReadJSON(&m); err != nil || m.Event != watchEventError {
+		t.Errorf("expected a final error message, got %+v (%v)", m, err)
+	}
+	if _, _, err := conn.ReadMessage(); !websocket.IsCloseError(err, websocket.CloseGoingAway) {
+		t.Errorf("expected a going away close, got %v", err)
+	}
+}
+
+func TestWatchAccessToken(t *testing.T) {
+	ts, _ := newWatchTestServer(t, withAPIKeys(map[string]auth.Principal{"key-1": {ID: "reader", Roles: []string{auth.RoleRead}}}))
+
+	if resp := openSSE(t, ts.URL+"/persons/watch?access_token=key-2", nil).resp; resp.StatusCode != http.StatusUnauthorized {
+		t.Errorf("expected 401 for an unknown token, got %d", resp.StatusCode)
+	}
+	if resp := openSSE(t, ts.URL+"/persons/1?access_token=key-1", nil).resp; resp.StatusCode != http.StatusUnauthorized {
+		t.Errorf("expected the token to be refused outside the watch routes, got %d", resp.StatusCode)
+	}
+	sse := openSSE(t, ts.URL+"/persons/watch?access_token=key-1&name=John+Doe", nil)
+	if sse.resp.StatusCode != http.StatusOK {
+		t.Fatalf("expected 200 with a valid token, got %d", sse.resp.StatusCode)
+	}
+	if _, m := sse.next(t); m.Event != watchEventReady {
+		t.Errorf("expected a ready event, got %+v", m)
+	}
+
+	url := "ws" + strings.TrimPrefix(ts.URL, "http")
+	conn, _, err := websocket.DefaultDialer.Dial(url+"/persons/watch/ws?access_token=key-1", nil)
+	if err != nil {
+		t.Fatalf("Dial() failed: %v", err)
+	}
+	defer conn.Close()
+	conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	var ready watchMessage
+	if err := conn.ReadJSON(&ready); err != nil || ready.Event != watchEventReady {
+		t.Errorf("expected a ready message, got %+v (%v)", ready, err)
+	}
+
+	// A GraphQL WebSocket without credentials is upgraded and authenticates in connection_init
+	gql, _, err := (&websocket.Dialer{Subprotocols: []string{"graphql-transport-ws"}}).Dial(url+"/graphql", nil)
+	if err != nil {
+		t.Fatalf("Dial() failed: %v", err)
+	}
+	defer gql.Close()
+	gql.SetReadDeadline(time.Now().Add(5 * time.Second))
+	gql.WriteJSON(map[string]interface{}{"type": "connection_init", "payload": map[string]string{"X-API-Key": "key-1"}})
+	var ack struct{ Type string }
+	if err := gql.ReadJSON(&ack); err != nil || ack.Type != "connection_ack" {
+		t.Errorf("expected connection_ack, got %+v (%v)", ack, err)
+	}
+	if _, resp, err := websocket.DefaultDialer.Dial(url+"/persons/watch/ws", nil); err == nil || resp.StatusCode != http.StatusUnauthorized {
+		t.Errorf("expected a watch without credentials to be rejected, got %v", err)
+	}
+}
@@ -0,0 +1,58 @@
+package tracing
+
+import (
+	"context"
+	"errors"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"go.opentelemetry.io/otel"
+)
+
+func TestSetupFileExporter(t *testing.T) {
+	provider := otel.GetTracerProvider()
+	t.Cleanup(func() { otel.SetTracerProvider(provider) })
+
+	path := filepath.Join(t.TempDir(), "traces.jsonl")
+	stop, err := Setup(context.Background(), Config{Exporter: ExporterFile, File: path, SampleRatio: 1})
+	if err != nil {
+		t.Fatalf("Setup() error: %v", err)
+	}
+
+	ctx, parent := Start(context.Background(), "parent")
+	_, child := Start(ctx, "child")
+	End(child, errors.New("boom"))
+	End(parent, nil)
+
+	if err := stop(context.Background()); err != nil {
+		t.Fatalf("stop() error: %v", err)
+	}
+
+	data, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatalf("ReadFile() error: %v", err)
+	}
+	for _, want := range []string{`"Name":"parent"`, `"Name":"child"`, `"Description":"boom"`, `"Value":"gocache"`, parent.SpanContext().TraceID().String()} {
+		if !strings.Contains(string(data), want) {
+			t.Errorf("expected %s in the exported spans, got %s", want, data)
+		}
+	}
+}
+
+func TestSetupRejectsBadConfig(t *testing.T) {
+	for _, cfg := range []Config{{Exporter: "zipkin"}, {Exporter: ExporterFile}} {
+		if _, err := Setup(context.Background(), cfg); err == nil {
+			t.Errorf("expected %+v to be rejected", cfg)
+		}
+	}
+
+	stop, err := Setup(context.Background(), Config{})
+	if err != nil {
+		t.Fatalf("Setup() error: %v", err)
+	}
+	if err := stop(context.Background()); err != nil {
+		t.Errorf("stop() error: %v", err)
+	}
+}
@@ -0,0 +1,57 @@
+package model
+
+import (
+	"errors"
+	"fmt"
+)
+
+// Write operation kinds
+const (
+	OpInsert = "insert"
+	OpUpdate = "update"
+	OpDelete = "delete"
+)
+
+// ErrAlreadyExists is returned when inserting a person whose ID is taken
+var ErrAlreadyExists = errors.New("person already exists")
+
+// WriteOp is one write in a transaction. Insert and update take Person, update follows the same
+// version rules as a single update, and delete removes the person with the given ID.
+type WriteOp struct {
+	Op     string `json:"op"`
+	Person Person `json:"person"`
+	ID     int    `json:"id,omitempty"`
+}
+
+// Key returns the ID of the person the operation writes
+func (w WriteOp) Key() int {
+	if w.Op == OpDelete {
+		return w.ID
+	}
+	return w.Person.ID
+}
+
+// Validate checks the operation is well formed and that inserts and updates write a valid person
+func (w WriteOp) Validate() error {
+	switch w.Op {
+	case OpInsert, OpUpdate:
+		return w.Person.Validate()
+	case OpDelete:
+		return nil
+	}
+	return fmt.Errorf("%w: unknown op %q", ErrInvalidOp, w.Op)
+}
+
+// OpError reports which operation of a transaction failed, the whole transaction is aborted
+type OpError struct {
+	Index int
+	Err   error
+}
+
+func (e *OpError) Error() string {
+	return fmt.Sprintf("operation %d: %v", e.Index, e.Err)
+}
+
+func (e *OpError) Unwrap() error {
+	return e.Err
+}
@@ -0,0 +1,47 @@
+package model
+
+// Change is a committed write to a person. Op is OpInsert, OpUpdate or OpDelete, Before is the value
+// the write replaced (nil for inserts) and After the value it stored (nil for deletes). Seq orders
+// changes and lets a watcher resume after the last one it saw.
+type Change struct {
+	Seq    uint64  `json:"seq"`
+	Op     string  `json:"op"`
+	ID     int     `json:"id"`
+	Before *Person `json:"before,omitempty"`
+	After  *Person `json:"after,omitempty"`
+}
+
+// Filter selects persons by the criteria of a query: an exact name, an exact email and any of Ages.
+// Empty criteria match every person.
+type Filter struct {
+	Name  string
+	Email string
+	Ages  []int
+}
+
+// Match reports whether p meets every criterion of the filter
+func (f Filter) Match(p Person) bool {
+	if f.Name != "" && p.Name != f.Name {
+		return false
+	}
+	if f.Email != "" && p.Email != f.Email {
+		return false
+	}
+	if len(f.Ages) == 0 {
+		return true
+	}
+	for _, age := range f.Ages {
+		if p.Age == age {
+			return true
+		}
+	}
+	return false
+}
+
+// MatchChange reports whether either image of c matches, so watchers also see persons leave the filter
+func (f Filter) MatchChange(c Change) bool {
+	if f.Name == "" && f.Email == "" && len(f.Ages) == 0 {
+		return true
+	}
+	return (c.Before != nil && f.Match(*c.Before)) || (c.After != nil && f.Match(*c.After))
+}
@@ -0,0 +1,29 @@
+package model
+
+import "testing"
+
+func TestFilterMatchChange(t *testing.T) {
+	john := Person{ID: 1, Name: "John Doe", Age: 30, Email: "john@example.com"}
+	older := john
+	older.Age = 31
+
+	cases := []struct {
+		name   string
+		filter Filter
+		change Change
+		want   bool
+	}{
+		{"empty filter", Filter{}, Change{Op: OpDelete, ID: 7}, true},
+		{"name and age", Filter{Name: "John Doe", Ages: []int{29, 30}}, Change{Op: OpInsert, After: &john}, true},
+		{"wrong email", Filter{Email: "jane@example.com"}, Change{Op: OpInsert, After: &john}, false},
+		{"leaves filter", Filter{Ages: []int{30}}, Change{Op: OpUpdate, Before: &john, After: &older}, true},
+		{"never matched", Filter{Ages: []int{40}}, Change{Op: OpUpdate, Before: &john, After: &older}, false},
+		{"uncached delete", Filter{Name: "John Doe"}, Change{Op: OpDelete, ID: 1}, false},
+	}
+
+	for _, c := range cases {
+		if got := c.filter.MatchChange(c.change); got != c.want {
+			t.Errorf("%s: expected %v, got %v", c.name, c.want, got)
+		}
+	}
+}
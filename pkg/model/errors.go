@@ -0,0 +1,10 @@
+package model
+
+import "errors"
+
+var (
+	// ErrNotFound is returned when a person doesn't exist, by the data sources and the store alike
+	ErrNotFound = errors.New("person not found")
+	// ErrConflict is returned when an update carries a stale version, by the data sources and the store alike
+	ErrConflict = errors.New("version conflict")
+)
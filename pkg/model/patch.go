@@ -0,0 +1,176 @@
+package model
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math"
+)
+
+// Field operation kinds
+const (
+	OpSet       = "set"
+	OpIncrement = "inc"
+	OpTest      = "test"
+)
+
+var (
+	// ErrInvalidOp is returned when a field operation is malformed
+	ErrInvalidOp = errors.New("invalid field operation")
+	// ErrTestFailed is returned when a test operation doesn't match the current value
+	ErrTestFailed = errors.New("test operation failed")
+)
+
+// FieldOp is a single operation on a person field, identified by its JSON name.
+// A list of ops is applied all-or-nothing: set replaces a value, inc adds to a numeric
+// field and test aborts the whole list unless the field currently equals Value.
+type FieldOp struct {
+	Op    string      `json:"op"`
+	Field string      `json:"field"`
+	Value interface{} `json:"value"`
+}
+
+// NormalizeOps validates ops and converts their values to the Go type of the target field,
+// so decoded JSON numbers can be compared and stored directly
+func NormalizeOps(ops []FieldOp) ([]FieldOp, error) {
+	normalized := make([]FieldOp, 0, len(ops))
+	modified := make(map[string]bool)
+
+	for _, op := range ops {
+		switch op.Op {
+		case OpSet, OpIncrement:
+			if op.Field == "id" || op.Field == "version" {
+				return nil, fmt.Errorf("%w: field %q can't be modified", ErrInvalidOp, op.Field)
+			}
+			if modified[op.Field] {
+				return nil, fmt.Errorf("%w: field %q modified more than once", ErrInvalidOp, op.Field)
+			}
+			modified[op.Field] = true
+		case OpTest:
+		default:
+			return nil, fmt.Errorf("%w: unknown op %q", ErrInvalidOp, op.Op)
+		}
+
+		value, err := normalizeValue(op.Field, op.Value)
+		if err != nil {
+			return nil, err
+		}
+
+		if op.Op == OpIncrement && op.Field != "age" {
+			return nil, fmt.Errorf("%w: field %q is not numeric", ErrInvalidOp, op.Field)
+		}
+		// Set values are checked up front, increments can only be checked against the current value by Apply
+		if op.Op == OpSet {
+			if msg := validateField(op.Field, value); msg != "" {
+				return nil, &ValidationError{Fields: []FieldError{{Field: op.Field, Message: msg}}}
+			}
+		}
+
+		normalized = append(normalized, FieldOp{Op: op.Op, Field: op.Field, Value: value})
+	}
+
+	return normalized, nil
+}
+
+// Apply applies ops to the person atomically, on error the person is left unchanged.
+// Apply doesn't touch Version, stores bump it once per successful call. Every modified
+// field must be valid afterwards, otherwise a *ValidationError is returned.
+func (p *Person) Apply(ops []FieldOp) error {
+	ops, err := NormalizeOps(ops)
+	if err != nil {
+		return err
+	}
+
+	next := *p
+	var modified []string
+	for _, op := range ops {
+		switch op.Op {
+		case OpTest:
+			if next.field(op.Field) != op.Value {
+				// The current value stays out of the message, it may be personal data the caller can't see
+				return fmt.Errorf("%w: %v doesn't match", ErrTestFailed, op.Field)
+			}
+		case OpSet:
+			next.setField(op.Field, op.Value)
+			modified = append(modified, op.Field)
+		case OpIncrement:
+			next.Age += op.Value.(int)
+			modified = append(modified, op.Field)
+		}
+	}
+	if err := next.validateFields(modified...); err != nil {
+		return err
+	}
+
+	*p = next
+	return nil
+}
+
+func (p *Person) field(name string) interface{} {
+	switch name {
+	case "id":
+		return p.ID
+	case "name":
+		return p.Name
+	case "age":
+		return p.Age
+	case "email":
+		return p.Email
+	case "version":
+		return p.Version
+	}
+	return nil
+}
+
+func (p *Person) setField(name string, value interface{}) {
+	switch name {
+	case "name":
+		p.Name = value.(string)
+	case "age":
+		p.Age = value.(int)
+	case "email":
+		p.Email = value.(string)
+	}
+}
+
+func normalizeValue(field string, value interface{}) (interface{}, error) {
+	switch field {
+	case "name", "email":
+		s, ok := value.(string)
+		if !ok {
+			return nil, fmt.Errorf("%w: field %q expects a string", ErrInvalidOp, field)
+		}
+		return s, nil
+	case "id", "age":
+		i, ok := toInt64(value)
+		if !ok || i < math.MinInt32 || i > math.MaxInt32 {
+			return nil, fmt.Errorf("%w: field %q expects an integer", ErrInvalidOp, field)
+		}
+		return int(i), nil
+	case "version":
+		i, ok := toInt64(value)
+		if !ok {
+			return nil, fmt.Errorf("%w: field %q expects an integer", ErrInvalidOp, field)
+		}
+		return i, nil
+	}
+	return nil, fmt.Errorf("%w: unknown field %q", ErrInvalidOp, field)
+}
+
+func toInt64(value interface{}) (int64, bool) {
+	switch v := value.(type) {
+	case int:
+		return int64(v), true
+	case int64:
+		return v, true
+	case float64:
+		if v != math.Trunc(v) {
+			return 0, false
+		}
+		return int64(v), true
+	case json.Number:
+		i, err := v.Int64()
+		return i, err == nil
+	}
+	return 0, false
+}
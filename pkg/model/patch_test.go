@@ -0,0 +1,59 @@
+package model
+
+import (
+	"encoding/json"
+	"errors"
+	"testing"
+)
+
+func TestApply(t *testing.T) {
+	p := Person{ID: 1, Name: "John Doe", Age: 30, Email: "john@example.com", Version: 2}
+
+	err := p.Apply([]FieldOp{
+		{Op: OpTest, Field: "version", Value: json.Number("2")},
+		{Op: OpIncrement, Field: "age", Value: float64(2)},
+		{Op: OpSet, Field: "name", Value: "John Smith"},
+	})
+	if err != nil {
+		t.Fatalf("Apply() error: %v", err)
+	}
+
+	if p.Age != 32 || p.Name != "John Smith" || p.Version != 2 {
+		t.Errorf("expected age 32, name John Smith and unchanged version, got %+v", p)
+	}
+}
+
+func TestApplyIsAllOrNothing(t *testing.T) {
+	p := Person{ID: 1, Name: "John Doe", Age: 30, Email: "john@example.com"}
+
+	err := p.Apply([]FieldOp{
+		{Op: OpSet, Field: "name", Value: "John Smith"},
+		{Op: OpTest, Field: "age", Value: 99},
+	})
+	if !errors.Is(err, ErrTestFailed) {
+		t.Fatalf("expected ErrTestFailed, got %v", err)
+	}
+
+	if p.Name != "John Doe" {
+		t.Errorf("expected person to be unchanged, got %+v", p)
+	}
+}
+
+func TestNormalizeOpsRejectsInvalid(t *testing.T) {
+	cases := [][]FieldOp{
+		{{Op: OpSet, Field: "id", Value: 2}},
+		{{Op: OpSet, Field: "version", Value: 2}},
+		{{Op: OpSet, Field: "unknown", Value: "x"}},
+		{{Op: OpSet, Field: "age", Value: "thirty"}},
+		{{Op: OpSet, Field: "age", Value: 30.5}},
+		{{Op: OpIncrement, Field: "name", Value: 1}},
+		{{Op: OpSet, Field: "age", Value: 1}, {Op: OpIncrement, Field: "age", Value: 1}},
+		{{Op: "remove", Field: "name"}},
+	}
+
+	for _, ops := range cases {
+		if _, err := NormalizeOps(ops); !errors.Is(err, ErrInvalidOp) {
+			t.Errorf("expected ErrInvalidOp for %+v, got %v", ops, err)
+		}
+	}
+}
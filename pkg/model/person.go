@@ -5,4 +5,6 @@ type Person struct {
 	Name  string `json:"name" bson:"name"`
 	Age   int    `json:"age" bson:"age"`
 	Email string `json:"email" bson:"email"`
+	// Version is incremented on every update and used for optimistic concurrency control
+	Version int64 `json:"version" bson:"version"`
 }
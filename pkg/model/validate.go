@@ -0,0 +1,98 @@
+package model
+
+import (
+	"errors"
+	"fmt"
+	"net/mail"
+	"strings"
+	"unicode/utf8"
+)
+
+// Limits enforced on every person written
+const (
+	MaxNameLength  = 100
+	MaxEmailLength = 254
+	MinAge         = 0
+	MaxAge         = 150
+)
+
+// ErrInvalidPerson is returned when a write would store a person breaking the validation rules
+var ErrInvalidPerson = errors.New("invalid person")
+
+// FieldError describes why one field of a person is invalid
+type FieldError struct {
+	Field   string `json:"field"`
+	Message string `json:"message"`
+}
+
+// ValidationError lists every invalid field of a person, it matches ErrInvalidPerson with errors.Is
+type ValidationError struct {
+	Fields []FieldError
+}
+
+func (e *ValidationError) Error() string {
+	msgs := make([]string, len(e.Fields))
+	for i, f := range e.Fields {
+		msgs[i] = f.Field + " " + f.Message
+	}
+	return fmt.Sprintf("%v: %v", ErrInvalidPerson, strings.Join(msgs, ", "))
+}
+
+func (e *ValidationError) Unwrap() error {
+	return ErrInvalidPerson
+}
+
+// Validate checks every field of the person, returning a *ValidationError if any is invalid
+func (p Person) Validate() error {
+	return p.validateFields("id", "name", "age", "email")
+}
+
+// validateFields checks the named fields only, so a patch isn't rejected for fields it doesn't touch
+func (p Person) validateFields(fields ...string) error {
+	var errs []FieldError
+	for _, field := range fields {
+		if msg := validateField(field, p.field(field)); msg != "" {
+			errs = append(errs, FieldError{Field: field, Message: msg})
+		}
+	}
+
+	if len(errs) > 0 {
+		return &ValidationError{Fields: errs}
+	}
+	return nil
+}
+
+// validateField returns why value is invalid for field, empty if it's valid
+func validateField(field string, value interface{}) string {
+	switch field {
+	case "id":
+		if value.(int) < 1 {
+			return "must be a positive integer"
+		}
+	case "name":
+		name := value.(string)
+		if strings.TrimSpace(name) == "" {
+			return "is required"
+		}
+		if utf8.RuneCountInString(name) > MaxNameLength {
+			return fmt.Sprintf("must be at most %d characters", MaxNameLength)
+		}
+	case "age":
+		if age := value.(int); age < MinAge || age > MaxAge {
+			return fmt.Sprintf("must be between %d and %d", MinAge, MaxAge)
+		}
+	case "email":
+		email := value.(string)
+		if email == "" {
+			return "is required"
+		}
+		if len(email) > MaxEmailLength {
+			return fmt.Sprintf("must be at most %d characters", MaxEmailLength)
+		}
+		// Only a bare address is accepted, not a display name or a group
+		if addr, err := mail.ParseAddress(email); err != nil || addr.Address != email {
+			return "must be a valid email address"
+		}
+	}
+	return ""
+}
@@ -0,0 +1,67 @@
+package model
+
+import (
+	"errors"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestValidate(t *testing.T) {
+	valid := Person{ID: 1, Name: "John Doe", Age: 30, Email: "john@example.com"}
+	if err := valid.Validate(); err != nil {
+		t.Fatalf("expected a valid person, got %v", err)
+	}
+
+	cases := []struct {
+		change func(p *Person)
+		want   []FieldError
+	}{
+		{func(p *Person) { p.ID = 0 }, []FieldError{{"id", "must be a positive integer"}}},
+		{func(p *Person) { p.Name = "  " }, []FieldError{{"name", "is required"}}},
+		{func(p *Person) { p.Name = strings.Repeat("é", MaxNameLength+1) }, []FieldError{{"name", "must be at most 100 characters"}}},
+		{func(p *Person) { p.Age = -1 }, []FieldError{{"age", "must be between 0 and 150"}}},
+		{func(p *Person) { p.Age = MaxAge + 1 }, []FieldError{{"age", "must be between 0 and 150"}}},
+		{func(p *Person) { p.Email = "john" }, []FieldError{{"email", "must be a valid email address"}}},
+		{func(p *Person) { p.Email = "John <john@example.com>" }, []FieldError{{"email", "must be a valid email address"}}},
+		{func(p *Person) { p.Email = strings.Repeat("j", MaxEmailLength) + "@example.com" }, []FieldError{{"email", "must be at most 254 characters"}}},
+		{func(p *Person) { p.Name, p.Email = "", "" }, []FieldError{{"name", "is required"}, {"email", "is required"}}},
+	}
+
+	for _, tc := range cases {
+		p := valid
+		tc.change(&p)
+
+		err := p.Validate()
+		var invalid *ValidationError
+		if !errors.As(err, &invalid) || !errors.Is(err, ErrInvalidPerson) {
+			t.Errorf("%+v: expected a ValidationError, got %v", p, err)
+			continue
+		}
+		if !reflect.DeepEqual(invalid.Fields, tc.want) {
+			t.Errorf("%+v: expected %v, got %v", p, tc.want, invalid.Fields)
+		}
+	}
+}
+
+func TestApplyValidatesModifiedFields(t *testing.T) {
+	// Stored data predating the rules doesn't block patches to other fields
+	p := Person{ID: 1, Name: "", Age: 149, Email: "john@example.com"}
+
+	if err := p.Apply([]FieldOp{{Op: OpIncrement, Field: "age", Value: 1}}); err != nil {
+		t.Fatalf("expected an increment to the limit to succeed, got %v", err)
+	}
+	if err := p.Apply([]FieldOp{{Op: OpIncrement, Field: "age", Value: 1}}); !errors.Is(err, ErrInvalidPerson) {
+		t.Errorf("expected an increment past the limit to fail, got %v", err)
+	}
+	if p.Age != MaxAge {
+		t.Errorf("expected the person to be unchanged, got %+v", p)
+	}
+
+	if _, err := NormalizeOps([]FieldOp{{Op: OpSet, Field: "email", Value: "not-an-email"}}); !errors.Is(err, ErrInvalidPerson) {
+		t.Errorf("expected an invalid set to be rejected up front, got %v", err)
+	}
+	if err := (WriteOp{Op: OpInsert, Person: p}).Validate(); !errors.Is(err, ErrInvalidPerson) {
+		t.Errorf("expected an insert without a name to be rejected, got %v", err)
+	}
+}
@@ -0,0 +1,195 @@
+package store
+
+import (
+	"errors"
+	"fmt"
+	"gocache/pkg/model"
+	"sync"
+)
+
+// DurableStore wraps a PersonStore and logs every write to a WAL, so the store can be rebuilt after a crash
+// by loading the last snapshot and replaying the log on top of it
+type DurableStore struct {
+	PersonStore
+	wal *WAL
+
+	// mu serializes writes so the log records them in the order they were applied,
+	// and keeps compaction from dropping a write that was applied but not yet logged
+	mu sync.Mutex
+}
+
+// NewDurableStore logs writes to inner through wal
+func NewDurableStore(inner PersonStore, wal *WAL) *DurableStore {
+	return &DurableStore{PersonStore: inner, wal: wal}
+}
+
+// ReplayWAL applies logged entries to s in order
+func ReplayWAL(s PersonStore, entries []WALEntry) error {
+	for _, e := range entries {
+		if e.Delete {
+			s.DeletePerson(e.Person.ID)
+		} else if err := s.InsertPerson(e.Person); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// InsertPerson stores p and logs it. When logging fails p stays in the store, but a recovery wouldn't restore it.
+func (d *DurableStore) InsertPerson(p model.Person) error {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	if err := d.PersonStore.InsertPerson(p); err != nil {
+		return err
+	}
+	if err := d.wal.Append(WALEntry{Person: p}); err != nil {
+		return fmt.Errorf("error logging insert: %w", err)
+	}
+	return nil
+}
+
+func (d *DurableStore) InsertPersons(p []model.Person) error {
+	// Only the persons the store takes are logged
+	valid, invalid := splitValid(p)
+
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	if err := d.PersonStore.InsertPersons(valid); err != nil {
+		return err
+	}
+
+	entries := make([]WALEntry, len(valid))
+	for i := range valid {
+		entries[i] = WALEntry{Person: valid[i]}
+	}
+	if err := d.wal.Append(entries...); err != nil {
+		return errors.Join(fmt.Errorf("error logging insert: %w", err), invalid)
+	}
+	return invalid
+}
+
+func (d *DurableStore) DeletePerson(id int) error {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	if err := d.PersonStore.DeletePerson(id); err != nil {
+		return err
+	}
+	return d.wal.Append(WALEntry{Delete: true, Person: model.Person{ID: id}})
+}
+
+func (d *DurableStore) UpdatePerson(p model.Person) error {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	if err := d.PersonStore.UpdatePerson(p); err != nil {
+		return err
+	}
+
+	p.Version++
+	return d.wal.Append(WALEntry{Person: p})
+}
+
+func (d *DurableStore) CompareAndSwap(old, updated model.Person) (model.Person, error) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	result, err := d.PersonStore.CompareAndSwap(old, updated)
+	if err != nil {
+		return result, err
+	}
+	return result, d.wal.Append(WALEntry{Person: result})
+}
+
+func (d *DurableStore) ApplyOps(id int, ops []model.FieldOp) (model.Person, error) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	result, err := d.PersonStore.ApplyOps(id, ops)
+	if err != nil {
+		return result, err
+	}
+	return result, d.wal.Append(WALEntry{Person: result})
+}
+
+// Begin starts a transaction whose committed writes are logged as one record, so replay applies all or none of them
+func (d *DurableStore) Begin() Transaction {
+	return &durableTransaction{Transaction: d.PersonStore.Begin(), d: d}
+}
+
+// Compact writes a snapshot to path and truncates the log, whose entries the snapshot now covers
+func (d *DurableStore) Compact(path string) error {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	if err := SaveSnapshot(path, d.PersonStore); err != nil {
+		return err
+	}
+	return d.wal.Reset()
+}
+
+// Close closes the log, the wrapped store stays usable
+func (d *DurableStore) Close() error {
+	return d.wal.Close()
+}
+
+// durableTransaction logs a transaction's results once it commits
+type durableTransaction struct {
+	Transaction
+	d *DurableStore
+
+	mu      sync.Mutex
+	deletes []bool
+}
+
+func (t *durableTransaction) Insert(p model.Person) {
+	t.stage(false)
+	t.Transaction.Insert(p)
+}
+
+func (t *durableTransaction) Update(p model.Person) {
+	t.stage(false)
+	t.Transaction.Update(p)
+}
+
+func (t *durableTransaction) Delete(id int) {
+	t.stage(true)
+	t.Transaction.Delete(id)
+}
+
+func (t *durableTransaction) Put(p model.Person) {
+	t.stage(false)
+	t.Transaction.Put(p)
+}
+
+func (t *durableTransaction) stage(isDelete bool) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	t.deletes = append(t.deletes, isDelete)
+}
+
+func (t *durableTransaction) Commit() ([]model.Person, error) {
+	t.d.mu.Lock()
+	defer t.d.mu.Unlock()
+
+	results, err := t.Transaction.Commit()
+	if err != nil {
+		return nil, err
+	}
+
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	entries := make([]WALEntry, len(results))
+	for i, p := range results {
+		entries[i] = WALEntry{Delete: t.deletes[i], Person: p}
+	}
+
+	if err := t.d.wal.Append(entries...); err != nil {
+		return results, fmt.Errorf("error logging transaction: %w", err)
+	}
+	return results, nil
+}
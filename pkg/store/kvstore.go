@@ -4,15 +4,21 @@ import (
 	"errors"
 	"fmt"
 	"gocache/pkg/model"
+	"slices"
+	"sync"
 )
 
-// KVStore is a simple in-memory key-value store
+// KVStore is a simple in-memory key-value store, safe for concurrent use
 type KVStore struct {
+	mu   sync.RWMutex
 	data []model.Person
 	// Index singular fields
 	idIndex    map[int]*model.Person
 	nameIndex  map[string][]*model.Person
 	emailIndex map[string][]*model.Person
+
+	// shared is set while data may be read by a View, so it must be copied before being changed in place
+	shared bool
 }
 
 func NewKVStore() PersonStore {
@@ -24,20 +30,49 @@ func NewKVStore() PersonStore {
 	}
 }
 
-func (k *KVStore) InsertPerson(p model.Person) {
-	k.data = append(k.data, p)
-	k.idIndex[p.ID] = &p
-	k.nameIndex[p.Name] = append(k.nameIndex[p.Name], &p)
-	k.emailIndex[p.Email] = append(k.emailIndex[p.Email], &p)
+// InsertPerson adds a person to the store, replacing any existing person with the same ID
+func (k *KVStore) InsertPerson(p model.Person) error {
+	if err := p.Validate(); err != nil {
+		return err
+	}
+
+	k.mu.Lock()
+	defer k.mu.Unlock()
+
+	k.insertPerson(p)
+	return nil
+}
+
+func (k *KVStore) InsertPersons(p []model.Person) error {
+	valid, err := splitValid(p)
+
+	k.mu.Lock()
+	defer k.mu.Unlock()
+
+	for _, person := range valid {
+		k.insertPerson(person)
+	}
+	return err
 }
 
-func (k *KVStore) InsertPersons(p []model.Person) {
+// splitValid returns the valid persons of p, and an error joining why each of the others is invalid
+func splitValid(p []model.Person) ([]model.Person, error) {
+	valid := make([]model.Person, 0, len(p))
+	var errs []error
 	for _, person := range p {
-		k.InsertPerson(person)
+		if err := person.Validate(); err != nil {
+			errs = append(errs, fmt.Errorf("person %v: %w", person.ID, err))
+			continue
+		}
+		valid = append(valid, person)
 	}
+	return valid, errors.Join(errs...)
 }
 
 func (k *KVStore) GetPerson(id int) (model.Person, bool) {
+	k.mu.RLock()
+	defer k.mu.RUnlock()
+
 	p, ok := k.idIndex[id]
 	if !ok {
 		return model.Person{}, false
@@ -46,74 +81,181 @@ func (k *KVStore) GetPerson(id int) (model.Person, bool) {
 	return *p, ok
 }
 
+// GetAllPersons returns a copy of every person in the store
 func (k *KVStore) GetAllPersons() []model.Person {
-	return k.data
+	k.mu.RLock()
+	defer k.mu.RUnlock()
+
+	return k.allPersons()
 }
 
 // Delete a person by ID
 func (k *KVStore) DeletePerson(id int) error {
-	person, ok := k.idIndex[id]
+	k.mu.Lock()
+	defer k.mu.Unlock()
+
+	if _, ok := k.idIndex[id]; !ok {
+		return model.ErrNotFound
+	}
+
+	k.deletePerson(id)
+
+	return nil
+}
+
+// Update a person by ID, the update is rejected with model.ErrConflict unless its version matches the stored one
+func (k *KVStore) UpdatePerson(updatedPerson model.Person) error {
+	if err := updatedPerson.Validate(); err != nil {
+		return err
+	}
+
+	k.mu.Lock()
+	defer k.mu.Unlock()
+
+	existing, ok := k.idIndex[updatedPerson.ID]
 	if !ok {
-		return errors.New("person not found")
+		return model.ErrNotFound
 	}
 
-	var indexToDelete int
-	for i, p := range k.data {
-		if p.ID == id {
-			indexToDelete = i
-			break
-		}
+	if existing.Version != updatedPerson.Version {
+		return model.ErrConflict
 	}
-	k.data = append(k.data[:indexToDelete], k.data[indexToDelete+1:]...)
 
-	delete(k.idIndex, id)
+	updatedPerson.Version++
+	k.insertPerson(updatedPerson)
 
-	for i, p := range k.nameIndex[person.Name] {
-		if p.ID == id {
-			k.nameIndex[person.Name] = append(k.nameIndex[person.Name][:i], k.nameIndex[person.Name][i+1:]...)
-			break
-		}
+	return nil
+}
+
+// CompareAndSwap replaces the stored person with updated if it still equals old, the new version is old.Version+1
+func (k *KVStore) CompareAndSwap(old, updated model.Person) (model.Person, error) {
+	if err := updated.Validate(); err != nil {
+		return model.Person{}, err
 	}
 
-	for i, p := range k.emailIndex[person.Email] {
-		if p.ID == id {
-			k.emailIndex[person.Email] = append(k.emailIndex[person.Email][:i], k.emailIndex[person.Email][i+1:]...)
-			break
+	k.mu.Lock()
+	defer k.mu.Unlock()
+
+	existing, ok := k.idIndex[old.ID]
+	if !ok {
+		return model.Person{}, model.ErrNotFound
+	}
+
+	if *existing != old || updated.ID != old.ID {
+		return model.Person{}, model.ErrConflict
+	}
+
+	updated.Version = old.Version + 1
+	k.insertPerson(updated)
+
+	return updated, nil
+}
+
+// ApplyOps atomically applies field operations to a person, no reader sees a partially applied list
+func (k *KVStore) ApplyOps(id int, ops []model.FieldOp) (model.Person, error) {
+	k.mu.Lock()
+	defer k.mu.Unlock()
+
+	existing, ok := k.idIndex[id]
+	if !ok {
+		return model.Person{}, model.ErrNotFound
+	}
+
+	updated := *existing
+	if err := updated.Apply(ops); err != nil {
+		return model.Person{}, err
+	}
+
+	updated.Version++
+	k.insertPerson(updated)
+
+	return updated, nil
+}
+
+// insertPerson adds or replaces a person in the data slice and indexes, callers must hold k.mu
+func (k *KVStore) insertPerson(p model.Person) {
+	if existing, ok := k.idIndex[p.ID]; ok {
+		k.removeFromIndexes(existing)
+		k.unshare()
+		for i := range k.data {
+			if k.data[i].ID == p.ID {
+				k.data[i] = p
+				break
+			}
 		}
+	} else {
+		k.data = append(k.data, p)
 	}
 
-	return nil
+	k.idIndex[p.ID] = &p
+	k.nameIndex[p.Name] = append(k.nameIndex[p.Name], &p)
+	k.emailIndex[p.Email] = append(k.emailIndex[p.Email], &p)
 }
 
-// Update a person by ID
-func (k *KVStore) UpdatePerson(updatedPerson model.Person) error {
-	id := updatedPerson.ID
-	existingPerson, ok := k.idIndex[id]
+// deletePerson removes a person from the data slice and indexes if present, callers must hold k.mu
+func (k *KVStore) deletePerson(id int) {
+	person, ok := k.idIndex[id]
 	if !ok {
-		return errors.New("person not found")
+		return
 	}
 
+	k.unshare()
 	for i, p := range k.data {
 		if p.ID == id {
-			k.data[i] = updatedPerson
+			k.data = append(k.data[:i], k.data[i+1:]...)
 			break
 		}
 	}
 
-	delete(k.nameIndex, existingPerson.Name)
-	delete(k.emailIndex, existingPerson.Email)
+	k.removeFromIndexes(person)
+}
+
+// removeFromIndexes drops a person from every index, callers must hold k.mu
+func (k *KVStore) removeFromIndexes(person *model.Person) {
+	delete(k.idIndex, person.ID)
+	k.nameIndex[person.Name] = removeFromIndex(k.nameIndex[person.Name], person.ID)
+	if len(k.nameIndex[person.Name]) == 0 {
+		delete(k.nameIndex, person.Name)
+	}
+	k.emailIndex[person.Email] = removeFromIndex(k.emailIndex[person.Email], person.ID)
+	if len(k.emailIndex[person.Email]) == 0 {
+		delete(k.emailIndex, person.Email)
+	}
+}
+
+// allPersons copies the data slice, callers must hold k.mu
+func (k *KVStore) allPersons() []model.Person {
+	result := make([]model.Person, len(k.data))
+	copy(result, k.data)
+	return result
+}
 
-	// Insert the updated person
-	k.InsertPerson(updatedPerson)
+// View returns the persons as of now without copying them. Appends never touch the part of data a view reads,
+// replacing or removing a person copies data first while it is shared.
+func (k *KVStore) View() View {
+	k.mu.Lock()
+	defer k.mu.Unlock()
 
-	return nil
+	k.shared = true
+	return View{persons: k.data[:len(k.data):len(k.data)]}
+}
+
+// unshare gives the store its own copy of data if a view may still be reading it, callers must hold k.mu
+func (k *KVStore) unshare() {
+	if k.shared {
+		k.data = slices.Clone(k.data)
+		k.shared = false
+	}
 }
 
 // Query KV store
 func (k *KVStore) Query(name, email string, age []int) []model.Person {
+	k.mu.RLock()
+	defer k.mu.RUnlock()
+
 	// BASE CASE: If all fields are empty, return all persons
 	if email == "" && name == "" && len(age) == 0 {
-		return k.GetAllPersons()
+		return k.allPersons()
 	}
 
 	set := k.querySetBuilder(name, email, age)
@@ -141,7 +283,21 @@ func (k *KVStore) querySetBuilder(name, email string, age []int) map[*model.Pers
 	return result
 }
 
+// Stats reports the number of persons and the number of keys of each index
+func (k *KVStore) Stats() Stats {
+	k.mu.RLock()
+	defer k.mu.RUnlock()
+
+	return Stats{
+		Persons: len(k.data),
+		Indexes: map[string]int{"id": len(k.idIndex), "name": len(k.nameIndex), "email": len(k.emailIndex)},
+	}
+}
+
 func (k *KVStore) String() string {
+	k.mu.RLock()
+	defer k.mu.RUnlock()
+
 	ret := "KVStore\n"
 	for _, p := range k.data {
 		ret += fmt.Sprintf("%+v\n", p)
@@ -189,6 +345,15 @@ func filterByAge(set map[*model.Person]bool, age []int) map[*model.Person]bool {
 	return result
 }
 
+func removeFromIndex(persons []*model.Person, id int) []*model.Person {
+	for i, p := range persons {
+		if p.ID == id {
+			return append(persons[:i], persons[i+1:]...)
+		}
+	}
+	return persons
+}
+
 func buildSlice(set map[*model.Person]bool) []model.Person {
 	result := make([]model.Person, 0, len(set))
 
@@ -1,7 +1,11 @@
 package store
 
 import (
+	"errors"
 	"gocache/pkg/model"
+	"reflect"
+	"slices"
+	"sync"
 	"testing"
 )
 
@@ -305,3 +309,266 @@ func TestQueryWithNoCriteria(t *testing.T) {
 		t.Errorf("expected 2 persons, got %d", len(result))
 	}
 }
+
+func TestUpdatePersonDoesNotDuplicate(t *testing.T) {
+	store := NewKVStore()
+
+	persons := []model.Person{
+		{ID: 1, Name: "John Doe", Email: "john@example.com", Age: 30},
+		{ID: 2, Name: "John Doe", Email: "john.doe@example.com", Age: 35},
+	}
+
+	store.InsertPersons(persons)
+
+	if err := store.UpdatePerson(model.Person{ID: 1, Name: "John Doe", Email: "john@example.com", Age: 31}); err != nil {
+		t.Fatalf("unexpected error updating person: %v", err)
+	}
+
+	if result := store.GetAllPersons(); len(result) != 2 {
+		t.Errorf("expected 2 persons after update, got %+v", result)
+	}
+
+	// Updating one person must not drop others sharing the same name from the index
+	result := store.Query("John Doe", "", nil)
+	if len(result) != 2 {
+		t.Errorf("expected 2 persons with name 'John Doe', got %+v", result)
+	}
+
+	result = store.Query("John Doe", "", []int{30})
+	if len(result) != 0 {
+		t.Errorf("expected stale age to be gone from the index, got %+v", result)
+	}
+}
+
+func TestConcurrentReadsAndWrites(t *testing.T) {
+	store := NewKVStore()
+	store.InsertPerson(model.Person{ID: 1, Name: "John Doe", Email: "john@example.com", Age: 30})
+
+	var wg sync.WaitGroup
+	for i := 0; i < 50; i++ {
+		wg.Add(2)
+		go func(age int) {
+			defer wg.Done()
+			store.UpdatePerson(model.Person{ID: 1, Name: "John Doe", Email: "john@example.com", Age: age})
+		}(i)
+		go func() {
+			defer wg.Done()
+			store.Query("John Doe", "", nil)
+			store.GetAllPersons()
+		}()
+	}
+	wg.Wait()
+
+	if result := store.GetAllPersons(); len(result) != 1 {
+		t.Errorf("expected 1 person, got %+v", result)
+	}
+}
+
+func TestUpdatePersonIncrementsVersion(t *testing.T) {
+	store := NewKVStore()
+
+	store.InsertPerson(model.Person{ID: 1, Name: "John Doe", Email: "john@example.com", Age: 30, Version: 4})
+
+	if err := store.UpdatePerson(model.Person{ID: 1, Name: "John Doe", Email: "john@example.com", Age: 31, Version: 4}); err != nil {
+		t.Fatalf("unexpected error updating person: %v", err)
+	}
+
+	person, _ := store.GetPerson(1)
+	if person.Version != 5 {
+		t.Errorf("expected version 5, got %d", person.Version)
+	}
+}
+
+func TestUpdatePersonStaleVersion(t *testing.T) {
+	store := NewKVStore()
+
+	store.InsertPerson(model.Person{ID: 1, Name: "John Doe", Email: "john@example.com", Age: 30, Version: 2})
+
+	err := store.UpdatePerson(model.Person{ID: 1, Name: "John Doe", Email: "john@example.com", Age: 31, Version: 1})
+	if !errors.Is(err, model.ErrConflict) {
+		t.Fatalf("expected model.ErrConflict, got %v", err)
+	}
+
+	person, _ := store.GetPerson(1)
+	if person.Age != 30 || person.Version != 2 {
+		t.Errorf("expected stale update to be rejected, got %+v", person)
+	}
+}
+
+func TestCompareAndSwap(t *testing.T) {
+	store := NewKVStore()
+
+	old := model.Person{ID: 1, Name: "John Doe", Email: "john@example.com", Age: 30}
+	store.InsertPerson(old)
+
+	swapped, err := store.CompareAndSwap(old, model.Person{ID: 1, Name: "John Doe", Email: "john@example.com", Age: 31})
+	if err != nil {
+		t.Fatalf("unexpected error swapping person: %v", err)
+	}
+	if swapped.Age != 31 || swapped.Version != 1 {
+		t.Errorf("expected age 31 at version 1, got %+v", swapped)
+	}
+
+	// The original value is no longer current
+	if _, err := store.CompareAndSwap(old, model.Person{ID: 1, Name: "Late Writer", Email: "late@example.com", Age: 30}); !errors.Is(err, model.ErrConflict) {
+		t.Errorf("expected model.ErrConflict, got %v", err)
+	}
+
+	if _, err := store.CompareAndSwap(model.Person{ID: 999}, model.Person{ID: 999, Name: "Nobody", Email: "nobody@example.com"}); !errors.Is(err, model.ErrNotFound) {
+		t.Errorf("expected model.ErrNotFound, got %v", err)
+	}
+}
+
+func TestApplyOps(t *testing.T) {
+	store := NewKVStore()
+
+	store.InsertPerson(model.Person{ID: 1, Name: "John Doe", Email: "john@example.com", Age: 30})
+
+	updated, err := store.ApplyOps(1, []model.FieldOp{
+		{Op: model.OpIncrement, Field: "age", Value: 1},
+		{Op: model.OpSet, Field: "email", Value: "john.doe@example.com"},
+	})
+	if err != nil {
+		t.Fatalf("unexpected error applying ops: %v", err)
+	}
+	if updated.Age != 31 || updated.Email != "john.doe@example.com" || updated.Version != 1 {
+		t.Errorf("expected age 31, new email and version 1, got %+v", updated)
+	}
+
+	if result := store.Query("", "john.doe@example.com", nil); len(result) != 1 {
+		t.Errorf("expected email index to be updated, got %+v", result)
+	}
+
+	// A failed test leaves the person untouched
+	_, err = store.ApplyOps(1, []model.FieldOp{
+		{Op: model.OpSet, Field: "name", Value: "Johnny"},
+		{Op: model.OpTest, Field: "version", Value: 0},
+	})
+	if !errors.Is(err, model.ErrTestFailed) {
+		t.Fatalf("expected ErrTestFailed, got %v", err)
+	}
+
+	person, _ := store.GetPerson(1)
+	if person.Name != "John Doe" || person.Version != 1 {
+		t.Errorf("expected person to be unchanged, got %+v", person)
+	}
+}
+
+func TestApplyOpsConcurrentIncrements(t *testing.T) {
+	store := NewKVStore()
+	store.InsertPerson(model.Person{ID: 1, Name: "John Doe", Email: "john@example.com", Age: 0})
+
+	var wg sync.WaitGroup
+	for i := 0; i < 100; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			store.ApplyOps(1, []model.FieldOp{{Op: model.OpIncrement, Field: "age", Value: 1}})
+		}()
+	}
+	wg.Wait()
+
+	person, _ := store.GetPerson(1)
+	if person.Age != 100 || person.Version != 100 {
+		t.Errorf("expected age and version 100, got %+v", person)
+	}
+}
+
+func TestStats(t *testing.T) {
+	store := NewKVStore()
+	store.InsertPersons([]model.Person{
+		{ID: 1, Name: "John Doe", Email: "john@example.com", Age: 30},
+		{ID: 2, Name: "John Doe", Email: "john.doe@example.com", Age: 30},
+		{ID: 3, Name: "Jane Smith", Email: "jane@example.com", Age: 25},
+	})
+	store.DeletePerson(3)
+
+	want := Stats{Persons: 2, Indexes: map[string]int{"id": 2, "name": 1, "email": 2}}
+	if got := store.Stats(); !reflect.DeepEqual(got, want) {
+		t.Errorf("expected %+v, got %+v", want, got)
+	}
+}
+
+func TestView(t *testing.T) {
+	store := NewKVStore()
+	store.InsertPersons([]model.Person{
+		{ID: 1, Name: "John Doe", Email: "john@example.com", Age: 30},
+		{ID: 2, Name: "Jane Smith", Email: "jane@example.com", Age: 25},
+		{ID: 3, Name: "John Doe", Email: "john.doe@example.com", Age: 40},
+	})
+	want := store.GetAllPersons()
+	view := store.View()
+
+	// Writes after the view was taken replace, remove and add persons without the view seeing them
+	store.UpdatePerson(model.Person{ID: 1, Name: "Johnny Doe", Email: "john@example.com", Age: 31})
+	store.DeletePerson(2)
+	store.InsertPerson(model.Person{ID: 4, Name: "New Person", Email: "new@example.com", Age: 20})
+
+	if got := slices.Collect(view.All()); !reflect.DeepEqual(got, want) {
+		t.Errorf("expected the view to keep %+v, got %+v", want, got)
+	}
+	if view.Len() != len(want) {
+		t.Errorf("expected %d persons, got %d", len(want), view.Len())
+	}
+
+	matched := slices.Collect(view.Match(model.Filter{Name: "John Doe", Ages: []int{40}}))
+	if len(matched) != 1 || matched[0].ID != 3 {
+		t.Errorf("expected person 3 to match, got %+v", matched)
+	}
+
+	if got := slices.Collect(store.View().All()); len(got) != 3 || got[0].Name != "Johnny Doe" || got[2].ID != 4 {
+		t.Errorf("expected a new view to see the writes, got %+v", got)
+	}
+}
+
+func TestViewConcurrentWrites(t *testing.T) {
+	store := NewKVStore()
+	for i := 1; i <= 100; i++ {
+		store.InsertPerson(model.Person{ID: i, Name: "Person", Email: "person@example.com", Age: 30})
+	}
+
+	var wg sync.WaitGroup
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		for i := 1; i <= 100; i++ {
+			p, _ := store.GetPerson(i)
+			p.Age++
+			store.UpdatePerson(p)
+			store.DeletePerson(i + 1)
+			store.InsertPerson(model.Person{ID: 100 + i, Name: "Person", Email: "person@example.com", Age: 30})
+		}
+	}()
+
+	// Every view holds distinct persons no matter what was written while it was read
+	for i := 0; i < 50; i++ {
+		seen := make(map[int]bool)
+		for p := range store.View().All() {
+			if seen[p.ID] {
+				t.Fatalf("person %d seen twice in one view", p.ID)
+			}
+			seen[p.ID] = true
+		}
+	}
+	wg.Wait()
+}
+
+func TestInsertRejectsInvalidPersons(t *testing.T) {
+	store := NewKVStore()
+
+	var invalid *model.ValidationError
+	if err := store.InsertPerson(model.Person{ID: 1, Name: "John Doe", Age: 30}); !errors.As(err, &invalid) {
+		t.Errorf("expected a validation error for a missing email, got %v", err)
+	}
+
+	err := store.InsertPersons([]model.Person{
+		{ID: 2, Name: "Jane Smith", Email: "jane@example.com", Age: 25},
+		{ID: 3, Name: " ", Email: "blank@example.com", Age: 40},
+	})
+	if !errors.As(err, &invalid) {
+		t.Errorf("expected a validation error for a blank name, got %v", err)
+	}
+	if got := store.GetAllPersons(); len(got) != 1 || got[0].ID != 2 {
+		t.Errorf("expected only the valid person to be stored, got %+v", got)
+	}
+}
@@ -0,0 +1,213 @@
+package store
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"gocache/pkg/model"
+	"hash/crc32"
+	"io"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+// Snapshot file layout, all integers little endian:
+//
+//	magic "GCSN" | format version uint16 | reserved uint16 | created unix nanos int64 | count uint64
+//	count records of: id varint | version varint | age varint | name uvarint len + bytes | email uvarint len + bytes
+//	CRC-32C of everything above uint32
+const (
+	snapshotMagic   = "GCSN"
+	snapshotVersion = 1
+)
+
+var (
+	// ErrBadSnapshot is returned when a snapshot file is truncated, corrupt or from an unknown format version
+	ErrBadSnapshot = errors.New("invalid snapshot")
+
+	crcTable = crc32.MakeTable(crc32.Castagnoli)
+)
+
+// Snapshot is a point-in-time copy of the store's contents
+type Snapshot struct {
+	Created time.Time
+	Persons []model.Person
+}
+
+// WriteSnapshot encodes persons to w in the snapshot format
+func WriteSnapshot(w io.Writer, persons []model.Person, created time.Time) error {
+	crc := crc32.New(crcTable)
+	bw := bufio.NewWriter(io.MultiWriter(w, crc))
+
+	header := make([]byte, 0, 24)
+	header = append(header, snapshotMagic...)
+	header = binary.LittleEndian.AppendUint16(header, snapshotVersion)
+	header = binary.LittleEndian.AppendUint16(header, 0)
+	header = binary.LittleEndian.AppendUint64(header, uint64(created.UnixNano()))
+	header = binary.LittleEndian.AppendUint64(header, uint64(len(persons)))
+	if _, err := bw.Write(header); err != nil {
+		return err
+	}
+
+	buf := make([]byte, 0, 128)
+	for _, p := range persons {
+		buf = appendRecord(buf[:0], p)
+		if _, err := bw.Write(buf); err != nil {
+			return err
+		}
+	}
+
+	if err := bw.Flush(); err != nil {
+		return err
+	}
+
+	return binary.Write(w, binary.LittleEndian, crc.Sum32())
+}
+
+// ReadSnapshot decodes a snapshot from r, verifying its checksum and format version
+func ReadSnapshot(r io.Reader) (Snapshot, error) {
+	data, err := io.ReadAll(r)
+	if err != nil {
+		return Snapshot{}, err
+	}
+
+	if len(data) < 24+4 {
+		return Snapshot{}, fmt.Errorf("%w: file too short", ErrBadSnapshot)
+	}
+
+	body, trailer := data[:len(data)-4], data[len(data)-4:]
+	if crc32.Checksum(body, crcTable) != binary.LittleEndian.Uint32(trailer) {
+		return Snapshot{}, fmt.Errorf("%w: checksum mismatch", ErrBadSnapshot)
+	}
+
+	if string(body[:4]) != snapshotMagic {
+		return Snapshot{}, fmt.Errorf("%w: bad magic", ErrBadSnapshot)
+	}
+	if v := binary.LittleEndian.Uint16(body[4:6]); v != snapshotVersion {
+		return Snapshot{}, fmt.Errorf("%w: unsupported format version %d", ErrBadSnapshot, v)
+	}
+
+	created := time.Unix(0, int64(binary.LittleEndian.Uint64(body[8:16])))
+	count := binary.LittleEndian.Uint64(body[16:24])
+
+	rd := bytes.NewReader(body[24:])
+	persons := make([]model.Person, 0, min(count, uint64(len(body))))
+	for i := uint64(0); i < count; i++ {
+		p, err := readRecord(rd)
+		if err != nil {
+			return Snapshot{}, fmt.Errorf("%w: record %d: %v", ErrBadSnapshot, i, err)
+		}
+		persons = append(persons, p)
+	}
+
+	if rd.Len() != 0 {
+		return Snapshot{}, fmt.Errorf("%w: %d trailing bytes", ErrBadSnapshot, rd.Len())
+	}
+
+	return Snapshot{Created: created, Persons: persons}, nil
+}
+
+// SaveSnapshot atomically writes a snapshot of the store to path
+func SaveSnapshot(path string, s PersonStore) error {
+	if err := os.MkdirAll(filepath.Dir(path), 0o755); err != nil {
+		return fmt.Errorf("error creating snapshot directory: %w", err)
+	}
+
+	tmp, err := os.CreateTemp(filepath.Dir(path), filepath.Base(path)+".tmp-*")
+	if err != nil {
+		return fmt.Errorf("error creating temporary snapshot file: %w", err)
+	}
+	defer os.Remove(tmp.Name())
+
+	if err := WriteSnapshot(tmp, s.GetAllPersons(), time.Now()); err != nil {
+		tmp.Close()
+		return fmt.Errorf("error writing snapshot: %w", err)
+	}
+
+	if err := tmp.Sync(); err != nil {
+		tmp.Close()
+		return fmt.Errorf("error syncing snapshot: %w", err)
+	}
+
+	if err := tmp.Close(); err != nil {
+		return fmt.Errorf("error closing snapshot: %w", err)
+	}
+
+	if err := os.Rename(tmp.Name(), path); err != nil {
+		return fmt.Errorf("error replacing snapshot: %w", err)
+	}
+
+	return nil
+}
+
+// LoadSnapshot reads the snapshot at path
+func LoadSnapshot(path string) (Snapshot, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return Snapshot{}, err
+	}
+	defer file.Close()
+
+	return ReadSnapshot(bufio.NewReader(file))
+}
+
+// appendRecord appends the binary encoding of a person, shared by snapshots and the write-ahead log
+func appendRecord(buf []byte, p model.Person) []byte {
+	buf = binary.AppendVarint(buf, int64(p.ID))
+	buf = binary.AppendVarint(buf, p.Version)
+	buf = binary.AppendVarint(buf, int64(p.Age))
+	buf = binary.AppendUvarint(buf, uint64(len(p.Name)))
+	buf = append(buf, p.Name...)
+	buf = binary.AppendUvarint(buf, uint64(len(p.Email)))
+	buf = append(buf, p.Email...)
+	return buf
+}
+
+func readRecord(r *bytes.Reader) (model.Person, error) {
+	id, err := binary.ReadVarint(r)
+	if err != nil {
+		return model.Person{}, err
+	}
+
+	version, err := binary.ReadVarint(r)
+	if err != nil {
+		return model.Person{}, err
+	}
+
+	age, err := binary.ReadVarint(r)
+	if err != nil {
+		return model.Person{}, err
+	}
+
+	name, err := readString(r)
+	if err != nil {
+		return model.Person{}, err
+	}
+
+	email, err := readString(r)
+	if err != nil {
+		return model.Person{}, err
+	}
+
+	return model.Person{ID: int(id), Name: name, Age: int(age), Email: email, Version: version}, nil
+}
+
+func readString(r *bytes.Reader) (string, error) {
+	n, err := binary.ReadUvarint(r)
+	if err != nil {
+		return "", err
+	}
+
+	if n > uint64(r.Len()) {
+		return "", io.ErrUnexpectedEOF
+	}
+
+	buf := make([]byte, n)
+	if _, err := io.ReadFull(r, buf); err != nil {
+		return "", err
+	}
+	return string(buf), nil
+}
@@ -0,0 +1,91 @@
+package store
+
+import (
+	"bytes"
+	"errors"
+	"gocache/pkg/model"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestSnapshotRoundTrip(t *testing.T) {
+	persons := []model.Person{
+		{ID: 1, Name: "John Doe", Email: "john@example.com", Age: 30, Version: 3},
+		{ID: 2, Name: "Jane Smith", Email: "jane@example.com", Age: 25},
+		{ID: -7, Name: "", Email: "", Age: 0},
+	}
+	created := time.Unix(1700000000, 42)
+
+	var buf bytes.Buffer
+	if err := WriteSnapshot(&buf, persons, created); err != nil {
+		t.Fatalf("WriteSnapshot() error: %v", err)
+	}
+
+	snap, err := ReadSnapshot(&buf)
+	if err != nil {
+		t.Fatalf("ReadSnapshot() error: %v", err)
+	}
+
+	if !snap.Created.Equal(created) {
+		t.Errorf("expected created %v, got %v", created, snap.Created)
+	}
+
+	if len(snap.Persons) != len(persons) {
+		t.Fatalf("expected %d persons, got %d", len(persons), len(snap.Persons))
+	}
+	for i := range persons {
+		if snap.Persons[i] != persons[i] {
+			t.Errorf("expected %+v, got %+v", persons[i], snap.Persons[i])
+		}
+	}
+}
+
+func TestSnapshotRejectsCorruption(t *testing.T) {
+	var buf bytes.Buffer
+	WriteSnapshot(&buf, []model.Person{{ID: 1, Name: "John Doe", Email: "john@example.com", Age: 30}}, time.Now())
+	data := buf.Bytes()
+
+	flipped := append([]byte(nil), data...)
+	flipped[30] ^= 0xff
+
+	truncated := data[:len(data)-3]
+
+	wrongVersion := append([]byte(nil), data...)
+	wrongVersion[4] = 9
+
+	for name, corrupt := range map[string][]byte{"flipped": flipped, "truncated": truncated, "version": wrongVersion, "empty": nil} {
+		if _, err := ReadSnapshot(bytes.NewReader(corrupt)); !errors.Is(err, ErrBadSnapshot) {
+			t.Errorf("%s: expected ErrBadSnapshot, got %v", name, err)
+		}
+	}
+}
+
+func TestSaveAndLoadSnapshot(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "snapshots", "persons.snap")
+
+	store := NewKVStore()
+	store.InsertPersons([]model.Person{
+		{ID: 1, Name: "John Doe", Email: "john@example.com", Age: 30},
+		{ID: 2, Name: "Jane Smith", Email: "jane@example.com", Age: 25},
+	})
+
+	if err := SaveSnapshot(path, store); err != nil {
+		t.Fatalf("SaveSnapshot() error: %v", err)
+	}
+
+	snap, err := LoadSnapshot(path)
+	if err != nil {
+		t.Fatalf("LoadSnapshot() error: %v", err)
+	}
+
+	if len(snap.Persons) != 2 {
+		t.Errorf("expected 2 persons, got %+v", snap.Persons)
+	}
+
+	entries, _ := os.ReadDir(filepath.Dir(path))
+	if len(entries) != 1 {
+		t.Errorf("expected only the snapshot file to remain, got %v", entries)
+	}
+}
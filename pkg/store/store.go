@@ -1,16 +1,47 @@
 package store
 
-import "gocache/pkg/model"
+import (
+	"errors"
+	"gocache/pkg/model"
+)
+
+var (
+	// ErrTxDone is returned when a transaction is used after Commit or Rollback
+	ErrTxDone = errors.New("transaction has already been committed or rolled back")
+)
 
 // TO DO - Implement the KVStore struct
 // Defines the basic functions that a store should implement
 type PersonStore interface {
-	InsertPerson(p model.Person)
-	InsertPersons(p []model.Person)
+	// InsertPerson adds a person, replacing any existing person with the same ID,
+	// an invalid person is rejected with a *model.ValidationError
+	InsertPerson(p model.Person) error
+	// InsertPersons adds the valid persons like InsertPerson, the error joins one for each invalid person
+	InsertPersons(p []model.Person) error
 	GetPerson(id int) (model.Person, bool)
 	GetAllPersons() []model.Person
 	DeletePerson(id int) error
+	// UpdatePerson replaces a person whose stored version matches p.Version and increments the version,
+	// an invalid person is rejected with a *model.ValidationError
 	UpdatePerson(p model.Person) error
+	// CompareAndSwap replaces a person with updated only if the stored person equals old, returning model.ErrConflict otherwise.
+	// An invalid updated person is rejected with a *model.ValidationError.
+	CompareAndSwap(old, updated model.Person) (model.Person, error)
+	// ApplyOps atomically applies field operations to a person and increments its version
+	ApplyOps(id int, ops []model.FieldOp) (model.Person, error)
 	Query(name, email string, ages []int) []model.Person
+	// View returns the persons as of the call, later writes don't change it
+	View() View
+	// Begin starts a transaction whose writes stay invisible to readers until it commits
+	Begin() Transaction
+	// Stats reports the size of the store and its indexes
+	Stats() Stats
 	String() string
 }
+
+// Stats describes the size of a store
+type Stats struct {
+	Persons int
+	// Indexes holds the number of distinct keys of each index, by indexed field
+	Indexes map[string]int
+}
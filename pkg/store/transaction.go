@@ -0,0 +1,147 @@
+package store
+
+import (
+	"gocache/pkg/model"
+	"sync"
+)
+
+// opPut is an unconditional upsert, used to mirror writes another system has already committed
+const opPut = "put"
+
+// Transaction stages inserts, updates and deletes and applies them all-or-nothing on Commit.
+// Operations run in the order they were staged, so later ones see the effects of earlier ones.
+type Transaction interface {
+	// Insert stages adding a new person, the commit fails if the ID is taken
+	Insert(p model.Person)
+	// Update stages an update with the same version rules as PersonStore.UpdatePerson
+	Update(p model.Person)
+	// Delete stages removing a person, the commit fails if they don't exist
+	Delete(id int)
+	// Put stages storing a person verbatim whether or not they exist
+	Put(p model.Person)
+	// Commit validates and applies every staged write atomically, returning the resulting persons
+	// in staging order (the deleted person for deletes). Failures are reported as *model.OpError,
+	// inserting, updating or putting an invalid person fails with a *model.ValidationError.
+	Commit() ([]model.Person, error)
+	// Rollback discards every staged write
+	Rollback()
+}
+
+// kvTransaction is the KVStore implementation of Transaction
+type kvTransaction struct {
+	k    *KVStore
+	mu   sync.Mutex
+	ops  []model.WriteOp
+	done bool
+}
+
+// Begin starts a transaction on the store
+func (k *KVStore) Begin() Transaction {
+	return &kvTransaction{k: k}
+}
+
+func (t *kvTransaction) Insert(p model.Person) {
+	t.stage(model.WriteOp{Op: model.OpInsert, Person: p})
+}
+
+func (t *kvTransaction) Update(p model.Person) {
+	t.stage(model.WriteOp{Op: model.OpUpdate, Person: p})
+}
+
+func (t *kvTransaction) Delete(id int) {
+	t.stage(model.WriteOp{Op: model.OpDelete, ID: id})
+}
+
+func (t *kvTransaction) Put(p model.Person) {
+	t.stage(model.WriteOp{Op: opPut, Person: p})
+}
+
+func (t *kvTransaction) stage(op model.WriteOp) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	t.ops = append(t.ops, op)
+}
+
+func (t *kvTransaction) Rollback() {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	t.ops = nil
+	t.done = true
+}
+
+func (t *kvTransaction) Commit() ([]model.Person, error) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	if t.done {
+		return nil, ErrTxDone
+	}
+	t.done = true
+
+	// Holding the write lock across validation and apply keeps readers from seeing a partial commit
+	t.k.mu.Lock()
+	defer t.k.mu.Unlock()
+
+	// view overlays the staged writes on the store, a nil entry marks a staged delete
+	view := make(map[int]*model.Person)
+	lookup := func(id int) (*model.Person, bool) {
+		if p, ok := view[id]; ok {
+			return p, p != nil
+		}
+		p, ok := t.k.idIndex[id]
+		return p, ok
+	}
+
+	results := make([]model.Person, len(t.ops))
+	for i, op := range t.ops {
+		existing, ok := lookup(op.Key())
+		if op.Op != model.OpDelete {
+			if err := op.Person.Validate(); err != nil {
+				return nil, &model.OpError{Index: i, Err: err}
+			}
+		}
+
+		switch op.Op {
+		case model.OpInsert:
+			if ok {
+				return nil, &model.OpError{Index: i, Err: model.ErrAlreadyExists}
+			}
+			results[i] = op.Person
+		case model.OpUpdate:
+			if !ok {
+				return nil, &model.OpError{Index: i, Err: model.ErrNotFound}
+			}
+			if existing.Version != op.Person.Version {
+				return nil, &model.OpError{Index: i, Err: model.ErrConflict}
+			}
+			results[i] = op.Person
+			results[i].Version++
+		case model.OpDelete:
+			if !ok {
+				return nil, &model.OpError{Index: i, Err: model.ErrNotFound}
+			}
+			results[i] = *existing
+			view[op.ID] = nil
+			continue
+		case opPut:
+			results[i] = op.Person
+		default:
+			return nil, &model.OpError{Index: i, Err: op.Validate()}
+		}
+
+		p := results[i]
+		view[p.ID] = &p
+	}
+
+	for i, op := range t.ops {
+		if op.Op == model.OpDelete {
+			t.k.deletePerson(op.ID)
+		} else {
+			t.k.insertPerson(results[i])
+		}
+	}
+
+	return results, nil
+}
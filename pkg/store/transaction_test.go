@@ -0,0 +1,198 @@
+package store
+
+import (
+	"errors"
+	"gocache/pkg/model"
+	"sync"
+	"testing"
+)
+
+func TestTransactionCommit(t *testing.T) {
+	store := NewKVStore()
+	store.InsertPersons([]model.Person{
+		{ID: 1, Name: "John Doe", Email: "john@example.com", Age: 30},
+		{ID: 2, Name: "Jane Smith", Email: "jane@example.com", Age: 25},
+	})
+
+	tx := store.Begin()
+	tx.Update(model.Person{ID: 1, Name: "John Doe", Email: "doe.household@example.com", Age: 30})
+	tx.Delete(2)
+	tx.Insert(model.Person{ID: 3, Name: "Alice Johnson", Email: "doe.household@example.com", Age: 8})
+
+	// Staged writes are invisible until commit
+	if result := store.Query("", "doe.household@example.com", nil); len(result) != 0 {
+		t.Errorf("expected staged writes to be invisible, got %+v", result)
+	}
+
+	results, err := tx.Commit()
+	if err != nil {
+		t.Fatalf("unexpected error committing: %v", err)
+	}
+
+	if len(results) != 3 || results[0].Version != 1 || results[1].ID != 2 || results[2].ID != 3 {
+		t.Errorf("unexpected commit results %+v", results)
+	}
+
+	if result := store.Query("", "doe.household@example.com", nil); len(result) != 2 {
+		t.Errorf("expected 2 persons sharing the household email, got %+v", result)
+	}
+
+	if _, ok := store.GetPerson(2); ok {
+		t.Error("expected person 2 to be deleted")
+	}
+}
+
+func TestTransactionAbortsOnFailure(t *testing.T) {
+	store := NewKVStore()
+	store.InsertPersons([]model.Person{
+		{ID: 1, Name: "John Doe", Email: "john@example.com", Age: 30},
+		{ID: 2, Name: "Jane Smith", Email: "jane@example.com", Age: 25, Version: 3},
+	})
+
+	tx := store.Begin()
+	tx.Update(model.Person{ID: 1, Name: "John Doe", Email: "changed@example.com", Age: 30})
+	tx.Update(model.Person{ID: 2, Name: "Jane Smith", Email: "changed@example.com", Age: 25, Version: 2})
+
+	_, err := tx.Commit()
+
+	var opErr *model.OpError
+	if !errors.As(err, &opErr) || opErr.Index != 1 || !errors.Is(err, model.ErrConflict) {
+		t.Fatalf("expected conflict on operation 1, got %v", err)
+	}
+
+	if person, _ := store.GetPerson(1); person.Email != "john@example.com" || person.Version != 0 {
+		t.Errorf("expected person 1 to be untouched, got %+v", person)
+	}
+}
+
+func TestTransactionSeesOwnWrites(t *testing.T) {
+	store := NewKVStore()
+
+	tx := store.Begin()
+	tx.Insert(model.Person{ID: 1, Name: "John Doe", Email: "john@example.com", Age: 30})
+	tx.Update(model.Person{ID: 1, Name: "John Doe", Email: "john@example.com", Age: 31})
+	tx.Delete(1)
+	tx.Insert(model.Person{ID: 1, Name: "John Doe", Email: "john@example.com", Age: 32})
+
+	if _, err := tx.Commit(); err != nil {
+		t.Fatalf("unexpected error committing: %v", err)
+	}
+
+	person, ok := store.GetPerson(1)
+	if !ok || person.Age != 32 || person.Version != 0 {
+		t.Errorf("expected re-inserted person at age 32, got %+v", person)
+	}
+
+	if result := store.GetAllPersons(); len(result) != 1 {
+		t.Errorf("expected 1 person, got %+v", result)
+	}
+}
+
+func TestTransactionInsertExisting(t *testing.T) {
+	store := NewKVStore()
+	store.InsertPerson(model.Person{ID: 1, Name: "John Doe", Email: "john@example.com", Age: 30})
+
+	tx := store.Begin()
+	tx.Insert(model.Person{ID: 1, Name: "Duplicate", Email: "dup@example.com"})
+
+	if _, err := tx.Commit(); !errors.Is(err, model.ErrAlreadyExists) {
+		t.Errorf("expected ErrAlreadyExists, got %v", err)
+	}
+}
+
+func TestTransactionRollback(t *testing.T) {
+	store := NewKVStore()
+
+	tx := store.Begin()
+	tx.Insert(model.Person{ID: 1, Name: "John Doe"})
+	tx.Rollback()
+
+	if _, err := tx.Commit(); !errors.Is(err, ErrTxDone) {
+		t.Errorf("expected ErrTxDone, got %v", err)
+	}
+
+	if _, ok := store.GetPerson(1); ok {
+		t.Error("expected rolled back insert to be discarded")
+	}
+}
+
+func TestTransactionIsolation(t *testing.T) {
+	store := NewKVStore()
+	store.InsertPersons([]model.Person{
+		{ID: 1, Name: "John Doe", Email: "a@example.com"},
+		{ID: 2, Name: "Jane Smith", Email: "a@example.com"},
+	})
+
+	var wg sync.WaitGroup
+	stop := make(chan struct{})
+
+	// Readers must always see both persons on the same email, never one of each
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		for {
+			select {
+			case <-stop:
+				return
+			default:
+			}
+			a := len(store.Query("", "a@example.com", nil))
+			if a != 0 && a != 2 {
+				t.Errorf("observed a partial commit: %d persons on a@example.com", a)
+				return
+			}
+		}
+	}()
+
+	for i := 0; i < 50; i++ {
+		from, to := "a@example.com", "b@example.com"
+		if i%2 == 1 {
+			from, to = to, from
+		}
+		tx := store.Begin()
+		for _, id := range []int{1, 2} {
+			p, _ := store.GetPerson(id)
+			p.Email = to
+			tx.Update(p)
+		}
+		if _, err := tx.Commit(); err != nil {
+			t.Fatalf("unexpected error moving persons from %v: %v", from, err)
+		}
+	}
+
+	close(stop)
+	wg.Wait()
+}
+
+func TestTransactionRejectsInvalidPersons(t *testing.T) {
+	store := NewKVStore()
+	store.InsertPerson(model.Person{ID: 1, Name: "John Doe", Email: "john@example.com"})
+
+	tx := store.Begin()
+	tx.Delete(1)
+	tx.Insert(model.Person{ID: 2, Name: "Jane Smith", Age: 200, Email: "jane@example.com"})
+
+	var opErr *model.OpError
+	if _, err := tx.Commit(); !errors.As(err, &opErr) || opErr.Index != 1 || !errors.Is(err, model.ErrInvalidPerson) {
+		t.Fatalf("expected operation 1 to fail validation, got %v", err)
+	}
+	if _, ok := store.GetPerson(1); !ok {
+		t.Error("expected the failed transaction to leave person 1 in place")
+	}
+}
+
+func TestTransactionPutRejectsInvalidPerson(t *testing.T) {
+	store := NewKVStore()
+
+	tx := store.Begin()
+	tx.Put(model.Person{ID: 1, Name: "John Doe", Email: "john@example.com", Age: 30})
+	tx.Put(model.Person{ID: 2, Name: "Jane Smith", Email: "not an email", Age: 25})
+
+	var invalid *model.ValidationError
+	if _, err := tx.Commit(); !errors.As(err, &invalid) {
+		t.Errorf("expected a validation error, got %v", err)
+	}
+	if got := store.GetAllPersons(); len(got) != 0 {
+		t.Errorf("expected nothing to be committed, got %+v", got)
+	}
+}
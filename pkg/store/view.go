@@ -0,0 +1,34 @@
+package store
+
+import (
+	"gocache/pkg/model"
+	"iter"
+)
+
+// View is the contents of a store at the moment it was taken. Taking a view copies nothing, the store copies its
+// data instead before the next write that would change it in place, so a view can be read at any pace without
+// holding up writers and costs the reader no memory.
+type View struct {
+	persons []model.Person
+}
+
+// Len returns the number of persons in the view
+func (v View) Len() int {
+	return len(v.persons)
+}
+
+// All yields every person in the view in insertion order
+func (v View) All() iter.Seq[model.Person] {
+	return v.Match(model.Filter{})
+}
+
+// Match yields the persons in the view matching f, in insertion order
+func (v View) Match(f model.Filter) iter.Seq[model.Person] {
+	return func(yield func(model.Person) bool) {
+		for _, p := range v.persons {
+			if f.Match(p) && !yield(p) {
+				return
+			}
+		}
+	}
+}
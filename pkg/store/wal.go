@@ -0,0 +1,294 @@
+package store
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"gocache/pkg/model"
+	"hash/crc32"
+	"io"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+)
+
+// WAL file layout: a sequence of frames, each
+//
+//	payload length uint32 | CRC-32C of payload uint32 | payload
+//
+// and each payload a list of entries applied together on replay:
+//
+//	entry count uvarint | entries of: walPut + person record, or walDelete + id varint
+const (
+	walPut    byte = 1
+	walDelete byte = 2
+
+	walFrameHeader = 8
+)
+
+// SyncPolicy controls when the WAL is fsynced
+type SyncPolicy string
+
+const (
+	// SyncAlways fsyncs every append before it returns
+	SyncAlways SyncPolicy = "always"
+	// SyncInterval fsyncs from a background worker, a crash can lose the last interval of writes
+	SyncInterval SyncPolicy = "interval"
+	// SyncNever leaves flushing to the operating system
+	SyncNever SyncPolicy = "never"
+)
+
+// WALEntry is a single logged mutation, Delete entries only carry Person.ID
+type WALEntry struct {
+	Delete bool
+	Person model.Person
+}
+
+// WAL is an append-only log of store mutations
+type WAL struct {
+	mu       sync.Mutex
+	path     string
+	file     *os.File
+	size     int64
+	policy   SyncPolicy
+	dirty    bool
+	quit     chan struct{}
+	done     chan struct{}
+	stopOnce sync.Once
+}
+
+// OpenWAL opens the log at path, creating it if needed, and returns every entry that survived intact.
+// Recovery stops at the first torn or corrupt frame and truncates the file there, so a crash midway
+// through an append loses only that append.
+func OpenWAL(path string, policy SyncPolicy, interval time.Duration) (*WAL, []WALEntry, error) {
+	switch policy {
+	case SyncAlways, SyncInterval, SyncNever:
+	default:
+		return nil, nil, fmt.Errorf("unknown WAL sync policy %q", policy)
+	}
+
+	if err := os.MkdirAll(filepath.Dir(path), 0o755); err != nil {
+		return nil, nil, fmt.Errorf("error creating WAL directory: %w", err)
+	}
+
+	file, err := os.OpenFile(path, os.O_CREATE|os.O_RDWR, 0o644)
+	if err != nil {
+		return nil, nil, fmt.Errorf("error opening WAL: %w", err)
+	}
+
+	entries, valid, err := readWAL(file)
+	if err != nil {
+		file.Close()
+		return nil, nil, err
+	}
+
+	if err := file.Truncate(valid); err != nil {
+		file.Close()
+		return nil, nil, fmt.Errorf("error truncating WAL tail: %w", err)
+	}
+	if _, err := file.Seek(valid, io.SeekStart); err != nil {
+		file.Close()
+		return nil, nil, fmt.Errorf("error seeking WAL: %w", err)
+	}
+
+	w := &WAL{
+		path:   path,
+		file:   file,
+		size:   valid,
+		policy: policy,
+		quit:   make(chan struct{}),
+		done:   make(chan struct{}),
+	}
+
+	if policy == SyncInterval {
+		if interval <= 0 {
+			interval = 100 * time.Millisecond
+		}
+		go w.syncLoop(interval)
+	} else {
+		close(w.done)
+	}
+
+	return w, entries, nil
+}
+
+// Append durably (per the sync policy) logs entries as a single frame that replays all-or-nothing
+func (w *WAL) Append(entries ...WALEntry) error {
+	if len(entries) == 0 {
+		return nil
+	}
+
+	payload := binary.AppendUvarint(nil, uint64(len(entries)))
+	for _, e := range entries {
+		if e.Delete {
+			payload = append(payload, walDelete)
+			payload = binary.AppendVarint(payload, int64(e.Person.ID))
+		} else {
+			payload = append(payload, walPut)
+			payload = appendRecord(payload, e.Person)
+		}
+	}
+
+	frame := make([]byte, walFrameHeader, walFrameHeader+len(payload))
+	binary.LittleEndian.PutUint32(frame[0:4], uint32(len(payload)))
+	binary.LittleEndian.PutUint32(frame[4:8], crc32.Checksum(payload, crcTable))
+	frame = append(frame, payload...)
+
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	if _, err := w.file.Write(frame); err != nil {
+		return fmt.Errorf("error appending to WAL: %w", err)
+	}
+	w.size += int64(len(frame))
+
+	switch w.policy {
+	case SyncAlways:
+		if err := w.file.Sync(); err != nil {
+			return fmt.Errorf("error syncing WAL: %w", err)
+		}
+	case SyncInterval:
+		w.dirty = true
+	}
+
+	return nil
+}
+
+// Size returns the current length of the log in bytes
+func (w *WAL) Size() int64 {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	return w.size
+}
+
+// Reset discards every logged entry, called once they are covered by a snapshot
+func (w *WAL) Reset() error {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	if err := w.file.Truncate(0); err != nil {
+		return fmt.Errorf("error truncating WAL: %w", err)
+	}
+	if _, err := w.file.Seek(0, io.SeekStart); err != nil {
+		return fmt.Errorf("error seeking WAL: %w", err)
+	}
+	w.size = 0
+	w.dirty = false
+
+	return w.file.Sync()
+}
+
+// Close syncs and closes the log
+func (w *WAL) Close() error {
+	w.stopOnce.Do(func() { close(w.quit) })
+	<-w.done
+
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	return errors.Join(w.file.Sync(), w.file.Close())
+}
+
+func (w *WAL) syncLoop(interval time.Duration) {
+	defer close(w.done)
+
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-w.quit:
+			return
+		case <-ticker.C:
+			w.mu.Lock()
+			if w.dirty {
+				w.file.Sync()
+				w.dirty = false
+			}
+			w.mu.Unlock()
+		}
+	}
+}
+
+// readWAL decodes frames from the start of r and returns the entries and the offset after the last intact frame
+func readWAL(r io.Reader) ([]WALEntry, int64, error) {
+	entries := make([]WALEntry, 0)
+	br := bufio.NewReader(r)
+	var valid int64
+
+	header := make([]byte, walFrameHeader)
+	for {
+		if _, err := io.ReadFull(br, header); err != nil {
+			// EOF or a torn header both end recovery at the last intact frame
+			return entries, valid, nil
+		}
+
+		length := binary.LittleEndian.Uint32(header[0:4])
+		sum := binary.LittleEndian.Uint32(header[4:8])
+
+		payload, err := readN(br, int64(length))
+		if err != nil || crc32.Checksum(payload, crcTable) != sum {
+			return entries, valid, nil
+		}
+
+		frame, err := decodeFrame(payload)
+		if err != nil {
+			return entries, valid, nil
+		}
+
+		entries = append(entries, frame...)
+		valid += int64(walFrameHeader + len(payload))
+	}
+}
+
+// readN reads exactly n bytes, growing the buffer as data arrives so a corrupt length can't force a huge allocation
+func readN(r io.Reader, n int64) ([]byte, error) {
+	var b bytes.Buffer
+	if _, err := io.CopyN(&b, r, n); err != nil {
+		return nil, err
+	}
+	return b.Bytes(), nil
+}
+
+func decodeFrame(payload []byte) ([]WALEntry, error) {
+	r := bytes.NewReader(payload)
+	count, err := binary.ReadUvarint(r)
+	if err != nil {
+		return nil, err
+	}
+
+	entries := make([]WALEntry, 0, min(count, uint64(len(payload))))
+	for i := uint64(0); i < count; i++ {
+		kind, err := r.ReadByte()
+		if err != nil {
+			return nil, err
+		}
+
+		switch kind {
+		case walPut:
+			p, err := readRecord(r)
+			if err != nil {
+				return nil, err
+			}
+			entries = append(entries, WALEntry{Person: p})
+		case walDelete:
+			id, err := binary.ReadVarint(r)
+			if err != nil {
+				return nil, err
+			}
+			entries = append(entries, WALEntry{Delete: true, Person: model.Person{ID: int(id)}})
+		default:
+			return nil, fmt.Errorf("unknown WAL entry type %d", kind)
+		}
+	}
+
+	if r.Len() != 0 {
+		return nil, fmt.Errorf("%d trailing bytes in WAL frame", r.Len())
+	}
+
+	return entries, nil
+}
@@ -0,0 +1,193 @@
+package store
+
+import (
+	"gocache/pkg/model"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func openTestWAL(t *testing.T, path string) (*WAL, []WALEntry) {
+	t.Helper()
+
+	wal, entries, err := OpenWAL(path, SyncAlways, 0)
+	if err != nil {
+		t.Fatalf("OpenWAL() error: %v", err)
+	}
+	return wal, entries
+}
+
+// writeTestWAL logs three frames, the last holding two entries
+func writeTestWAL(t *testing.T, path string) {
+	t.Helper()
+
+	wal, _ := openTestWAL(t, path)
+	defer wal.Close()
+
+	wal.Append(WALEntry{Person: model.Person{ID: 1, Name: "John Doe", Email: "john@example.com", Age: 30}})
+	wal.Append(WALEntry{Person: model.Person{ID: 1, Name: "John Doe", Email: "john@example.com", Age: 31, Version: 1}})
+	wal.Append(
+		WALEntry{Delete: true, Person: model.Person{ID: 1}},
+		WALEntry{Person: model.Person{ID: 2, Name: "Jane Smith", Email: "jane@example.com", Age: 25}},
+	)
+}
+
+func TestWALRoundTrip(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "wal", "persons.wal")
+	writeTestWAL(t, path)
+
+	wal, entries := openTestWAL(t, path)
+	defer wal.Close()
+
+	if len(entries) != 4 {
+		t.Fatalf("expected 4 entries, got %+v", entries)
+	}
+	if entries[1].Person.Age != 31 || entries[1].Person.Version != 1 {
+		t.Errorf("unexpected second entry %+v", entries[1])
+	}
+	if !entries[2].Delete || entries[2].Person.ID != 1 {
+		t.Errorf("expected a delete of person 1, got %+v", entries[2])
+	}
+
+	kv := NewKVStore()
+	ReplayWAL(kv, entries)
+	if persons := kv.GetAllPersons(); len(persons) != 1 || persons[0].ID != 2 {
+		t.Errorf("expected only person 2 after replay, got %+v", persons)
+	}
+}
+
+func TestWALRecoversFromTornTail(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "persons.wal")
+	writeTestWAL(t, path)
+
+	info, _ := os.Stat(path)
+	// Cut into the last frame, as a crash midway through an append would
+	if err := os.Truncate(path, info.Size()-5); err != nil {
+		t.Fatalf("failed to truncate WAL: %v", err)
+	}
+
+	wal, entries := openTestWAL(t, path)
+	if len(entries) != 2 {
+		t.Fatalf("expected the 2 entries before the torn frame, got %+v", entries)
+	}
+
+	// Appends after recovery must land after the last intact frame
+	if err := wal.Append(WALEntry{Person: model.Person{ID: 3, Name: "Alice Johnson"}}); err != nil {
+		t.Fatalf("Append() error: %v", err)
+	}
+	wal.Close()
+
+	wal, entries = openTestWAL(t, path)
+	defer wal.Close()
+
+	if len(entries) != 3 || entries[2].Person.ID != 3 {
+		t.Errorf("expected the recovered entries plus the new one, got %+v", entries)
+	}
+}
+
+func TestWALRecoversFromCorruptTail(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "persons.wal")
+	writeTestWAL(t, path)
+
+	data, _ := os.ReadFile(path)
+	data[len(data)-2] ^= 0xff
+	if err := os.WriteFile(path, data, 0o644); err != nil {
+		t.Fatalf("failed to corrupt WAL: %v", err)
+	}
+
+	wal, entries := openTestWAL(t, path)
+	defer wal.Close()
+
+	// The corrupt frame held both the delete and the insert, neither may be replayed alone
+	if len(entries) != 2 {
+		t.Fatalf("expected the 2 entries before the corrupt frame, got %+v", entries)
+	}
+
+	info, _ := os.Stat(path)
+	if info.Size() != wal.Size() || info.Size() >= int64(len(data)) {
+		t.Errorf("expected the corrupt frame to be truncated, file is %d bytes and WAL reports %d", info.Size(), wal.Size())
+	}
+}
+
+func TestWALRejectsUnknownSyncPolicy(t *testing.T) {
+	if _, _, err := OpenWAL(filepath.Join(t.TempDir(), "persons.wal"), "sometimes", 0); err == nil {
+		t.Error("expected an error for an unknown sync policy")
+	}
+}
+
+func TestDurableStoreRecovery(t *testing.T) {
+	dir := t.TempDir()
+	snapPath, walPath := filepath.Join(dir, "persons.snap"), filepath.Join(dir, "persons.wal")
+
+	wal, _ := openTestWAL(t, walPath)
+	durable := NewDurableStore(NewKVStore(), wal)
+	if err := durable.InsertPersons([]model.Person{
+		{ID: 1, Name: "John Doe", Email: "john@example.com", Age: 30},
+		{ID: 2, Name: "Jane Smith", Email: "jane@example.com", Age: 25},
+	}); err != nil {
+		t.Fatalf("InsertPersons() error: %v", err)
+	}
+
+	if err := durable.Compact(snapPath); err != nil {
+		t.Fatalf("Compact() error: %v", err)
+	}
+	if wal.Size() != 0 {
+		t.Errorf("expected compaction to empty the WAL, got %d bytes", wal.Size())
+	}
+
+	// Writes after the snapshot only live in the WAL
+	if err := durable.UpdatePerson(model.Person{ID: 1, Name: "John Doe", Email: "john@example.com", Age: 31}); err != nil {
+		t.Fatalf("UpdatePerson() error: %v", err)
+	}
+	if _, err := durable.ApplyOps(2, []model.FieldOp{{Op: model.OpIncrement, Field: "age", Value: 1}}); err != nil {
+		t.Fatalf("ApplyOps() error: %v", err)
+	}
+	tx := durable.Begin()
+	tx.Delete(1)
+	tx.Insert(model.Person{ID: 3, Name: "Alice Johnson", Age: 8, Email: "alice@example.com"})
+	if _, err := tx.Commit(); err != nil {
+		t.Fatalf("Commit() error: %v", err)
+	}
+	want := durable.GetAllPersons()
+	wal.Close()
+
+	// Recover as a restart would, the snapshot plus the replayed log
+	snap, err := LoadSnapshot(snapPath)
+	if err != nil {
+		t.Fatalf("LoadSnapshot() error: %v", err)
+	}
+	wal, entries := openTestWAL(t, walPath)
+	defer wal.Close()
+
+	recovered := NewKVStore()
+	recovered.InsertPersons(snap.Persons)
+	if err := ReplayWAL(recovered, entries); err != nil {
+		t.Fatalf("ReplayWAL() error: %v", err)
+	}
+
+	if got := recovered.GetAllPersons(); len(got) != len(want) {
+		t.Fatalf("expected %+v after recovery, got %+v", want, got)
+	}
+	for _, p := range want {
+		if got, ok := recovered.GetPerson(p.ID); !ok || got != p {
+			t.Errorf("expected %+v after recovery, got %+v", p, got)
+		}
+	}
+}
+
+func TestDurableStoreReportsLogErrors(t *testing.T) {
+	wal, _ := openTestWAL(t, filepath.Join(t.TempDir(), "persons.wal"))
+	durable := NewDurableStore(NewKVStore(), wal)
+	wal.Close()
+
+	p := model.Person{ID: 1, Name: "John Doe", Email: "john@example.com", Age: 30}
+	if err := durable.InsertPerson(p); err == nil {
+		t.Error("expected InsertPerson to report the failed log write")
+	}
+	if err := durable.InsertPersons([]model.Person{p}); err == nil {
+		t.Error("expected InsertPersons to report the failed log write")
+	}
+	if got, ok := durable.GetPerson(1); !ok || got != p {
+		t.Errorf("expected the person to stay in the store, got %+v", got)
+	}
+}